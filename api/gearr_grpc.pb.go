@@ -0,0 +1,285 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: api/gearr.proto
+
+package api
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Gearr_SubmitJob_FullMethodName = "/gearr.api.v1.Gearr/SubmitJob"
+	Gearr_GetJob_FullMethodName    = "/gearr.api.v1.Gearr/GetJob"
+	Gearr_ListJobs_FullMethodName  = "/gearr.api.v1.Gearr/ListJobs"
+	Gearr_CancelJob_FullMethodName = "/gearr.api.v1.Gearr/CancelJob"
+	Gearr_WatchJob_FullMethodName  = "/gearr.api.v1.Gearr/WatchJob"
+)
+
+// GearrClient is the client API for Gearr service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type GearrClient interface {
+	SubmitJob(ctx context.Context, in *SubmitJobRequest, opts ...grpc.CallOption) (*Job, error)
+	GetJob(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (*Job, error)
+	ListJobs(ctx context.Context, in *ListJobsRequest, opts ...grpc.CallOption) (*ListJobsResponse, error)
+	CancelJob(ctx context.Context, in *CancelJobRequest, opts ...grpc.CallOption) (*CancelJobResponse, error)
+	WatchJob(ctx context.Context, in *WatchJobRequest, opts ...grpc.CallOption) (Gearr_WatchJobClient, error)
+}
+
+type gearrClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewGearrClient(cc grpc.ClientConnInterface) GearrClient {
+	return &gearrClient{cc}
+}
+
+func (c *gearrClient) SubmitJob(ctx context.Context, in *SubmitJobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, Gearr_SubmitJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gearrClient) GetJob(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, Gearr_GetJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gearrClient) ListJobs(ctx context.Context, in *ListJobsRequest, opts ...grpc.CallOption) (*ListJobsResponse, error) {
+	out := new(ListJobsResponse)
+	err := c.cc.Invoke(ctx, Gearr_ListJobs_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gearrClient) CancelJob(ctx context.Context, in *CancelJobRequest, opts ...grpc.CallOption) (*CancelJobResponse, error) {
+	out := new(CancelJobResponse)
+	err := c.cc.Invoke(ctx, Gearr_CancelJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gearrClient) WatchJob(ctx context.Context, in *WatchJobRequest, opts ...grpc.CallOption) (Gearr_WatchJobClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Gearr_ServiceDesc.Streams[0], Gearr_WatchJob_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &gearrWatchJobClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Gearr_WatchJobClient interface {
+	Recv() (*TaskEvent, error)
+	grpc.ClientStream
+}
+
+type gearrWatchJobClient struct {
+	grpc.ClientStream
+}
+
+func (x *gearrWatchJobClient) Recv() (*TaskEvent, error) {
+	m := new(TaskEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GearrServer is the server API for Gearr service.
+// All implementations must embed UnimplementedGearrServer
+// for forward compatibility
+type GearrServer interface {
+	SubmitJob(context.Context, *SubmitJobRequest) (*Job, error)
+	GetJob(context.Context, *GetJobRequest) (*Job, error)
+	ListJobs(context.Context, *ListJobsRequest) (*ListJobsResponse, error)
+	CancelJob(context.Context, *CancelJobRequest) (*CancelJobResponse, error)
+	WatchJob(*WatchJobRequest, Gearr_WatchJobServer) error
+	mustEmbedUnimplementedGearrServer()
+}
+
+// UnimplementedGearrServer must be embedded to have forward compatible implementations.
+type UnimplementedGearrServer struct {
+}
+
+func (UnimplementedGearrServer) SubmitJob(context.Context, *SubmitJobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitJob not implemented")
+}
+func (UnimplementedGearrServer) GetJob(context.Context, *GetJobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetJob not implemented")
+}
+func (UnimplementedGearrServer) ListJobs(context.Context, *ListJobsRequest) (*ListJobsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListJobs not implemented")
+}
+func (UnimplementedGearrServer) CancelJob(context.Context, *CancelJobRequest) (*CancelJobResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelJob not implemented")
+}
+func (UnimplementedGearrServer) WatchJob(*WatchJobRequest, Gearr_WatchJobServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchJob not implemented")
+}
+func (UnimplementedGearrServer) mustEmbedUnimplementedGearrServer() {}
+
+// UnsafeGearrServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to GearrServer will
+// result in compilation errors.
+type UnsafeGearrServer interface {
+	mustEmbedUnimplementedGearrServer()
+}
+
+func RegisterGearrServer(s grpc.ServiceRegistrar, srv GearrServer) {
+	s.RegisterService(&Gearr_ServiceDesc, srv)
+}
+
+func _Gearr_SubmitJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SubmitJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GearrServer).SubmitJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gearr_SubmitJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GearrServer).SubmitJob(ctx, req.(*SubmitJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gearr_GetJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GearrServer).GetJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gearr_GetJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GearrServer).GetJob(ctx, req.(*GetJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gearr_ListJobs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListJobsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GearrServer).ListJobs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gearr_ListJobs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GearrServer).ListJobs(ctx, req.(*ListJobsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gearr_CancelJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GearrServer).CancelJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gearr_CancelJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GearrServer).CancelJob(ctx, req.(*CancelJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gearr_WatchJob_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchJobRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GearrServer).WatchJob(m, &gearrWatchJobServer{stream})
+}
+
+type Gearr_WatchJobServer interface {
+	Send(*TaskEvent) error
+	grpc.ServerStream
+}
+
+type gearrWatchJobServer struct {
+	grpc.ServerStream
+}
+
+func (x *gearrWatchJobServer) Send(m *TaskEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Gearr_ServiceDesc is the grpc.ServiceDesc for Gearr service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Gearr_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gearr.api.v1.Gearr",
+	HandlerType: (*GearrServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SubmitJob",
+			Handler:    _Gearr_SubmitJob_Handler,
+		},
+		{
+			MethodName: "GetJob",
+			Handler:    _Gearr_GetJob_Handler,
+		},
+		{
+			MethodName: "ListJobs",
+			Handler:    _Gearr_ListJobs_Handler,
+		},
+		{
+			MethodName: "CancelJob",
+			Handler:    _Gearr_CancelJob_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchJob",
+			Handler:       _Gearr_WatchJob_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/gearr.proto",
+}
@@ -33,13 +33,38 @@ func LogLevelFlags() {
 func SchedulerFlags() {
 	pflag.String("scheduler.domain", "http://localhost:8080", "Base domain where workers will try to download upload videos")
 	pflag.Duration("scheduler.scheduleTime", time.Minute*5, "Execute the scheduling loop every X seconds")
-	pflag.Duration("scheduler.jobTimeout", time.Hour*24, "Requeue jobs that are running for more than X minutes")
+	pflag.Duration("scheduler.jobTimeout", time.Hour*24, "Requeue jobs that are running for more than X minutes, 0 disables it")
+	pflag.Duration("scheduler.workerTimeout", time.Minute*5, "Requeue jobs of workers not seen for more than X minutes, 0 disables it")
+	pflag.String("scheduler.jobTimeoutAction", "requeue", "Action applied to jobs exceeding the job timeout: requeue or fail")
 	pflag.String("scheduler.downloadPath", "/data/current", "Download path")
 	pflag.String("scheduler.uploadPath", "/data/processed", "Upload path")
+	pflag.String("scheduler.destinationURL", "", "sftp:// URL of the upload path, workers write the encoded files to it instead of uploading them to the server")
+	pflag.String("scheduler.sourceURL", "", "sftp:// or smb:// URL of the download path, workers read the sources from it instead of downloading them from the server")
 	pflag.Int64("scheduler.minFileSize", 1e+8, "Min File Size")
+	pflag.Duration("scheduler.dispatchInterval", time.Second*10, "Execute the dispatch loop every X seconds when dispatch is limited")
+	pflag.Int("scheduler.maxDispatchPerInterval", 0, "Maximum number of jobs dispatched to workers per dispatch interval, 0 means unlimited")
+	pflag.Int("scheduler.maxInFlightJobs", 0, "Maximum number of dispatched but not finished jobs, 0 means unlimited")
+	pflag.Int("scheduler.maxActiveEncodes", 0, "Maximum number of jobs running across all the workers, not counting the workers without pings for workerTimeout, 0 means unlimited")
+	pflag.Duration("scheduler.retentionPeriod", 0, "Delete the finished jobs in retentionStatuses after this duration, 0 keeps them forever")
+	pflag.StringSlice("scheduler.retentionStatuses", []string{"completed"}, "Final statuses of the jobs deleted by the retention policy: completed, failed, canceled or skipped")
+	pflag.Int("scheduler.batchProbeWorkers", 16, "Number of sources of a batch submission probed at the same time")
+	pflag.Duration("scheduler.batchProbeTimeout", time.Second*30, "Fail the sources of a batch submission not probed in X seconds, 0 waits forever")
+	pflag.Int("scheduler.maxDownloads", 0, "Maximum number of sources served to the workers at the same time, workers wait in line for a slot, 0 means unlimited")
+	pflag.String("scheduler.notificationURL", "", "http:// or https:// URL receiving a POST with the status changes of every job, empty disables it")
+	pflag.StringSlice("scheduler.notificationStatuses", []string{}, "Job statuses posted to notificationURL, empty posts the final ones: completed, failed, canceled and skipped")
 }
 
 func WebFlags() {
 	pflag.Int("web.port", 8080, "WebServer Port")
 	pflag.String("web.token", "admin", "WebServer Port")
+	pflag.String("web.basicAuthUser", "", "Basic auth user accepted by the API besides the token")
+	pflag.String("web.basicAuthPassword", "", "Basic auth password accepted by the API besides the token")
+	pflag.StringSlice("web.allowedNetworks", []string{}, "IPs or CIDRs allowed to reach the WebServer, empty allows all")
+	pflag.StringSlice("web.trustedProxies", []string{}, "IPs or CIDRs of the reverse proxies whose X-Forwarded-For header is trusted, empty trusts none")
+}
+
+func GRPCFlags() {
+	pflag.Int("grpc.port", 0, "gRPC Server Port, 0 disables the gRPC server")
+	pflag.String("grpc.certFile", "", "PEM certificate serving the gRPC server over TLS, empty serves it in plain text")
+	pflag.String("grpc.keyFile", "", "PEM private key of grpc.certFile")
 }
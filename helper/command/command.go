@@ -23,6 +23,7 @@ type Command struct {
 	WorkDir    string
 	StdoutFunc ReaderFunc
 	SterrFunc  ReaderFunc
+	Stdin      io.Reader
 }
 
 func NewPanicOption() Option {
@@ -76,6 +77,11 @@ func (C *Command) SetStderrFunc(StderrtFunc ReaderFunc) *Command {
 	C.SterrFunc = StderrtFunc
 	return C
 }
+func (C *Command) SetStdin(stdin io.Reader) *Command {
+	C.Stdin = stdin
+	return C
+}
+
 func (C *Command) Run(opt ...Option) (exitCode int, err error) {
 	return C.RunWithContext(context.Background(), opt...)
 }
@@ -90,6 +96,7 @@ func (C *Command) RunWithContext(ctx context.Context, opt ...Option) (exitCode i
 	}
 	cmd.Env = C.Env
 	cmd.Dir = C.WorkDir
+	cmd.Stdin = C.Stdin
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return
@@ -99,7 +106,7 @@ func (C *Command) RunWithContext(ctx context.Context, opt ...Option) (exitCode i
 		return
 	}
 	if err = cmd.Start(); err != nil {
-		return -1, err
+		return -1, &StartError{Err: err}
 	}
 
 	go C.readerStreamProcessor(ctx, stdout, C.StdoutFunc)
@@ -108,10 +115,23 @@ func (C *Command) RunWithContext(ctx context.Context, opt ...Option) (exitCode i
 	err = cmd.Wait()
 	if err != nil {
 		if msg, ok := err.(*exec.ExitError); ok { // there is error code
-			exitCode := msg.Sys().(syscall.WaitStatus).ExitStatus()
+			status := msg.Sys().(syscall.WaitStatus)
+			if status.Signaled() {
+				err = &SignalError{Signal: status.Signal()}
+				// the context kills the process on cancel, that is not a crash of the process
+				if ctx.Err() != nil {
+					err = fmt.Errorf("%w: %w", ctx.Err(), err)
+				}
+				if isPanicOpt(opt) {
+					panic(err)
+				}
+				return -1, err
+			}
+			exitCode := status.ExitStatus()
 			if allowedCodes(opt, exitCode) {
 				return exitCode, nil
 			}
+			err = &ExitCodeError{Code: exitCode}
 			if isPanicOpt(opt) {
 				panic(err)
 			}
@@ -171,8 +191,17 @@ loop:
 	}
 }
 
+// GetFullCommand is the command line for logs, the params with spaces or quotes are quoted so it can be copied
+// to a shell.
 func (C *Command) GetFullCommand() string {
-	return fmt.Sprintf("%s %s", C.Command, strings.Join(C.Params, " "))
+	params := make([]string, len(C.Params))
+	for i, param := range C.Params {
+		params[i] = param
+		if param == "" || strings.ContainsAny(param, " \t\"'`$\\") {
+			params[i] = "'" + strings.ReplaceAll(param, "'", `'\''`) + "'"
+		}
+	}
+	return fmt.Sprintf("%s %s", C.Command, strings.Join(params, " "))
 }
 
 func GetWD() string {
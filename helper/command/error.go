@@ -0,0 +1,41 @@
+package command
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// StartError is returned when the process could not be started, like when the binary is missing.
+type StartError struct {
+	Err error
+}
+
+func (e *StartError) Error() string {
+	return fmt.Sprintf("process could not start: %v", e.Err)
+}
+
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
+
+// SignalError is returned when the process was killed by a signal. An unexpected SIGKILL is usually the kernel
+// OOM killer.
+type SignalError struct {
+	Signal syscall.Signal
+}
+
+func (e *SignalError) Error() string {
+	if e.Signal == syscall.SIGKILL {
+		return fmt.Sprintf("killed by signal %d (%s), possibly out of memory", int(e.Signal), e.Signal)
+	}
+	return fmt.Sprintf("killed by signal %d (%s)", int(e.Signal), e.Signal)
+}
+
+// ExitCodeError is returned when the process exited with a code that is not allowed.
+type ExitCodeError struct {
+	Code int
+}
+
+func (e *ExitCodeError) Error() string {
+	return fmt.Sprintf("exited with code %d", e.Code)
+}
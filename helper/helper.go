@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"time"
 
@@ -19,12 +20,17 @@ import (
 )
 
 var (
+	// Version is set at build time with -ldflags "-X gearr/helper.Version=<version>"
+	Version              = "dev"
 	ApplicationFileName  string
 	ValidVideoExtensions = []string{"mp4", "mpg", "m4a", "m4v", "f4v", "f4a", "m4b", "m4r", "f4b", "mov ", "ogg", "oga", "ogv", "ogx ", "wmv", "wma", "asf ", "webm", "avi", "flv", "vob ", "mkv"}
 	STUNServers          = []string{"https://api.ipify.org?format=text", "https://ifconfig.me", "https://ident.me/", "https://myexternalip.com/raw"}
 	workingDirectory     = filepath.Join(os.TempDir(), "gearr")
 	ffmpegPath           = "ffmpeg"
+	ffprobePath          = "ffprobe"
 	mkvExtractPath       = "mkvextract"
+	curlPath             = "curl"
+	binaryLibraryPath    = true
 )
 
 func ValidExtension(extension string) bool {
@@ -139,10 +145,54 @@ func DisembedFile(embedFS http.FileSystem, statikPath string, targetFilePath str
 	return targetCopyFile, nil
 }
 
+// SetFFmpegPath overrides the ffmpeg binary, an empty path keeps the default one.
+func SetFFmpegPath(path string) {
+	if path != "" {
+		ffmpegPath = path
+	}
+}
+
+// SetFFProbePath overrides the ffprobe binary, an empty path keeps the default one.
+func SetFFProbePath(path string) {
+	if path != "" {
+		ffprobePath = path
+	}
+}
+
+// SetMKVExtractPath overrides the mkvextract binary, an empty path keeps the default one.
+func SetMKVExtractPath(path string) {
+	if path != "" {
+		mkvExtractPath = path
+	}
+}
+
+// SetBinaryLibraryPath enables pointing LD_LIBRARY_PATH to the directory of the binaries, where bundled binaries
+// keep their shared libraries. Binaries linked against the system libraries don't need it.
+func SetBinaryLibraryPath(enabled bool) {
+	binaryLibraryPath = enabled
+}
+
+// LibraryPathEnv is the LD_LIBRARY_PATH environment variable of a binary, empty when it is not needed: binaries
+// found in the PATH use the system libraries.
+func LibraryPathEnv(binaryPath string) string {
+	if !binaryLibraryPath || runtime.GOOS != "linux" || !filepath.IsAbs(binaryPath) {
+		return ""
+	}
+	return fmt.Sprintf("LD_LIBRARY_PATH=%s", filepath.Dir(binaryPath))
+}
+
 func GetFFmpegPath() string {
 	return ffmpegPath
 }
 
+func GetFFProbePath() string {
+	return ffprobePath
+}
+
+func GetCurlPath() string {
+	return curlPath
+}
+
 func GetMKVExtractPath() string {
 	return mkvExtractPath
 }
@@ -0,0 +1,41 @@
+package helper
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseNetworks parses a list of IPs and CIDRs, a plain IP is a network of that single address.
+func ParseNetworks(networks []string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network = network + "/32"
+			} else {
+				network = network + "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed network %s: %w", network, err)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// NetworksContain reports whether the ip belongs to any of the networks, a nil ip belongs to none.
+func NetworksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,8 +1,11 @@
 package model
 
 import (
+	"fmt"
 	"gearr/helper/max"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -24,23 +27,34 @@ func (e *CustomError) Error() string {
 }
 
 const (
-	PingEvent         EventType = "Ping"
-	NotificationEvent EventType = "Notification"
-
-	JobNotification        NotificationType = "Job"
-	DownloadNotification   NotificationType = "Download"
-	UploadNotification     NotificationType = "Upload"
-	MKVExtractNotification NotificationType = "MKVExtract"
-	FFProbeNotification    NotificationType = "FFProbe"
-	PGSNotification        NotificationType = "PGS"
-	FFMPEGSNotification    NotificationType = "FFMPEG"
+	PingEvent          EventType = "Ping"
+	NotificationEvent  EventType = "Notification"
+	WorkerStartedEvent EventType = "WorkerStarted"
+	WorkerStoppedEvent EventType = "WorkerStopped"
+
+	JobNotification           NotificationType = "Job"
+	DownloadNotification      NotificationType = "Download"
+	UploadNotification        NotificationType = "Upload"
+	MKVExtractNotification    NotificationType = "MKVExtract"
+	FFMPEGExtractNotification NotificationType = "FFMPEGExtract"
+	FFProbeNotification       NotificationType = "FFProbe"
+	PGSNotification           NotificationType = "PGS"
+	FFMPEGSNotification       NotificationType = "FFMPEG"
+	VMAFNotification          NotificationType = "VMAF"
 
 	QueuedNotificationStatus      NotificationStatus = "queued"
+	DispatchedNotificationStatus  NotificationStatus = "dispatched"
 	ReQueuedNotificationStatus    NotificationStatus = "requeued"
 	ProgressingNotificationStatus NotificationStatus = "progressing"
 	CompletedNotificationStatus   NotificationStatus = "completed"
 	CanceledNotificationStatus    NotificationStatus = "canceled"
 	FailedNotificationStatus      NotificationStatus = "failed"
+	// WaitingNotificationStatus is a step stalled on a resource out of the worker, like the OCR of the PGS workers,
+	// the step is back to progressing once it gets it
+	WaitingNotificationStatus NotificationStatus = "waiting"
+	// SkippedNotificationStatus closes a job whose encode was discarded because it brought no benefit, nothing is
+	// uploaded and the source file is kept as it is
+	SkippedNotificationStatus NotificationStatus = "skipped"
 
 	EncodeJobType   JobType = "encode"
 	PGSToSrtJobType JobType = "pgstosrt"
@@ -50,24 +64,259 @@ type Identity interface {
 	getUUID() uuid.UUID
 }
 type Job struct {
-	SourcePath      string     `json:"source_path,omitempty"`
-	DestinationPath string     `json:"destination_path,omitempty"`
-	Id              uuid.UUID  `json:"id"`
-	Events          TaskEvents `json:"events,omitempty"`
-	Status          string     `json:"status,omitempty"`
-	StatusMessage   string     `json:"status_message,omitempty"`
-	LastUpdate      *time.Time `json:"last_update,omitempty"`
+	SourcePath      string           `json:"source_path,omitempty"`
+	DestinationPath string           `json:"destination_path,omitempty"`
+	Id              uuid.UUID        `json:"id"`
+	Events          TaskEvents       `json:"events,omitempty"`
+	Status          string           `json:"status,omitempty"`
+	StatusMessage   string           `json:"status_message,omitempty"`
+	LastUpdate      *time.Time       `json:"last_update,omitempty"`
+	Report          *EncodeReport    `json:"report,omitempty"`
+	StreamSelection *StreamSelection `json:"stream_selection,omitempty"`
+	QualityProfile  string           `json:"quality_profile,omitempty"`
+	BatchId         *uuid.UUID       `json:"batch_id,omitempty"`
+	EncodeOverrides *EncodeOverrides `json:"encode_overrides,omitempty"`
+	// SourceChecksum is the sha256 of the source given when the job was submitted
+	SourceChecksum string `json:"source_checksum,omitempty"`
+	// WorkDirRoot is the directory the worker places the job work directory in instead of its temp path
+	WorkDirRoot string `json:"work_dir_root,omitempty"`
+	// Notification is the endpoint of the submitter notified of the status changes of the job
+	Notification *NotificationTarget `json:"notification,omitempty"`
+	// Metadata are the container tags written to the output, over the ones preserved from the source
+	Metadata ContainerMetadata `json:"metadata,omitempty"`
+	// IndexOnly jobs only record the Manifest of the source, they complete without encoding it
+	IndexOnly bool            `json:"index_only,omitempty"`
+	Manifest  *SourceManifest `json:"manifest,omitempty"`
+}
+
+// SourceManifest describes a source file as an indexOnly job found it: its checksum, container and streams.
+type SourceManifest struct {
+	Checksum        string            `json:"checksum"`
+	Size            int64             `json:"size"`
+	FormatName      string            `json:"format_name,omitempty"`
+	DurationSeconds float64           `json:"duration_seconds,omitempty"`
+	Bitrate         int64             `json:"bitrate,omitempty"`
+	Streams         []*ManifestStream `json:"streams"`
+}
+
+// ManifestStream is a stream of a SourceManifest, Bitrate is 0 when unknown.
+type ManifestStream struct {
+	Index    int    `json:"index"`
+	Type     string `json:"type"`
+	Codec    string `json:"codec,omitempty"`
+	Profile  string `json:"profile,omitempty"`
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	PixFmt   string `json:"pix_fmt,omitempty"`
+	Channels int    `json:"channels,omitempty"`
+	Bitrate  int64  `json:"bitrate,omitempty"`
+	Default  bool   `json:"default,omitempty"`
+	Forced   bool   `json:"forced,omitempty"`
+}
+
+// NotificationTarget is an HTTP endpoint receiving a JobUpdateNotification POST when a job reaches one of Statuses,
+// the final statuses when empty.
+type NotificationTarget struct {
+	URL      string               `json:"url"`
+	Statuses []NotificationStatus `json:"statuses,omitempty"`
+}
+
+func (t *NotificationTarget) Validate() error {
+	if t == nil {
+		return nil
+	}
+	targetURL, err := url.Parse(t.URL)
+	if err != nil || (targetURL.Scheme != "http" && targetURL.Scheme != "https") || targetURL.Host == "" {
+		return fmt.Errorf("invalid notification url %s, must be an http or https URL", t.URL)
+	}
+	for _, status := range t.Statuses {
+		switch status {
+		case QueuedNotificationStatus, DispatchedNotificationStatus, ReQueuedNotificationStatus, ProgressingNotificationStatus,
+			CompletedNotificationStatus, CanceledNotificationStatus, FailedNotificationStatus, SkippedNotificationStatus:
+		default:
+			return fmt.Errorf("invalid notification status %s", status)
+		}
+	}
+	return nil
+}
+
+// Notifies reports whether the target is notified when a job reaches status.
+func (t *NotificationTarget) Notifies(status NotificationStatus) bool {
+	if t == nil || t.URL == "" {
+		return false
+	}
+	if len(t.Statuses) == 0 {
+		return TaskEvent{EventType: NotificationEvent, NotificationType: JobNotification, Status: status}.IsFinished()
+	}
+	for _, s := range t.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// EncodeParametersMetadataKey is the container tag the worker records the encode settings in, jobs can not set it.
+const EncodeParametersMetadataKey = "encodeParameters"
+
+// ContainerMetadata are container level tags, like title or comment, set on the output of a job. An empty value
+// removes the tag the output would get from the source.
+type ContainerMetadata map[string]string
+
+func (m ContainerMetadata) Validate() error {
+	for key := range m {
+		if strings.TrimSpace(key) == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("invalid metadata key %q", key)
+		}
+		if strings.EqualFold(key, EncodeParametersMetadataKey) {
+			return fmt.Errorf("metadata key %s is reserved", key)
+		}
+	}
+	return nil
+}
+
+// EncodeOverrides replaces encode settings for a single job, on top of its quality profile and the worker defaults.
+// The fields left empty keep the profile, or default, value.
+type EncodeOverrides struct {
+	VideoCodec   string `json:"video_codec,omitempty"`
+	CRF          int    `json:"crf,omitempty"`
+	Preset       string `json:"preset,omitempty"`
+	PixFmt       string `json:"pix_fmt,omitempty"`
+	MaxWidth     int    `json:"max_width,omitempty"`
+	AudioCodec   string `json:"audio_codec,omitempty"`
+	AudioBitrate string `json:"audio_bitrate,omitempty"`
+}
+
+// Validate checks the values the server can check by itself. The codecs and presets depend on the worker, which
+// fails the job when it does not support them.
+func (o *EncodeOverrides) Validate() error {
+	if o == nil {
+		return nil
+	}
+	// 63 is the highest crf of libvpx-vp9, the worker checks the range of the codec
+	if o.CRF < 0 || o.CRF > 63 {
+		return fmt.Errorf("invalid encode_overrides crf %d, must be between 0 and 63", o.CRF)
+	}
+	if o.MaxWidth < 0 {
+		return fmt.Errorf("invalid encode_overrides max_width %d", o.MaxWidth)
+	}
+	return nil
+}
+
+// StreamSelection overrides the automatic choice of audio and subtitle streams done by the worker.
+// A nil filter keeps the automatic choice for that kind of stream.
+type StreamSelection struct {
+	Audio    *StreamFilter `json:"audio,omitempty"`
+	Subtitle *StreamFilter `json:"subtitle,omitempty"`
+}
+
+// StreamFilter keeps the streams matching any of the stream indexes or languages, an empty filter drops them all.
+type StreamFilter struct {
+	Indexes   []int    `json:"indexes,omitempty"`
+	Languages []string `json:"languages,omitempty"`
+}
+
+func (f *StreamFilter) Matches(index int, language string) bool {
+	for _, i := range f.Indexes {
+		if i == index {
+			return true
+		}
+	}
+	for _, l := range f.Languages {
+		if strings.EqualFold(l, language) {
+			return true
+		}
+	}
+	return false
+}
+
+// EncodeReport summarizes the result of an encode. While FFMPEG is running EncodedSize is projected from the
+// partial output and Estimated is set, the FFMPEG completed notification carries the actual sizes.
+type EncodeReport struct {
+	SourceSize   int64   `json:"source_size"`
+	EncodedSize  int64   `json:"encoded_size"`
+	SourceCodec  string  `json:"source_codec,omitempty"`
+	EncodedCodec string  `json:"encoded_codec,omitempty"`
+	Estimated    bool    `json:"estimated,omitempty"`
+	VMAFScore    float64 `json:"vmaf_score,omitempty"`
+	// SourceVideoBitrate is the bitrate of the source video stream in bits per second, 0 when unknown
+	SourceVideoBitrate int64 `json:"source_video_bitrate,omitempty"`
+	// CRF used to encode the video, 0 when the video was copied
+	CRF int `json:"crf,omitempty"`
+	// EncodeSeconds is the wall time of FFMPEG, AverageSpeed and PeakSpeed the realtime multiplier over it
+	EncodeSeconds float64 `json:"encode_seconds,omitempty"`
+	AverageSpeed  float64 `json:"average_speed,omitempty"`
+	PeakSpeed     float64 `json:"peak_speed,omitempty"`
+	AverageFPS    float64 `json:"average_fps,omitempty"`
+}
+
+func (r *EncodeReport) SavedSize() int64 {
+	return r.SourceSize - r.EncodedSize
+}
+
+type CodecSavings struct {
+	Codec       string `json:"codec"`
+	Jobs        int    `json:"jobs"`
+	SourceSize  int64  `json:"source_size"`
+	EncodedSize int64  `json:"encoded_size"`
+	SavedSize   int64  `json:"saved_size"`
+}
+
+type SpaceSavings struct {
+	Jobs        int             `json:"jobs"`
+	SourceSize  int64           `json:"source_size"`
+	EncodedSize int64           `json:"encoded_size"`
+	SavedSize   int64           `json:"saved_size"`
+	PerCodec    []*CodecSavings `json:"per_codec"`
 }
 
 type JobEventQueue struct {
 	Queue    string
 	JobEvent *JobEvent
 }
+type WorkerStatus string
+
+const (
+	WorkerOnlineStatus  WorkerStatus = "online"
+	WorkerStoppedStatus WorkerStatus = "stopped"
+)
+
 type Worker struct {
-	Name      string    `json:"name"`
-	Ip        string    `json:"id"`
-	QueueName string    `json:"queue_name"`
-	LastSeen  time.Time `json:"last_seen"`
+	Name      string       `json:"name"`
+	Ip        string       `json:"id"`
+	QueueName string       `json:"queue_name"`
+	LastSeen  time.Time    `json:"last_seen"`
+	Status    WorkerStatus `json:"status,omitempty"`
+	StartedAt *time.Time   `json:"started_at,omitempty"`
+	StoppedAt *time.Time   `json:"stopped_at,omitempty"`
+	Info      *WorkerInfo  `json:"info,omitempty"`
+	// Throughput is the one of the last PingEvent that carried it
+	Throughput *WorkerThroughput `json:"throughput,omitempty"`
+}
+
+// WorkerThroughput is the encode speed of a worker over its last encodes, weighted by the encode duration.
+// AverageSpeed and PeakSpeed are realtime multipliers, 2 means one hour of video encoded in half an hour.
+type WorkerThroughput struct {
+	Jobs         int     `json:"jobs"`
+	AverageSpeed float64 `json:"average_speed"`
+	AverageFPS   float64 `json:"average_fps"`
+	PeakSpeed    float64 `json:"peak_speed"`
+}
+
+// WorkerInfo describes the worker in its WorkerStartedEvent.
+type WorkerInfo struct {
+	Version      string    `json:"version"`
+	AcceptedJobs []JobType `json:"accepted_jobs"`
+	Threads      int       `json:"threads"`
+	EncodeJobs   int       `json:"encode_jobs"`
+	// EncodePools are the encode pools besides the default one, with their concurrency
+	EncodePools map[string]int `json:"encode_pools,omitempty"`
+	PGSJobs     int            `json:"pgs_jobs"`
+	// FFmpegVersion and Encoders describe the ffmpeg binary of encode workers
+	FFmpegVersion string   `json:"ffmpeg_version,omitempty"`
+	Encoders      []string `json:"encoders,omitempty"`
 }
 
 type ControlEvent struct {
@@ -83,11 +332,22 @@ type JobEvent struct {
 type JobType string
 
 type TaskEncode struct {
-	Id          uuid.UUID `json:"id"`
-	DownloadURL string    `json:"downloadURL"`
-	UploadURL   string    `json:"uploadURL"`
-	ChecksumURL string    `json:"checksumURL"`
-	EventID     int       `json:"eventID"`
+	Id              uuid.UUID        `json:"id"`
+	DownloadURL     string           `json:"downloadURL"`
+	UploadURL       string           `json:"uploadURL"`
+	ChecksumURL     string           `json:"checksumURL"`
+	EventID         int              `json:"eventID"`
+	StreamSelection *StreamSelection `json:"streamSelection,omitempty"`
+	QualityProfile  string           `json:"qualityProfile,omitempty"`
+	EncodeOverrides *EncodeOverrides `json:"encodeOverrides,omitempty"`
+	// SourceChecksum is the expected sha256 of the source, when set ChecksumURL is not requested
+	SourceChecksum string `json:"sourceChecksum,omitempty"`
+	// WorkDirRoot places the work directory in one of the worker.workDirRoots, empty is the worker temp path
+	WorkDirRoot string `json:"workDirRoot,omitempty"`
+	// Metadata are container tags written to the output over the ones kept from the source
+	Metadata ContainerMetadata `json:"metadata,omitempty"`
+	// IndexOnly reports the manifest of the source with the completed event instead of encoding and uploading it
+	IndexOnly bool `json:"indexOnly,omitempty"`
 }
 
 type WorkTaskEncode struct {
@@ -95,6 +355,27 @@ type WorkTaskEncode struct {
 	WorkDir        string
 	SourceFilePath string
 	TargetFilePath string
+	// TargetFileChecksum is the sha256 of TargetFilePath, computed once for all the upload attempts
+	TargetFileChecksum string
+	Report             *EncodeReport
+	// FFmpegWarnings are the ffmpeg messages of a successful encode matching worker.ffmpegWarningPatterns
+	FFmpegWarnings string
+	// StreamDecisions tell which audio and subtitle streams of the source are in the output and why
+	StreamDecisions []*StreamDecision
+	// Manifest is the manifest of the source an IndexOnly job reports
+	Manifest *SourceManifest
+	// DestinationFileName is the name the encoded file got on the destination share, which the server can't see
+	DestinationFileName string
+}
+
+// StreamDecision records whether a source stream is kept in the output and the reason, the last rule that applied.
+type StreamDecision struct {
+	Index    int    `json:"index"`
+	Type     string `json:"type"`
+	Language string `json:"language,omitempty"`
+	Codec    string `json:"codec,omitempty"`
+	Kept     bool   `json:"kept"`
+	Reason   string `json:"reason"`
 }
 
 type TaskPGS struct {
@@ -140,6 +421,12 @@ type TaskEvent struct {
 	NotificationType NotificationType   `json:"notification_type"`
 	Status           NotificationStatus `json:"status"`
 	Message          string             `json:"message"`
+	Report           *EncodeReport      `json:"report,omitempty"`
+	Manifest         *SourceManifest    `json:"manifest,omitempty"`
+	// DestinationFileName renames the destination of the job to the file the worker wrote on the destination share
+	DestinationFileName string            `json:"destination_file_name,omitempty"`
+	WorkerInfo          *WorkerInfo       `json:"worker_info,omitempty"`
+	Throughput          *WorkerThroughput `json:"throughput,omitempty"`
 }
 
 type TaskStatus struct {
@@ -172,15 +459,21 @@ func (e TaskEvent) IsEncoding() bool {
 	if e.NotificationType == MKVExtractNotification && (e.Status == ProgressingNotificationStatus || e.Status == CompletedNotificationStatus) {
 		return true
 	}
+	if e.NotificationType == FFMPEGExtractNotification && (e.Status == ProgressingNotificationStatus || e.Status == CompletedNotificationStatus) {
+		return true
+	}
 	if e.NotificationType == FFProbeNotification && (e.Status == ProgressingNotificationStatus || e.Status == CompletedNotificationStatus) {
 		return true
 	}
-	if e.NotificationType == PGSNotification && (e.Status == ProgressingNotificationStatus || e.Status == CompletedNotificationStatus) {
+	if e.NotificationType == PGSNotification && (e.Status == ProgressingNotificationStatus || e.Status == WaitingNotificationStatus || e.Status == CompletedNotificationStatus) {
 		return true
 	}
 	if e.NotificationType == FFMPEGSNotification && e.Status == ProgressingNotificationStatus {
 		return true
 	}
+	if e.NotificationType == VMAFNotification && e.Status == ProgressingNotificationStatus {
+		return true
+	}
 
 	return false
 }
@@ -193,6 +486,9 @@ func (e TaskEvent) IsUploading() bool {
 		return true
 	}
 
+	if e.NotificationType == VMAFNotification && e.Status == CompletedNotificationStatus {
+		return true
+	}
 	if e.NotificationType == UploadNotification && e.Status == ProgressingNotificationStatus {
 		return true
 	}
@@ -200,6 +496,14 @@ func (e TaskEvent) IsUploading() bool {
 	return false
 }
 
+// IsFinished reports whether the event closes the job, no more events follow it.
+func (e TaskEvent) IsFinished() bool {
+	if e.EventType != NotificationEvent || e.NotificationType != JobNotification {
+		return false
+	}
+	return e.Status == CompletedNotificationStatus || e.Status == FailedNotificationStatus || e.Status == CanceledNotificationStatus || e.Status == SkippedNotificationStatus
+}
+
 func (W *WorkTaskEncode) Clean() error {
 	//log.Warnf("[%s] cleaning up task workspace", W.TaskEncode.Id.String())
 	err := os.RemoveAll(W.WorkDir)
@@ -236,8 +540,66 @@ func (t *TaskEvents) GetStatus() NotificationStatus {
 }
 
 type JobRequest struct {
-	SourcePath      string `json:"source_path"`
-	DestinationPath string `json:"destination_path"`
+	SourcePath      string           `json:"source_path"`
+	DestinationPath string           `json:"destination_path"`
+	StreamSelection *StreamSelection `json:"stream_selection,omitempty"`
+	QualityProfile  string           `json:"quality_profile,omitempty"`
+	EncodeOverrides *EncodeOverrides `json:"encode_overrides,omitempty"`
+	// SourceChecksum is the sha256 of the source, workers verify the download against it
+	SourceChecksum string `json:"source_checksum,omitempty"`
+	// WorkDirRoot is the directory, one of the worker.workDirRoots, the worker places the job work directory in
+	WorkDirRoot string `json:"work_dir_root,omitempty"`
+	// Notification is notified of the status changes of the job, besides the scheduler.notificationURL
+	Notification *NotificationTarget `json:"notification,omitempty"`
+	// Metadata are the container tags of the output, like its title
+	Metadata ContainerMetadata `json:"metadata,omitempty"`
+	// IndexOnly probes and hashes the source into a manifest instead of encoding it
+	IndexOnly bool       `json:"index_only,omitempty"`
+	BatchId   *uuid.UUID `json:"-"`
+}
+
+// BatchJobRequest creates a job for each of the SourcePaths and for each video found in Directory. Include
+// and Exclude are glob patterns matched against the file name and the path relative to Directory.
+type BatchJobRequest struct {
+	SourcePaths     []string         `json:"source_paths,omitempty"`
+	Directory       string           `json:"directory,omitempty"`
+	Recursive       bool             `json:"recursive,omitempty"`
+	Include         []string         `json:"include,omitempty"`
+	Exclude         []string         `json:"exclude,omitempty"`
+	StreamSelection *StreamSelection `json:"stream_selection,omitempty"`
+	QualityProfile  string           `json:"quality_profile,omitempty"`
+	EncodeOverrides *EncodeOverrides `json:"encode_overrides,omitempty"`
+	// Notification is notified of the status changes of every job of the batch
+	Notification *NotificationTarget `json:"notification,omitempty"`
+	// IndexOnly indexes the sources of the batch instead of encoding them
+	IndexOnly bool `json:"index_only,omitempty"`
+}
+
+// PurgeRequest selects the finished jobs to delete: the ones whose final status is one of Statuses, completed when
+// empty, and that finished more than OlderThanDays days ago. DryRun only lists them.
+type PurgeRequest struct {
+	Statuses      []NotificationStatus `json:"statuses,omitempty"`
+	OlderThanDays int                  `json:"older_than_days,omitempty"`
+	DryRun        bool                 `json:"dry_run,omitempty"`
+}
+
+// PurgeResult lists the jobs deleted, or that would be deleted on a dry run, and the leftover upload files removed.
+type PurgeResult struct {
+	DryRun    bool        `json:"dry_run"`
+	JobIds    []uuid.UUID `json:"job_ids"`
+	Artifacts []string    `json:"artifacts"`
+}
+
+type BatchJob struct {
+	SourcePath string     `json:"source_path"`
+	JobId      *uuid.UUID `json:"job_id,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type Batch struct {
+	Id        uuid.UUID   `json:"id"`
+	CreatedAt time.Time   `json:"created_at"`
+	Jobs      []*BatchJob `json:"jobs"`
 }
 
 func (a TaskEvents) Len() int {
@@ -276,4 +638,5 @@ type Manager interface {
 	EventNotification(event TaskEvent)
 	ResponsePGSJob(response TaskPGSResponse) error
 	RequestPGSJob(pgsJob TaskPGS) <-chan *TaskPGSResponse
+	PGSQueueMessages() (int, error)
 }
@@ -6,8 +6,10 @@ import (
 	"gearr/broker"
 	"gearr/cmd"
 	"gearr/helper"
+	"gearr/model"
 	"gearr/server/queue"
 	"gearr/server/repository"
+	"gearr/server/rpc"
 	"gearr/server/scheduler"
 	"gearr/server/web"
 	"net/url"
@@ -31,6 +33,7 @@ type CmdLineOpts struct {
 	LogLevel  string                     `mapstructure:"log-level"`
 	Scheduler scheduler.SchedulerConfig  `mapstructure:"scheduler"`
 	Web       web.WebServerConfig        `mapstructure:"web"`
+	GRPC      rpc.GRPCServerConfig       `mapstructure:"grpc"`
 }
 
 var (
@@ -44,6 +47,7 @@ func init() {
 	cmd.LogLevelFlags()
 	cmd.SchedulerFlags()
 	cmd.WebFlags()
+	cmd.GRPCFlags()
 
 	pflag.Usage = usage
 
@@ -89,22 +93,37 @@ func init() {
 	opts.Scheduler.UploadPath = filepath.Clean(opts.Scheduler.UploadPath)
 	helper.CheckPath(opts.Scheduler.DownloadPath)
 	helper.CheckPath(opts.Scheduler.UploadPath)
-	/*
-	   scheduleTimeDuration, err := time.ParseDuration(opts.ScheduleTime)
-
-	   	if err!=nil {
-	   		log.Panic(err)
-	   	}
-
-	   jobTimeout, err := time.ParseDuration(opts.JobTimeout)
-
-	   	if err!=nil {
-	   		log.Panic(err)
-	   	}
-
-	   opts.Scheduler.ScheduleTime = scheduleTimeDuration
-	   opts.Scheduler.JobTimeout = jobTimeout
-	*/
+	if opts.Scheduler.SourceURL != "" {
+		parsedURL, err := url.Parse(opts.Scheduler.SourceURL)
+		if err != nil || (parsedURL.Scheme != "sftp" && parsedURL.Scheme != "smb") {
+			log.Panicf("invalid scheduler.sourceURL %s, must be a sftp:// or smb:// URL", opts.Scheduler.SourceURL)
+		}
+	}
+	// the uploads are renamed into place once complete, which curl can't do on smb shares
+	if opts.Scheduler.DestinationURL != "" {
+		parsedURL, err := url.Parse(opts.Scheduler.DestinationURL)
+		if err != nil || parsedURL.Scheme != "sftp" {
+			log.Panicf("invalid scheduler.destinationURL %s, must be a sftp:// URL", opts.Scheduler.DestinationURL)
+		}
+	}
+	if opts.Scheduler.JobTimeoutAction != scheduler.JobTimeoutActionRequeue && opts.Scheduler.JobTimeoutAction != scheduler.JobTimeoutActionFail {
+		log.Panicf("invalid scheduler.jobTimeoutAction %s, must be %s or %s", opts.Scheduler.JobTimeoutAction, scheduler.JobTimeoutActionRequeue, scheduler.JobTimeoutActionFail)
+	}
+	if err := scheduler.ValidatePurgeStatuses(opts.Scheduler.RetentionStatuses); err != nil || (opts.Scheduler.RetentionPeriod > 0 && len(opts.Scheduler.RetentionStatuses) == 0) {
+		log.Panicf("invalid scheduler.retentionStatuses %v, must be some of completed, failed, canceled or skipped", opts.Scheduler.RetentionStatuses)
+	}
+	if opts.Scheduler.NotificationURL != "" {
+		globalTarget := &model.NotificationTarget{URL: opts.Scheduler.NotificationURL, Statuses: opts.Scheduler.NotificationStatuses}
+		if err := globalTarget.Validate(); err != nil {
+			log.Panicf("invalid scheduler.notificationURL: %v", err)
+		}
+	}
+	if opts.Web.Token == "" {
+		log.Panicf("web.token must not be empty, an empty bearer token would be accepted")
+	}
+	if (opts.GRPC.CertFile == "") != (opts.GRPC.KeyFile == "") {
+		log.Panicf("grpc.certFile and grpc.keyFile must be set together")
+	}
 }
 
 func usage() {
@@ -154,6 +173,12 @@ func main() {
 	var webServer *web.WebServer
 	webServer = web.NewWebServer(opts.Web, scheduler)
 	webServer.Run(wg, ctx)
+
+	//gRPC Server
+	if opts.GRPC.Port > 0 {
+		grpcServer := rpc.NewGRPCServer(opts.GRPC, opts.Web.Token, opts.Web.AllowedNetworks, scheduler)
+		grpcServer.Run(wg, ctx)
+	}
 	wg.Wait()
 }
 
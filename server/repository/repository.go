@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"gearr/model"
 	"strings"
@@ -22,10 +23,13 @@ type Repository interface {
 	getConnection(ctx context.Context) (Transaction, error)
 	Initialize(ctx context.Context) error
 	ProcessEvent(ctx context.Context, event *model.TaskEvent) error
-	PingServerUpdate(ctx context.Context, name string, ip string, queueName string) error
+	PingServerUpdate(ctx context.Context, name string, queueName string, ip string, throughput *model.WorkerThroughput) error
+	UpdateWorkerLifecycle(ctx context.Context, event *model.TaskEvent) error
 	GetTimeoutJobs(ctx context.Context, timeout time.Duration) ([]*model.TaskEvent, error)
+	GetOrphanJobs(ctx context.Context, workerTimeout time.Duration) ([]*model.TaskEvent, error)
 	GetJob(ctx context.Context, uuid string) (*model.Job, error)
 	DeleteJob(ctx context.Context, uuid string) error
+	UpdateJobDestinationPath(ctx context.Context, uuid string, destinationPath string) error
 	GetJobs(ctx context.Context) (*[]model.Job, error)
 	GetJobByPath(ctx context.Context, path string) (*model.Job, error)
 	AddNewTaskEvent(ctx context.Context, event *model.TaskEvent) error
@@ -33,6 +37,14 @@ type Repository interface {
 	WithTransaction(ctx context.Context, transactionFunc func(ctx context.Context, tx Repository) error) error
 	GetWorker(ctx context.Context, name string) (*model.Worker, error)
 	GetWorkers(ctx context.Context) (*[]model.Worker, error)
+	GetQueuedJobs(ctx context.Context, limit int) ([]*model.Job, error)
+	CountInFlightJobs(ctx context.Context) (int, error)
+	CountActiveEncodes(ctx context.Context, workerTimeout time.Duration) (int, error)
+	GetSpaceSavings(ctx context.Context) (*model.SpaceSavings, error)
+	AddBatch(ctx context.Context, batch *model.Batch) error
+	GetBatch(ctx context.Context, uuid string) (*model.Batch, error)
+	GetFinishedJobs(ctx context.Context, statuses []model.NotificationStatus, finishedBefore time.Time) ([]*model.Job, error)
+	PurgeJobs(ctx context.Context, uuids []string) error
 }
 
 type Transaction interface {
@@ -117,7 +129,9 @@ func (S *SQLRepository) ProcessEvent(ctx context.Context, taskEvent *model.TaskE
 	var err error
 	switch taskEvent.EventType {
 	case model.PingEvent:
-		err = S.PingServerUpdate(ctx, taskEvent.WorkerName, taskEvent.WorkerQueue, taskEvent.IP)
+		err = S.PingServerUpdate(ctx, taskEvent.WorkerName, taskEvent.WorkerQueue, taskEvent.IP, taskEvent.Throughput)
+	case model.WorkerStartedEvent, model.WorkerStoppedEvent:
+		err = S.UpdateWorkerLifecycle(ctx, taskEvent)
 	case model.NotificationEvent:
 		err = S.AddNewTaskEvent(ctx, taskEvent)
 		/*if taskEvent.NotificationType == model.FFProbeNotification && taskEvent.Status ==  model.CompletedNotificationStatus {
@@ -185,7 +199,7 @@ func (S *SQLRepository) GetWorkers(ctx context.Context) (*[]model.Worker, error)
 }
 
 func (S *SQLRepository) getWorkers(ctx context.Context, db Transaction) (*[]model.Worker, error) {
-	rows, err := db.QueryContext(ctx, "SELECT name, ip, queue_name, last_seen FROM workers")
+	rows, err := db.QueryContext(ctx, "SELECT name, ip, queue_name, last_seen, coalesce(status,''), started_at, stopped_at, info, throughput FROM workers")
 	if err != nil {
 		return nil, err
 	}
@@ -194,7 +208,20 @@ func (S *SQLRepository) getWorkers(ctx context.Context, db Transaction) (*[]mode
 	workers := []model.Worker{}
 	for rows.Next() {
 		worker := model.Worker{}
-		rows.Scan(&worker.Name, &worker.Ip, &worker.QueueName, &worker.LastSeen)
+		var info, throughput sql.NullString
+		rows.Scan(&worker.Name, &worker.Ip, &worker.QueueName, &worker.LastSeen, &worker.Status, &worker.StartedAt, &worker.StoppedAt, &info, &throughput)
+		if info.Valid {
+			worker.Info = &model.WorkerInfo{}
+			if err = json.Unmarshal([]byte(info.String), worker.Info); err != nil {
+				worker.Info = nil
+			}
+		}
+		if throughput.Valid {
+			worker.Throughput = &model.WorkerThroughput{}
+			if err = json.Unmarshal([]byte(throughput.String), worker.Throughput); err != nil {
+				worker.Throughput = nil
+			}
+		}
 		workers = append(workers, worker)
 	}
 
@@ -219,6 +246,15 @@ func (S *SQLRepository) DeleteJob(ctx context.Context, uuid string) error {
 	return err
 }
 
+func (S *SQLRepository) UpdateJobDestinationPath(ctx context.Context, uuid string, destinationPath string) error {
+	db, err := S.getConnection(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "UPDATE jobs SET destination_path=$1 WHERE id=$2", destinationPath, uuid)
+	return err
+}
+
 func (S *SQLRepository) GetJobs(ctx context.Context) (jobs *[]model.Job, returnError error) {
 	db, err := S.getConnection(ctx)
 	if err != nil {
@@ -240,21 +276,43 @@ func (S *SQLRepository) GetTimeoutJobs(ctx context.Context, timeout time.Duratio
 	return taskEvent, nil
 }
 
+func (S *SQLRepository) GetOrphanJobs(ctx context.Context, workerTimeout time.Duration) ([]*model.TaskEvent, error) {
+	conn, err := S.getConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return S.getOrphanJobs(ctx, conn, workerTimeout)
+}
+
 func (S *SQLRepository) getJob(ctx context.Context, tx Transaction, uuid string) (*model.Job, error) {
-	rows, err := tx.QueryContext(ctx, "SELECT id, source_path, destination_path FROM jobs WHERE id=$1", uuid)
+	rows, err := tx.QueryContext(ctx, "SELECT id, source_path, destination_path, stream_selection, quality_profile, encode_overrides, coalesce(source_checksum,''), coalesce(work_dir_root,''), notification, metadata, index_only FROM jobs WHERE id=$1", uuid)
 	if err != nil {
 		return nil, err
 	}
 	job := model.Job{}
 	found := false
+	var streamSelection, qualityProfile, encodeOverrides, notification, metadata sql.NullString
 	if rows.Next() {
-		rows.Scan(&job.Id, &job.SourcePath, &job.DestinationPath)
+		rows.Scan(&job.Id, &job.SourcePath, &job.DestinationPath, &streamSelection, &qualityProfile, &encodeOverrides, &job.SourceChecksum, &job.WorkDirRoot, &notification, &metadata, &job.IndexOnly)
+		job.QualityProfile = qualityProfile.String
 		found = true
 	}
 	rows.Close()
 	if !found {
 		return nil, fmt.Errorf("%w, %s", ErrElementNotFound, uuid)
 	}
+	if job.StreamSelection, err = unmarshalStreamSelection(streamSelection); err != nil {
+		return nil, err
+	}
+	if job.EncodeOverrides, err = unmarshalEncodeOverrides(encodeOverrides); err != nil {
+		return nil, err
+	}
+	if job.Notification, err = unmarshalNotificationTarget(notification); err != nil {
+		return nil, err
+	}
+	if job.Metadata, err = unmarshalContainerMetadata(metadata); err != nil {
+		return nil, err
+	}
 
 	taskEvents, err := S.getTaskEvents(ctx, tx, job.Id.String())
 	if err != nil {
@@ -269,6 +327,17 @@ func (S *SQLRepository) getJob(ctx context.Context, tx Transaction, uuid string)
 	job.Status = status
 	job.StatusMessage = statusMessage
 
+	report, err := S.getJobReport(ctx, tx, job.Id.String())
+	if err != nil {
+		return nil, err
+	}
+	job.Report = report
+	if job.IndexOnly {
+		if job.Manifest, err = S.getJobManifest(ctx, tx, job.Id.String()); err != nil {
+			return nil, err
+		}
+	}
+
 	return &job, nil
 }
 
@@ -339,7 +408,7 @@ func (S *SQLRepository) getJobStatus(ctx context.Context, tx Transaction, uuid s
 
 func (S *SQLRepository) getJobByPath(ctx context.Context, tx Transaction, path string) (*model.Job, error) {
 	log.Debugf("get job by path: %s", path)
-	rows, err := tx.QueryContext(ctx, "SELECT * FROM jobs WHERE source_path=$1", path)
+	rows, err := tx.QueryContext(ctx, "SELECT id, source_path, destination_path, stream_selection, quality_profile, encode_overrides, coalesce(source_checksum,''), coalesce(work_dir_root,''), notification, metadata, index_only FROM jobs WHERE source_path=$1", path)
 	if err != nil {
 		log.Errorf("no job founds by path: %s", path)
 		return nil, err
@@ -350,8 +419,10 @@ func (S *SQLRepository) getJobByPath(ctx context.Context, tx Transaction, path s
 	job := model.Job{}
 
 	found := false
+	var streamSelection, qualityProfile, encodeOverrides, notification, metadata sql.NullString
 	if rows.Next() {
-		rows.Scan(&job.Id, &job.SourcePath, &job.DestinationPath)
+		rows.Scan(&job.Id, &job.SourcePath, &job.DestinationPath, &streamSelection, &qualityProfile, &encodeOverrides, &job.SourceChecksum, &job.WorkDirRoot, &notification, &metadata, &job.IndexOnly)
+		job.QualityProfile = qualityProfile.String
 		found = true
 	}
 	log.Debugf("job: %+v", job)
@@ -359,6 +430,18 @@ func (S *SQLRepository) getJobByPath(ctx context.Context, tx Transaction, path s
 	if !found {
 		return nil, nil
 	}
+	if job.StreamSelection, err = unmarshalStreamSelection(streamSelection); err != nil {
+		return nil, err
+	}
+	if job.EncodeOverrides, err = unmarshalEncodeOverrides(encodeOverrides); err != nil {
+		return nil, err
+	}
+	if job.Notification, err = unmarshalNotificationTarget(notification); err != nil {
+		return nil, err
+	}
+	if job.Metadata, err = unmarshalContainerMetadata(metadata); err != nil {
+		return nil, err
+	}
 
 	taskEvents, err := S.getTaskEvents(ctx, tx, job.Id.String())
 	log.Debugf("taskEvents: %+v", taskEvents)
@@ -377,12 +460,43 @@ func (S *SQLRepository) GetJobByPath(ctx context.Context, path string) (*model.J
 	return S.getJobByPath(ctx, conn, path)
 }
 
-func (S *SQLRepository) PingServerUpdate(ctx context.Context, name string, queueName string, ip string) (returnError error) {
+// PingServerUpdate refreshes last_seen, the throughput is only replaced when the ping carries one, so it survives
+// the pings of older workers and of workers that did not encode since they started.
+func (S *SQLRepository) PingServerUpdate(ctx context.Context, name string, queueName string, ip string, throughput *model.WorkerThroughput) (returnError error) {
+	conn, err := S.getConnection(ctx)
+	if err != nil {
+		return err
+	}
+	var throughputJSON sql.NullString
+	if throughput != nil {
+		data, err := json.Marshal(throughput)
+		if err != nil {
+			return err
+		}
+		throughputJSON = sql.NullString{String: string(data), Valid: true}
+	}
+	_, err = conn.ExecContext(ctx, "INSERT INTO workers (name, ip,queue_name,last_seen,throughput) VALUES ($1,$2,$3,$4,$5) ON CONFLICT (name) DO UPDATE SET ip = $2, queue_name=$3, last_seen=$4, throughput=coalesce($5, workers.throughput);", name, ip, queueName, time.Now(), throughputJSON)
+	return err
+}
+
+// UpdateWorkerLifecycle marks the worker online with its info on WorkerStartedEvent and stopped on
+// WorkerStoppedEvent. Workers that crash never send the later, so they stay online until last_seen gets old.
+func (S *SQLRepository) UpdateWorkerLifecycle(ctx context.Context, event *model.TaskEvent) error {
 	conn, err := S.getConnection(ctx)
 	if err != nil {
 		return err
 	}
-	_, err = conn.ExecContext(ctx, "INSERT INTO workers (name, ip,queue_name,last_seen ) VALUES ($1,$2,$3,$4) ON CONFLICT (name) DO UPDATE SET ip = $2, queue_name=$3, last_seen=$4;", name, ip, queueName, time.Now())
+	if event.EventType == model.WorkerStoppedEvent {
+		_, err = conn.ExecContext(ctx, "UPDATE workers SET status=$2, stopped_at=$3, last_seen=$3 WHERE name=$1", event.WorkerName, model.WorkerStoppedStatus, event.EventTime)
+		return err
+	}
+	info, err := json.Marshal(event.WorkerInfo)
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "INSERT INTO workers (name, ip, queue_name, last_seen, status, started_at, info) VALUES ($1,$2,$3,$4,$5,$4,$6) "+
+		"ON CONFLICT (name) DO UPDATE SET ip=$2, queue_name=$3, last_seen=$4, status=$5, started_at=$4, info=$6",
+		event.WorkerName, event.IP, event.WorkerQueue, event.EventTime, model.WorkerOnlineStatus, string(info))
 	return err
 }
 
@@ -411,8 +525,77 @@ func (S *SQLRepository) addNewTaskEvent(ctx context.Context, tx Transaction, eve
 
 	_, err = tx.ExecContext(ctx, "INSERT INTO job_events (job_id, job_event_id,worker_name,event_time,event_type,notification_type,status,message)"+
 		" VALUES ($1,$2,$3,$4,$5,$6,$7,$8)", event.Id.String(), event.EventID, event.WorkerName, time.Now(), event.EventType, event.NotificationType, event.Status, strings.TrimSpace(event.Message))
+	if err != nil {
+		return err
+	}
+	if event.Report != nil {
+		if err = S.saveJobReport(ctx, tx, event.Id.String(), event.Report); err != nil {
+			return err
+		}
+	}
+	if event.Manifest != nil {
+		return S.saveJobManifest(ctx, tx, event.Id.String(), event.Manifest)
+	}
+	return nil
+}
+
+func (S *SQLRepository) saveJobManifest(ctx context.Context, tx Transaction, uuid string, manifest *model.SourceManifest) error {
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO job_manifests (job_id, checksum, manifest) VALUES ($1,$2,$3) "+
+		"ON CONFLICT (job_id) DO UPDATE SET checksum=$2, manifest=$3", uuid, manifest.Checksum, string(b))
+	return err
+}
+
+func (S *SQLRepository) getJobManifest(ctx context.Context, tx Transaction, uuid string) (*model.SourceManifest, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT manifest FROM job_manifests WHERE job_id=$1", uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, nil
+	}
+	var b string
+	if err = rows.Scan(&b); err != nil {
+		return nil, err
+	}
+	manifest := &model.SourceManifest{}
+	if err = json.Unmarshal([]byte(b), manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func (S *SQLRepository) saveJobReport(ctx context.Context, tx Transaction, uuid string, report *model.EncodeReport) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO job_reports (job_id, source_size, encoded_size, source_codec, encoded_codec, estimated, vmaf_score, source_video_bitrate, crf, encode_seconds, average_speed, peak_speed, average_fps) "+
+		"VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13) "+
+		"ON CONFLICT (job_id) DO UPDATE SET source_size=$2, encoded_size=$3, source_codec=$4, encoded_codec=$5, estimated=$6, vmaf_score=$7, source_video_bitrate=$8, crf=$9, "+
+		"encode_seconds=$10, average_speed=$11, peak_speed=$12, average_fps=$13",
+		uuid, report.SourceSize, report.EncodedSize, report.SourceCodec, report.EncodedCodec, report.Estimated, report.VMAFScore, report.SourceVideoBitrate, report.CRF,
+		report.EncodeSeconds, report.AverageSpeed, report.PeakSpeed, report.AverageFPS)
 	return err
 }
+
+func (S *SQLRepository) getJobReport(ctx context.Context, tx Transaction, uuid string) (*model.EncodeReport, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT source_size, encoded_size, coalesce(source_codec,''), coalesce(encoded_codec,''), estimated, coalesce(vmaf_score,0), coalesce(source_video_bitrate,0), coalesce(crf,0), "+
+		"coalesce(encode_seconds,0), coalesce(average_speed,0), coalesce(peak_speed,0), coalesce(average_fps,0) FROM job_reports WHERE job_id=$1", uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, nil
+	}
+	report := model.EncodeReport{}
+	rows.Scan(&report.SourceSize, &report.EncodedSize, &report.SourceCodec, &report.EncodedCodec, &report.Estimated, &report.VMAFScore, &report.SourceVideoBitrate, &report.CRF,
+		&report.EncodeSeconds, &report.AverageSpeed, &report.PeakSpeed, &report.AverageFPS)
+	return &report, nil
+}
 func (S *SQLRepository) AddJob(ctx context.Context, job *model.Job) error {
 	conn, err := S.getConnection(ctx)
 	if err != nil {
@@ -422,22 +605,313 @@ func (S *SQLRepository) AddJob(ctx context.Context, job *model.Job) error {
 }
 
 func (S *SQLRepository) addJob(ctx context.Context, tx Transaction, job *model.Job) error {
-	_, err := tx.ExecContext(ctx, "INSERT INTO jobs (id, source_path,destination_path)"+
-		" VALUES ($1,$2,$3)", job.Id.String(), job.SourcePath, job.DestinationPath)
+	var streamSelection sql.NullString
+	if job.StreamSelection != nil {
+		b, err := json.Marshal(job.StreamSelection)
+		if err != nil {
+			return err
+		}
+		streamSelection = sql.NullString{String: string(b), Valid: true}
+	}
+	var batchId sql.NullString
+	if job.BatchId != nil {
+		batchId = sql.NullString{String: job.BatchId.String(), Valid: true}
+	}
+	var qualityProfile sql.NullString
+	if job.QualityProfile != "" {
+		qualityProfile = sql.NullString{String: job.QualityProfile, Valid: true}
+	}
+	var encodeOverrides sql.NullString
+	if job.EncodeOverrides != nil {
+		b, err := json.Marshal(job.EncodeOverrides)
+		if err != nil {
+			return err
+		}
+		encodeOverrides = sql.NullString{String: string(b), Valid: true}
+	}
+	var notification sql.NullString
+	if job.Notification != nil {
+		b, err := json.Marshal(job.Notification)
+		if err != nil {
+			return err
+		}
+		notification = sql.NullString{String: string(b), Valid: true}
+	}
+	var metadata sql.NullString
+	if len(job.Metadata) > 0 {
+		b, err := json.Marshal(job.Metadata)
+		if err != nil {
+			return err
+		}
+		metadata = sql.NullString{String: string(b), Valid: true}
+	}
+	var sourceChecksum sql.NullString
+	if job.SourceChecksum != "" {
+		sourceChecksum = sql.NullString{String: job.SourceChecksum, Valid: true}
+	}
+	var workDirRoot sql.NullString
+	if job.WorkDirRoot != "" {
+		workDirRoot = sql.NullString{String: job.WorkDirRoot, Valid: true}
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO jobs (id, source_path,destination_path,stream_selection,quality_profile,batch_id,encode_overrides,source_checksum,work_dir_root,notification,metadata,index_only)"+
+		" VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)", job.Id.String(), job.SourcePath, job.DestinationPath, streamSelection, qualityProfile, batchId, encodeOverrides, sourceChecksum, workDirRoot, notification, metadata, job.IndexOnly)
+	return err
+}
+
+func (S *SQLRepository) AddBatch(ctx context.Context, batch *model.Batch) error {
+	conn, err := S.getConnection(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "INSERT INTO batches (id, created_at) VALUES ($1,$2)", batch.Id.String(), batch.CreatedAt)
 	return err
 }
 
+func (S *SQLRepository) GetBatch(ctx context.Context, uuid string) (*model.Batch, error) {
+	conn, err := S.getConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return S.getBatch(ctx, conn, uuid)
+}
+
+func (S *SQLRepository) getBatch(ctx context.Context, tx Transaction, uuid string) (*model.Batch, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, created_at FROM batches WHERE id=$1", uuid)
+	if err != nil {
+		return nil, err
+	}
+	batch := model.Batch{Jobs: []*model.BatchJob{}}
+	found := false
+	if rows.Next() {
+		rows.Scan(&batch.Id, &batch.CreatedAt)
+		found = true
+	}
+	rows.Close()
+	if !found {
+		return nil, fmt.Errorf("%w, %s", ErrElementNotFound, uuid)
+	}
+
+	rows, err = tx.QueryContext(ctx, "SELECT id, source_path FROM jobs WHERE batch_id=$1 ORDER BY source_path", uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		job := model.Job{}
+		rows.Scan(&job.Id, &job.SourcePath)
+		batch.Jobs = append(batch.Jobs, &model.BatchJob{SourcePath: job.SourcePath, JobId: &job.Id})
+	}
+	return &batch, nil
+}
+
+func unmarshalStreamSelection(streamSelection sql.NullString) (*model.StreamSelection, error) {
+	if !streamSelection.Valid {
+		return nil, nil
+	}
+	selection := &model.StreamSelection{}
+	if err := json.Unmarshal([]byte(streamSelection.String), selection); err != nil {
+		return nil, err
+	}
+	return selection, nil
+}
+
+func unmarshalEncodeOverrides(encodeOverrides sql.NullString) (*model.EncodeOverrides, error) {
+	if !encodeOverrides.Valid {
+		return nil, nil
+	}
+	overrides := &model.EncodeOverrides{}
+	if err := json.Unmarshal([]byte(encodeOverrides.String), overrides); err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+func unmarshalNotificationTarget(notification sql.NullString) (*model.NotificationTarget, error) {
+	if !notification.Valid {
+		return nil, nil
+	}
+	target := &model.NotificationTarget{}
+	if err := json.Unmarshal([]byte(notification.String), target); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+func unmarshalContainerMetadata(metadata sql.NullString) (model.ContainerMetadata, error) {
+	if !metadata.Valid {
+		return nil, nil
+	}
+	containerMetadata := model.ContainerMetadata{}
+	if err := json.Unmarshal([]byte(metadata.String), &containerMetadata); err != nil {
+		return nil, err
+	}
+	return containerMetadata, nil
+}
+
 func (S *SQLRepository) getTimeoutJobs(ctx context.Context, tx Transaction, timeout time.Duration) ([]*model.TaskEvent, error) {
 	timeoutDate := time.Now().Add(-timeout)
 
-	rows, err := tx.QueryContext(ctx, "SELECT v.* FROM job_events v right join "+
+	rows, err := tx.QueryContext(ctx, "SELECT v.job_id, v.job_event_id, v.worker_name, v.event_time, v.event_type, v.notification_type, v.status, v.message FROM job_events v inner join "+
 		"(SELECT job_id,max(job_event_id) as job_event_id  FROM job_events WHERE notification_type='Job'  group by job_id) as m "+
-		"on m.job_id=v.job_id and m.job_event_id=v.job_event_id WHERE status='started' and v.event_time < $1::timestamptz", timeoutDate)
+		"on m.job_id=v.job_id and m.job_event_id=v.job_event_id WHERE v.status=$1 and v.event_time < $2::timestamptz", model.ProgressingNotificationStatus, timeoutDate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var taskEvents []*model.TaskEvent
+	for rows.Next() {
+		event := model.TaskEvent{}
+		rows.Scan(&event.Id, &event.EventID, &event.WorkerName, &event.EventTime, &event.EventType, &event.NotificationType, &event.Status, &event.Message)
+		taskEvents = append(taskEvents, &event)
+	}
+	return taskEvents, nil
+}
+
+func (S *SQLRepository) GetFinishedJobs(ctx context.Context, statuses []model.NotificationStatus, finishedBefore time.Time) ([]*model.Job, error) {
+	conn, err := S.getConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return S.getFinishedJobs(ctx, conn, statuses, finishedBefore)
+}
 
-	//2020-05-17 20:50:41.428531 +00:00
+// getFinishedJobs returns the jobs whose final Job status is one of statuses and was reached before finishedBefore.
+func (S *SQLRepository) getFinishedJobs(ctx context.Context, tx Transaction, statuses []model.NotificationStatus, finishedBefore time.Time) ([]*model.Job, error) {
+	args := []interface{}{finishedBefore}
+	var placeholders []string
+	for _, status := range statuses {
+		args = append(args, status)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT v.id, v.source_path, v.destination_path FROM jobs v "+
+		"INNER JOIN job_status vs ON v.id = vs.job_id WHERE vs.notification_type='Job' AND vs.event_time < $1::timestamptz "+
+		"AND vs.status IN ("+strings.Join(placeholders, ",")+") ORDER BY vs.event_time ASC", args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	var jobs []*model.Job
+	for rows.Next() {
+		job := model.Job{}
+		rows.Scan(&job.Id, &job.SourcePath, &job.DestinationPath)
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
+
+// PurgeJobs deletes the jobs with their events, status and report, and the batches left without jobs.
+func (S *SQLRepository) PurgeJobs(ctx context.Context, uuids []string) error {
+	return S.WithTransaction(ctx, func(ctx context.Context, tx Repository) error {
+		conn, err := tx.getConnection(ctx)
+		if err != nil {
+			return err
+		}
+		for _, uuid := range uuids {
+			if err = S.deleteJob(conn, uuid); err != nil {
+				return err
+			}
+		}
+		_, err = conn.ExecContext(ctx, "DELETE FROM batches b WHERE NOT EXISTS (SELECT 1 FROM jobs j WHERE j.batch_id = b.id)")
+		return err
+	})
+}
+
+func (S *SQLRepository) GetQueuedJobs(ctx context.Context, limit int) ([]*model.Job, error) {
+	conn, err := S.getConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return S.getQueuedJobs(ctx, conn, limit)
+}
+
+func (S *SQLRepository) getQueuedJobs(ctx context.Context, tx Transaction, limit int) ([]*model.Job, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT v.id, v.source_path, v.destination_path FROM jobs v "+
+		"INNER JOIN job_status vs ON v.id = vs.job_id WHERE vs.notification_type='Job' AND vs.status IN ($1,$2) "+
+		"ORDER BY vs.event_time ASC LIMIT $3", model.QueuedNotificationStatus, model.ReQueuedNotificationStatus, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*model.Job
+	for rows.Next() {
+		job := model.Job{}
+		rows.Scan(&job.Id, &job.SourcePath, &job.DestinationPath)
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
+
+func (S *SQLRepository) CountInFlightJobs(ctx context.Context) (int, error) {
+	conn, err := S.getConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return S.countInFlightJobs(ctx, conn)
+}
+
+// countInFlightJobs counts jobs dispatched to the broker that have not reached a final state yet.
+func (S *SQLRepository) countInFlightJobs(ctx context.Context, tx Transaction) (int, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT count(*) FROM job_status WHERE NOT (notification_type='Job' AND status IN ($1,$2,$3,$4,$5,$6))",
+		model.QueuedNotificationStatus, model.ReQueuedNotificationStatus, model.CompletedNotificationStatus, model.FailedNotificationStatus, model.CanceledNotificationStatus, model.SkippedNotificationStatus)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	inFlight := 0
+	if rows.Next() {
+		rows.Scan(&inFlight)
+	}
+	return inFlight, nil
+}
+
+func (S *SQLRepository) CountActiveEncodes(ctx context.Context, workerTimeout time.Duration) (int, error) {
+	conn, err := S.getConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return S.countActiveEncodes(ctx, conn, workerTimeout)
+}
+
+// countActiveEncodes counts the jobs running across the fleet: the dispatched jobs no worker picked up yet and the
+// unfinished jobs of the workers that pinged within workerTimeout. The jobs of a crashed worker stop counting once
+// its pings are late, before the orphan sweep requeues them. A workerTimeout of 0 counts every worker.
+func (S *SQLRepository) countActiveEncodes(ctx context.Context, tx Transaction, workerTimeout time.Duration) (int, error) {
+	var lastSeenDate time.Time
+	if workerTimeout > 0 {
+		lastSeenDate = time.Now().Add(-workerTimeout)
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT count(*) FROM job_status s LEFT JOIN workers w ON w.name=s.worker_name "+
+		"WHERE NOT (s.notification_type='Job' AND s.status IN ($1,$2,$3,$4,$5,$6)) "+
+		"AND ((s.notification_type='Job' AND s.status=$7) OR w.last_seen >= $8::timestamptz)",
+		model.QueuedNotificationStatus, model.ReQueuedNotificationStatus, model.CompletedNotificationStatus, model.FailedNotificationStatus, model.CanceledNotificationStatus, model.SkippedNotificationStatus,
+		model.DispatchedNotificationStatus, lastSeenDate)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	active := 0
+	if rows.Next() {
+		rows.Scan(&active)
+	}
+	return active, nil
+}
+
+// getOrphanJobs returns the latest Job event of the jobs progressing on workers whose last ping is older than workerTimeout.
+func (S *SQLRepository) getOrphanJobs(ctx context.Context, tx Transaction, workerTimeout time.Duration) ([]*model.TaskEvent, error) {
+	lastSeenDate := time.Now().Add(-workerTimeout)
+
+	rows, err := tx.QueryContext(ctx, "SELECT v.job_id, v.job_event_id, v.worker_name, v.event_time, v.event_type, v.notification_type, v.status, v.message FROM job_events v inner join "+
+		"(SELECT job_id,max(job_event_id) as job_event_id  FROM job_events WHERE notification_type='Job'  group by job_id) as m "+
+		"on m.job_id=v.job_id and m.job_event_id=v.job_event_id inner join workers w on w.name=v.worker_name "+
+		"WHERE v.status=$1 and w.last_seen < $2::timestamptz", model.ProgressingNotificationStatus, lastSeenDate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 	var taskEvents []*model.TaskEvent
 	for rows.Next() {
 		event := model.TaskEvent{}
@@ -468,3 +942,35 @@ func (S *SQLRepository) WithTransaction(ctx context.Context, transactionFunc fun
 	}
 	return nil
 }
+
+func (S *SQLRepository) GetSpaceSavings(ctx context.Context) (*model.SpaceSavings, error) {
+	conn, err := S.getConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return S.getSpaceSavings(ctx, conn)
+}
+
+// getSpaceSavings aggregates the reports of completed jobs, grouped by source codec.
+func (S *SQLRepository) getSpaceSavings(ctx context.Context, tx Transaction) (*model.SpaceSavings, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT coalesce(r.source_codec,''), count(*), sum(r.source_size), sum(r.encoded_size) FROM job_reports r "+
+		"INNER JOIN job_status vs ON r.job_id = vs.job_id WHERE NOT r.estimated AND vs.notification_type='Job' AND vs.status=$1 "+
+		"GROUP BY coalesce(r.source_codec,'') ORDER BY 1", model.CompletedNotificationStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	savings := &model.SpaceSavings{PerCodec: []*model.CodecSavings{}}
+	for rows.Next() {
+		codecSavings := model.CodecSavings{}
+		rows.Scan(&codecSavings.Codec, &codecSavings.Jobs, &codecSavings.SourceSize, &codecSavings.EncodedSize)
+		codecSavings.SavedSize = codecSavings.SourceSize - codecSavings.EncodedSize
+		savings.Jobs += codecSavings.Jobs
+		savings.SourceSize += codecSavings.SourceSize
+		savings.EncodedSize += codecSavings.EncodedSize
+		savings.PerCodec = append(savings.PerCodec, &codecSavings)
+	}
+	savings.SavedSize = savings.SourceSize - savings.EncodedSize
+	return savings, nil
+}
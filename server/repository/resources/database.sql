@@ -129,3 +129,53 @@ CREATE TRIGGER event_insert_job_status_update
 AFTER
 INSERT
     ON job_events FOR EACH ROW EXECUTE PROCEDURE fn_trigger_job_status_update();
+
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS stream_selection text;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS quality_profile text;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS encode_overrides text;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS source_checksum varchar(64);
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS work_dir_root text;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS notification text;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS metadata text;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS index_only boolean NOT NULL DEFAULT false;
+
+-- Define batches table
+CREATE TABLE IF NOT EXISTS batches (
+    id varchar(255) PRIMARY KEY,
+    created_at timestamp NOT NULL
+);
+
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS batch_id varchar(255) REFERENCES batches(id) ON DELETE SET NULL;
+
+-- Define job_reports table
+CREATE TABLE IF NOT EXISTS job_reports (
+    job_id varchar(255) PRIMARY KEY,
+    source_size bigint NOT NULL,
+    encoded_size bigint NOT NULL,
+    source_codec varchar(50),
+    encoded_codec varchar(50),
+    estimated boolean NOT NULL DEFAULT false,
+    FOREIGN KEY (job_id) REFERENCES jobs(id) ON DELETE CASCADE
+);
+
+ALTER TABLE job_reports ADD COLUMN IF NOT EXISTS vmaf_score double precision;
+ALTER TABLE job_reports ADD COLUMN IF NOT EXISTS source_video_bitrate bigint;
+ALTER TABLE job_reports ADD COLUMN IF NOT EXISTS crf integer;
+ALTER TABLE job_reports ADD COLUMN IF NOT EXISTS encode_seconds double precision;
+ALTER TABLE job_reports ADD COLUMN IF NOT EXISTS average_speed double precision;
+ALTER TABLE job_reports ADD COLUMN IF NOT EXISTS peak_speed double precision;
+ALTER TABLE job_reports ADD COLUMN IF NOT EXISTS average_fps double precision;
+
+-- Define job_manifests table, the sources recorded by the index only jobs
+CREATE TABLE IF NOT EXISTS job_manifests (
+    job_id varchar(255) PRIMARY KEY,
+    checksum varchar(64) NOT NULL,
+    manifest text NOT NULL,
+    FOREIGN KEY (job_id) REFERENCES jobs(id) ON DELETE CASCADE
+);
+
+ALTER TABLE workers ADD COLUMN IF NOT EXISTS status varchar(20);
+ALTER TABLE workers ADD COLUMN IF NOT EXISTS started_at timestamp;
+ALTER TABLE workers ADD COLUMN IF NOT EXISTS stopped_at timestamp;
+ALTER TABLE workers ADD COLUMN IF NOT EXISTS info text;
+ALTER TABLE workers ADD COLUMN IF NOT EXISTS throughput text;
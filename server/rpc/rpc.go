@@ -0,0 +1,345 @@
+package rpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"gearr/api"
+	"gearr/helper"
+	"gearr/model"
+	"gearr/server/repository"
+	"gearr/server/scheduler"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type GRPCServerConfig struct {
+	// Port of the gRPC server, 0 disables it
+	Port int `mapstructure:"port"`
+	// CertFile and KeyFile serve the gRPC server over TLS, empty serves it in plain text
+	CertFile string `mapstructure:"certFile"`
+	KeyFile  string `mapstructure:"keyFile"`
+}
+
+// GRPCServer serves the Gearr gRPC service next to the web server, authenticated with the same token and reachable
+// from the same allowed networks.
+type GRPCServer struct {
+	api.UnimplementedGearrServer
+	GRPCServerConfig
+	scheduler       scheduler.Scheduler
+	token           string
+	allowedNetworks []*net.IPNet
+	server          *grpc.Server
+	ctx             context.Context
+}
+
+func NewGRPCServer(config GRPCServerConfig, token string, allowedNetworks []string, scheduler scheduler.Scheduler) *GRPCServer {
+	networks, err := helper.ParseNetworks(allowedNetworks)
+	if err != nil {
+		log.Panic(err)
+	}
+	grpcServer := &GRPCServer{
+		GRPCServerConfig: config,
+		scheduler:        scheduler,
+		token:            token,
+		allowedNetworks:  networks,
+	}
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(grpcServer.authUnaryInterceptor),
+		grpc.StreamInterceptor(grpcServer.authStreamInterceptor),
+	}
+	if config.CertFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(config.CertFile, config.KeyFile)
+		if err != nil {
+			log.Panicf("error loading the grpc TLS certificate: %v", err)
+		}
+		options = append(options, grpc.Creds(creds))
+	}
+	grpcServer.server = grpc.NewServer(options...)
+	api.RegisterGearrServer(grpcServer.server, grpcServer)
+	return grpcServer
+}
+
+func (G *GRPCServer) Run(wg *sync.WaitGroup, ctx context.Context) {
+	G.ctx = ctx
+	log.Infof("starting grpc server, tls %t", G.CertFile != "")
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(G.Port))
+	if err != nil {
+		log.Panic(err)
+	}
+	go func() {
+		if err := G.server.Serve(listener); err != nil {
+			log.Panic(err)
+		}
+	}()
+	log.Info("started grpc server")
+	wg.Add(1)
+	go func() {
+		<-ctx.Done()
+		log.Info("stopping grpc server")
+		G.server.GracefulStop()
+		wg.Done()
+	}()
+}
+
+// authorize checks the connection comes from web.allowedNetworks and carries the web token. The address is the one
+// of the connection, web.trustedProxies don't apply as there are no forwarded headers.
+func (G *GRPCServer) authorize(ctx context.Context) error {
+	if len(G.allowedNetworks) > 0 {
+		var clientIP net.IP
+		if p, ok := peer.FromContext(ctx); ok {
+			if tcpAddr, ok := p.Addr.(*net.TCPAddr); ok {
+				clientIP = tcpAddr.IP
+			}
+		}
+		if !helper.NetworksContain(G.allowedNetworks, clientIP) {
+			return status.Error(codes.PermissionDenied, "client address not allowed")
+		}
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get("authorization")) == 0 {
+		return status.Error(codes.Unauthenticated, "missing authorization metadata")
+	}
+	const bearerPrefix = "Bearer "
+	authorization := md.Get("authorization")[0]
+	if !strings.HasPrefix(authorization, bearerPrefix) {
+		return status.Error(codes.Unauthenticated, "invalid authorization metadata format")
+	}
+	token := strings.TrimPrefix(authorization, bearerPrefix)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(G.token)) != 1 {
+		return status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return nil
+}
+
+func (G *GRPCServer) authUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := G.authorize(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (G *GRPCServer) authStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := G.authorize(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+func (G *GRPCServer) SubmitJob(ctx context.Context, request *api.SubmitJobRequest) (*api.Job, error) {
+	jobRequest := &model.JobRequest{
+		SourcePath:      request.SourcePath,
+		DestinationPath: request.DestinationPath,
+		StreamSelection: fromStreamSelection(request.StreamSelection),
+		QualityProfile:  request.QualityProfile,
+		EncodeOverrides: fromEncodeOverrides(request.EncodeOverrides),
+		SourceChecksum:  request.SourceChecksum,
+		WorkDirRoot:     request.WorkDirRoot,
+		IndexOnly:       request.IndexOnly,
+		Metadata:        request.Metadata,
+	}
+	if request.NotificationUrl != "" {
+		jobRequest.Notification = &model.NotificationTarget{URL: request.NotificationUrl}
+		for _, status := range request.NotificationStatuses {
+			jobRequest.Notification.Statuses = append(jobRequest.Notification.Statuses, model.NotificationStatus(status))
+		}
+	}
+	job, err := G.scheduler.ScheduleJobRequest(ctx, jobRequest)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toJob(job), nil
+}
+
+func (G *GRPCServer) GetJob(ctx context.Context, request *api.GetJobRequest) (*api.Job, error) {
+	job, err := G.scheduler.GetJob(ctx, request.Id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toJob(job), nil
+}
+
+func (G *GRPCServer) ListJobs(ctx context.Context, request *api.ListJobsRequest) (*api.ListJobsResponse, error) {
+	jobs, err := G.scheduler.GetJobs(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	response := &api.ListJobsResponse{}
+	for index := range *jobs {
+		response.Jobs = append(response.Jobs, toJob(&(*jobs)[index]))
+	}
+	return response, nil
+}
+
+func (G *GRPCServer) CancelJob(ctx context.Context, request *api.CancelJobRequest) (*api.CancelJobResponse, error) {
+	if err := G.scheduler.DeleteJob(ctx, request.Id); err != nil {
+		return nil, grpcError(err)
+	}
+	return &api.CancelJobResponse{}, nil
+}
+
+// WatchJob subscribes to the job events before reading the stored ones, so no event is lost in between, and skips
+// the live events already sent from the stored ones.
+func (G *GRPCServer) WatchJob(request *api.WatchJobRequest, stream api.Gearr_WatchJobServer) error {
+	id, ch := G.scheduler.SubscribeJobEvents()
+	defer G.scheduler.UnsubscribeJobEvents(id)
+
+	job, err := G.scheduler.GetJob(stream.Context(), request.Id)
+	if err != nil {
+		return grpcError(err)
+	}
+	lastEventID := -1
+	for _, event := range job.Events {
+		if err := stream.Send(toTaskEvent(event)); err != nil {
+			return err
+		}
+		lastEventID = event.EventID
+		if event.IsFinished() {
+			return nil
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-G.ctx.Done():
+			return status.Error(codes.Unavailable, "server is stopping")
+		case event, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if event.Id.String() != job.Id.String() || event.EventID <= lastEventID {
+				continue
+			}
+			if err := stream.Send(toTaskEvent(event)); err != nil {
+				return err
+			}
+			lastEventID = event.EventID
+			if event.IsFinished() {
+				return nil
+			}
+		}
+	}
+}
+
+func grpcError(err error) error {
+	var customError *model.CustomError
+	switch {
+	case errors.As(err, &customError):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, repository.ErrElementNotFound), errors.Is(err, scheduler.ErrorJobNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case err.Error() == "job already exists":
+		return status.Error(codes.AlreadyExists, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func fromStreamSelection(selection *api.StreamSelection) *model.StreamSelection {
+	if selection == nil {
+		return nil
+	}
+	return &model.StreamSelection{
+		Audio:    fromStreamFilter(selection.Audio),
+		Subtitle: fromStreamFilter(selection.Subtitle),
+	}
+}
+
+func fromStreamFilter(filter *api.StreamFilter) *model.StreamFilter {
+	if filter == nil {
+		return nil
+	}
+	streamFilter := &model.StreamFilter{Languages: filter.Languages}
+	for _, index := range filter.Indexes {
+		streamFilter.Indexes = append(streamFilter.Indexes, int(index))
+	}
+	return streamFilter
+}
+
+func fromEncodeOverrides(overrides *api.EncodeOverrides) *model.EncodeOverrides {
+	if overrides == nil {
+		return nil
+	}
+	return &model.EncodeOverrides{
+		VideoCodec:   overrides.VideoCodec,
+		CRF:          int(overrides.Crf),
+		Preset:       overrides.Preset,
+		PixFmt:       overrides.PixFmt,
+		MaxWidth:     int(overrides.MaxWidth),
+		AudioCodec:   overrides.AudioCodec,
+		AudioBitrate: overrides.AudioBitrate,
+	}
+}
+
+func toEncodeOverrides(overrides *model.EncodeOverrides) *api.EncodeOverrides {
+	if overrides == nil {
+		return nil
+	}
+	return &api.EncodeOverrides{
+		VideoCodec:   overrides.VideoCodec,
+		Crf:          int32(overrides.CRF),
+		Preset:       overrides.Preset,
+		PixFmt:       overrides.PixFmt,
+		MaxWidth:     int32(overrides.MaxWidth),
+		AudioCodec:   overrides.AudioCodec,
+		AudioBitrate: overrides.AudioBitrate,
+	}
+}
+
+func toJob(job *model.Job) *api.Job {
+	apiJob := &api.Job{
+		Id:              job.Id.String(),
+		SourcePath:      job.SourcePath,
+		DestinationPath: job.DestinationPath,
+		Status:          job.Status,
+		StatusMessage:   job.StatusMessage,
+		QualityProfile:  job.QualityProfile,
+		EncodeOverrides: toEncodeOverrides(job.EncodeOverrides),
+		SourceChecksum:  job.SourceChecksum,
+		WorkDirRoot:     job.WorkDirRoot,
+		IndexOnly:       job.IndexOnly,
+		Metadata:        job.Metadata,
+	}
+	if job.LastUpdate != nil {
+		apiJob.LastUpdate = timestamppb.New(*job.LastUpdate)
+	}
+	if job.Notification != nil {
+		apiJob.NotificationUrl = job.Notification.URL
+		for _, status := range job.Notification.Statuses {
+			apiJob.NotificationStatuses = append(apiJob.NotificationStatuses, string(status))
+		}
+	}
+	if job.BatchId != nil && *job.BatchId != uuid.Nil {
+		apiJob.BatchId = job.BatchId.String()
+	}
+	for _, event := range job.Events {
+		apiJob.Events = append(apiJob.Events, toTaskEvent(event))
+	}
+	return apiJob
+}
+
+func toTaskEvent(event *model.TaskEvent) *api.TaskEvent {
+	return &api.TaskEvent{
+		JobId:            event.Id.String(),
+		EventId:          int32(event.EventID),
+		EventType:        string(event.EventType),
+		WorkerName:       event.WorkerName,
+		EventTime:        timestamppb.New(event.EventTime),
+		NotificationType: string(event.NotificationType),
+		Status:           string(event.Status),
+		Message:          event.Message,
+	}
+}
@@ -0,0 +1,192 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"gearr/helper"
+	"gearr/model"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// ScheduleBatchJobRequest schedules a job for every source path of the batch, a failure on one of them is
+// reported in its BatchJob and does not stop the rest.
+func (R *RuntimeScheduler) ScheduleBatchJobRequest(ctx context.Context, batchRequest *model.BatchJobRequest) (*model.Batch, error) {
+	sourcePaths := batchRequest.SourcePaths
+	if batchRequest.Directory != "" {
+		directoryPaths, err := R.scanBatchDirectory(batchRequest)
+		if err != nil {
+			return nil, err
+		}
+		sourcePaths = append(sourcePaths, directoryPaths...)
+	}
+	if len(sourcePaths) == 0 {
+		return nil, &model.CustomError{Message: "batch has no source paths"}
+	}
+	if err := batchRequest.EncodeOverrides.Validate(); err != nil {
+		return nil, &model.CustomError{Message: err.Error()}
+	}
+	if err := batchRequest.Notification.Validate(); err != nil {
+		return nil, &model.CustomError{Message: err.Error()}
+	}
+
+	newUUID, _ := uuid.NewUUID()
+	batch := &model.Batch{
+		Id:        newUUID,
+		CreatedAt: time.Now(),
+	}
+	if err := R.repo.AddBatch(ctx, batch); err != nil {
+		return nil, err
+	}
+
+	probes := R.probeBatchSources(ctx, sourcePaths, func(sourcePath string) *model.JobRequest {
+		return &model.JobRequest{
+			SourcePath:      sourcePath,
+			StreamSelection: batchRequest.StreamSelection,
+			QualityProfile:  batchRequest.QualityProfile,
+			EncodeOverrides: batchRequest.EncodeOverrides,
+			Notification:    batchRequest.Notification,
+			IndexOnly:       batchRequest.IndexOnly,
+			BatchId:         &batch.Id,
+		}
+	})
+	// the jobs are added in the order of the batch, so a source listed twice fails as an existing job
+	for i, sourcePath := range sourcePaths {
+		batchJob := &model.BatchJob{SourcePath: sourcePath}
+		err := probes[i].err
+		var job *model.Job
+		if err == nil {
+			job, err = R.submitJobRequest(ctx, probes[i].jobRequest)
+		}
+		if err != nil {
+			batchJob.Error = err.Error()
+		} else {
+			batchJob.JobId = &job.Id
+		}
+		batch.Jobs = append(batch.Jobs, batchJob)
+	}
+	log.Infof("batch %s scheduled with %d source paths", batch.Id.String(), len(sourcePaths))
+	return batch, nil
+}
+
+type batchProbe struct {
+	jobRequest *model.JobRequest
+	err        error
+}
+
+// probeBatchSources probes the sources of a batch with scheduler.batchProbeWorkers workers, a source on a slow or
+// unreachable share only fails itself after scheduler.batchProbeTimeout. The probes are returned in the order of the
+// source paths.
+func (R *RuntimeScheduler) probeBatchSources(ctx context.Context, sourcePaths []string, jobRequest func(sourcePath string) *model.JobRequest) []batchProbe {
+	probes := make([]batchProbe, len(sourcePaths))
+	workers := R.config.BatchProbeWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	indexes := make(chan int)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				filteredJobRequest, err := R.probeSourceWithTimeout(ctx, jobRequest(sourcePaths[i]))
+				probes[i] = batchProbe{jobRequest: filteredJobRequest, err: err}
+			}
+		}()
+	}
+	for i := range sourcePaths {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return probes
+}
+
+// probeSourceWithTimeout gives up on a probe after scheduler.batchProbeTimeout. A stat blocked on a dead share can't
+// be interrupted, it is left behind and its result discarded.
+func (R *RuntimeScheduler) probeSourceWithTimeout(ctx context.Context, jobRequest *model.JobRequest) (*model.JobRequest, error) {
+	if R.config.BatchProbeTimeout <= 0 {
+		return R.probeSource(jobRequest)
+	}
+	result := make(chan batchProbe, 1)
+	go func() {
+		filteredJobRequest, err := R.probeSource(jobRequest)
+		result <- batchProbe{jobRequest: filteredJobRequest, err: err}
+	}()
+	select {
+	case probe := <-result:
+		return probe.jobRequest, probe.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(R.config.BatchProbeTimeout):
+		return nil, &model.CustomError{Message: fmt.Sprintf("%s not probed in %s", jobRequest.SourcePath, R.config.BatchProbeTimeout)}
+	}
+}
+
+// scanBatchDirectory returns the videos inside the batch directory relative to the download path.
+func (R *RuntimeScheduler) scanBatchDirectory(batchRequest *model.BatchJobRequest) ([]string, error) {
+	directory := filepath.Join(R.config.DownloadPath, batchRequest.Directory)
+	relativeDirectory, err := filepath.Rel(R.config.DownloadPath, directory)
+	if err != nil || strings.HasPrefix(relativeDirectory, "..") {
+		return nil, &model.CustomError{Message: fmt.Sprintf("%s is not inside the download path", batchRequest.Directory)}
+	}
+
+	if fileInfo, err := os.Stat(directory); err != nil || !fileInfo.IsDir() {
+		return nil, &model.CustomError{Message: fmt.Sprintf("%s is not a directory", batchRequest.Directory)}
+	}
+
+	var sourcePaths []string
+	err = filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path != directory && !batchRequest.Recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		extension := strings.TrimPrefix(filepath.Ext(entry.Name()), ".")
+		if !helper.ValidExtension(extension) {
+			return nil
+		}
+		pathInDirectory, _ := filepath.Rel(directory, path)
+		if len(batchRequest.Include) > 0 && !matchesAnyPattern(batchRequest.Include, pathInDirectory) {
+			return nil
+		}
+		if matchesAnyPattern(batchRequest.Exclude, pathInDirectory) {
+			return nil
+		}
+		sourcePath, _ := filepath.Rel(R.config.DownloadPath, path)
+		sourcePaths = append(sourcePaths, sourcePath)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sourcePaths, nil
+}
+
+func matchesAnyPattern(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, filepath.Base(path)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (R *RuntimeScheduler) GetBatch(ctx context.Context, uuid string) (*model.Batch, error) {
+	return R.repo.GetBatch(ctx, uuid)
+}
@@ -0,0 +1,72 @@
+package scheduler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// sourceChecksum is the checksum of a source as it was when hashed, a source replaced in place is hashed again.
+type sourceChecksum struct {
+	once     sync.Once
+	size     int64
+	modTime  time.Time
+	checksum string
+	err      error
+}
+
+// sourceChecksums hashes the sources workers read from scheduler.sourceURL. Those downloads never go through the
+// server, so the checksum of the download stream is never published, the source is hashed on the first checksum
+// request instead and kept for the next ones. Requests for the same source wait on a single hash.
+type sourceChecksums struct {
+	mu        sync.Mutex
+	checksums map[string]*sourceChecksum
+}
+
+func (s *sourceChecksums) get(filePath string) (string, error) {
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	if s.checksums == nil {
+		s.checksums = make(map[string]*sourceChecksum)
+	}
+	entry, found := s.checksums[filePath]
+	if !found || entry.size != stat.Size() || !entry.modTime.Equal(stat.ModTime()) {
+		entry = &sourceChecksum{size: stat.Size(), modTime: stat.ModTime()}
+		s.checksums[filePath] = entry
+	}
+	s.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.checksum, entry.err = fileSHA256(filePath)
+	})
+	if entry.err != nil {
+		// a failed hash is not kept, the next request tries again
+		s.mu.Lock()
+		if s.checksums[filePath] == entry {
+			delete(s.checksums, filePath)
+		}
+		s.mu.Unlock()
+		return "", fmt.Errorf("error hashing %s: %w", filePath, entry.err)
+	}
+	return entry.checksum, nil
+}
+
+func fileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	sha := sha256.New()
+	if _, err := io.Copy(sha, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sha.Sum(nil)), nil
+}
@@ -0,0 +1,92 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"gearr/model"
+	"gearr/server/repository"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// jobRepository serves a single job, the rest of the repository is not used by the tests.
+type jobRepository struct {
+	repository.Repository
+	job *model.Job
+}
+
+func (r *jobRepository) GetJob(ctx context.Context, id string) (*model.Job, error) {
+	if r.job == nil || r.job.Id.String() != id {
+		return nil, repository.ErrElementNotFound
+	}
+	return r.job, nil
+}
+
+func TestGetChecksumHashesSourceURLJobs(t *testing.T) {
+	downloadPath := t.TempDir()
+	content := []byte("source read by the workers from the share")
+	if err := os.MkdirAll(filepath.Join(downloadPath, "movies"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	sourcePath := filepath.Join(downloadPath, "movies", "movie.mkv")
+	if err := os.WriteFile(sourcePath, content, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	job := &model.Job{Id: uuid.New(), SourcePath: filepath.Join("movies", "movie.mkv")}
+	scheduler, err := NewScheduler(SchedulerConfig{DownloadPath: downloadPath, SourceURL: "sftp://nas/media"}, &jobRepository{job: job}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(content)
+	checksum, err := scheduler.GetChecksum(context.Background(), job.Id.String())
+	if err != nil {
+		t.Fatalf("the checksum of a source read from the share must be computed by the server: %v", err)
+	}
+	if checksum != hex.EncodeToString(sum[:]) {
+		t.Fatalf("checksum %s, expected %s", checksum, hex.EncodeToString(sum[:]))
+	}
+
+	// a source replaced in place is hashed again
+	content = []byte("another source at the same path")
+	if err = os.WriteFile(sourcePath, content, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Hour)
+	if err = os.Chtimes(sourcePath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	sum = sha256.Sum256(content)
+	if checksum, err = scheduler.GetChecksum(context.Background(), job.Id.String()); err != nil || checksum != hex.EncodeToString(sum[:]) {
+		t.Fatalf("checksum %s, error %v, expected %s", checksum, err, hex.EncodeToString(sum[:]))
+	}
+
+	if err = os.Remove(sourcePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = scheduler.GetChecksum(context.Background(), job.Id.String()); !errors.Is(err, ErrorJobNotFound) {
+		t.Fatalf("a missing source must be not found, got %v", err)
+	}
+}
+
+func TestGetChecksumWithoutSourceURLNeedsTheServedDownload(t *testing.T) {
+	job := &model.Job{Id: uuid.New(), SourcePath: "movie.mkv"}
+	scheduler, err := NewScheduler(SchedulerConfig{DownloadPath: t.TempDir()}, &jobRepository{job: job}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = scheduler.GetChecksum(context.Background(), job.Id.String()); !errors.Is(err, ErrorJobNotFound) {
+		t.Fatalf("a source never downloaded has no checksum yet, got %v", err)
+	}
+	filePath := filepath.Join(scheduler.config.DownloadPath, job.SourcePath)
+	scheduler.pathChecksumMap[filePath] = "abc"
+	if checksum, err := scheduler.GetChecksum(context.Background(), job.Id.String()); err != nil || checksum != "abc" {
+		t.Fatalf("checksum %s, error %v, expected the one of the served download", checksum, err)
+	}
+}
@@ -9,4 +9,6 @@ var (
 	ErrorStreamNotAllowed = errors.New("upload not allowed")
 	ErrorInvalidStatus    = errors.New("job invalid status")
 	ErrorFileSkipped      = errors.New("path skipped")
+	// ErrorDownloadsBusy refuses a download while scheduler.maxDownloads are already served
+	ErrorDownloadsBusy = errors.New("too many downloads in progress")
 )
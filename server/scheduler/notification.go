@@ -0,0 +1,124 @@
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gearr/model"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/avast/retry-go"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// notificationClient posts the job notifications, an endpoint not answering in time counts as a failed attempt.
+// Redirects are not followed, the targets come from job requests and a redirect could lead the server to an internal
+// service, the 3xx answer fails the post instead.
+var notificationClient = &http.Client{
+	Timeout: time.Second * 10,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// jobNotifier runs the notification posts of each job one after the other, in the order of its events, so a target
+// never hears of a job completed before it hears it was dispatched. The posts of different jobs run concurrently.
+type jobNotifier struct {
+	mu     sync.Mutex
+	queues map[uuid.UUID][]func()
+}
+
+func (n *jobNotifier) enqueue(jobId uuid.UUID, post func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.queues == nil {
+		n.queues = make(map[uuid.UUID][]func())
+	}
+	queue, running := n.queues[jobId]
+	n.queues[jobId] = append(queue, post)
+	if !running {
+		go n.run(jobId)
+	}
+}
+
+func (n *jobNotifier) run(jobId uuid.UUID) {
+	for {
+		n.mu.Lock()
+		queue := n.queues[jobId]
+		if len(queue) == 0 {
+			delete(n.queues, jobId)
+			n.mu.Unlock()
+			return
+		}
+		post := queue[0]
+		n.queues[jobId] = queue[1:]
+		n.mu.Unlock()
+		post()
+	}
+}
+
+// notifyTargets posts the job status changes to scheduler.notificationURL and to the notification target of the
+// job, both are notified independently, each of the statuses it asked for. The posts run in the background so a slow
+// endpoint never holds the scheduler, but those of a job are sent in order.
+func (R *RuntimeScheduler) notifyTargets(event *model.TaskEvent) {
+	if event == nil || event.EventType != model.NotificationEvent || event.NotificationType != model.JobNotification {
+		return
+	}
+	globalTarget := &model.NotificationTarget{URL: R.config.NotificationURL, Statuses: R.config.NotificationStatuses}
+	R.notifier.enqueue(event.Id, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		notification := &model.JobUpdateNotification{
+			Id:        event.Id,
+			Status:    event.Status,
+			Message:   event.Message,
+			EventTime: event.EventTime,
+		}
+		var jobTarget *model.NotificationTarget
+		// canceled jobs are already deleted, only the global target hears of them
+		if job, err := R.repo.GetJob(ctx, event.Id.String()); err == nil {
+			notification.SourcePath = job.SourcePath
+			notification.DestinationPath = job.DestinationPath
+			jobTarget = job.Notification
+		}
+		for _, target := range []*model.NotificationTarget{globalTarget, jobTarget} {
+			if !target.Notifies(event.Status) {
+				continue
+			}
+			if err := postNotification(ctx, target.URL, notification); err != nil {
+				log.Warnf("error notifying %s of job %s %s: %v", target.URL, event.Id.String(), event.Status, err)
+			}
+		}
+	})
+}
+
+// postNotification sends the notification, retrying the network errors and the 5xx answers.
+func postNotification(ctx context.Context, targetURL string, notification *model.JobUpdateNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	return retry.Do(func() error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, targetURL, bytes.NewReader(body))
+		if err != nil {
+			return retry.Unrecoverable(err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+		response, err := notificationClient.Do(request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode >= 500 {
+			return fmt.Errorf("status code %d", response.StatusCode)
+		}
+		if response.StatusCode >= 300 {
+			return retry.Unrecoverable(fmt.Errorf("status code %d", response.StatusCode))
+		}
+		return nil
+	}, retry.Context(ctx), retry.Delay(time.Second*5), retry.Attempts(3), retry.LastErrorOnly(true))
+}
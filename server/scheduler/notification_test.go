@@ -0,0 +1,153 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"gearr/model"
+	"gearr/server/repository"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// submitRepository stores the single job submitted, without a database.
+type submitRepository struct {
+	jobRepository
+}
+
+func (r *submitRepository) WithTransaction(ctx context.Context, transactionFunc func(ctx context.Context, tx repository.Repository) error) error {
+	return transactionFunc(ctx, r)
+}
+
+func (r *submitRepository) GetJobByPath(ctx context.Context, path string) (*model.Job, error) {
+	return nil, nil
+}
+
+func (r *submitRepository) AddJob(ctx context.Context, job *model.Job) error {
+	r.job = job
+	return nil
+}
+
+func (r *submitRepository) AddNewTaskEvent(ctx context.Context, event *model.TaskEvent) error {
+	return nil
+}
+
+// notificationRecorder is a notification target recording the statuses posted to it.
+type notificationRecorder struct {
+	mu       sync.Mutex
+	statuses []model.NotificationStatus
+	received chan struct{}
+	// delay holds the answer to the first post
+	delay time.Duration
+}
+
+func newNotificationRecorder(delay time.Duration) (*notificationRecorder, *httptest.Server) {
+	recorder := &notificationRecorder{received: make(chan struct{}, 16), delay: delay}
+	return recorder, httptest.NewServer(recorder)
+}
+
+func (n *notificationRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	notification := &model.JobUpdateNotification{}
+	if err := json.NewDecoder(r.Body).Decode(notification); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	n.mu.Lock()
+	first := len(n.statuses) == 0
+	n.mu.Unlock()
+	if first {
+		time.Sleep(n.delay)
+	}
+	n.mu.Lock()
+	n.statuses = append(n.statuses, notification.Status)
+	n.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+	n.received <- struct{}{}
+}
+
+// wait returns the statuses once count of them were posted.
+func (n *notificationRecorder) wait(t *testing.T, count int) []model.NotificationStatus {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		select {
+		case <-n.received:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d notifications received, expected %d", i, count)
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]model.NotificationStatus{}, n.statuses...)
+}
+
+func TestSubmitJobRequestNotifiesTheQueuedStatus(t *testing.T) {
+	recorder, server := newNotificationRecorder(0)
+	defer server.Close()
+	// a limited dispatch leaves the job queued without a broker
+	scheduler, err := NewScheduler(SchedulerConfig{MaxInFlightJobs: 1}, &submitRepository{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobRequest := &model.JobRequest{
+		SourcePath:   "movie.mkv",
+		Notification: &model.NotificationTarget{URL: server.URL, Statuses: []model.NotificationStatus{model.QueuedNotificationStatus}},
+	}
+	if err = jobRequest.Notification.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = scheduler.submitJobRequest(context.Background(), jobRequest); err != nil {
+		t.Fatal(err)
+	}
+	if statuses := recorder.wait(t, 1); statuses[0] != model.QueuedNotificationStatus {
+		t.Fatalf("statuses %v, expected queued", statuses)
+	}
+}
+
+func TestNotifyTargetsPostsTheEventsOfAJobInOrder(t *testing.T) {
+	recorder, server := newNotificationRecorder(200 * time.Millisecond)
+	defer server.Close()
+	job := &model.Job{Id: uuid.New(), SourcePath: "movie.mkv", Notification: &model.NotificationTarget{URL: server.URL, Statuses: []model.NotificationStatus{
+		model.DispatchedNotificationStatus, model.ProgressingNotificationStatus, model.CompletedNotificationStatus,
+	}}}
+	scheduler, err := NewScheduler(SchedulerConfig{}, &jobRepository{job: job}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the dispatched post is held by the target while the next events come in
+	expected := []model.NotificationStatus{model.DispatchedNotificationStatus, model.ProgressingNotificationStatus, model.CompletedNotificationStatus}
+	for _, status := range expected {
+		scheduler.notifyTargets(job.AddEvent(model.NotificationEvent, model.JobNotification, status))
+	}
+	statuses := recorder.wait(t, len(expected))
+	for i := range expected {
+		if statuses[i] != expected[i] {
+			t.Fatalf("statuses %v, expected %v", statuses, expected)
+		}
+	}
+}
+
+func TestPostNotificationDoesNotFollowRedirects(t *testing.T) {
+	internalRequests := make(chan struct{}, 1)
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internalRequests <- struct{}{}
+	}))
+	defer internal.Close()
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL, http.StatusTemporaryRedirect)
+	}))
+	defer redirect.Close()
+
+	err := postNotification(context.Background(), redirect.URL, &model.JobUpdateNotification{Id: uuid.New(), Status: model.CompletedNotificationStatus})
+	if err == nil {
+		t.Fatal("a redirect answer must fail the post")
+	}
+	select {
+	case <-internalRequests:
+		t.Fatal("the redirect must not be followed")
+	default:
+	}
+}
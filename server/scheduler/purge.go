@@ -0,0 +1,95 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"gearr/model"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// purgeableStatuses are the final job statuses, jobs in any other status are still queued or in progress.
+var purgeableStatuses = []model.NotificationStatus{model.CompletedNotificationStatus, model.FailedNotificationStatus, model.CanceledNotificationStatus, model.SkippedNotificationStatus}
+
+// ValidatePurgeStatuses checks that only finished jobs can be purged.
+func ValidatePurgeStatuses(statuses []model.NotificationStatus) error {
+	for _, status := range statuses {
+		found := false
+		for _, purgeableStatus := range purgeableStatuses {
+			found = found || status == purgeableStatus
+		}
+		if !found {
+			return &model.CustomError{Message: fmt.Sprintf("invalid status %s, only %v jobs can be purged", status, purgeableStatuses)}
+		}
+	}
+	return nil
+}
+
+// PurgeJobs deletes the finished jobs selected by the request from the repository, with the temporary files left
+// behind by their interrupted uploads.
+func (R *RuntimeScheduler) PurgeJobs(ctx context.Context, purgeRequest *model.PurgeRequest) (*model.PurgeResult, error) {
+	statuses := purgeRequest.Statuses
+	if len(statuses) == 0 {
+		statuses = []model.NotificationStatus{model.CompletedNotificationStatus}
+	}
+	if err := ValidatePurgeStatuses(statuses); err != nil {
+		return nil, err
+	}
+	if purgeRequest.OlderThanDays < 0 {
+		return nil, &model.CustomError{Message: fmt.Sprintf("invalid older_than_days %d", purgeRequest.OlderThanDays)}
+	}
+	jobs, err := R.repo.GetFinishedJobs(ctx, statuses, time.Now().AddDate(0, 0, -purgeRequest.OlderThanDays))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &model.PurgeResult{DryRun: purgeRequest.DryRun, Artifacts: []string{}}
+	var uuids []string
+	for _, job := range jobs {
+		result.JobIds = append(result.JobIds, job.Id)
+		uuids = append(uuids, job.Id.String())
+		uploadPath := filepath.Join(R.config.UploadPath, job.DestinationPath)
+		temporalPath := filepath.Join(filepath.Dir(uploadPath), fmt.Sprintf(".%s.upload", filepath.Base(uploadPath)))
+		if _, err := os.Stat(temporalPath); err == nil {
+			result.Artifacts = append(result.Artifacts, temporalPath)
+		}
+	}
+	if purgeRequest.DryRun || len(uuids) == 0 {
+		return result, nil
+	}
+
+	if err = R.repo.PurgeJobs(ctx, uuids); err != nil {
+		return nil, err
+	}
+	for _, artifact := range result.Artifacts {
+		if err = os.Remove(artifact); err != nil {
+			log.Warnf("error removing %s: %v", artifact, err)
+		}
+	}
+	log.Infof("purged %d jobs in status %v and %d upload leftovers", len(uuids), statuses, len(result.Artifacts))
+	return result, nil
+}
+
+// purgeExpiredJobs applies the retention policy, deleting the jobs finished more than RetentionPeriod ago.
+func (R *RuntimeScheduler) purgeExpiredJobs(ctx context.Context) {
+	jobs, err := R.repo.GetFinishedJobs(ctx, R.config.RetentionStatuses, time.Now().Add(-R.config.RetentionPeriod))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if len(jobs) == 0 {
+		return
+	}
+	var uuids []string
+	for _, job := range jobs {
+		uuids = append(uuids, job.Id.String())
+	}
+	if err = R.repo.PurgeJobs(ctx, uuids); err != nil {
+		log.Error(err)
+		return
+	}
+	log.Infof("retention policy purged %d jobs finished more than %s ago", len(uuids), R.config.RetentionPeriod)
+}
@@ -2,11 +2,13 @@ package scheduler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"gearr/helper"
 	"gearr/model"
 	"gearr/server/queue"
 	"gearr/server/repository"
+	"math"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -22,29 +24,68 @@ import (
 var (
 	x264ex = regexp.MustCompile(`(?i)(((x|h)264)|mpeg-4|mpeg-1|mpeg-2|mpeg|xvid|divx|vc-1|av1|vp8|vp9|wmv3|mp43)`)
 	ac3ex  = regexp.MustCompile(`(?i)(ac3|eac3|pcm|flac|mp2|dts|mp2|mp3|truehd|wma|vorbis|opus|mpeg audio)`)
+	// sha256Regexp matches a lower case hex encoded sha256, like the checksum endpoint returns
+	sha256Regexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
 )
 
 type Scheduler interface {
 	Run(wg *sync.WaitGroup, ctx context.Context)
 	ScheduleJobRequest(ctx context.Context, jobRequest *model.JobRequest) (*model.Job, error)
+	ScheduleBatchJobRequest(ctx context.Context, batchRequest *model.BatchJobRequest) (*model.Batch, error)
+	GetBatch(ctx context.Context, uuid string) (*model.Batch, error)
+	PurgeJobs(ctx context.Context, purgeRequest *model.PurgeRequest) (*model.PurgeResult, error)
 	GetJob(ctx context.Context, uuid string) (*model.Job, error)
 	DeleteJob(ctx context.Context, uuid string) error
 	GetJobs(ctx context.Context) (*[]model.Job, error)
-	GetUploadJobWriter(ctx context.Context, uuid string) (*UploadJobStream, error)
+	GetUploadJobWriter(ctx context.Context, uuid string, fileName string) (*UploadJobStream, error)
 	GetDownloadJobWriter(ctx context.Context, uuid string) (*DownloadJobStream, error)
 	GetChecksum(ctx context.Context, uuid string) (string, error)
 	GetWorkers(ctx context.Context) (*[]model.Worker, error)
+	GetSpaceSavings(ctx context.Context) (*model.SpaceSavings, error)
 	GetUpdateJobsChan(ctx context.Context) (uuid.UUID, chan *model.JobUpdateNotification)
 	CloseUpdateJobsChan(id uuid.UUID)
+	SubscribeJobEvents() (uuid.UUID, <-chan *model.TaskEvent)
+	UnsubscribeJobEvents(id uuid.UUID)
 }
 
 type SchedulerConfig struct {
-	ScheduleTime time.Duration `mapstructure:"scheduleTime"`
-	JobTimeout   time.Duration `mapstructure:"jobTimeout"`
-	DownloadPath string        `mapstructure:"downloadPath"`
-	UploadPath   string        `mapstructure:"uploadPath"`
-	Domain       *url.URL
-	MinFileSize  int64 `mapstructure:"minFileSize"`
+	ScheduleTime           time.Duration `mapstructure:"scheduleTime"`
+	JobTimeout             time.Duration `mapstructure:"jobTimeout"`
+	DownloadPath           string        `mapstructure:"downloadPath"`
+	UploadPath             string        `mapstructure:"uploadPath"`
+	Domain                 *url.URL
+	MinFileSize            int64         `mapstructure:"minFileSize"`
+	DispatchInterval       time.Duration `mapstructure:"dispatchInterval"`
+	MaxDispatchPerInterval int           `mapstructure:"maxDispatchPerInterval"`
+	MaxInFlightJobs        int           `mapstructure:"maxInFlightJobs"`
+	MaxActiveEncodes       int           `mapstructure:"maxActiveEncodes"`
+	JobTimeoutAction       string        `mapstructure:"jobTimeoutAction"`
+	WorkerTimeout          time.Duration `mapstructure:"workerTimeout"`
+	SourceURL              string        `mapstructure:"sourceURL"`
+	DestinationURL         string        `mapstructure:"destinationURL"`
+	// RetentionPeriod deletes the jobs in RetentionStatuses finished longer ago, 0 keeps them forever
+	RetentionPeriod   time.Duration              `mapstructure:"retentionPeriod"`
+	RetentionStatuses []model.NotificationStatus `mapstructure:"retentionStatuses"`
+	// BatchProbeWorkers is the number of sources of a batch probed at the same time
+	BatchProbeWorkers int `mapstructure:"batchProbeWorkers"`
+	// BatchProbeTimeout fails the sources of a batch not probed in time, 0 waits forever
+	BatchProbeTimeout time.Duration `mapstructure:"batchProbeTimeout"`
+	// NotificationURL receives the status changes in NotificationStatuses of every job, empty disables it
+	NotificationURL      string                     `mapstructure:"notificationURL"`
+	NotificationStatuses []model.NotificationStatus `mapstructure:"notificationStatuses"`
+	// MaxDownloads is the number of sources served to the workers at the same time, 0 means unlimited
+	MaxDownloads int `mapstructure:"maxDownloads"`
+}
+
+const (
+	JobTimeoutActionRequeue = "requeue"
+	JobTimeoutActionFail    = "fail"
+)
+
+// IsDispatchLimited reports whether new jobs must wait in the repository to be paced by the dispatch loop
+// instead of being published to the broker as soon as they are scheduled.
+func (c SchedulerConfig) IsDispatchLimited() bool {
+	return c.MaxDispatchPerInterval > 0 || c.MaxInFlightJobs > 0 || c.MaxActiveEncodes > 0
 }
 
 type RuntimeScheduler struct {
@@ -54,7 +95,14 @@ type RuntimeScheduler struct {
 	checksumChan       chan PathChecksum
 	updateJobsChannels map[uuid.UUID]chan *model.JobUpdateNotification
 	jobChannelsMutex   sync.Mutex
+	jobEventChannels   map[uuid.UUID]chan *model.TaskEvent
 	pathChecksumMap    map[string]string
+	// sourceChecksums are the checksums of the sources read from scheduler.sourceURL
+	sourceChecksums sourceChecksums
+	// notifier posts the notifications of each job in order
+	notifier jobNotifier
+	// downloadSlots holds a value for every download served, nil when the downloads are not limited
+	downloadSlots chan struct{}
 }
 
 func NewScheduler(config SchedulerConfig, repo repository.Repository, queue queue.BrokerServer) (*RuntimeScheduler, error) {
@@ -64,8 +112,12 @@ func NewScheduler(config SchedulerConfig, repo repository.Repository, queue queu
 		queue:              queue,
 		checksumChan:       make(chan PathChecksum),
 		updateJobsChannels: make(map[uuid.UUID]chan *model.JobUpdateNotification, 0),
+		jobEventChannels:   make(map[uuid.UUID]chan *model.TaskEvent),
 		pathChecksumMap:    make(map[string]string),
 	}
+	if config.MaxDownloads > 0 {
+		runtimeScheduler.downloadSlots = make(chan struct{}, config.MaxDownloads)
+	}
 
 	return runtimeScheduler, nil
 }
@@ -85,10 +137,15 @@ func (R *RuntimeScheduler) Run(wg *sync.WaitGroup, ctx context.Context) {
 
 func (R *RuntimeScheduler) start(ctx context.Context) {
 	go R.schedule(ctx)
+	if R.config.IsDispatchLimited() {
+		go R.dispatch(ctx)
+	}
 }
 
+// GetUpdateJobsChan returns a channel receiving the job updates. Like the job events subscribers, a receiver not
+// able to keep up loses updates instead of blocking the scheduler.
 func (R *RuntimeScheduler) GetUpdateJobsChan(ctx context.Context) (uuid.UUID, chan *model.JobUpdateNotification) {
-	ch := make(chan *model.JobUpdateNotification)
+	ch := make(chan *model.JobUpdateNotification, 100)
 	id := uuid.New()
 	R.jobChannelsMutex.Lock()
 	R.updateJobsChannels[id] = ch
@@ -102,14 +159,54 @@ func (R *RuntimeScheduler) CloseUpdateJobsChan(id uuid.UUID) {
 	R.jobChannelsMutex.Unlock()
 }
 
+// SubscribeJobEvents returns a channel receiving every job event. Subscribers that are not able to keep
+// up lose events instead of blocking the scheduler.
+func (R *RuntimeScheduler) SubscribeJobEvents() (uuid.UUID, <-chan *model.TaskEvent) {
+	ch := make(chan *model.TaskEvent, 100)
+	id := uuid.New()
+	R.jobChannelsMutex.Lock()
+	R.jobEventChannels[id] = ch
+	R.jobChannelsMutex.Unlock()
+	return id, ch
+}
+
+func (R *RuntimeScheduler) UnsubscribeJobEvents(id uuid.UUID) {
+	R.jobChannelsMutex.Lock()
+	defer R.jobChannelsMutex.Unlock()
+	if ch, ok := R.jobEventChannels[id]; ok {
+		delete(R.jobEventChannels, id)
+		close(ch)
+	}
+}
+
+func (R *RuntimeScheduler) publishJobEvent(event *model.TaskEvent) {
+	R.jobChannelsMutex.Lock()
+	defer R.jobChannelsMutex.Unlock()
+	for id, ch := range R.jobEventChannels {
+		select {
+		case ch <- event:
+		default:
+			log.Debugf("job events subscriber %s is full, dropping event %d of job %s", id.String(), event.EventID, event.Id.String())
+		}
+	}
+}
+
 func (R *RuntimeScheduler) sendUpdateJobsNotification(notification *model.JobUpdateNotification) {
-	for _, ch := range R.updateJobsChannels {
-		ch <- notification
+	R.jobChannelsMutex.Lock()
+	defer R.jobChannelsMutex.Unlock()
+	for id, ch := range R.updateJobsChannels {
+		select {
+		case ch <- notification:
+		default:
+			log.Debugf("job updates receiver %s is full, dropping update %s of job %s", id.String(), notification.Status, notification.Id.String())
+		}
 	}
 }
 
 func (R *RuntimeScheduler) schedule(ctx context.Context) {
 	jobEventConsumerChan := R.queue.ReceiveJobEvent()
+	scheduleTicker := time.NewTicker(R.config.ScheduleTime)
+	defer scheduleTicker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
@@ -119,7 +216,7 @@ func (R *RuntimeScheduler) schedule(ctx context.Context) {
 				return
 			}
 
-			if jobEvent.EventType != model.PingEvent {
+			if jobEvent.EventType == model.NotificationEvent {
 				jobUpdateNotification := model.JobUpdateNotification{
 					Id:        jobEvent.Id,
 					Status:    jobEvent.Status,
@@ -127,8 +224,18 @@ func (R *RuntimeScheduler) schedule(ctx context.Context) {
 					EventTime: jobEvent.EventTime,
 				}
 				R.sendUpdateJobsNotification(&jobUpdateNotification)
+				R.publishJobEvent(jobEvent)
+				R.notifyTargets(jobEvent)
 			}
 
+			if jobEvent.EventType == model.NotificationEvent && jobEvent.NotificationType == model.UploadNotification && jobEvent.Status == model.CompletedNotificationStatus && jobEvent.DestinationFileName != "" {
+				if err := R.updateUploadedDestination(ctx, jobEvent); err != nil {
+					log.Errorf("error recording the destination of job %s: %v", jobEvent.Id.String(), err)
+				}
+			}
+			if jobEvent.EventType == model.NotificationEvent && jobEvent.NotificationType == model.JobNotification && jobEvent.Status == model.SkippedNotificationStatus {
+				log.Infof("job %s skipped, keeping source file: %s", jobEvent.Id.String(), jobEvent.Message)
+			}
 			if jobEvent.EventType == model.NotificationEvent && jobEvent.NotificationType == model.JobNotification && jobEvent.Status == model.CompletedNotificationStatus {
 				job, err := R.repo.GetJob(ctx, jobEvent.Id.String())
 				if err != nil {
@@ -136,6 +243,11 @@ func (R *RuntimeScheduler) schedule(ctx context.Context) {
 					continue
 				}
 				sourcePath := filepath.Join(R.config.DownloadPath, job.SourcePath)
+				// an index only job never produced a target, its source is the file being indexed
+				if job.IndexOnly {
+					log.Infof("job %s completed, indexed source file %s", jobEvent.Id.String(), sourcePath)
+					continue
+				}
 				target := filepath.Join(R.config.DownloadPath, job.DestinationPath)
 				if _, err := os.Stat(target); err != nil {
 					log.Warnf("job %s completed, source file %s can not be removed because target file does not exists", jobEvent.Id.String(), sourcePath)
@@ -149,33 +261,119 @@ func (R *RuntimeScheduler) schedule(ctx context.Context) {
 			}
 		case checksumPath := <-R.checksumChan:
 			R.pathChecksumMap[checksumPath.path] = checksumPath.checksum
-		case <-time.After(R.config.ScheduleTime):
-			taskEvents, err := R.repo.GetTimeoutJobs(ctx, R.config.JobTimeout)
-			if err != nil {
-				log.Error(err)
+		case <-scheduleTicker.C:
+			if R.config.WorkerTimeout > 0 {
+				R.sweepOrphanJobs(ctx)
 			}
-			for _, taskEvent := range taskEvents {
-				if taskEvent.Status == model.ProgressingNotificationStatus {
-					log.Infof("rescheduling %s after job timeout", taskEvent.Id.String())
-					job, err := R.repo.GetJob(ctx, taskEvent.Id.String())
-					if err != nil {
-						log.Error(err)
-						continue
-					}
-					jobRequest := &model.JobRequest{
-						SourcePath:      job.SourcePath,
-						DestinationPath: job.DestinationPath,
-					}
-					_, err = R.scheduleJobRequest(ctx, jobRequest)
-					if err != nil {
-						log.Error(err)
-					}
-				}
+			if R.config.JobTimeout > 0 {
+				R.sweepTimeoutJobs(ctx)
+			}
+			if R.config.RetentionPeriod > 0 {
+				R.purgeExpiredJobs(ctx)
 			}
 		}
 	}
 }
 
+// sweepTimeoutJobs recovers jobs that have been progressing for more than JobTimeout, usually because the
+// worker processing them died in the middle of the encode.
+func (R *RuntimeScheduler) sweepTimeoutJobs(ctx context.Context) {
+	taskEvents, err := R.repo.GetTimeoutJobs(ctx, R.config.JobTimeout)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, taskEvent := range taskEvents {
+		reason := fmt.Sprintf("job timeout, progressing on worker %s since %s", taskEvent.WorkerName, taskEvent.EventTime.Format(time.RFC3339))
+		var err error
+		switch R.config.JobTimeoutAction {
+		case JobTimeoutActionFail:
+			log.Infof("failing %s after job timeout", taskEvent.Id.String())
+			err = R.failJob(ctx, taskEvent.Id.String(), reason)
+		default:
+			log.Infof("rescheduling %s after job timeout", taskEvent.Id.String())
+			err = R.requeueJob(ctx, taskEvent.Id.String(), reason)
+		}
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// sweepOrphanJobs requeues the jobs owned by workers that stopped sending pings, a worker killed by OOM
+// never reports the failure of the jobs it was processing.
+func (R *RuntimeScheduler) sweepOrphanJobs(ctx context.Context) {
+	taskEvents, err := R.repo.GetOrphanJobs(ctx, R.config.WorkerTimeout)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, taskEvent := range taskEvents {
+		log.Infof("rescheduling %s, worker %s is offline", taskEvent.Id.String(), taskEvent.WorkerName)
+		reason := fmt.Sprintf("worker %s offline for more than %s", taskEvent.WorkerName, R.config.WorkerTimeout)
+		if err = R.requeueJob(ctx, taskEvent.Id.String(), reason); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// requeueJob publishes again a job that was already dispatched. Events from the previous execution will
+// be rejected by the repository because their EventID does not follow the new sequence.
+func (R *RuntimeScheduler) requeueJob(ctx context.Context, uuid string, reason string) error {
+	var requeueEvent *model.TaskEvent
+	err := R.repo.WithTransaction(ctx, func(ctx context.Context, tx repository.Repository) error {
+		job, err := tx.GetJob(ctx, uuid)
+		if err != nil {
+			return err
+		}
+		requeueEvent = job.AddEvent(model.NotificationEvent, model.JobNotification, model.ReQueuedNotificationStatus)
+		requeueEvent.Message = reason
+		if err = tx.AddNewTaskEvent(ctx, requeueEvent); err != nil {
+			return err
+		}
+		if R.config.IsDispatchLimited() {
+			return nil
+		}
+		return R.publishJob(job)
+	})
+	if err != nil {
+		return err
+	}
+	R.notifyJobEvent(requeueEvent)
+	return nil
+}
+
+func (R *RuntimeScheduler) failJob(ctx context.Context, uuid string, reason string) error {
+	var failEvent *model.TaskEvent
+	err := R.repo.WithTransaction(ctx, func(ctx context.Context, tx repository.Repository) error {
+		job, err := tx.GetJob(ctx, uuid)
+		if err != nil {
+			return err
+		}
+		failEvent = job.AddEvent(model.NotificationEvent, model.JobNotification, model.FailedNotificationStatus)
+		failEvent.Message = reason
+		return tx.AddNewTaskEvent(ctx, failEvent)
+	})
+	if err != nil {
+		return err
+	}
+	R.notifyJobEvent(failEvent)
+	return nil
+}
+
+// notifyJobEvent forwards to the update channels the events generated by the scheduler itself, the ones
+// coming from workers are forwarded when received from the broker.
+func (R *RuntimeScheduler) notifyJobEvent(event *model.TaskEvent) {
+	R.sendUpdateJobsNotification(&model.JobUpdateNotification{
+		Id:        event.Id,
+		Status:    event.Status,
+		Message:   event.Message,
+		EventTime: event.EventTime,
+	})
+	R.publishJobEvent(event)
+	R.notifyTargets(event)
+}
+
 func (R *RuntimeScheduler) scheduleJobRequest(ctx context.Context, jobRequest *model.JobRequest) (job *model.Job, err error) {
 	err = R.repo.WithTransaction(ctx, func(ctx context.Context, tx repository.Repository) error {
 		job, err = tx.GetJobByPath(ctx, jobRequest.SourcePath)
@@ -191,6 +389,15 @@ func (R *RuntimeScheduler) scheduleJobRequest(ctx context.Context, jobRequest *m
 			SourcePath:      jobRequest.SourcePath,
 			DestinationPath: jobRequest.DestinationPath,
 			Id:              newUUID,
+			StreamSelection: jobRequest.StreamSelection,
+			QualityProfile:  jobRequest.QualityProfile,
+			EncodeOverrides: jobRequest.EncodeOverrides,
+			SourceChecksum:  jobRequest.SourceChecksum,
+			WorkDirRoot:     jobRequest.WorkDirRoot,
+			Notification:    jobRequest.Notification,
+			Metadata:        jobRequest.Metadata,
+			IndexOnly:       jobRequest.IndexOnly,
+			BatchId:         jobRequest.BatchId,
 		}
 		err = tx.AddJob(ctx, job)
 		if err != nil {
@@ -207,25 +414,154 @@ func (R *RuntimeScheduler) scheduleJobRequest(ctx context.Context, jobRequest *m
 			}
 		}
 
-		downloadURL, _ := url.Parse(fmt.Sprintf("%s/api/v1/job/%s/download", R.config.Domain.String(), job.Id.String()))
-		uploadURL, _ := url.Parse(fmt.Sprintf("%s/api/v1/job/%s/upload", R.config.Domain.String(), job.Id.String()))
-		checksumURL, _ := url.Parse(fmt.Sprintf("%s/api/v1/job/%s/checksum", R.config.Domain.String(), job.Id.String()))
-		task := &model.TaskEncode{
-			Id:          job.Id,
-			DownloadURL: downloadURL.String(),
-			UploadURL:   uploadURL.String(),
-			ChecksumURL: checksumURL.String(),
-			EventID:     job.Events.GetLatest().EventID,
+		if R.config.IsDispatchLimited() {
+			log.Debugf("job %s queued, waiting for dispatch", job.Id.String())
+			return nil
 		}
-		return R.queue.PublishJobRequest(task)
+		return R.publishJob(job)
 	})
 	return job, err
 }
 
+func (R *RuntimeScheduler) publishJob(job *model.Job) error {
+	downloadURL, _ := url.Parse(fmt.Sprintf("%s/api/v1/job/%s/download", R.config.Domain.String(), job.Id.String()))
+	if R.config.SourceURL != "" {
+		// workers read the source directly from the share exposing downloadPath
+		downloadURL, _ = url.Parse(R.config.SourceURL)
+		downloadURL = downloadURL.JoinPath(filepath.ToSlash(job.SourcePath))
+	}
+	uploadURL, _ := url.Parse(fmt.Sprintf("%s/api/v1/job/%s/upload", R.config.Domain.String(), job.Id.String()))
+	if R.config.DestinationURL != "" {
+		// workers write the encoded file directly into the destination directory of the share exposing uploadPath
+		uploadURL, _ = url.Parse(R.config.DestinationURL)
+		uploadURL = uploadURL.JoinPath(filepath.ToSlash(filepath.Dir(job.DestinationPath)))
+		if !strings.HasSuffix(uploadURL.Path, "/") {
+			uploadURL.Path += "/"
+		}
+	}
+	checksumURL, _ := url.Parse(fmt.Sprintf("%s/api/v1/job/%s/checksum", R.config.Domain.String(), job.Id.String()))
+	task := &model.TaskEncode{
+		Id:              job.Id,
+		DownloadURL:     downloadURL.String(),
+		UploadURL:       uploadURL.String(),
+		ChecksumURL:     checksumURL.String(),
+		EventID:         job.Events.GetLatest().EventID,
+		StreamSelection: job.StreamSelection,
+		QualityProfile:  job.QualityProfile,
+		EncodeOverrides: job.EncodeOverrides,
+		SourceChecksum:  job.SourceChecksum,
+		WorkDirRoot:     job.WorkDirRoot,
+		Metadata:        job.Metadata,
+		IndexOnly:       job.IndexOnly,
+	}
+	return R.queue.PublishJobRequest(task)
+}
+
+// dispatch publishes queued jobs to the broker at the configured pace. Workers still apply their own
+// maxPrefetchJobs on top of it, so this only bounds how many jobs are available in the broker at once.
+func (R *RuntimeScheduler) dispatch(ctx context.Context) {
+	ticker := time.NewTicker(R.config.DispatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := R.dispatchQueuedJobs(ctx); err != nil {
+				log.Errorf("error dispatching queued jobs: %s", err)
+			}
+		}
+	}
+}
+
+func (R *RuntimeScheduler) dispatchBudget(ctx context.Context) (int, error) {
+	budget := math.MaxInt32
+	if R.config.MaxDispatchPerInterval > 0 {
+		budget = R.config.MaxDispatchPerInterval
+	}
+	if R.config.MaxInFlightJobs > 0 {
+		inFlight, err := R.repo.CountInFlightJobs(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if available := R.config.MaxInFlightJobs - inFlight; available < budget {
+			budget = available
+		}
+	}
+	if R.config.MaxActiveEncodes > 0 {
+		active, err := R.repo.CountActiveEncodes(ctx, R.config.WorkerTimeout)
+		if err != nil {
+			return 0, err
+		}
+		if available := R.config.MaxActiveEncodes - active; available < budget {
+			budget = available
+		}
+	}
+	return budget, nil
+}
+
+func (R *RuntimeScheduler) dispatchQueuedJobs(ctx context.Context) error {
+	budget, err := R.dispatchBudget(ctx)
+	if err != nil || budget <= 0 {
+		return err
+	}
+	queuedJobs, err := R.repo.GetQueuedJobs(ctx, budget)
+	if err != nil {
+		return err
+	}
+	for _, queuedJob := range queuedJobs {
+		var dispatchEvent *model.TaskEvent
+		err = R.repo.WithTransaction(ctx, func(ctx context.Context, tx repository.Repository) error {
+			job, err := tx.GetJob(ctx, queuedJob.Id.String())
+			if err != nil {
+				return err
+			}
+			dispatchEvent = job.AddEvent(model.NotificationEvent, model.JobNotification, model.DispatchedNotificationStatus)
+			if err = tx.AddNewTaskEvent(ctx, dispatchEvent); err != nil {
+				return err
+			}
+			return R.publishJob(job)
+		})
+		if err != nil {
+			return err
+		}
+		R.notifyJobEvent(dispatchEvent)
+		log.Infof("dispatched job %s", queuedJob.Id.String())
+	}
+	return nil
+}
+
 func (R *RuntimeScheduler) ScheduleJobRequest(ctx context.Context, jobRequest *model.JobRequest) (*model.Job, error) {
+	if err := jobRequest.EncodeOverrides.Validate(); err != nil {
+		return nil, &model.CustomError{Message: err.Error()}
+	}
+	if err := jobRequest.Notification.Validate(); err != nil {
+		return nil, &model.CustomError{Message: err.Error()}
+	}
+	if err := jobRequest.Metadata.Validate(); err != nil {
+		return nil, &model.CustomError{Message: err.Error()}
+	}
+	filteredJobRequest, err := R.probeSource(jobRequest)
+	if err != nil {
+		return nil, err
+	}
+	return R.submitJobRequest(ctx, filteredJobRequest)
+}
+
+// probeSource checks the source of the job request and returns the request with its source and destination paths
+// relative to the download and upload paths.
+func (R *RuntimeScheduler) probeSource(jobRequest *model.JobRequest) (*model.JobRequest, error) {
+	sourceChecksum := strings.ToLower(jobRequest.SourceChecksum)
+	if sourceChecksum != "" && !sha256Regexp.MatchString(sourceChecksum) {
+		return nil, &model.CustomError{Message: fmt.Sprintf("invalid source_checksum %s, must be a hex encoded sha256", jobRequest.SourceChecksum)}
+	}
+	// the roots are paths of the workers, which only accept the ones they list
+	if jobRequest.WorkDirRoot != "" && !filepath.IsAbs(jobRequest.WorkDirRoot) {
+		return nil, &model.CustomError{Message: fmt.Sprintf("invalid work_dir_root %s, must be an absolute path", jobRequest.WorkDirRoot)}
+	}
 	filePath := filepath.Join(R.config.DownloadPath, jobRequest.SourcePath)
 	fileInfo, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
+	if err != nil {
 		return nil, err
 	}
 
@@ -259,8 +595,21 @@ func (R *RuntimeScheduler) ScheduleJobRequest(ctx context.Context, jobRequest *m
 	filteredJobRequest := &model.JobRequest{
 		SourcePath:      relativePathSource,
 		DestinationPath: relativePathTarget,
+		StreamSelection: jobRequest.StreamSelection,
+		QualityProfile:  jobRequest.QualityProfile,
+		EncodeOverrides: jobRequest.EncodeOverrides,
+		SourceChecksum:  sourceChecksum,
+		WorkDirRoot:     jobRequest.WorkDirRoot,
+		Notification:    jobRequest.Notification,
+		Metadata:        jobRequest.Metadata,
+		IndexOnly:       jobRequest.IndexOnly,
+		BatchId:         jobRequest.BatchId,
 	}
+	return filteredJobRequest, nil
+}
 
+// submitJobRequest schedules the job of a probed job request and notifies the job list subscribers.
+func (R *RuntimeScheduler) submitJobRequest(ctx context.Context, filteredJobRequest *model.JobRequest) (*model.Job, error) {
 	job, err := R.scheduleJobRequest(ctx, filteredJobRequest)
 	if err != nil {
 		return nil, err
@@ -273,6 +622,10 @@ func (R *RuntimeScheduler) ScheduleJobRequest(ctx context.Context, jobRequest *m
 	}
 
 	R.sendUpdateJobsNotification(&jobUpdateNotification)
+	// the queued event is added by the scheduler itself, the following ones by the dispatch and the workers
+	queuedEvent := job.Events.GetLatest()
+	R.publishJobEvent(queuedEvent)
+	R.notifyTargets(queuedEvent)
 	return job, nil
 }
 
@@ -305,9 +658,17 @@ func (R *RuntimeScheduler) GetDownloadJobWriter(ctx context.Context, uuid string
 	if err != nil {
 		return nil, err
 	}
+	if R.downloadSlots != nil {
+		select {
+		case R.downloadSlots <- struct{}{}:
+		default:
+			return nil, ErrorDownloadsBusy
+		}
+	}
 	filePath := filepath.Join(R.config.DownloadPath, job.SourcePath)
 	downloadFile, err := os.Open(filePath)
 	if err != nil {
+		R.releaseDownloadSlot()
 		if os.IsNotExist(err) {
 			return nil, ErrorJobNotFound
 		} else {
@@ -316,6 +677,8 @@ func (R *RuntimeScheduler) GetDownloadJobWriter(ctx context.Context, uuid string
 	}
 	dfStat, err := downloadFile.Stat()
 	if err != nil {
+		downloadFile.Close()
+		R.releaseDownloadSlot()
 		if os.IsNotExist(err) {
 			return nil, ErrorJobNotFound
 		} else {
@@ -329,41 +692,99 @@ func (R *RuntimeScheduler) GetDownloadJobWriter(ctx context.Context, uuid string
 			path:              filePath,
 			checksumPublisher: R.checksumChan,
 		},
-		FileSize: dfStat.Size(),
-		FileName: dfStat.Name(),
+		FileSize:    dfStat.Size(),
+		FileName:    dfStat.Name(),
+		FileModTime: dfStat.ModTime(),
+		release:     R.releaseDownloadSlot,
 	}, nil
 
 }
 
-func (R *RuntimeScheduler) GetUploadJobWriter(ctx context.Context, uuid string) (*UploadJobStream, error) {
+// releaseDownloadSlot frees the download slot taken by GetDownloadJobWriter.
+func (R *RuntimeScheduler) releaseDownloadSlot() {
+	if R.downloadSlots != nil {
+		<-R.downloadSlots
+	}
+}
+
+// GetUploadJobWriter opens the destination of the job for writing. When the worker names the encoded file, the
+// file is saved with that name in the destination directory and the job destination path is updated.
+func (R *RuntimeScheduler) GetUploadJobWriter(ctx context.Context, uuid string, fileName string) (*UploadJobStream, error) {
 	job, err := R.isValidStremeableJob(ctx, uuid)
 	if err != nil {
 		return nil, err
 	}
 
+	// the job keeps its destination until the upload with the new name is committed, a failed upload never arrived
+	var commitDestination func() error
+	if fileName != "" && fileName != filepath.Base(job.DestinationPath) {
+		if job.DestinationPath, err = renamedDestination(job.DestinationPath, fileName); err != nil {
+			return nil, err
+		}
+		destinationPath := job.DestinationPath
+		commitDestination = func() error {
+			return R.repo.UpdateJobDestinationPath(ctx, uuid, destinationPath)
+		}
+	}
+
 	filePath := filepath.Join(R.config.UploadPath, job.DestinationPath)
 	err = os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
-	temporalPath := filePath + ".upload"
+	temporalPath := filepath.Join(filepath.Dir(filePath), fmt.Sprintf(".%s.upload", filepath.Base(filePath)))
 	uploadFile, err := os.OpenFile(temporalPath, os.O_TRUNC|os.O_CREATE|os.O_RDWR, os.ModePerm)
 	return &UploadJobStream{
-		&JobStream{
+		JobStream: &JobStream{
 			job:          job,
 			file:         uploadFile,
 			path:         filePath,
 			temporalPath: temporalPath,
 		},
+		commitDestination: commitDestination,
 	}, err
 }
 
+// renamedDestination is the destination path of a job whose encoded file the worker named fileName, the output file
+// template of the worker decides it. It stays in the directory of the destination.
+func renamedDestination(destinationPath string, fileName string) (string, error) {
+	if fileName != filepath.Base(fileName) || fileName == "." || fileName == ".." {
+		return "", &model.CustomError{Message: fmt.Sprintf("invalid file name %s", fileName)}
+	}
+	return filepath.Join(filepath.Dir(destinationPath), fileName), nil
+}
+
+// updateUploadedDestination records the file name a worker wrote on scheduler.destinationURL, reported with the
+// completed upload since the server doesn't receive that upload.
+func (R *RuntimeScheduler) updateUploadedDestination(ctx context.Context, event *model.TaskEvent) error {
+	job, err := R.repo.GetJob(ctx, event.Id.String())
+	if err != nil {
+		return err
+	}
+	if event.DestinationFileName == filepath.Base(job.DestinationPath) {
+		return nil
+	}
+	destinationPath, err := renamedDestination(job.DestinationPath, event.DestinationFileName)
+	if err != nil {
+		return err
+	}
+	return R.repo.UpdateJobDestinationPath(ctx, job.Id.String(), destinationPath)
+}
+
 func (R *RuntimeScheduler) GetChecksum(ctx context.Context, uuid string) (string, error) {
 	job, err := R.repo.GetJob(ctx, uuid)
 	if err != nil {
 		return "", err
 	}
 	filePath := filepath.Join(R.config.DownloadPath, job.SourcePath)
+	if R.config.SourceURL != "" {
+		// the workers read the source from the share, the server never streamed it
+		checksum, err := R.sourceChecksums.get(filePath)
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("%w: %s not found", ErrorJobNotFound, filePath)
+		}
+		return checksum, err
+	}
 	checksum := R.pathChecksumMap[filePath]
 	if checksum == "" {
 		return "", fmt.Errorf("%w: Checksum not found for %s", ErrorJobNotFound, filePath)
@@ -375,6 +796,10 @@ func (R *RuntimeScheduler) GetWorkers(ctx context.Context) (*[]model.Worker, err
 	return R.repo.GetWorkers(ctx)
 }
 
+func (R *RuntimeScheduler) GetSpaceSavings(ctx context.Context) (*model.SpaceSavings, error) {
+	return R.repo.GetSpaceSavings(ctx)
+}
+
 func (S *RuntimeScheduler) stop() {
 
 }
@@ -0,0 +1,50 @@
+package scheduler
+
+import (
+	"context"
+	"gearr/model"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSendUpdateJobsNotificationDoesNotWaitForTheReceivers(t *testing.T) {
+	scheduler, err := NewScheduler(SchedulerConfig{}, &jobRepository{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a receiver that never reads, like a stalled websocket client
+	_, stalled := scheduler.GetUpdateJobsChan(context.Background())
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			scheduler.sendUpdateJobsNotification(&model.JobUpdateNotification{Id: uuid.New(), Status: model.ProgressingNotificationStatus})
+		}
+	}()
+	// websocket clients connect and leave while the updates are sent
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			id, _ := scheduler.GetUpdateJobsChan(context.Background())
+			scheduler.CloseUpdateJobsChan(id)
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("sending the job updates blocked on a receiver")
+	}
+	if len(stalled) != cap(stalled) {
+		t.Fatalf("%d updates buffered for the stalled receiver, expected the first %d", len(stalled), cap(stalled))
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"gearr/model"
 	"hash"
 	"os"
+	"time"
 )
 
 type PathChecksum struct {
@@ -21,14 +22,24 @@ type JobStream struct {
 	temporalPath      string
 }
 
+// UploadJobStream writes the upload to a hidden staging file next to the destination, which is only renamed to the
+// destination by Commit, so watchers of the upload path never see partial files.
 type UploadJobStream struct {
 	*JobStream
+	committed bool
+	// modTime is the modification time given to the destination, zero keeps the upload time
+	modTime time.Time
+	// commitDestination records the destination path the worker renamed the output to, nil when unchanged
+	commitDestination func() error
 }
 
 type DownloadJobStream struct {
 	*JobStream
-	FileSize int64
-	FileName string
+	FileSize    int64
+	FileName    string
+	FileModTime time.Time
+	// release frees the download slot of the stream
+	release func()
 }
 
 func (U *JobStream) hash(p []byte) (err error) {
@@ -64,10 +75,45 @@ func (D *DownloadJobStream) Name() string {
 	return D.FileName
 }
 
+func (D *DownloadJobStream) ModTime() time.Time {
+	return D.FileModTime
+}
+
+// SetModTime keeps the modification time of the source the worker sent with the upload.
+func (U *UploadJobStream) SetModTime(modTime time.Time) {
+	U.modTime = modTime
+}
+
+// Commit moves the complete and verified upload to its destination and records a renamed destination on the job.
+func (U *UploadJobStream) Commit() error {
+	if err := U.file.Sync(); err != nil {
+		return err
+	}
+	if err := U.file.Close(); err != nil {
+		return err
+	}
+	if !U.modTime.IsZero() {
+		if err := os.Chtimes(U.temporalPath, time.Now(), U.modTime); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(U.temporalPath, U.path); err != nil {
+		return err
+	}
+	U.committed = true
+	if U.commitDestination != nil {
+		return U.commitDestination()
+	}
+	return nil
+}
+
+// Close discards the staging file unless the upload was committed.
 func (U *UploadJobStream) Close(pushChecksum bool) error {
-	U.file.Sync()
+	if U.committed {
+		return nil
+	}
 	U.file.Close()
-	return os.Rename(U.temporalPath, U.path)
+	return U.Clean()
 }
 
 func (U *JobStream) Close(pushChecksum bool) error {
@@ -81,6 +127,12 @@ func (U *JobStream) Close(pushChecksum bool) error {
 	}
 	return nil
 }
+func (D *DownloadJobStream) Close(pushChecksum bool) error {
+	err := D.JobStream.Close(pushChecksum)
+	D.release()
+	return err
+}
+
 func (U *UploadJobStream) Clean() error {
-	return os.Remove(U.path)
+	return os.Remove(U.temporalPath)
 }
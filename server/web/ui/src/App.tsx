@@ -5,6 +5,7 @@ import { Visibility, VisibilityOff, ErrorOutline } from '@mui/icons-material';
 
 import JobTable from './JobTable';
 import WorkerTable from './WorkerTable';
+import SavingsTable from './SavingsTable';
 import useMedia from './hooks/useMedia';
 import Navigation from './Navbar';
 import { ThemeContext, themeName, themeSetting } from './contexts/ThemeContext';
@@ -45,6 +46,12 @@ const App: React.FC = () => {
     </div>
   );
 
+  const Savings: React.FC = () => (
+    <div className="content-container">
+      {showJobTable && <SavingsTable token={token} setShowJobTable={setShowJobTable} setErrorText={setErrorText} />}
+    </div>
+  );
+
   const [userTheme, setUserTheme] = useLocalStorage<themeSetting>(themeLocalStorageKey, 'auto');
   const browserHasThemes = useMedia('(prefers-color-scheme)');
   const browserWantsDarkTheme = useMedia('(prefers-color-scheme: dark)');
@@ -110,6 +117,7 @@ const App: React.FC = () => {
             <Route path="/" element={<Navigate to="/jobs" replace />} />
             <Route path="/jobs" element={<Jobs />} />
             <Route path="/workers" element={<Workers />} />
+            <Route path="/savings" element={<Savings />} />
           </Routes>
           )}
         </div>
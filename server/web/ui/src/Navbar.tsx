@@ -30,6 +30,11 @@ const CollapseNav: React.FC<CollapseNavProps> = ({ isOpen, className, id }) => (
           Workers
         </NavLink>
       </NavItem>
+      <NavItem>
+        <NavLink tag={Link} to="/savings">
+          Savings
+        </NavLink>
+      </NavItem>
       <NavItem>
         <NavLink href="https://github.com/pando85/gearr" title="GitHub">
           <GitHubIcon />
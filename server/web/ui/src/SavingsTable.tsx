@@ -0,0 +1,97 @@
+import React, { useState, useEffect } from 'react';
+import axios from 'axios';
+import {
+  Table,
+  TableBody,
+  TableCell,
+  TableHead,
+  TableRow,
+  CircularProgress,
+} from '@mui/material';
+
+import { formatBytes } from './utils';
+
+interface CodecSavings {
+  codec: string;
+  jobs: number;
+  source_size: number;
+  encoded_size: number;
+  saved_size: number;
+}
+
+interface SpaceSavings {
+  jobs: number;
+  source_size: number;
+  encoded_size: number;
+  saved_size: number;
+  per_codec: CodecSavings[];
+}
+
+interface SavingsTableProps {
+  token: string;
+  setShowJobTable: React.Dispatch<React.SetStateAction<boolean>>;
+  setErrorText: React.Dispatch<React.SetStateAction<string>>;
+}
+
+const SavingsTable: React.FC<SavingsTableProps> = ({ token, setShowJobTable, setErrorText }) => {
+  const [savings, setSavings] = useState<SpaceSavings | null>(null);
+  const [loading, setLoading] = useState<boolean>(false);
+
+  useEffect(() => {
+    const fetchSavings = async () => {
+      try {
+        setLoading(true);
+        const response = await axios.get('/api/v1/stats/savings',
+          {
+            headers: {
+              Authorization: `Bearer ${token}`,
+            },
+          });
+        setSavings(response.data);
+      } catch (error) {
+        console.error('Error fetching savings:', error);
+        setShowJobTable(false);
+        if (error instanceof Error) {
+          setErrorText(error.message);
+        }
+      } finally {
+        setLoading(false);
+      }
+    };
+
+    fetchSavings();
+  }, [token, setShowJobTable, setErrorText]);
+
+  return (
+    <div>
+      {savings && (
+        <h5>Saved {formatBytes(savings.saved_size)} across {savings.jobs} files</h5>
+      )}
+      <Table>
+        <TableHead>
+          <TableRow>
+            <TableCell>Source Codec</TableCell>
+            <TableCell>Files</TableCell>
+            <TableCell>Source Size</TableCell>
+            <TableCell>Encoded Size</TableCell>
+            <TableCell>Saved</TableCell>
+          </TableRow>
+        </TableHead>
+        <TableBody>
+          {savings?.per_codec.map((codecSavings) => (
+            <TableRow key={codecSavings.codec}>
+              <TableCell>{codecSavings.codec || 'unknown'}</TableCell>
+              <TableCell>{codecSavings.jobs}</TableCell>
+              <TableCell>{formatBytes(codecSavings.source_size)}</TableCell>
+              <TableCell>{formatBytes(codecSavings.encoded_size)}</TableCell>
+              <TableCell>{formatBytes(codecSavings.saved_size)}</TableCell>
+            </TableRow>
+          ))}
+        </TableBody>
+      </Table>
+      {loading && <CircularProgress />}
+    </div>
+  );
+};
+
+export default SavingsTable;
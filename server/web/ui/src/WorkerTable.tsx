@@ -14,6 +14,15 @@ interface Worker {
   id: string;
   queue_name: string;
   last_seen: string;
+  status?: string;
+  started_at?: string;
+  stopped_at?: string;
+  info?: {
+    version: string;
+    accepted_jobs: string[];
+    ffmpeg_version?: string;
+    encoders?: string[];
+  };
 }
 
 interface WorkerTableProps {
@@ -60,6 +69,12 @@ const WorkersTable: React.FC<WorkerTableProps> = ({ token, setShowJobTable, setE
             <TableCell>ID</TableCell>
             <TableCell>Queue Name</TableCell>
             <TableCell>Last Seen</TableCell>
+            <TableCell>Status</TableCell>
+            <TableCell>Started</TableCell>
+            <TableCell>Stopped</TableCell>
+            <TableCell>Version</TableCell>
+            <TableCell>Jobs</TableCell>
+            <TableCell>FFmpeg</TableCell>
           </TableRow>
         </TableHead>
         <TableBody>
@@ -69,6 +84,12 @@ const WorkersTable: React.FC<WorkerTableProps> = ({ token, setShowJobTable, setE
               <TableCell>{worker.id}</TableCell>
               <TableCell>{worker.queue_name}</TableCell>
               <TableCell>{worker.last_seen}</TableCell>
+              <TableCell>{worker.status}</TableCell>
+              <TableCell>{worker.started_at}</TableCell>
+              <TableCell>{worker.stopped_at}</TableCell>
+              <TableCell>{worker.info?.version}</TableCell>
+              <TableCell>{worker.info?.accepted_jobs?.join(', ')}</TableCell>
+              <TableCell>{worker.info?.ffmpeg_version}</TableCell>
             </TableRow>
           ))}
         </TableBody>
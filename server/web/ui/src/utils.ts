@@ -2,8 +2,10 @@ import { Job } from './model';
 
 export const STATUS_FILTER_OPTIONS = [
     'progressing',
+    'waiting',
     'queued',
     'completed',
+    'skipped',
     'failed',
 ];
 
@@ -80,6 +82,8 @@ export const getStatusColor = (status: string): string => {
     switch (status) {
         case 'completed':
             return 'green';
+        case 'skipped':
+            return 'orange';
         case 'failed':
             return 'red';
         default:
@@ -112,3 +116,14 @@ export const sortJobs = (sortColumn: string | null, sortDirection: 'asc' | 'desc
 
     return sortedJobs;
 };
+
+export const formatBytes = (bytes: number): string => {
+    const units = ['B', 'KB', 'MB', 'GB', 'TB', 'PB'];
+    let value = Math.abs(bytes);
+    let unit = 0;
+    while (value >= 1024 && unit < units.length - 1) {
+        value /= 1024;
+        unit++;
+    }
+    return `${bytes < 0 ? '-' : ''}${value.toFixed(unit === 0 ? 0 : 1)}${units[unit]}`;
+};
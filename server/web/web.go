@@ -2,30 +2,38 @@ package web
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"gearr/helper"
 	"gearr/model"
 	"gearr/server/scheduler"
 	"gearr/server/web/ui"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
 
+// downloadRetryAfter are the seconds a worker refused a download waits before asking again.
+const downloadRetryAfter = 10
+
 type WebServer struct {
 	WebServerConfig
-	scheduler scheduler.Scheduler
-	router    *gin.Engine
-	ctx       context.Context
-	upgrader  websocket.Upgrader
+	scheduler       scheduler.Scheduler
+	router          *gin.Engine
+	ctx             context.Context
+	upgrader        websocket.Upgrader
+	allowedNetworks []*net.IPNet
 }
 
 func (w *WebServer) addJob(c *gin.Context) {
@@ -48,6 +56,64 @@ func (w *WebServer) addJob(c *gin.Context) {
 	c.JSON(http.StatusOK, job)
 }
 
+func (w *WebServer) addBatch(c *gin.Context) {
+	var batchRequest model.BatchJobRequest
+	if err := c.ShouldBindJSON(&batchRequest); err != nil {
+		webError(c, err, http.StatusBadRequest)
+		return
+	}
+
+	batch, err := w.scheduler.ScheduleBatchJobRequest(w.ctx, &batchRequest)
+	if err != nil {
+		var customError *model.CustomError
+		if errors.As(err, &customError) {
+			webError(c, err, http.StatusBadRequest)
+			return
+		}
+		webError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, batch)
+}
+
+func (w *WebServer) purgeJobs(c *gin.Context) {
+	var purgeRequest model.PurgeRequest
+	if err := c.ShouldBindJSON(&purgeRequest); err != nil {
+		webError(c, err, http.StatusBadRequest)
+		return
+	}
+
+	result, err := w.scheduler.PurgeJobs(w.ctx, &purgeRequest)
+	if err != nil {
+		var customError *model.CustomError
+		if errors.As(err, &customError) {
+			webError(c, err, http.StatusBadRequest)
+			return
+		}
+		webError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func (w *WebServer) getBatchByID(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		webError(c, fmt.Errorf("batch ID parameter not found"), 404)
+		return
+	}
+
+	batch, err := w.scheduler.GetBatch(w.ctx, id)
+	if err != nil {
+		webError(c, err, http.StatusNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, batch)
+}
+
 func (w *WebServer) getJobs(c *gin.Context) {
 	jobs, err := w.scheduler.GetJobs(w.ctx)
 	if err != nil {
@@ -113,10 +179,46 @@ func (w *WebServer) getJobsUpdates(c *gin.Context) {
 			return
 		}
 		log.Debugf("sending update: %+v", jobUpdateNotification)
-		conn.WriteMessage(websocket.TextMessage, []byte(jsonBytes))
+		if err = conn.WriteMessage(websocket.TextMessage, []byte(jsonBytes)); err != nil {
+			log.Debugf("websocket disconnected: %s", err)
+			return
+		}
 	}
 }
 
+func (w *WebServer) getEvents(c *gin.Context) {
+	jobID := c.Query("job")
+	id, ch := w.scheduler.SubscribeJobEvents()
+	defer w.scheduler.UnsubscribeJobEvents(id)
+	log.Debugf("events subscriber %s connected", id.String())
+
+	keepAlive := time.NewTicker(time.Second * 30)
+	defer keepAlive.Stop()
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(writer io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-w.ctx.Done():
+			return false
+		case <-keepAlive.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		case event, ok := <-ch:
+			if !ok {
+				return false
+			}
+			if jobID != "" && event.Id.String() != jobID {
+				return true
+			}
+			c.SSEvent("job", event)
+			return true
+		}
+	})
+	log.Debugf("events subscriber %s disconnected", id.String())
+}
+
 func (w *WebServer) upload(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
@@ -124,8 +226,12 @@ func (w *WebServer) upload(c *gin.Context) {
 		return
 	}
 
-	uploadStream, err := w.scheduler.GetUploadJobWriter(c.Request.Context(), id)
-	if errors.Is(err, scheduler.ErrorStreamNotAllowed) {
+	uploadStream, err := w.scheduler.GetUploadJobWriter(c.Request.Context(), id, c.GetHeader("filename"))
+	var customError *model.CustomError
+	if errors.As(err, &customError) {
+		webError(c, err, 400)
+		return
+	} else if errors.Is(err, scheduler.ErrorStreamNotAllowed) {
 		webError(c, err, 403)
 		return
 	} else if errors.Is(err, scheduler.ErrorJobNotFound) {
@@ -154,24 +260,32 @@ loop:
 		default:
 			readedBytes, err := reader.Read(b)
 			readed += uint64(readedBytes)
-			uploadStream.Write(b[:readedBytes])
-			//TODO check error here?
+			if _, writeErr := uploadStream.Write(b[:readedBytes]); writeErr != nil {
+				webError(c, writeErr, 500)
+				return
+			}
 			if err == io.EOF {
 				break loop
 			}
 		}
 	}
 	if size != readed {
-		defer uploadStream.Clean()
 		webError(c, fmt.Errorf("invalid size, expected %d, received %d", size, readed), 400)
 		return
 	}
 	checksumUpload := uploadStream.GetHash()
 	if checksumUpload != checksum {
-		defer uploadStream.Clean()
 		webError(c, fmt.Errorf("invalid checksum, received %s, calculated %s", checksum, checksumUpload), 400)
 		return
 	}
+	// workers with worker.preserveModTime send the modification time of the source
+	if modTime, err := time.Parse(time.RFC3339, c.GetHeader("modtime")); err == nil {
+		uploadStream.SetModTime(modTime)
+	}
+	if err = uploadStream.Commit(); err != nil {
+		webError(c, err, 500)
+		return
+	}
 	c.Status(http.StatusCreated)
 }
 
@@ -183,7 +297,12 @@ func (w *WebServer) download(c *gin.Context) {
 	}
 
 	downloadStream, err := w.scheduler.GetDownloadJobWriter(c.Request.Context(), id)
-	if errors.Is(err, scheduler.ErrorStreamNotAllowed) {
+	if errors.Is(err, scheduler.ErrorDownloadsBusy) {
+		// the workers wait for a slot and ask again after Retry-After
+		c.Header("Retry-After", strconv.Itoa(downloadRetryAfter))
+		webError(c, err, http.StatusServiceUnavailable)
+		return
+	} else if errors.Is(err, scheduler.ErrorStreamNotAllowed) {
 		webError(c, err, 403)
 		return
 	} else if errors.Is(err, scheduler.ErrorJobNotFound) {
@@ -196,6 +315,7 @@ func (w *WebServer) download(c *gin.Context) {
 
 	c.Header("Content-Length", strconv.FormatInt(downloadStream.Size(), 10))
 	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(downloadStream.Name())))
+	c.Header("Last-Modified", downloadStream.ModTime().UTC().Format(http.TimeFormat))
 	c.Status(http.StatusOK)
 
 	b := make([]byte, 131072)
@@ -224,6 +344,16 @@ func (w *WebServer) getWorkers(c *gin.Context) {
 	c.JSON(http.StatusOK, workers)
 }
 
+func (w *WebServer) getSpaceSavings(c *gin.Context) {
+	savings, err := w.scheduler.GetSpaceSavings(c.Request.Context())
+	if err != nil {
+		webError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, savings)
+}
+
 func (w *WebServer) checksum(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
@@ -241,18 +371,37 @@ func (w *WebServer) checksum(c *gin.Context) {
 }
 
 type WebServerConfig struct {
-	Port  int    `mapstructure:"port"`
-	Token string `mapstructure:"token"`
+	Port              int      `mapstructure:"port"`
+	Token             string   `mapstructure:"token"`
+	BasicAuthUser     string   `mapstructure:"basicAuthUser"`
+	BasicAuthPassword string   `mapstructure:"basicAuthPassword"`
+	AllowedNetworks   []string `mapstructure:"allowedNetworks"`
+	// TrustedProxies are the addresses whose X-Forwarded-For header tells the client address, empty trusts none
+	TrustedProxies []string `mapstructure:"trustedProxies"`
 }
 
 func NewWebServer(config WebServerConfig, scheduler scheduler.Scheduler) *WebServer {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
 
+	allowedNetworks, err := helper.ParseNetworks(config.AllowedNetworks)
+	if err != nil {
+		log.Panic(err)
+	}
+	// gin trusts the forwarded headers of any client by default, which would let them pick their address
+	var trustedProxies []string
+	if len(config.TrustedProxies) > 0 {
+		trustedProxies = config.TrustedProxies
+	}
+	if err = r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Panicf("invalid trusted proxies: %v", err)
+	}
+
 	webServer := &WebServer{
 		WebServerConfig: config,
 		scheduler:       scheduler,
 		router:          r,
+		allowedNetworks: allowedNetworks,
 	}
 
 	r.GET("/-/healthy", func(c *gin.Context) {
@@ -262,6 +411,9 @@ func NewWebServer(config WebServerConfig, scheduler scheduler.Scheduler) *WebSer
 		c.Status(http.StatusOK)
 	})
 
+	// health checks are registered before, so they are never restricted
+	r.Use(webServer.AllowedNetworksMiddleware())
+
 	api := r.Group("/api/v1")
 	api.GET("/job/", webServer.AuthHeaderFunc(webServer.getJobs))
 	api.POST("/job/", webServer.AuthHeaderFunc(webServer.addJob))
@@ -271,9 +423,14 @@ func NewWebServer(config WebServerConfig, scheduler scheduler.Scheduler) *WebSer
 	api.GET("/job/:id/checksum", webServer.checksum)
 	api.POST("/job/:id/upload", webServer.upload)
 
+	api.POST("/batch/", webServer.AuthHeaderFunc(webServer.addBatch))
+	api.GET("/batch/:id", webServer.AuthHeaderFunc(webServer.getBatchByID))
+	api.POST("/purge/", webServer.AuthHeaderFunc(webServer.purgeJobs))
 	api.GET("/workers/", webServer.AuthHeaderFunc(webServer.getWorkers))
+	api.GET("/stats/savings", webServer.AuthHeaderFunc(webServer.getSpaceSavings))
 
 	r.GET("/ws/job", webServer.AuthParamFunc(webServer.getJobsUpdates))
+	r.GET("/events", webServer.AuthParamFunc(webServer.getEvents))
 	ui.AddRoutes(r)
 
 	return webServer
@@ -318,6 +475,17 @@ func (w *WebServer) AuthHeaderFunc(handler gin.HandlerFunc) gin.HandlerFunc {
 		}
 
 		const bearerPrefix = "Bearer "
+		if w.isBasicAuthEnabled() {
+			if user, password, ok := c.Request.BasicAuth(); ok {
+				if !w.validBasicAuth(user, password) {
+					c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid credentials"})
+					return
+				}
+				handler(c)
+				return
+			}
+		}
+
 		if !strings.HasPrefix(authHeader, bearerPrefix) {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid Authorization header format"})
 			return
@@ -325,7 +493,7 @@ func (w *WebServer) AuthHeaderFunc(handler gin.HandlerFunc) gin.HandlerFunc {
 
 		t := strings.TrimPrefix(authHeader, bearerPrefix)
 
-		if t != w.Token {
+		if t == "" || !secureCompare(t, w.Token) {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: Invalid token"})
 			return
 		}
@@ -334,11 +502,57 @@ func (w *WebServer) AuthHeaderFunc(handler gin.HandlerFunc) gin.HandlerFunc {
 	}
 }
 
+func (w *WebServer) isBasicAuthEnabled() bool {
+	return w.BasicAuthUser != "" && w.BasicAuthPassword != ""
+}
+
+func (w *WebServer) validBasicAuth(user string, password string) bool {
+	return secureCompare(user, w.BasicAuthUser) && secureCompare(password, w.BasicAuthPassword)
+}
+
+// AllowedNetworksMiddleware rejects requests from clients outside AllowedNetworks. Workers download and
+// upload through this server too, so their networks must be allowed as well.
+func (w *WebServer) AllowedNetworksMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(w.allowedNetworks) == 0 {
+			c.Next()
+			return
+		}
+		// without trusted proxies the address is the one of the connection, a client can't forge it with headers
+		clientIP := net.ParseIP(c.RemoteIP())
+		if len(w.TrustedProxies) > 0 {
+			clientIP = net.ParseIP(c.ClientIP())
+		}
+		if helper.NetworksContain(w.allowedNetworks, clientIP) {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden: client address not allowed"})
+	}
+}
+
+func secureCompare(given string, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+// AuthParamFunc authorizes the event streams with the token query parameter, browsers can't set a bearer token on
+// websockets or server-sent events. The basic auth credentials a browser sends on its own are accepted too.
 func (w *WebServer) AuthParamFunc(handler gin.HandlerFunc) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if w.isBasicAuthEnabled() {
+			if user, password, ok := c.Request.BasicAuth(); ok {
+				if !w.validBasicAuth(user, password) {
+					c.AbortWithStatus(http.StatusUnauthorized)
+					return
+				}
+				handler(c)
+				return
+			}
+		}
+
 		token := c.Query("token")
 
-		if token == "" || token != w.Token {
+		if token == "" || !secureCompare(token, w.Token) {
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
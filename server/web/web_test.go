@@ -0,0 +1,56 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func authRequest(t *testing.T, auth func(gin.HandlerFunc) gin.HandlerFunc, request *http.Request) int {
+	t.Helper()
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.GET("/", auth(func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestAuthParamFuncAcceptsTheTokenOrBasicAuth(t *testing.T) {
+	w := &WebServer{WebServerConfig: WebServerConfig{Token: "secret", BasicAuthUser: "admin", BasicAuthPassword: "password"}}
+	basic := func(user string, password string) *http.Request {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.SetBasicAuth(user, password)
+		return request
+	}
+	tests := map[string]struct {
+		request  *http.Request
+		expected int
+	}{
+		"token":          {httptest.NewRequest(http.MethodGet, "/?token=secret", nil), http.StatusOK},
+		"wrong token":    {httptest.NewRequest(http.MethodGet, "/?token=other", nil), http.StatusUnauthorized},
+		"no credentials": {httptest.NewRequest(http.MethodGet, "/", nil), http.StatusUnauthorized},
+		"basic auth":     {basic("admin", "password"), http.StatusOK},
+		"wrong password": {basic("admin", "other"), http.StatusUnauthorized},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if code := authRequest(t, w.AuthParamFunc, test.request); code != test.expected {
+				t.Fatalf("status %d, expected %d", code, test.expected)
+			}
+		})
+	}
+}
+
+func TestAuthHeaderFuncRejectsAnEmptyBearerToken(t *testing.T) {
+	w := &WebServer{WebServerConfig: WebServerConfig{}}
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Authorization", "Bearer ")
+	if code := authRequest(t, w.AuthHeaderFunc, request); code != http.StatusUnauthorized {
+		t.Fatalf("status %d, an empty token must never match", code)
+	}
+}
@@ -6,24 +6,30 @@ import (
 	"gearr/broker"
 	"gearr/cmd"
 	"gearr/helper"
+	"gearr/model"
 	"gearr/worker/task"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	pflag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"gopkg.in/vansante/go-ffprobe.v2"
 )
 
 type CmdLineOpts struct {
-	Broker   broker.Config `mapstructure:"broker"`
-	Worker   task.Config   `mapstructure:"worker"`
-	LogLevel string        `mapstructure:"log-level"`
+	Broker             broker.Config `mapstructure:"broker"`
+	Worker             task.Config   `mapstructure:"worker"`
+	LogLevel           string        `mapstructure:"log-level"`
+	Plan               string        `mapstructure:"plan"`
+	PlanQualityProfile string        `mapstructure:"plan-quality-profile"`
 }
 
 var (
@@ -40,18 +46,115 @@ func init() {
 
 	cmd.BrokerFlags()
 	cmd.LogLevelFlags()
+	pflag.String("plan-quality-profile", "", "Quality profile used by --plan")
+	pflag.String("plan", "", "Print the streams and the ffmpeg command the worker would use for this source file, then exit without encoding")
 	pflag.String("worker.temporalPath", os.TempDir(), "Path used for temporal data")
+	pflag.StringSlice("worker.workDirRoots", []string{}, "Directories jobs can ask to place their work directory in instead of the temporal path, like a bigger volume")
 	pflag.String("worker.name", hostname, "Worker Name used for statistics")
+	pflag.String("worker.nameSuffix", "none", "Suffix added to the worker name to make it unique: none, pid or random")
 	pflag.Int("worker.threads", runtime.NumCPU(), "Worker Threads")
 	pflag.StringSlice("worker.acceptedJobs", []string{"encode"}, "type of jobs this Worker will accept: encode,pgstosrt")
+	pflag.String("worker.jobSource", task.JobSourceBroker, "Where the encode jobs come from: broker, directory or both. directory reads the job files of worker.jobDirectory")
+	pflag.String("worker.jobDirectory", "", "Directory watched for encode job files, JSON documents like the broker messages")
+	pflag.String("worker.consoleMode", task.ConsoleModeAuto, "How the progress is printed: interactive progress bars, plain log lines or auto, plain when the output is not a terminal")
+	pflag.Duration("worker.consoleProgressInterval", time.Minute, "Interval between the progress lines of every task in plain console mode, 0 only logs when the tasks end")
 	pflag.Int("worker.maxPrefetchJobs", 1, "Maximum number of jobs to prefetch")
+	pflag.Int("worker.encodeQueueHighWatermark", 0, "Pause downloads while this many downloaded jobs wait to be encoded, 0 disables it")
+	pflag.Int("worker.encodeQueueLowWatermark", 0, "Resume paused downloads once the downloaded jobs waiting to be encoded drop to this many")
 	pflag.Int("worker.encodeJobs", 1, "Worker Encode Jobs in parallel")
 	pflag.Int("worker.pgsJobs", 0, "Worker PGS Jobs in parallel")
 	pflag.String("worker.dotnetPath", "/usr/bin/dotnet", "dotnet path")
 	pflag.String("worker.pgsToSrtDLLPath", "/app/PgsToSrt.dll", "PGSToSrt.dll path")
 	pflag.String("worker.tesseractDataPath", "/tessdata", "tesseract data path (https://github.com/tesseract-ocr/tessdata/)")
+	pflag.Duration("worker.pgsTimeout", time.Minute*90, "Maximum time to wait for the PGS to SRT conversion of a job, 0 waits forever")
+	pflag.Duration("worker.pgsTimeoutPerTrack", 0, "Time to wait for the PGS to SRT conversion for every image subtitle of a job, capped by worker.pgsTimeout. 0 uses worker.pgsTimeout alone")
+	pflag.Duration("worker.pgsTimeoutPerMB", 0, "Time to wait for the PGS to SRT conversion for every MB of image subtitles of a job, capped by worker.pgsTimeout. 0 uses worker.pgsTimeout alone")
+	pflag.Duration("worker.pgsPickupTimeout", time.Minute*10, "Consider no PGS worker is available when the PGS queue does not shrink for X minutes, 0 disables it")
+	pflag.String("worker.pgsUnavailableAction", task.PGSUnavailableActionFail, "Action when no PGS worker is available: fail,drop. drop encodes the video without its image subtitles")
+	pflag.Int("worker.pgsRetries", 2, "Times a subtitle is sent again to the PGS workers after they fail to convert it, 0 disables the retries")
+	pflag.Duration("worker.pgsRetryDelay", time.Second*30, "Wait before the first retry of a failed PGS conversion, doubled on every retry")
+	pflag.Duration("worker.pgsRetryMaxDelay", time.Minute*5, "Maximum wait between the retries of a failed PGS conversion, 0 leaves it uncapped")
+	pflag.String("worker.pgsFailureAction", task.PGSFailureActionFail, "Action when a subtitle still fails to convert after worker.pgsRetries: fail,drop. drop encodes the video without that subtitle")
+	pflag.Bool("worker.globalHeader", true, "Add -flags +global_header to the encoded output")
+	pflag.Int("worker.maxInterleaveDelta", 0, "ffmpeg -max_interleave_delta of the encoded output in microseconds, -1 uses the ffmpeg default")
+	pflag.Bool("worker.faststart", false, "Add -movflags +faststart to mp4 outputs so they can be played while downloading")
+	pflag.Bool("worker.mkvCuesToFront", false, "Write the seek index of mkv outputs at the start of the file so players seek without reading its end")
+	pflag.Duration("worker.mkvClusterTimeLimit", 0, "Maximum duration of the clusters of mkv outputs, shorter clusters seek more precisely, 0 uses the ffmpeg default")
+	pflag.Float64("worker.progressStep", 10, "Notify the encode progress every X percent")
+	pflag.Duration("worker.progressInterval", 0, "Minimum time between encode progress notifications, 0 disables it")
+	pflag.Duration("worker.taskStatusSyncInterval", 0, "Write progress updates of the task status files to disk at most every X seconds, 0 writes every update")
+	pflag.String("worker.outputFileTemplate", "{basename}-encoded", "Name of the encoded file without extension, tokens: {basename},{codec},{crf},{resolution},{id}")
+	pflag.String("worker.dynamicHDRAction", "warn", "Action when the source has Dolby Vision or HDR10+ metadata, which is not preserved: warn or fail")
+	pflag.String("worker.noAudioAction", "keep", "Action when the source has no audio streams: keep it without audio, add a silent track or fail")
+	pflag.Bool("worker.remuxIfAlreadyTarget", false, "Copy the video stream instead of encoding it when the source is already HEVC Main 10 up to 1920 wide")
+	pflag.Bool("worker.copyAttachments", false, "Copy attachments, like subtitle fonts, to mkv outputs")
+	pflag.Bool("worker.copyCoverArt", false, "Copy the cover art pictures of the source, stored as attached picture video streams")
+	pflag.Bool("worker.preserveMetadata", true, "Keep the container tags of the source, like its title, in the output")
+	pflag.Int("worker.encodeSegments", 1, "Split the video in X segments encoded at the same time, 1 encodes it in a single pass")
+	pflag.Duration("worker.analyzeDuration", 0, "How much of the source ffprobe and ffmpeg analyze to find its streams, 0 uses the ffmpeg default")
+	pflag.Int64("worker.probeSize", 0, "Bytes of the source ffprobe and ffmpeg read to find its streams, 0 uses the ffmpeg default")
+	pflag.StringSlice("worker.inputOptions", []string{}, "ffmpeg options placed before the -i of the source, like -fflags,+genpts")
+	pflag.String("worker.hwDecode", task.HWDecodeNone, "Hardware decoder of the source video: cuda,qsv,vaapi, empty decodes it on the CPU. Independent of the video encoder")
+	pflag.String("worker.hwDecodeDevice", "", "Device of worker.hwDecode, like /dev/dri/renderD128 for vaapi or the GPU index for cuda")
+	pflag.String("worker.rotationAction", task.RotationActionTranspose, "Handling of rotated videos, like phone recordings: transpose,ignore. transpose turns the frames upright in the encode, ignore leaves it to ffmpeg")
+	pflag.StringSlice("worker.ffmpegWarningPatterns", task.DefaultFFmpegWarningPatterns, "Regular expressions matched against the ffmpeg output of encodes that exit fine, to detect likely broken encodes")
+	pflag.String("worker.ffmpegWarningAction", task.FFmpegWarningActionWarn, "Action when the ffmpeg output of an encode matches ffmpegWarningPatterns: ignore, warn or fail")
+	pflag.Bool("worker.durationCheck", true, "Fail the job when the encoded duration differs from the source")
+	pflag.Duration("worker.durationTolerance", time.Minute, "Maximum difference between the source and encoded durations")
+	pflag.Float64("worker.durationTolerancePercent", 0, "Maximum difference between the source and encoded durations as percentage of the source duration, overrides durationTolerance")
+	pflag.Duration("worker.maxEncodeDuration", 0, "Maximum time a single job can spend encoding before it fails, 0 disables it")
+	pflag.String("worker.netrcFile", "", "netrc file with the credentials of the sftp and smb hosts")
+	pflag.String("worker.sshKeyFile", "", "Private key used to authenticate on sftp hosts")
+	pflag.String("worker.incompatibleSubtitleAction", task.IncompatibleSubtitleActionConvert, "Action for subtitles the output container can not hold: drop,convert. convert turns text subtitles into a supported codec and drops the rest")
+	pflag.Bool("worker.loudnorm", false, "Normalize the loudness of the audio streams to EBU R128 with a two pass loudnorm filter")
+	pflag.Float64("worker.loudnormTarget", -23, "Integrated loudness target of the loudness normalization in LUFS")
+	pflag.Float64("worker.loudnormTruePeak", -1, "Maximum true peak of the loudness normalization in dBTP")
+	pflag.Float64("worker.loudnormRange", 7, "Loudness range target of the loudness normalization in LU")
+	pflag.Bool("worker.mobileCompatAudio", false, "Add an AAC stereo copy of the main audio track as the first and default one, for phones")
+	pflag.String("worker.ffmpegPath", "", "ffmpeg binary used instead of the one found in the PATH")
+	pflag.String("worker.ffprobePath", "", "ffprobe binary used instead of the one found in the PATH")
+	pflag.String("worker.mkvExtractPath", "", "mkvextract binary used instead of the one found in the PATH")
+	pflag.Bool("worker.binaryLibraryPath", true, "Point LD_LIBRARY_PATH to the directory of the ffmpeg and mkvextract binaries given by absolute path, disable it for binaries linked against the system libraries")
+	pflag.String("worker.postProcessCommand", "", "Command run after a job is uploaded, the job details are passed as GEARR_* environment variables")
+	pflag.Duration("worker.postProcessTimeout", time.Minute*5, "Maximum time the post process command can run, 0 waits forever")
+	pflag.Bool("worker.postProcessFailJob", false, "Fail the job when the post process command fails instead of only logging it")
+	pflag.Duration("worker.cleanupDelay", 0, "Time the work directory of a completed job is kept before it is removed, 0 removes it right away")
+	pflag.Int("worker.downloadMaxRedirects", 10, "Maximum number of redirects followed by the download, checksum and upload requests")
+	pflag.StringSlice("worker.allowedHosts", []string{}, "Hosts, *.domain wildcards, IPs or CIDRs the download, checksum and upload URLs of the jobs may target, empty allows all")
+	pflag.StringSlice("worker.deniedHosts", []string{}, "Hosts, *.domain wildcards, IPs or CIDRs the download, checksum and upload URLs of the jobs may not target, they win over worker.allowedHosts")
+	pflag.Bool("worker.preserveModTime", false, "Give the encoded file the modification time of the source instead of the encode time")
+	pflag.Bool("worker.downloadResume", true, "Resume interrupted source downloads with range requests")
+	pflag.String("worker.retryJitter", task.RetryJitterSmall, "Random spread of the download, checksum and upload retry waits: none, small, full or decorrelated")
+	pflag.Int("worker.checksumMismatchRetries", 2, "Times a complete download is retried when its checksum doesn't match before failing the job")
+	pflag.Int("worker.checksumJobs", 0, "Checksums of whole files computed at the same time, like the encoded files before their upload, 0 is unlimited")
+	pflag.Int("worker.ffmpegJobs", 0, "ffmpeg processes run at the same time by every phase of every job, encodes first, 0 is unlimited")
+	pflag.Int("worker.downloadJobs", 1, "Sources downloaded at the same time")
+	pflag.Int("worker.maxHostDownloads", 0, "Sources downloaded at the same time from a single host, 0 is only bounded by worker.downloadJobs")
+	pflag.Bool("worker.requireSourceChecksum", false, "Fail the jobs without a source checksum or checksum URL instead of skipping the source verification")
+	pflag.Int64("worker.minSourceSize", 0, "Bytes below which a source is not encoded, 0 accepts any size")
+	pflag.String("worker.smallSourceAction", task.SmallSourceActionFail, "Action for sources smaller than worker.minSourceSize: fail the job or skip it keeping the source")
+	pflag.String("worker.subtitleSelection", task.SubtitleSelectionAll, "Subtitles kept per language, besides forced and comment ones: all, first or smallest")
+	pflag.String("worker.subtitleSDH", task.SubtitleSDHKeep, "SDH subtitles handling: keep, avoid (prefer other subtitles of the same language) or drop")
+	pflag.String("worker.titleSanitization", task.TitleSanitizationReplace, "How quotes of stream titles are cleaned before they are written to the encoded file: replace, strip or none")
+	pflag.String("worker.noBenefitAction", task.NoBenefitActionFail, "Action when the encode of a source already in the target codec is bigger than the source: fail the job or keep the source")
+	pflag.String("worker.benefitCheck", task.BenefitCheckSize, "How an encode is judged worth keeping: size compares the whole files, videoBitrate only the video streams")
+	pflag.Float64("worker.minVideoReduction", 0, "Percent the video bitrate must shrink by with worker.benefitCheck videoBitrate, 0 only requires it to shrink")
+	pflag.Bool("worker.forcedSubtitleDefault", false, "Make the forced subtitle in the language of the default audio the default subtitle")
+	pflag.Bool("worker.deepVerify", false, "Decode the whole encoded file to detect corruption before uploading it, a full decode pass")
+	pflag.StringSlice("worker.preferredLanguages", []string{}, "Languages kept first when the audio or subtitle tracks are limited, in order of preference")
+	pflag.Int("worker.maxAudioTracks", 0, "Maximum audio tracks in the encoded file, 0 is unlimited")
+	pflag.Int("worker.maxSubtitleTracks", 0, "Maximum subtitle tracks in the encoded file, 0 is unlimited")
+	pflag.StringSlice("worker.requiredAudioLanguages", []string{}, "Audio languages every encoded file must have, jobs whose selected audio lacks one fail")
+	pflag.StringSlice("worker.requiredSubtitleLanguages", []string{}, "Subtitle languages every encoded file must have, jobs whose selected subtitles lack one fail")
 	pflag.Var(&opts.Worker.StartAfter, "worker.startAfter", "Accept jobs only After HH:mm")
 	pflag.Var(&opts.Worker.StopAfter, "worker.stopAfter", "Stop Accepting new Jobs after HH:mm")
+	pflag.Var(&opts.Worker.CRFBitrateRules, "worker.crfBitrateRules", "CRF by source video bitrate as <max bitrate>:<crf> list, like 2M:32,5M:30")
+	pflag.Float64("worker.vmafMinScore", 0, "Minimum VMAF score of the encoded video, 0 disables the VMAF check")
+	pflag.String("worker.vmafAction", task.VMAFActionWarn, "Action when the VMAF score is below vmafMinScore: warn,fail")
+	pflag.Bool("worker.closedCaptions", false, "Extract the EIA-608/708 closed captions embedded in the video stream to a subtitle track, decoding the video once more")
+	pflag.String("worker.subtitleExtractor", task.SubtitleExtractorAuto, "Tool used to extract image subtitles: auto,mkvextract,ffmpeg. auto uses mkvextract for mkv sources and ffmpeg otherwise")
+	pflag.Duration("worker.subtitleExtractTimeout", time.Hour*2, "Maximum time the extraction of the image subtitles of a job can take before it fails, 0 disables it")
+	pflag.Duration("worker.vmafSampleDuration", time.Minute, "Duration of the video sample compared by the VMAF check, 0 compares the whole video")
 
 	pflag.Usage = usage
 
@@ -83,6 +186,12 @@ func init() {
 		if target == reflect.TypeOf(timeHourMinute) {
 			timeHourMinute.Set(data.(string))
 			return timeHourMinute, nil
+		} else if target == reflect.TypeOf(time.Duration(5)) {
+			return time.ParseDuration(data.(string))
+		} else if target == reflect.TypeOf(task.CRFBitrateRules{}) {
+			crfBitrateRules := task.CRFBitrateRules{}
+			err := crfBitrateRules.Set(data.(string))
+			return crfBitrateRules, err
 		}
 		return data, nil
 	})
@@ -90,6 +199,161 @@ func init() {
 	if err != nil {
 		log.Panic(err)
 	}
+	if opts.Worker.EncodeQueueHighWatermark > 0 && (opts.Worker.EncodeQueueLowWatermark < 0 || opts.Worker.EncodeQueueLowWatermark >= opts.Worker.EncodeQueueHighWatermark) {
+		log.Panicf("invalid worker.encodeQueueLowWatermark %d, must be between 0 and worker.encodeQueueHighWatermark %d", opts.Worker.EncodeQueueLowWatermark, opts.Worker.EncodeQueueHighWatermark)
+	}
+	if opts.Worker.VMAFAction != task.VMAFActionWarn && opts.Worker.VMAFAction != task.VMAFActionFail {
+		log.Panicf("invalid worker.vmafAction %s, must be %s or %s", opts.Worker.VMAFAction, task.VMAFActionWarn, task.VMAFActionFail)
+	}
+	if opts.Worker.PGSUnavailableAction != task.PGSUnavailableActionFail && opts.Worker.PGSUnavailableAction != task.PGSUnavailableActionDrop {
+		log.Panicf("invalid worker.pgsUnavailableAction %s, must be %s or %s", opts.Worker.PGSUnavailableAction, task.PGSUnavailableActionFail, task.PGSUnavailableActionDrop)
+	}
+	if opts.Worker.ConsoleMode != task.ConsoleModeAuto && opts.Worker.ConsoleMode != task.ConsoleModeInteractive && opts.Worker.ConsoleMode != task.ConsoleModePlain {
+		log.Panicf("invalid worker.consoleMode %s, must be %s, %s or %s", opts.Worker.ConsoleMode, task.ConsoleModeAuto, task.ConsoleModeInteractive, task.ConsoleModePlain)
+	}
+	if opts.Worker.PGSRetries < 0 {
+		log.Panicf("invalid worker.pgsRetries %d, must be 0 or more", opts.Worker.PGSRetries)
+	}
+	if opts.Worker.PGSFailureAction != task.PGSFailureActionFail && opts.Worker.PGSFailureAction != task.PGSFailureActionDrop {
+		log.Panicf("invalid worker.pgsFailureAction %s, must be %s or %s", opts.Worker.PGSFailureAction, task.PGSFailureActionFail, task.PGSFailureActionDrop)
+	}
+	if opts.Worker.RotationAction != task.RotationActionTranspose && opts.Worker.RotationAction != task.RotationActionIgnore {
+		log.Panicf("invalid worker.rotationAction %s, must be %s or %s", opts.Worker.RotationAction, task.RotationActionTranspose, task.RotationActionIgnore)
+	}
+	switch opts.Worker.HWDecode {
+	case task.HWDecodeNone, task.HWDecodeCUDA, task.HWDecodeQSV, task.HWDecodeVAAPI:
+	default:
+		log.Panicf("invalid worker.hwDecode %s, must be empty, %s, %s or %s", opts.Worker.HWDecode, task.HWDecodeCUDA, task.HWDecodeQSV, task.HWDecodeVAAPI)
+	}
+	if opts.Worker.DynamicHDRAction != task.DynamicHDRActionWarn && opts.Worker.DynamicHDRAction != task.DynamicHDRActionFail {
+		log.Panicf("invalid worker.dynamicHDRAction %s, must be %s or %s", opts.Worker.DynamicHDRAction, task.DynamicHDRActionWarn, task.DynamicHDRActionFail)
+	}
+	if opts.Worker.IncompatibleSubtitleAction != task.IncompatibleSubtitleActionDrop && opts.Worker.IncompatibleSubtitleAction != task.IncompatibleSubtitleActionConvert {
+		log.Panicf("invalid worker.incompatibleSubtitleAction %s, must be %s or %s", opts.Worker.IncompatibleSubtitleAction, task.IncompatibleSubtitleActionDrop, task.IncompatibleSubtitleActionConvert)
+	}
+	if opts.Worker.LoudnormTarget < -70 || opts.Worker.LoudnormTarget > -5 {
+		log.Panicf("invalid worker.loudnormTarget %.1f, must be between -70 and -5", opts.Worker.LoudnormTarget)
+	}
+	if opts.Worker.LoudnormTruePeak < -9 || opts.Worker.LoudnormTruePeak > 0 {
+		log.Panicf("invalid worker.loudnormTruePeak %.1f, must be between -9 and 0", opts.Worker.LoudnormTruePeak)
+	}
+	if opts.Worker.LoudnormRange < 1 || opts.Worker.LoudnormRange > 50 {
+		log.Panicf("invalid worker.loudnormRange %.1f, must be between 1 and 50", opts.Worker.LoudnormRange)
+	}
+	if opts.Worker.EncodeSegments < 1 {
+		log.Panicf("invalid worker.encodeSegments %d, must be 1 or more", opts.Worker.EncodeSegments)
+	}
+	switch opts.Worker.SubtitleSelection {
+	case task.SubtitleSelectionAll, task.SubtitleSelectionFirst, task.SubtitleSelectionSmallest:
+	default:
+		log.Panicf("invalid worker.subtitleSelection %s, must be %s, %s or %s", opts.Worker.SubtitleSelection, task.SubtitleSelectionAll, task.SubtitleSelectionFirst, task.SubtitleSelectionSmallest)
+	}
+	switch opts.Worker.SubtitleSDH {
+	case task.SubtitleSDHKeep, task.SubtitleSDHAvoid, task.SubtitleSDHDrop:
+	default:
+		log.Panicf("invalid worker.subtitleSDH %s, must be %s, %s or %s", opts.Worker.SubtitleSDH, task.SubtitleSDHKeep, task.SubtitleSDHAvoid, task.SubtitleSDHDrop)
+	}
+	if opts.Worker.TitleSanitization != task.TitleSanitizationReplace && opts.Worker.TitleSanitization != task.TitleSanitizationStrip && opts.Worker.TitleSanitization != task.TitleSanitizationNone {
+		log.Panicf("invalid worker.titleSanitization %s, must be %s, %s or %s", opts.Worker.TitleSanitization, task.TitleSanitizationReplace, task.TitleSanitizationStrip, task.TitleSanitizationNone)
+	}
+	if opts.Worker.NoBenefitAction != task.NoBenefitActionFail && opts.Worker.NoBenefitAction != task.NoBenefitActionKeep {
+		log.Panicf("invalid worker.noBenefitAction %s, must be %s or %s", opts.Worker.NoBenefitAction, task.NoBenefitActionFail, task.NoBenefitActionKeep)
+	}
+	if opts.Worker.BenefitCheck != task.BenefitCheckSize && opts.Worker.BenefitCheck != task.BenefitCheckVideoBitrate {
+		log.Panicf("invalid worker.benefitCheck %s, must be %s or %s", opts.Worker.BenefitCheck, task.BenefitCheckSize, task.BenefitCheckVideoBitrate)
+	}
+	if opts.Worker.MinVideoReduction < 0 || opts.Worker.MinVideoReduction >= 100 {
+		log.Panicf("invalid worker.minVideoReduction %f, must be between 0 and 100", opts.Worker.MinVideoReduction)
+	}
+	if opts.Worker.MinSourceSize < 0 {
+		log.Panicf("invalid worker.minSourceSize %d, must not be negative", opts.Worker.MinSourceSize)
+	}
+	if opts.Worker.SmallSourceAction != task.SmallSourceActionFail && opts.Worker.SmallSourceAction != task.SmallSourceActionSkip {
+		log.Panicf("invalid worker.smallSourceAction %s, must be %s or %s", opts.Worker.SmallSourceAction, task.SmallSourceActionFail, task.SmallSourceActionSkip)
+	}
+	switch opts.Worker.NoAudioAction {
+	case task.NoAudioActionKeep, task.NoAudioActionSilent, task.NoAudioActionFail:
+	default:
+		log.Panicf("invalid worker.noAudioAction %s, must be %s, %s or %s", opts.Worker.NoAudioAction, task.NoAudioActionKeep, task.NoAudioActionSilent, task.NoAudioActionFail)
+	}
+	switch opts.Worker.RetryJitter {
+	case task.RetryJitterNone, task.RetryJitterSmall, task.RetryJitterFull, task.RetryJitterDecorrelated:
+	default:
+		log.Panicf("invalid worker.retryJitter %s, must be %s, %s, %s or %s", opts.Worker.RetryJitter, task.RetryJitterNone, task.RetryJitterSmall, task.RetryJitterFull, task.RetryJitterDecorrelated)
+	}
+	if opts.Worker.ChecksumMismatchRetries < 0 {
+		log.Panicf("invalid worker.checksumMismatchRetries %d, must not be negative", opts.Worker.ChecksumMismatchRetries)
+	}
+	switch opts.Worker.JobSource {
+	case task.JobSourceBroker:
+	case task.JobSourceDirectory, task.JobSourceBoth:
+		if opts.Worker.JobDirectory == "" {
+			log.Panicf("worker.jobDirectory is required with worker.jobSource %s", opts.Worker.JobSource)
+		}
+		if !opts.Worker.Jobs.IsAccepted(model.EncodeJobType) {
+			log.Panicf("worker.jobSource %s requires accepting %s jobs", opts.Worker.JobSource, model.EncodeJobType)
+		}
+		if opts.Worker.JobSource == task.JobSourceDirectory && opts.Worker.Jobs.IsAccepted(model.PGSToSrtJobType) {
+			log.Panicf("worker.jobSource %s can not accept %s jobs, they come from the broker", task.JobSourceDirectory, model.PGSToSrtJobType)
+		}
+	default:
+		log.Panicf("invalid worker.jobSource %s, must be %s, %s or %s", opts.Worker.JobSource, task.JobSourceBroker, task.JobSourceDirectory, task.JobSourceBoth)
+	}
+	if opts.Worker.ChecksumJobs < 0 {
+		log.Panicf("invalid worker.checksumJobs %d, must not be negative", opts.Worker.ChecksumJobs)
+	}
+	if opts.Worker.FFmpegJobs < 0 {
+		log.Panicf("invalid worker.ffmpegJobs %d, must not be negative", opts.Worker.FFmpegJobs)
+	}
+	if opts.Worker.DownloadJobs < 1 {
+		log.Panicf("invalid worker.downloadJobs %d, must be at least 1", opts.Worker.DownloadJobs)
+	}
+	if opts.Worker.MaxHostDownloads < 0 {
+		log.Panicf("invalid worker.maxHostDownloads %d, must not be negative", opts.Worker.MaxHostDownloads)
+	}
+	if opts.Worker.MaxAudioTracks < 0 || opts.Worker.MaxSubtitleTracks < 0 {
+		log.Panicf("invalid worker.maxAudioTracks %d or worker.maxSubtitleTracks %d, must not be negative", opts.Worker.MaxAudioTracks, opts.Worker.MaxSubtitleTracks)
+	}
+	if err = task.ValidateQualityProfiles(opts.Worker.QualityProfiles); err != nil {
+		log.Panic(err)
+	}
+	if err = task.ValidateInputOptions(opts.Worker.InputOptions); err != nil {
+		log.Panicf("worker.inputOptions: %v", err)
+	}
+	for _, warning := range task.InputOptionsWarnings(opts.Worker) {
+		log.Warn(warning)
+	}
+	switch opts.Worker.FFmpegWarningAction {
+	case task.FFmpegWarningActionIgnore, task.FFmpegWarningActionWarn, task.FFmpegWarningActionFail:
+	default:
+		log.Panicf("invalid worker.ffmpegWarningAction %s, must be %s, %s or %s", opts.Worker.FFmpegWarningAction, task.FFmpegWarningActionIgnore, task.FFmpegWarningActionWarn, task.FFmpegWarningActionFail)
+	}
+	if _, err = task.CompileFFmpegWarningPatterns(opts.Worker.FFmpegWarningPatterns); err != nil {
+		log.Panic(err)
+	}
+	if err = task.ValidateEncodePools(opts.Worker.EncodePools, opts.Worker.QualityProfiles); err != nil {
+		log.Panic(err)
+	}
+	if err = task.ValidateOutputFileTemplate(opts.Worker.OutputFileTemplate); err != nil {
+		log.Panic(err)
+	}
+	if err = task.ValidateWorkDirRoots(opts.Worker.WorkDirRoots); err != nil {
+		log.Panic(err)
+	}
+	switch opts.Worker.SubtitleExtractor {
+	case task.SubtitleExtractorAuto, task.SubtitleExtractorMKVExtract, task.SubtitleExtractorFFMPEG:
+	default:
+		log.Panicf("invalid worker.subtitleExtractor %s, must be %s, %s or %s", opts.Worker.SubtitleExtractor, task.SubtitleExtractorAuto, task.SubtitleExtractorMKVExtract, task.SubtitleExtractorFFMPEG)
+	}
+	switch opts.Worker.NameSuffix {
+	case task.NameSuffixNone:
+	case task.NameSuffixPID, task.NameSuffixRandom:
+		// every uniquely named worker gets its own temporal path, so workers sharing a config do not resume each other jobs
+		opts.Worker.Name = task.WorkerName(opts.Worker.Name, opts.Worker.NameSuffix)
+		opts.Worker.TemporalPath = filepath.Join(opts.Worker.TemporalPath, opts.Worker.Name)
+	default:
+		log.Panicf("invalid worker.nameSuffix %s, must be %s, %s or %s", opts.Worker.NameSuffix, task.NameSuffixNone, task.NameSuffixPID, task.NameSuffixRandom)
+	}
 }
 
 func usage() {
@@ -100,6 +364,24 @@ func usage() {
 
 func main() {
 	helper.SetLogLevel(opts.LogLevel)
+	helper.SetFFmpegPath(opts.Worker.FFmpegPath)
+	helper.SetFFProbePath(opts.Worker.FFProbePath)
+	helper.SetMKVExtractPath(opts.Worker.MKVExtractPath)
+	helper.SetBinaryLibraryPath(opts.Worker.BinaryLibraryPath)
+	ffprobe.SetFFProbeBinPath(helper.GetFFProbePath())
+	if opts.Worker.Jobs.IsAccepted(model.EncodeJobType) {
+		capabilities, err := task.DetectFFmpegCapabilities(context.Background())
+		if err != nil {
+			log.Panic(err)
+		}
+		log.Infof("ffmpeg %s, encoders: %s", capabilities.Version, strings.Join(capabilities.Encoders, ","))
+		log.Debugf("ffmpeg filters: %s", strings.Join(capabilities.Filters, ","))
+		log.Debugf("ffmpeg hwaccels: %s", strings.Join(capabilities.HWAccels, ","))
+		if err = task.ValidateFFmpegCapabilities(capabilities, opts.Worker); err != nil {
+			log.Panic(err)
+		}
+		opts.Worker.FFmpeg = capabilities
+	}
 	wg := &sync.WaitGroup{}
 	ctx, cancel := context.WithCancel(context.Background())
 	sigs := make(chan os.Signal, 1)
@@ -111,14 +393,35 @@ func main() {
 	}()
 	helper.ApplicationFileName = ApplicationFileName
 	log.Debugf("%+v", opts)
+	log.Infof("starting worker %s", opts.Worker.Name)
 
-	printer := task.NewConsoleWorkerPrinter()
+	printer := task.NewConsoleWorkerPrinter(task.PlainConsole(opts.Worker.ConsoleMode), opts.Worker.ConsoleProgressInterval)
+
+	if opts.Plan != "" {
+		plan, err := task.NewEncodeWorker(ctx, opts.Worker, opts.Worker.Name, printer).Plan(opts.Plan, opts.PlanQualityProfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Streams: %s\n", plan.Container.ToJson())
+		if plan.Segments {
+			fmt.Printf("Video encoded in %d segments, then muxed with:\n", opts.Worker.EncodeSegments)
+		}
+		fmt.Printf("FFMPEG Command: %s\n", plan.Command)
+		return
+	}
 
 	//BrokerClient System
-	broker := task.NewBrokerClientRabbit(opts.Broker, opts.Worker, printer)
-	broker.Run(wg, ctx)
+	var brokerClient *task.RabbitMQClient
+	if opts.Worker.JobSource != task.JobSourceDirectory {
+		brokerClient = task.NewBrokerClientRabbit(opts.Broker, opts.Worker, printer)
+		brokerClient.Run(wg, ctx)
+	}
+	var directoryQueue *task.DirectoryQueue
+	if opts.Worker.JobSource != task.JobSourceBroker {
+		directoryQueue = task.NewDirectoryQueue(opts.Worker.JobDirectory, printer)
+	}
 
-	worker := task.NewWorkerClient(opts.Worker, broker, printer)
+	worker := task.NewWorkerClient(opts.Worker, brokerClient, directoryQueue, printer)
 	worker.Run(wg, ctx)
 
 	wg.Wait()
@@ -0,0 +1,62 @@
+package task
+
+import (
+	"fmt"
+	"strconv"
+
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+const (
+	BenefitCheckSize         = "size"
+	BenefitCheckVideoBitrate = "videoBitrate"
+)
+
+// encodeBenefit returns why the encode brings nothing over the source, nil when it is worth keeping. The size check
+// compares the whole files. The videoBitrate check compares only the video streams, so upgrading the audio or adding
+// tracks doesn't hide a video that shrank, and requires the video to shrink by worker.minVideoReduction percent.
+// Copied videos didn't change, they are always judged on the size.
+func (c Config) encodeBenefit(source *ffprobe.ProbeData, sourceSize int64, encoded *ffprobe.ProbeData, encodedSize int64, videoCopied bool) error {
+	if c.BenefitCheck == BenefitCheckVideoBitrate && !videoCopied {
+		sourceBitrate := streamBitrate(mainVideoStream(source), source.Format)
+		encodedBitrate := streamBitrate(mainVideoStream(encoded), encoded.Format)
+		if sourceBitrate > 0 && encodedBitrate > 0 {
+			reduction := 100 * float64(sourceBitrate-encodedBitrate) / float64(sourceBitrate)
+			if reduction <= 0 || reduction < c.MinVideoReduction {
+				return fmt.Errorf("video bitrate went from %d to %d, a %.1f%% reduction, %.1f%% required", sourceBitrate, encodedBitrate, reduction, c.MinVideoReduction)
+			}
+			return nil
+		}
+		// without the bitrate of both video streams only the sizes can be compared
+	}
+	if encodedSize > sourceSize {
+		return fmt.Errorf("source file size %d bytes is less than encoded %d bytes", sourceSize, encodedSize)
+	}
+	return nil
+}
+
+// streamBitrate is the bitrate of a single stream, 0 when unknown. ffprobe reads it from the stream bit_rate most
+// containers store, like mp4, and from the statistics tags the matroska muxer writes for every stream: BPS or
+// NUMBER_OF_BYTES over the duration of the file. Unlike videoBitrate it never falls back to the bitrate of the whole
+// file, which includes the audio.
+func streamBitrate(stream *ffprobe.Stream, format *ffprobe.Format) int64 {
+	if stream == nil {
+		return 0
+	}
+	if bitrate, err := strconv.ParseInt(stream.BitRate, 10, 64); err == nil && bitrate > 0 {
+		return bitrate
+	}
+	if bps, err := stream.TagList.GetString("BPS"); err == nil {
+		if bitrate, err := strconv.ParseInt(bps, 10, 64); err == nil && bitrate > 0 {
+			return bitrate
+		}
+	}
+	if format != nil && format.DurationSeconds > 0 {
+		if numberOfBytes, err := stream.TagList.GetString("NUMBER_OF_BYTES"); err == nil {
+			if size, err := strconv.ParseInt(numberOfBytes, 10, 64); err == nil && size > 0 {
+				return int64(float64(size*8) / format.DurationSeconds)
+			}
+		}
+	}
+	return 0
+}
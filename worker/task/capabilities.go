@@ -0,0 +1,146 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"gearr/helper"
+	"gearr/helper/command"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	ffmpegVersionRegex = regexp.MustCompile(`ffmpeg version (\S+)`)
+	ffmpegEncoderRegex = regexp.MustCompile(`(?m)^\s[VAS][F.][S.][X.][B.][D.]\s+(\S+)`)
+	ffmpegFilterRegex  = regexp.MustCompile(`(?m)^\s[T.][S.][C.]\s+(\S+)\s+\S*->\S*`)
+)
+
+// FFmpegCapabilities are the version, encoders, filters and hardware decoders of the ffmpeg binary used by the worker.
+type FFmpegCapabilities struct {
+	Version  string
+	Encoders []string
+	Filters  []string
+	HWAccels []string
+}
+
+func (F *FFmpegCapabilities) hasEncoder(encoder string) bool {
+	return containsCodec(F.Encoders, encoder)
+}
+
+func (F *FFmpegCapabilities) hasFilter(filter string) bool {
+	return containsCodec(F.Filters, filter)
+}
+
+func (F *FFmpegCapabilities) hasHWAccel(hwAccel string) bool {
+	return containsCodec(F.HWAccels, hwAccel)
+}
+
+// DetectFFmpegCapabilities asks the ffmpeg binary for its version, encoders, filters and hardware decoders.
+func DetectFFmpegCapabilities(ctx context.Context) (*FFmpegCapabilities, error) {
+	version, err := ffmpegOutput(ctx, "-version")
+	if err != nil {
+		return nil, err
+	}
+	encoders, err := ffmpegOutput(ctx, "-encoders")
+	if err != nil {
+		return nil, err
+	}
+	filters, err := ffmpegOutput(ctx, "-filters")
+	if err != nil {
+		return nil, err
+	}
+	hwAccels, err := ffmpegOutput(ctx, "-hwaccels")
+	if err != nil {
+		return nil, err
+	}
+	capabilities := &FFmpegCapabilities{}
+	if match := ffmpegVersionRegex.FindStringSubmatch(version); match != nil {
+		capabilities.Version = match[1]
+	}
+	for _, match := range ffmpegEncoderRegex.FindAllStringSubmatch(encoders, -1) {
+		capabilities.Encoders = append(capabilities.Encoders, match[1])
+	}
+	for _, match := range ffmpegFilterRegex.FindAllStringSubmatch(filters, -1) {
+		capabilities.Filters = append(capabilities.Filters, match[1])
+	}
+	// the methods are listed one per line after a header line
+	for _, line := range strings.Split(hwAccels, "\n")[1:] {
+		if hwAccel := strings.TrimSpace(line); hwAccel != "" {
+			capabilities.HWAccels = append(capabilities.HWAccels, hwAccel)
+		}
+	}
+	sort.Strings(capabilities.Encoders)
+	sort.Strings(capabilities.Filters)
+	return capabilities, nil
+}
+
+func ffmpegOutput(ctx context.Context, option string) (string, error) {
+	output := ""
+	ffmpegCommand := command.NewCommand(helper.GetFFmpegPath(), "-hide_banner", option).
+		SetStdoutFunc(func(buffer []byte, exit bool) {
+			output += string(buffer)
+		}).
+		SetStderrFunc(func(buffer []byte, exit bool) {})
+	if libraryPathEnv := helper.LibraryPathEnv(helper.GetFFmpegPath()); libraryPathEnv != "" {
+		ffmpegCommand.AddEnv(libraryPathEnv)
+	}
+	exitCode, err := ffmpegCommand.RunWithContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error running %s %s: %w", helper.GetFFmpegPath(), option, err)
+	}
+	if exitCode != 0 {
+		return "", fmt.Errorf("error running %s %s: exit code %d", helper.GetFFmpegPath(), option, exitCode)
+	}
+	return output, nil
+}
+
+// ValidateFFmpegCapabilities checks the ffmpeg binary has every encoder, filter and hardware decoder the config can use, so a
+// misconfiguration fails when the worker starts instead of in the middle of an encode.
+func ValidateFFmpegCapabilities(capabilities *FFmpegCapabilities, config Config) error {
+	encoders := map[string]bool{}
+	profiles := []QualityProfile{defaultQualityProfile}
+	for _, profile := range config.QualityProfiles {
+		profiles = append(profiles, profile.withDefaults())
+	}
+	for _, profile := range profiles {
+		if !profile.audioOnly() {
+			encoders[profile.VideoCodec] = true
+		}
+		encoders[profile.AudioCodec] = true
+		// image subtitles are converted to the text subtitle codec of the container, webm always converts
+		if config.IncompatibleSubtitleAction == IncompatibleSubtitleActionConvert || profile.Container == ContainerWebM {
+			encoders[subtitleConvertCodecs[profile.Container]] = true
+		}
+	}
+	var missing []string
+	filters := map[string]bool{"scale": true}
+	if config.Loudnorm {
+		filters["loudnorm"] = true
+	}
+	if config.VMAFMinScore > 0 {
+		filters["libvmaf"] = true
+	}
+	if config.NoAudioAction == NoAudioActionSilent {
+		filters["anullsrc"] = true
+	}
+	if config.HWDecode != HWDecodeNone && !capabilities.hasHWAccel(config.HWDecode) {
+		missing = append(missing, fmt.Sprintf("hwaccel %s", config.HWDecode))
+	}
+
+	for encoder := range encoders {
+		if !capabilities.hasEncoder(encoder) {
+			missing = append(missing, fmt.Sprintf("encoder %s", encoder))
+		}
+	}
+	for filter := range filters {
+		if !capabilities.hasFilter(filter) {
+			missing = append(missing, fmt.Sprintf("filter %s", filter))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("%s %s lacks %s used by the worker config", helper.GetFFmpegPath(), capabilities.Version, strings.Join(missing, ", "))
+	}
+	return nil
+}
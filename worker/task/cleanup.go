@@ -0,0 +1,65 @@
+package task
+
+import (
+	"gearr/model"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cleanupMarkerFileName marks a work directory whose job finished and waits for worker.cleanupDelay to be removed, it
+// holds the time the directory can be removed.
+const cleanupMarkerFileName = ".cleanup"
+
+// cleanJob removes the work directory of a finished job, after worker.cleanupDelay when it is set so the downstream
+// tools can still pick up the files. The removal time is written to the directory so a restart doesn't lose it.
+func (J *EncodeWorker) cleanJob(job *model.WorkTaskEncode) {
+	if J.workerConfig.CleanupDelay <= 0 {
+		job.Clean()
+		return
+	}
+	cleanupTime := time.Now().Add(J.workerConfig.CleanupDelay)
+	if err := os.WriteFile(filepath.Join(job.WorkDir, cleanupMarkerFileName), []byte(cleanupTime.Format(time.RFC3339)), 0644); err != nil {
+		J.terminal.Warn("[%s] error marking the work directory for cleanup, removing it now: %v", job.TaskEncode.Id.String(), err)
+		job.Clean()
+		return
+	}
+	J.scheduleCleanup(job.WorkDir, cleanupTime)
+}
+
+func (J *EncodeWorker) scheduleCleanup(workDir string, cleanupTime time.Time) {
+	time.AfterFunc(time.Until(cleanupTime), func() {
+		if err := os.RemoveAll(workDir); err != nil {
+			J.terminal.Warn("error cleaning up %s: %v", workDir, err)
+		}
+	})
+}
+
+// resumeCleanups schedules again the removal of the work directories still waiting for worker.cleanupDelay, the ones
+// whose time passed while the worker was stopped are removed right away.
+func (J *EncodeWorker) resumeCleanups() {
+	var markers []string
+	for _, workPath := range J.workPaths() {
+		workPathMarkers, err := filepath.Glob(filepath.Join(workPath, "*", cleanupMarkerFileName))
+		if err != nil {
+			J.terminal.Warn("error resuming cleanups from %s: %v", workPath, err)
+			continue
+		}
+		markers = append(markers, workPathMarkers...)
+	}
+	for _, marker := range markers {
+		cleanupTime := time.Now()
+		if content, err := os.ReadFile(marker); err == nil {
+			if markerTime, err := time.Parse(time.RFC3339, string(content)); err == nil {
+				cleanupTime = markerTime
+			}
+		}
+		J.scheduleCleanup(filepath.Dir(marker), cleanupTime)
+	}
+}
+
+// isPendingCleanup reports whether the work directory belongs to a finished job waiting to be removed.
+func isPendingCleanup(workDir string) bool {
+	_, err := os.Stat(filepath.Join(workDir, cleanupMarkerFileName))
+	return err == nil
+}
@@ -0,0 +1,97 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"gearr/helper"
+	"gearr/helper/command"
+	"gearr/model"
+	"os"
+	"path/filepath"
+)
+
+// closedCaptionsFileName is the SRT the closed captions are extracted to, in the job work directory.
+const closedCaptionsFileName = "closed-captions.srt"
+
+type closedCaptionsProbe struct {
+	Streams []struct {
+		ClosedCaptions int `json:"closed_captions"`
+	} `json:"streams"`
+}
+
+// detectClosedCaptions reports whether the video stream carries EIA-608/708 captions, ffprobe finds them in the
+// frames of the first seconds.
+func (J *EncodeWorker) detectClosedCaptions(job *model.WorkTaskEncode, video *Video) (bool, error) {
+	arguments := append([]string{"-v", "error"}, J.probeOptions()...)
+	ffprobeCommand := command.NewCommand(helper.GetFFProbePath(), append(arguments, "-select_streams", fmt.Sprintf("%d", video.Id),
+		"-show_entries", "stream=index,closed_captions", "-of", "json", job.SourceFilePath)...)
+
+	ffprobeOutput := ""
+	ffprobeErrLog := ""
+	ffprobeCommand.SetWorkDir(job.WorkDir).
+		SetStdoutFunc(func(buffer []byte, exit bool) {
+			ffprobeOutput += string(buffer)
+		}).
+		SetStderrFunc(func(buffer []byte, exit bool) {
+			ffprobeErrLog += string(buffer)
+		})
+	exitCode, err := ffprobeCommand.RunWithContext(J.ctx)
+	if err != nil {
+		return false, fmt.Errorf("%w: stderr:%s", err, ffprobeErrLog)
+	}
+	if exitCode != 0 {
+		return false, fmt.Errorf("exit code %d: stderr:%s", exitCode, ffprobeErrLog)
+	}
+
+	probe := &closedCaptionsProbe{}
+	if err = json.Unmarshal([]byte(ffprobeOutput), probe); err != nil {
+		return false, fmt.Errorf("error parsing ffprobe output: %v", err)
+	}
+	for _, stream := range probe.Streams {
+		if stream.ClosedCaptions == 1 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// extractClosedCaptions decodes the closed captions embedded in the video stream to a SRT with the subcc output of
+// the movie source filter, which decodes the whole video stream. The SRT is added as a subtitle of the output.
+func (J *EncodeWorker) extractClosedCaptions(job *model.WorkTaskEncode, track *TaskTracks, container *ContainerData) error {
+	found, err := J.detectClosedCaptions(job, container.Video)
+	if err != nil || !found {
+		return err
+	}
+	track.Message("closed captions")
+	ffmpegErrLog := ""
+	// the source is named after the job id, its name needs no escaping in the filter graph
+	ffmpegCommand := newFFMPEGCommand(filepath.Dir(job.SourceFilePath), "-hide_banner", "-nostats", "-f", "lavfi",
+		"-i", fmt.Sprintf("movie=%s:si=%d[out0+subcc]", filepath.Base(job.SourceFilePath), container.Video.Id),
+		"-map", "0:s", "-c:s", "srt", "-y", filepath.Join(job.WorkDir, closedCaptionsFileName)).
+		SetStderrFunc(func(buffer []byte, exit bool) {
+			ffmpegErrLog += string(buffer)
+		})
+	J.terminal.Cmd("FFMPEG closed captions command:%s", ffmpegCommand.GetFullCommand())
+	exitCode, err := J.runFFmpeg(J.ctx, ffmpegCommand, ffmpegPriorityAuxiliary)
+	if err != nil {
+		return fmt.Errorf("%w: stderr:%s", err, ffmpegErrLog)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("exit code %d: stderr:%s", exitCode, ffmpegErrLog)
+	}
+	if stat, err := os.Stat(filepath.Join(job.WorkDir, closedCaptionsFileName)); err != nil || stat.Size() == 0 {
+		J.terminal.Warn("[%s] closed captions announced but none decoded", job.TaskEncode.Id.String())
+		return nil
+	}
+	// captions carry no language, they are in the language of the broadcast
+	container.Subtitle = append(container.Subtitle, &Subtitle{
+		Id:             container.Video.Id,
+		Language:       container.preferredAudioLanguage(),
+		Format:         "subrip",
+		Title:          "Closed Captions",
+		SDH:            true,
+		ClosedCaptions: true,
+	})
+	J.terminal.Log("[%s] closed captions extracted", job.TaskEncode.Id.String())
+	return nil
+}
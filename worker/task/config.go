@@ -3,8 +3,11 @@ package task
 import (
 	"fmt"
 	"gearr/model"
+	"math/rand"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/errgo.v2/errors"
@@ -54,21 +57,204 @@ func (t *TimeHourMinute) Set(value string) error {
 	return nil
 }
 
+const (
+	SubtitleExtractorAuto       = "auto"
+	SubtitleExtractorMKVExtract = "mkvextract"
+	SubtitleExtractorFFMPEG     = "ffmpeg"
+)
+
+const (
+	PGSUnavailableActionFail = "fail"
+	PGSUnavailableActionDrop = "drop"
+)
+
+const (
+	PGSFailureActionFail = "fail"
+	PGSFailureActionDrop = "drop"
+)
+
+const (
+	IncompatibleSubtitleActionDrop    = "drop"
+	IncompatibleSubtitleActionConvert = "convert"
+)
+
+const (
+	SubtitleSelectionAll      = "all"
+	SubtitleSelectionFirst    = "first"
+	SubtitleSelectionSmallest = "smallest"
+)
+
+const (
+	SubtitleSDHKeep  = "keep"
+	SubtitleSDHAvoid = "avoid"
+	SubtitleSDHDrop  = "drop"
+)
+
+const (
+	TitleSanitizationReplace = "replace"
+	TitleSanitizationStrip   = "strip"
+	TitleSanitizationNone    = "none"
+)
+
+const (
+	NoBenefitActionFail = "fail"
+	NoBenefitActionKeep = "keep"
+)
+
+const (
+	JobSourceBroker    = "broker"
+	JobSourceDirectory = "directory"
+	JobSourceBoth      = "both"
+)
+
+const (
+	SmallSourceActionFail = "fail"
+	SmallSourceActionSkip = "skip"
+)
+
+const (
+	NoAudioActionKeep   = "keep"
+	NoAudioActionSilent = "silent"
+	NoAudioActionFail   = "fail"
+)
+
+const (
+	NameSuffixNone   = "none"
+	NameSuffixPID    = "pid"
+	NameSuffixRandom = "random"
+)
+
+// WorkerName adds the configured suffix to the worker name, so several workers can share the same config and host.
+func WorkerName(name string, suffix string) string {
+	switch suffix {
+	case NameSuffixPID:
+		return fmt.Sprintf("%s-%d", name, os.Getpid())
+	case NameSuffixRandom:
+		return fmt.Sprintf("%s-%06x", name, rand.New(rand.NewSource(time.Now().UnixNano())).Intn(0xffffff))
+	}
+	return name
+}
+
 type Config struct {
-	UpdateMode        bool           `mapstructure:"updateMode"`
-	TemporalPath      string         `mapstructure:"temporalPath"`
-	Name              string         `mapstructure:"name"`
-	Threads           int            `mapstructure:"threads"`
-	MaxPrefetchJobs   int            `mapstructure:"maxPrefetchJobs"`
-	Jobs              AcceptedJobs   `mapstructure:"acceptedJobs"`
-	EncodeJobs        int            `mapstructure:"encodeJobs"`
-	PgsJobs           int            `mapstructure:"pgsJobs"`
-	StartAfter        TimeHourMinute `mapstructure:"startAfter"`
-	StopAfter         TimeHourMinute `mapstructure:"stopAfter"`
-	Paused            bool
-	PGSTOSrtDLLPath   string `mapstructure:"pgsToSrtDLLPath"`
-	TesseractDataPath string `mapstructure:"tesseractDataPath"`
-	DotnetPath        string `mapstructure:"dotnetPath"`
+	UpdateMode   bool   `mapstructure:"updateMode"`
+	TemporalPath string `mapstructure:"temporalPath"`
+	// WorkDirRoots are the directories jobs can ask for their work directory to be placed in, instead of the temp path
+	WorkDirRoots    []string `mapstructure:"workDirRoots"`
+	Name            string   `mapstructure:"name"`
+	NameSuffix      string   `mapstructure:"nameSuffix"`
+	Threads         int      `mapstructure:"threads"`
+	MaxPrefetchJobs int      `mapstructure:"maxPrefetchJobs"`
+	// EncodeQueueHighWatermark pauses the downloads while that many downloaded jobs wait to be encoded, 0 disables it
+	EncodeQueueHighWatermark int `mapstructure:"encodeQueueHighWatermark"`
+	// EncodeQueueLowWatermark resumes the paused downloads once the jobs waiting to be encoded drop to it
+	EncodeQueueLowWatermark int          `mapstructure:"encodeQueueLowWatermark"`
+	Jobs                    AcceptedJobs `mapstructure:"acceptedJobs"`
+	EncodeJobs              int          `mapstructure:"encodeJobs"`
+	// JobSource is where the encode jobs come from: the broker, the job files of JobDirectory or both
+	JobSource    string `mapstructure:"jobSource"`
+	JobDirectory string `mapstructure:"jobDirectory"`
+	// EncodePools are encode pools besides the default encodeJobs one, with their concurrency by pool name
+	EncodePools map[string]int `mapstructure:"encodePools"`
+	PgsJobs     int            `mapstructure:"pgsJobs"`
+	StartAfter  TimeHourMinute `mapstructure:"startAfter"`
+	StopAfter   TimeHourMinute `mapstructure:"stopAfter"`
+	Paused      bool
+	// ConsoleMode draws the progress bars in place or prints plain log lines, auto picks plain without a terminal
+	ConsoleMode             string        `mapstructure:"consoleMode"`
+	ConsoleProgressInterval time.Duration `mapstructure:"consoleProgressInterval"`
+	// FFmpeg are the capabilities of the ffmpeg binary, detected at startup by encode workers
+	FFmpeg                     *FFmpegCapabilities       `mapstructure:"-"`
+	PGSTOSrtDLLPath            string                    `mapstructure:"pgsToSrtDLLPath"`
+	TesseractDataPath          string                    `mapstructure:"tesseractDataPath"`
+	DotnetPath                 string                    `mapstructure:"dotnetPath"`
+	VMAFMinScore               float64                   `mapstructure:"vmafMinScore"`
+	VMAFAction                 string                    `mapstructure:"vmafAction"`
+	VMAFSampleDuration         time.Duration             `mapstructure:"vmafSampleDuration"`
+	SubtitleExtractor          string                    `mapstructure:"subtitleExtractor"`
+	SubtitleExtractTimeout     time.Duration             `mapstructure:"subtitleExtractTimeout"`
+	PGSTimeout                 time.Duration             `mapstructure:"pgsTimeout"`
+	PGSTimeoutPerTrack         time.Duration             `mapstructure:"pgsTimeoutPerTrack"`
+	PGSTimeoutPerMB            time.Duration             `mapstructure:"pgsTimeoutPerMB"`
+	PGSPickupTimeout           time.Duration             `mapstructure:"pgsPickupTimeout"`
+	PGSUnavailableAction       string                    `mapstructure:"pgsUnavailableAction"`
+	PGSRetries                 int                       `mapstructure:"pgsRetries"`
+	PGSRetryDelay              time.Duration             `mapstructure:"pgsRetryDelay"`
+	PGSRetryMaxDelay           time.Duration             `mapstructure:"pgsRetryMaxDelay"`
+	PGSFailureAction           string                    `mapstructure:"pgsFailureAction"`
+	GlobalHeader               bool                      `mapstructure:"globalHeader"`
+	MaxInterleaveDelta         int                       `mapstructure:"maxInterleaveDelta"`
+	Faststart                  bool                      `mapstructure:"faststart"`
+	MKVCuesToFront             bool                      `mapstructure:"mkvCuesToFront"`
+	MKVClusterTimeLimit        time.Duration             `mapstructure:"mkvClusterTimeLimit"`
+	ProgressStep               float64                   `mapstructure:"progressStep"`
+	ProgressInterval           time.Duration             `mapstructure:"progressInterval"`
+	TaskStatusSyncInterval     time.Duration             `mapstructure:"taskStatusSyncInterval"`
+	OutputFileTemplate         string                    `mapstructure:"outputFileTemplate"`
+	DynamicHDRAction           string                    `mapstructure:"dynamicHDRAction"`
+	NoAudioAction              string                    `mapstructure:"noAudioAction"`
+	RemuxIfAlreadyTarget       bool                      `mapstructure:"remuxIfAlreadyTarget"`
+	CopyAttachments            bool                      `mapstructure:"copyAttachments"`
+	CopyCoverArt               bool                      `mapstructure:"copyCoverArt"`
+	PreserveMetadata           bool                      `mapstructure:"preserveMetadata"`
+	EncodeSegments             int                       `mapstructure:"encodeSegments"`
+	AnalyzeDuration            time.Duration             `mapstructure:"analyzeDuration"`
+	ProbeSize                  int64                     `mapstructure:"probeSize"`
+	InputOptions               []string                  `mapstructure:"inputOptions"`
+	HWDecode                   string                    `mapstructure:"hwDecode"`
+	HWDecodeDevice             string                    `mapstructure:"hwDecodeDevice"`
+	RotationAction             string                    `mapstructure:"rotationAction"`
+	AllowedHosts               []string                  `mapstructure:"allowedHosts"`
+	DeniedHosts                []string                  `mapstructure:"deniedHosts"`
+	PreserveModTime            bool                      `mapstructure:"preserveModTime"`
+	ClosedCaptions             bool                      `mapstructure:"closedCaptions"`
+	FFmpegWarningPatterns      []string                  `mapstructure:"ffmpegWarningPatterns"`
+	FFmpegWarningAction        string                    `mapstructure:"ffmpegWarningAction"`
+	CleanupDelay               time.Duration             `mapstructure:"cleanupDelay"`
+	CRFBitrateRules            CRFBitrateRules           `mapstructure:"crfBitrateRules"`
+	DurationCheck              bool                      `mapstructure:"durationCheck"`
+	DeepVerify                 bool                      `mapstructure:"deepVerify"`
+	DurationTolerance          time.Duration             `mapstructure:"durationTolerance"`
+	DurationTolerancePercent   float64                   `mapstructure:"durationTolerancePercent"`
+	MaxEncodeDuration          time.Duration             `mapstructure:"maxEncodeDuration"`
+	NetrcFile                  string                    `mapstructure:"netrcFile"`
+	SSHKeyFile                 string                    `mapstructure:"sshKeyFile"`
+	QualityProfiles            map[string]QualityProfile `mapstructure:"qualityProfiles"`
+	Loudnorm                   bool                      `mapstructure:"loudnorm"`
+	MobileCompatAudio          bool                      `mapstructure:"mobileCompatAudio"`
+	LoudnormTarget             float64                   `mapstructure:"loudnormTarget"`
+	LoudnormTruePeak           float64                   `mapstructure:"loudnormTruePeak"`
+	LoudnormRange              float64                   `mapstructure:"loudnormRange"`
+	FFmpegPath                 string                    `mapstructure:"ffmpegPath"`
+	FFProbePath                string                    `mapstructure:"ffprobePath"`
+	MKVExtractPath             string                    `mapstructure:"mkvExtractPath"`
+	BinaryLibraryPath          bool                      `mapstructure:"binaryLibraryPath"`
+	PostProcessCommand         string                    `mapstructure:"postProcessCommand"`
+	PostProcessTimeout         time.Duration             `mapstructure:"postProcessTimeout"`
+	PostProcessFailJob         bool                      `mapstructure:"postProcessFailJob"`
+	DownloadMaxRedirects       int                       `mapstructure:"downloadMaxRedirects"`
+	DownloadResume             bool                      `mapstructure:"downloadResume"`
+	ChecksumMismatchRetries    int                       `mapstructure:"checksumMismatchRetries"`
+	RetryJitter                string                    `mapstructure:"retryJitter"`
+	ChecksumJobs               int                       `mapstructure:"checksumJobs"`
+	FFmpegJobs                 int                       `mapstructure:"ffmpegJobs"`
+	DownloadJobs               int                       `mapstructure:"downloadJobs"`
+	MaxHostDownloads           int                       `mapstructure:"maxHostDownloads"`
+	RequireSourceChecksum      bool                      `mapstructure:"requireSourceChecksum"`
+	MinSourceSize              int64                     `mapstructure:"minSourceSize"`
+	SmallSourceAction          string                    `mapstructure:"smallSourceAction"`
+	SubtitleSelection          string                    `mapstructure:"subtitleSelection"`
+	SubtitleSDH                string                    `mapstructure:"subtitleSDH"`
+	TitleSanitization          string                    `mapstructure:"titleSanitization"`
+	NoBenefitAction            string                    `mapstructure:"noBenefitAction"`
+	BenefitCheck               string                    `mapstructure:"benefitCheck"`
+	MinVideoReduction          float64                   `mapstructure:"minVideoReduction"`
+	ForcedSubtitleDefault      bool                      `mapstructure:"forcedSubtitleDefault"`
+	PreferredLanguages         []string                  `mapstructure:"preferredLanguages"`
+	MaxAudioTracks             int                       `mapstructure:"maxAudioTracks"`
+	MaxSubtitleTracks          int                       `mapstructure:"maxSubtitleTracks"`
+	RequiredAudioLanguages     []string                  `mapstructure:"requiredAudioLanguages"`
+	RequiredSubtitleLanguages  []string                  `mapstructure:"requiredSubtitleLanguages"`
+	IncompatibleSubtitleAction string                    `mapstructure:"incompatibleSubtitleAction"`
 }
 
 func (c Config) HaveSetPeriodTime() bool {
@@ -1,6 +1,8 @@
 package task
 
 import (
+	"fmt"
+	"os"
 	"sync"
 	"time"
 
@@ -15,9 +17,19 @@ const DownloadJobStepType = "download"
 const UploadJobStepType = "upload"
 const EncodeJobStepType = "encode"
 
+const (
+	ConsoleModeAuto        = "auto"
+	ConsoleModeInteractive = "interactive"
+	ConsoleModePlain       = "plain"
+)
+
 type ConsoleWorkerPrinter struct {
 	pw progress.Writer
 	mu sync.RWMutex
+	// plain prints the progress as periodic log lines instead of redrawing the progress bars
+	plain            bool
+	progressInterval time.Duration
+	tracks           []*TaskTracks
 }
 
 type TaskTracks struct {
@@ -25,9 +37,34 @@ type TaskTracks struct {
 	stepType        JobStepType
 	progressTracker *progress.Tracker
 	printer         *text.Color
+	mu              sync.Mutex
+	message         string
+	// console is the plain printer logging the task, nil when the task is a progress bar
+	console *ConsoleWorkerPrinter
+	started time.Time
+}
+
+// PlainConsole reports whether the worker.consoleMode prints plain log lines, auto does when the standard output is
+// not a terminal, like the logs of a container or a CI job.
+func PlainConsole(mode string) bool {
+	switch mode {
+	case ConsoleModeInteractive:
+		return false
+	case ConsoleModePlain:
+		return true
+	default:
+		stat, err := os.Stdout.Stat()
+		return err != nil || stat.Mode()&os.ModeCharDevice == 0
+	}
 }
 
-func NewConsoleWorkerPrinter() *ConsoleWorkerPrinter {
+// NewConsoleWorkerPrinter draws the progress bars of the tasks in place, or with plain logs them without colors
+// every progressInterval, one line per task.
+func NewConsoleWorkerPrinter(plain bool, progressInterval time.Duration) *ConsoleWorkerPrinter {
+	if plain {
+		text.DisableColors()
+		return &ConsoleWorkerPrinter{plain: true, progressInterval: progressInterval}
+	}
 	pw := progress.NewWriter()
 	pw.SetAutoStop(false)
 	pw.SetTrackerLength(40)
@@ -56,9 +93,42 @@ func NewConsoleWorkerPrinter() *ConsoleWorkerPrinter {
 	}
 }
 func (C *ConsoleWorkerPrinter) Render() {
+	if C.plain {
+		C.renderPlain()
+		return
+	}
 	C.pw.Render()
 }
 
+// renderPlain logs the progress of the running tasks every progressInterval, 0 only logs when they end.
+func (C *ConsoleWorkerPrinter) renderPlain() {
+	var ticker <-chan time.Time
+	if C.progressInterval > 0 {
+		ticker = time.NewTicker(C.progressInterval).C
+	}
+	for range ticker {
+		C.mu.RLock()
+		tracks := append([]*TaskTracks(nil), C.tracks...)
+		C.mu.RUnlock()
+		for _, track := range tracks {
+			log.Info(track.progressLine())
+		}
+	}
+}
+
+// removeTrack stops the periodic progress of an ended task, it reports false when the task already ended.
+func (C *ConsoleWorkerPrinter) removeTrack(track *TaskTracks) bool {
+	C.mu.Lock()
+	defer C.mu.Unlock()
+	for i, t := range C.tracks {
+		if t == track {
+			C.tracks = append(C.tracks[:i], C.tracks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 func (C *ConsoleWorkerPrinter) AddTask(id string, stepType JobStepType) *TaskTracks {
 	C.mu.Lock()
 	defer C.mu.Unlock()
@@ -90,32 +160,73 @@ func (C *ConsoleWorkerPrinter) AddTask(id string, stepType JobStepType) *TaskTra
 		stepType:        stepType,
 		progressTracker: tracker,
 		printer:         &printer,
+		message:         string(stepType),
 	}
 
+	if C.plain {
+		tracker.Start()
+		taskTrack.console = C
+		taskTrack.started = time.Now()
+		C.tracks = append(C.tracks, taskTrack)
+		return taskTrack
+	}
 	C.pw.AppendTracker(tracker)
 	return taskTrack
 }
 
 func (C *ConsoleWorkerPrinter) Log(msg string, a ...interface{}) {
+	if C.plain {
+		log.Infof(msg, a...)
+		return
+	}
 	C.pw.Log(msg, a...)
 }
 
 func (C *ConsoleWorkerPrinter) Warn(msg string, a ...interface{}) {
+	if C.plain {
+		log.Warnf(msg, a...)
+		return
+	}
 	C.pw.Log(text.FgHiYellow.Sprintf(msg, a...))
 }
 
 func (C *ConsoleWorkerPrinter) Cmd(msg string, a ...interface{}) {
+	if C.plain {
+		log.Infof(msg, a...)
+		return
+	}
 	C.pw.Log(text.FgHiCyan.Sprintf(msg, a...))
 }
 
 func (C *ConsoleWorkerPrinter) Error(msg string, a ...interface{}) {
+	if C.plain {
+		log.Errorf(msg, a...)
+		return
+	}
 	C.pw.Log(text.FgHiRed.Sprintf(msg, a...))
 }
 
+// progressLine is the plain progress of the task: its message, percent, value and ETA.
+func (C *TaskTracks) progressLine() string {
+	C.mu.Lock()
+	message := C.message
+	C.mu.Unlock()
+	line := fmt.Sprintf("[%s] %s %.2f%% %s", C.id, message, C.progressTracker.PercentDone(), C.progressTracker.Units.Sprint(C.progressTracker.Value()))
+	if eta := C.progressTracker.ETA(); eta > 0 {
+		line += fmt.Sprintf(" ETA %s", eta.Round(time.Second))
+	}
+	return line
+}
+
 func (C *TaskTracks) SetTotal(total int64) {
 	C.progressTracker.UpdateTotal(total)
 }
 
+// AddTotal grows the total of the track by total.
+func (C *TaskTracks) AddTotal(total int64) {
+	C.progressTracker.UpdateTotal(C.progressTracker.Total + total)
+}
+
 func (C *TaskTracks) ETA() time.Duration {
 	return C.progressTracker.ETA()
 }
@@ -137,18 +248,34 @@ func (C *TaskTracks) Increment(increment int) {
 
 func (C *TaskTracks) Message(msg string) {
 	log.Debug("Showing progress message")
-	C.progressTracker.UpdateMessage(C.printer.Sprintf("[%s] %s", C.id, msg))
+	C.setMessage(msg)
 }
 
 func (C *TaskTracks) ResetMessage() {
-	C.progressTracker.UpdateMessage(C.printer.Sprintf("[%s] %s", C.id, C.stepType))
+	C.setMessage(string(C.stepType))
+}
+
+func (C *TaskTracks) setMessage(msg string) {
+	C.mu.Lock()
+	C.message = msg
+	C.mu.Unlock()
+	if C.console != nil {
+		return
+	}
+	C.progressTracker.UpdateMessage(C.printer.Sprintf("[%s] %s", C.id, msg))
 }
 
 func (C *TaskTracks) Done() {
 	C.progressTracker.SetValue(C.progressTracker.Total)
 	C.progressTracker.MarkAsDone()
+	if C.console != nil && C.console.removeTrack(C) {
+		log.Infof("[%s] %s done in %s", C.id, C.stepType, time.Since(C.started).Round(time.Second))
+	}
 }
 
 func (C *TaskTracks) Error() {
 	C.progressTracker.MarkAsErrored()
+	if C.console != nil && C.console.removeTrack(C) {
+		log.Warnf("[%s] %s failed at %.2f%%", C.id, C.stepType, C.progressTracker.PercentDone())
+	}
 }
@@ -0,0 +1,116 @@
+package task
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+// CRFBitrateRule encodes sources with a video bitrate up to MaxBitrate bits per second with CRF.
+type CRFBitrateRule struct {
+	MaxBitrate int64
+	CRF        int
+}
+
+// CRFBitrateRules chooses the CRF from the source video bitrate, written as a comma separated list of
+// <max bitrate>:<crf> like 2M:32,5M:30. Sources above every rule, or with unknown bitrate, use videoCRF.
+type CRFBitrateRules []CRFBitrateRule
+
+func (C *CRFBitrateRules) Type() string {
+	return "CRFBitrateRules"
+}
+
+func (C *CRFBitrateRules) String() string {
+	var rules []string
+	for _, rule := range *C {
+		rules = append(rules, fmt.Sprintf("%d:%d", rule.MaxBitrate, rule.CRF))
+	}
+	return strings.Join(rules, ",")
+}
+
+func (C *CRFBitrateRules) Set(value string) error {
+	var rules CRFBitrateRules
+	for _, ruleString := range strings.Split(value, ",") {
+		ruleString = strings.TrimSpace(ruleString)
+		if ruleString == "" {
+			continue
+		}
+		bitrateCRF := strings.Split(ruleString, ":")
+		if len(bitrateCRF) != 2 {
+			return fmt.Errorf("%s is not a <max bitrate>:<crf> rule", ruleString)
+		}
+		maxBitrate, err := parseBitrate(bitrateCRF[0])
+		if err != nil {
+			return err
+		}
+		crf, err := strconv.Atoi(bitrateCRF[1])
+		if err != nil {
+			return fmt.Errorf("invalid crf %s: %v", bitrateCRF[1], err)
+		}
+		if crf < 0 || crf > 51 {
+			return fmt.Errorf("crf %d must be between 0 and 51", crf)
+		}
+		rules = append(rules, CRFBitrateRule{MaxBitrate: maxBitrate, CRF: crf})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].MaxBitrate < rules[j].MaxBitrate
+	})
+	*C = rules
+	return nil
+}
+
+// CRF returns the CRF of the first rule covering the bitrate.
+func (C CRFBitrateRules) CRF(bitrate int64) int {
+	if bitrate <= 0 {
+		return videoCRF
+	}
+	for _, rule := range C {
+		if bitrate <= rule.MaxBitrate {
+			return rule.CRF
+		}
+	}
+	return videoCRF
+}
+
+// parseBitrate parses bits per second with an optional k, M or G suffix.
+func parseBitrate(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	multiplier := float64(1)
+	switch {
+	case strings.HasSuffix(value, "k"), strings.HasSuffix(value, "K"):
+		multiplier = 1000
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1000 * 1000
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1000 * 1000 * 1000
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	bitrate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bitrate %s: %v", value, err)
+	}
+	return int64(bitrate * multiplier), nil
+}
+
+// videoBitrate is the bitrate of the video stream, matroska only stores it in the BPS tag. As last resort the
+// bitrate of the whole file is used, which includes the audio.
+func videoBitrate(data *ffprobe.ProbeData, videoStream *ffprobe.Stream) int64 {
+	bitrates := []string{videoStream.BitRate}
+	if bps, err := videoStream.TagList.GetString("BPS"); err == nil {
+		bitrates = append(bitrates, bps)
+	}
+	if data.Format != nil {
+		bitrates = append(bitrates, data.Format.BitRate)
+	}
+	for _, bitrate := range bitrates {
+		if b, err := strconv.ParseInt(bitrate, 10, 64); err == nil && b > 0 {
+			return b
+		}
+	}
+	return 0
+}
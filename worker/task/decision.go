@@ -0,0 +1,95 @@
+package task
+
+import (
+	"fmt"
+	"gearr/model"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+// addStreamDecision records the first decision on a source audio or subtitle stream.
+func (C *ContainerData) addStreamDecision(stream *ffprobe.Stream, kept bool, reason string) {
+	C.StreamDecisions = append(C.StreamDecisions, &model.StreamDecision{
+		Index:    stream.Index,
+		Type:     stream.CodecType,
+		Language: sanitizeLanguage(stream.Tags.Language),
+		Codec:    stream.CodecName,
+		Kept:     kept,
+		Reason:   reason,
+	})
+}
+
+// setStreamDecision replaces the decision on a source stream already recorded.
+func (C *ContainerData) setStreamDecision(index uint8, kept bool, reason string) {
+	for _, decision := range C.StreamDecisions {
+		if decision.Index == int(index) {
+			decision.Kept = kept
+			decision.Reason = reason
+		}
+	}
+}
+
+// dropUnselectedStreams marks as dropped the kept streams no longer in the audios or subtitles of the container, the
+// ones the last selection step removed.
+func (C *ContainerData) dropUnselectedStreams(reason string) {
+	selected := make(map[int]bool)
+	for _, audio := range C.Audios {
+		selected[int(audio.Id)] = true
+	}
+	for _, subtitle := range C.Subtitle {
+		selected[int(subtitle.Id)] = true
+	}
+	for _, decision := range C.StreamDecisions {
+		if decision.Kept && !selected[decision.Index] {
+			decision.Kept = false
+			decision.Reason = reason
+		}
+	}
+}
+
+// recordSubtitleSelection records the decisions of worker.subtitleSelection and worker.subtitleSDH on the subtitles
+// that are not forced or comments.
+func (C *ContainerData) recordSubtitleSelection(config Config, candidates []*Subtitle, selected []*Subtitle) {
+	for _, candidate := range candidates {
+		var chosen *Subtitle
+		for _, subtitle := range selected {
+			if subtitle.Language == candidate.Language {
+				chosen = subtitle
+				break
+			}
+		}
+		switch {
+		case containsSubtitle(selected, candidate) && config.SubtitleSelection == SubtitleSelectionAll:
+			C.setStreamDecision(candidate.Id, true, "worker.subtitleSelection all keeps every subtitle")
+		case containsSubtitle(selected, candidate):
+			C.setStreamDecision(candidate.Id, true, fmt.Sprintf("chosen for language %s by worker.subtitleSelection %s", candidate.Language, config.SubtitleSelection))
+		case candidate.SDH && config.SubtitleSDH == SubtitleSDHDrop:
+			C.setStreamDecision(candidate.Id, false, "SDH subtitle, worker.subtitleSDH is drop")
+		case chosen != nil:
+			C.setStreamDecision(candidate.Id, false, fmt.Sprintf("subtitle %d chosen for language %s by worker.subtitleSelection %s", chosen.Id, candidate.Language, config.SubtitleSelection))
+		default:
+			C.setStreamDecision(candidate.Id, false, "dropped by worker.subtitleSelection")
+		}
+	}
+}
+
+func containsSubtitle(subtitles []*Subtitle, subtitle *Subtitle) bool {
+	for _, s := range subtitles {
+		if s == subtitle {
+			return true
+		}
+	}
+	return false
+}
+
+// logStreamDecisions logs every stream decision at debug level, so a missing track can be explained.
+func (C *ContainerData) logStreamDecisions(id string) {
+	for _, decision := range C.StreamDecisions {
+		action := "dropping"
+		if decision.Kept {
+			action = "keeping"
+		}
+		log.Debugf("[%s] %s %s stream %d (%s, %s): %s", id, action, decision.Type, decision.Index, decision.Language, decision.Codec, decision.Reason)
+	}
+}
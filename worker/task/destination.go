@@ -0,0 +1,161 @@
+package task
+
+import (
+	"fmt"
+	"gearr/model"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UploadDestination stores the encoded file of a job where the server expects it.
+type UploadDestination interface {
+	Upload(task *model.WorkTaskEncode, reader io.Reader, size int64, checksum string) error
+}
+
+// uploadDestination picks the destination from the scheme of the job upload URL, posting to the server by default.
+func (J *EncodeWorker) uploadDestination(uploadURL string) UploadDestination {
+	if isRemoteURL(uploadURL) {
+		return &remoteDestination{worker: J}
+	}
+	return &httpDestination{worker: J}
+}
+
+// httpDestination posts the encoded file to the server upload endpoint, which verifies the checksum.
+type httpDestination struct {
+	worker *EncodeWorker
+}
+
+func (H *httpDestination) Upload(task *model.WorkTaskEncode, reader io.Reader, size int64, checksum string) error {
+	config := H.worker.workerConfig
+	client := config.jobHTTPClient(func(req *http.Request, via []*http.Request) error {
+		// the redirects of the upload share the limit of the download ones
+		if len(via) > config.DownloadMaxRedirects {
+			return fmt.Errorf("%w: stopped after %d redirects", ErrorUploadRejected, config.DownloadMaxRedirects)
+		}
+		return config.checkURLHost(req.URL.String())
+	})
+	defer client.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(H.worker.ctx, "POST", task.TaskEncode.UploadURL, reader)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(reader), nil
+	}
+
+	req.Header.Add("checksum", checksum)
+	req.Header.Add("filename", filepath.Base(task.TargetFilePath))
+	req.Header.Add("Content-Type", "application/octet-stream")
+	req.Header.Add("Content-Length", strconv.FormatInt(size, 10))
+	if modTime := targetModTime(task); H.worker.workerConfig.PreserveModTime && !modTime.IsZero() {
+		req.Header.Add(modTimeHeader, modTime.Format(time.RFC3339))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 {
+		return fmt.Errorf("invalid status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// remoteDestination writes the encoded file to a sftp:// share with curl. Like the server does with the uploads it
+// receives, the file is written to a hidden staging file next to the destination and only renamed to it once complete,
+// so the tools watching the share never see a partial file. Shares can't compute a checksum, so the staging file is
+// verified by comparing the size stored on the share. curl can't rename files on smb:// shares, they are rejected.
+type remoteDestination struct {
+	worker *EncodeWorker
+}
+
+func (R *remoteDestination) Upload(task *model.WorkTaskEncode, reader io.Reader, size int64, checksum string) error {
+	uploadURL, err := url.Parse(task.TaskEncode.UploadURL)
+	if err != nil {
+		return err
+	}
+	if uploadURL.Scheme == smbScheme {
+		return fmt.Errorf("%w: files on smb shares can't be renamed, the upload would not be atomic", ErrorUploadRejected)
+	}
+	// the server sends the destination directory, the file keeps the rendered output name
+	if strings.HasSuffix(uploadURL.Path, "/") {
+		uploadURL = uploadURL.JoinPath(filepath.Base(task.TargetFilePath))
+	}
+	fileName := path.Base(uploadURL.Path)
+	stagingURL := uploadURL.JoinPath("..", fmt.Sprintf(".%s.upload", fileName))
+
+	curlErrLog := ""
+	curlCommand := R.worker.curlCommand(task.WorkDir, "--ftp-create-dirs", "--upload-file", "-", stagingURL.String()).
+		SetStdin(reader).
+		SetStderrFunc(func(buffer []byte, exit bool) {
+			curlErrLog += string(buffer)
+		})
+	exitCode, err := curlCommand.RunWithContext(R.worker.ctx)
+	if err != nil {
+		return fmt.Errorf("%w: stderr:%s", err, curlErrLog)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("exit code %d: stderr:%s", exitCode, curlErrLog)
+	}
+
+	// a size that can't be read leaves the upload unverified, it is uploaded again
+	remoteSize, err := R.worker.remoteFileSize(task.WorkDir, stagingURL.String())
+	if err != nil {
+		return fmt.Errorf("error verifying the size of upload %s: %w", stagingURL.Redacted(), err)
+	}
+	if remoteSize != size {
+		return fmt.Errorf("size error on upload %s: uploaded %d of %d bytes", stagingURL.Redacted(), remoteSize, size)
+	}
+	if err = R.rename(task, stagingURL, uploadURL); err != nil {
+		return fmt.Errorf("error renaming upload %s: %w", stagingURL.Redacted(), err)
+	}
+	// the server only knows the default output name, the one of the file is reported with the upload
+	task.DestinationFileName = fileName
+
+	// curl can't set the modification time on sftp shares, only on local paths
+	if modTime := targetModTime(task); R.worker.workerConfig.PreserveModTime && uploadURL.Scheme == fileScheme && !modTime.IsZero() {
+		if err = os.Chtimes(uploadURL.Path, time.Now(), modTime); err != nil {
+			R.worker.terminal.Warn("[%s] error preserving the source modification time: %v", task.TaskEncode.Id.String(), err)
+		}
+	}
+	return nil
+}
+
+// rename moves the staging file over the destination, replacing a previous upload. On sftp the quote commands run
+// before listing the destination directory, which is discarded.
+func (R *remoteDestination) rename(task *model.WorkTaskEncode, stagingURL *url.URL, uploadURL *url.URL) error {
+	if uploadURL.Scheme == fileScheme {
+		return os.Rename(stagingURL.Path, uploadURL.Path)
+	}
+	curlErrLog := ""
+	curlCommand := R.worker.curlCommand(task.WorkDir,
+		"--quote", fmt.Sprintf("*rm %s", sftpQuotePath(uploadURL.Path)),
+		"--quote", fmt.Sprintf("rename %s %s", sftpQuotePath(stagingURL.Path), sftpQuotePath(uploadURL.Path)),
+		strings.TrimSuffix(uploadURL.JoinPath("..").String(), "/")+"/").
+		SetStderrFunc(func(buffer []byte, exit bool) {
+			curlErrLog += string(buffer)
+		})
+	exitCode, err := curlCommand.RunWithContext(R.worker.ctx)
+	if err != nil {
+		return fmt.Errorf("%w: stderr:%s", err, curlErrLog)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("exit code %d: stderr:%s", exitCode, curlErrLog)
+	}
+	return nil
+}
+
+// sftpQuotePath quotes a path for the curl sftp quote commands. The URL paths under /~/ are relative to the home
+// directory of the user, which is where relative paths start.
+func sftpQuotePath(p string) string {
+	p = strings.TrimPrefix(p, "/~/")
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(p) + `"`
+}
@@ -0,0 +1,254 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gearr/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// subdirectories of worker.jobDirectory, the job files are moved between them as their jobs go on
+const (
+	jobDirectoryProcessing = "processing"
+	jobDirectoryDone       = "done"
+	jobDirectoryFailed     = "failed"
+	jobDirectoryStatus     = "status"
+)
+
+var errorNoBroker = errors.New("the worker has no broker")
+
+// DirectoryQueue feeds the encode worker with the job files, TaskEncode JSON documents, dropped in
+// worker.jobDirectory, and writes the events of those jobs to status files instead of publishing them. It sits
+// between the encode worker and the broker: the events of the jobs received from the broker and the PGS requests
+// still go to it, when the worker has one.
+type DirectoryQueue struct {
+	directory    string
+	printer      *ConsoleWorkerPrinter
+	broker       model.Manager
+	encodeWorker *EncodeWorker
+	mu           sync.Mutex
+	// jobFiles are the names of the job files in processing, by job id
+	jobFiles map[uuid.UUID]string
+}
+
+func NewDirectoryQueue(directory string, printer *ConsoleWorkerPrinter) *DirectoryQueue {
+	return &DirectoryQueue{
+		directory: directory,
+		printer:   printer,
+		jobFiles:  make(map[uuid.UUID]string),
+	}
+}
+
+// RegisterEncodeWorker places the queue in front of the manager the worker already has, the broker or none. It must
+// be called before the worker resumes its jobs, so the events of the resumed directory jobs land in their status
+// files.
+func (D *DirectoryQueue) RegisterEncodeWorker(worker *EncodeWorker) error {
+	for _, subdirectory := range []string{jobDirectoryProcessing, jobDirectoryDone, jobDirectoryFailed, jobDirectoryStatus} {
+		if err := os.MkdirAll(filepath.Join(D.directory, subdirectory), os.ModePerm); err != nil {
+			return err
+		}
+	}
+	D.broker = worker.Manager
+	D.encodeWorker = worker
+	worker.Manager = D
+
+	processingFiles, err := filepath.Glob(filepath.Join(D.directory, jobDirectoryProcessing, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, processingFile := range processingFiles {
+		taskEncode, _, err := readJobFile(processingFile)
+		if err != nil {
+			D.printer.Warn("skipping job file %s: %v", processingFile, err)
+			continue
+		}
+		D.jobFiles[taskEncode.Id] = filepath.Base(processingFile)
+	}
+	return nil
+}
+
+// Run picks a job file whenever the encode worker accepts jobs, like the broker consumer does with its queue.
+func (D *DirectoryQueue) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+			if !D.encodeWorker.AcceptJobs() {
+				continue
+			}
+			fileName, found := D.nextJobFile()
+			if !found {
+				<-time.After(time.Second * 5)
+				continue
+			}
+			D.executeJobFile(fileName)
+		}
+	}
+}
+
+// nextJobFile is the first job file in name order. Files still being written must use another extension and be
+// renamed to .json once complete.
+func (D *DirectoryQueue) nextJobFile() (string, bool) {
+	entries, err := os.ReadDir(D.directory)
+	if err != nil {
+		D.printer.Warn("error reading job directory %s: %v", D.directory, err)
+		return "", false
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.EqualFold(filepath.Ext(entry.Name()), ".json") {
+			return entry.Name(), true
+		}
+	}
+	return "", false
+}
+
+func (D *DirectoryQueue) executeJobFile(fileName string) {
+	processingPath := filepath.Join(D.directory, jobDirectoryProcessing, fileName)
+	if err := os.Rename(filepath.Join(D.directory, fileName), processingPath); err != nil {
+		D.printer.Error("error taking job file %s: %v", fileName, err)
+		return
+	}
+	taskEncode, workData, err := readJobFile(processingPath)
+	if err == nil {
+		D.mu.Lock()
+		if _, running := D.jobFiles[taskEncode.Id]; running {
+			err = fmt.Errorf("job %s is already running", taskEncode.Id.String())
+		} else {
+			D.jobFiles[taskEncode.Id] = fileName
+		}
+		D.mu.Unlock()
+	}
+	if err == nil {
+		D.printer.Log("[%s] Job file %s assigned", model.EncodeJobType, fileName)
+		if err = D.encodeWorker.Execute(workData); err != nil {
+			D.mu.Lock()
+			delete(D.jobFiles, taskEncode.Id)
+			D.mu.Unlock()
+		}
+	}
+	if err != nil {
+		D.printer.Error("[%s] Error preparing job file %s: %v", model.EncodeJobType, fileName, err)
+		event := model.TaskEvent{
+			EventType:        model.NotificationEvent,
+			WorkerName:       D.encodeWorker.workerConfig.Name,
+			EventTime:        time.Now(),
+			NotificationType: model.JobNotification,
+			Status:           model.FailedNotificationStatus,
+			Message:          err.Error(),
+		}
+		if taskEncode != nil {
+			event.Id = taskEncode.Id
+		}
+		D.writeStatus(fileName, event)
+		D.finishJobFile(fileName, event.Status)
+	}
+}
+
+// readJobFile reads a job file, a job without id gets a random one so it has its own work directory. It returns the
+// job and its JSON with the id.
+func readJobFile(path string) (*model.TaskEncode, []byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	taskEncode := &model.TaskEncode{}
+	if err = json.Unmarshal(b, taskEncode); err != nil {
+		return nil, nil, err
+	}
+	if taskEncode.DownloadURL == "" || taskEncode.UploadURL == "" {
+		return taskEncode, nil, errors.New("downloadURL and uploadURL are required")
+	}
+	if taskEncode.Id == uuid.Nil {
+		taskEncode.Id = uuid.New()
+		if b, err = json.Marshal(taskEncode); err != nil {
+			return nil, nil, err
+		}
+		// the id is kept in the file so a resumed job keeps it
+		if err = os.WriteFile(path, b, 0644); err != nil {
+			return nil, nil, err
+		}
+	}
+	return taskEncode, b, nil
+}
+
+// writeStatus replaces the status file of the job file with its last event, the final one carries the encode report.
+func (D *DirectoryQueue) writeStatus(fileName string, event model.TaskEvent) {
+	b, err := json.MarshalIndent(event, "", "\t")
+	if err != nil {
+		D.printer.Warn("error writing status of job file %s: %v", fileName, err)
+		return
+	}
+	statusPath := filepath.Join(D.directory, jobDirectoryStatus, fileName)
+	if err = os.WriteFile(statusPath+".tmp", b, 0644); err == nil {
+		err = os.Rename(statusPath+".tmp", statusPath)
+	}
+	if err != nil {
+		D.printer.Warn("error writing status of job file %s: %v", fileName, err)
+	}
+}
+
+// finishJobFile moves the job file out of processing, to done for the completed and skipped jobs and to failed for
+// the rest.
+func (D *DirectoryQueue) finishJobFile(fileName string, status model.NotificationStatus) {
+	subdirectory := jobDirectoryFailed
+	if status == model.CompletedNotificationStatus || status == model.SkippedNotificationStatus {
+		subdirectory = jobDirectoryDone
+	}
+	if err := os.Rename(filepath.Join(D.directory, jobDirectoryProcessing, fileName), filepath.Join(D.directory, subdirectory, fileName)); err != nil {
+		D.printer.Warn("error moving job file %s to %s: %v", fileName, subdirectory, err)
+	}
+}
+
+func (D *DirectoryQueue) EventNotification(event model.TaskEvent) {
+	D.mu.Lock()
+	fileName, found := D.jobFiles[event.Id]
+	if found && event.IsFinished() {
+		delete(D.jobFiles, event.Id)
+	}
+	D.mu.Unlock()
+	if !found {
+		if D.broker != nil {
+			D.broker.EventNotification(event)
+		}
+		return
+	}
+	D.writeStatus(fileName, event)
+	if event.IsFinished() {
+		D.finishJobFile(fileName, event.Status)
+	}
+}
+
+// RequestPGSJob sends the subtitle to the PGS workers through the broker. Without broker no PGS worker can be reached
+// and the request is answered right away with ErrorPGSWorkerUnavailable, so worker.pgsUnavailableAction applies.
+func (D *DirectoryQueue) RequestPGSJob(pgsJob model.TaskPGS) <-chan *model.TaskPGSResponse {
+	if D.broker != nil {
+		return D.broker.RequestPGSJob(pgsJob)
+	}
+	response := make(chan *model.TaskPGSResponse, 1)
+	response <- &model.TaskPGSResponse{Id: pgsJob.Id, PGSID: pgsJob.PGSID, Err: ErrorPGSWorkerUnavailable.Error()}
+	close(response)
+	return response
+}
+
+func (D *DirectoryQueue) ResponsePGSJob(response model.TaskPGSResponse) error {
+	if D.broker != nil {
+		return D.broker.ResponsePGSJob(response)
+	}
+	return errorNoBroker
+}
+
+func (D *DirectoryQueue) PGSQueueMessages() (int, error) {
+	if D.broker != nil {
+		return D.broker.PGSQueueMessages()
+	}
+	return 0, errorNoBroker
+}
@@ -0,0 +1,81 @@
+package task
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDownloadSlotWait bounds the Retry-After honored while waiting for a download slot, so a bogus header can't park
+// the download queue for hours.
+const maxDownloadSlotWait = time.Minute
+
+// downloadSlotBusy reports whether the server refused the download because it already serves scheduler.maxDownloads,
+// it answers 503 with a Retry-After header. Any other 503 is a failure retried like the rest.
+func downloadSlotBusy(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != ""
+}
+
+// retryAfter is the wait the server asked for in seconds, between a second and maxDownloadSlotWait.
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 1 {
+		return time.Second
+	}
+	wait := time.Duration(seconds) * time.Second
+	if wait > maxDownloadSlotWait {
+		return maxDownloadSlotWait
+	}
+	return wait
+}
+
+// hostDownloadSlots bounds the downloads running at the same time against a single host to worker.maxHostDownloads.
+// Unlike scheduler.maxDownloads it also covers the sources the worker reads from shares and other hosts, which never
+// go through the server.
+type hostDownloadSlots struct {
+	limit int
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newHostDownloadSlots(limit int) *hostDownloadSlots {
+	return &hostDownloadSlots{limit: limit, slots: make(map[string]chan struct{})}
+}
+
+// acquire takes a download slot of the host of the URL, calling wait first when they are all taken, and returns the
+// release of the slot. It fails when the context is done while waiting.
+func (h *hostDownloadSlots) acquire(ctx context.Context, rawURL string, wait func(host string)) (func(), error) {
+	if h == nil || h.limit <= 0 {
+		return func() {}, nil
+	}
+	host := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		// the ports of a host share its disks and its network
+		host = strings.ToLower(u.Hostname())
+	}
+	h.mu.Lock()
+	slots, found := h.slots[host]
+	if !found {
+		slots = make(chan struct{}, h.limit)
+		h.slots[host] = slots
+	}
+	h.mu.Unlock()
+
+	release := func() { <-slots }
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	wait(host)
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,100 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"gearr/model"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHostDownloadSlotsLimitTheDownloadsOfAHost(t *testing.T) {
+	slots := newHostDownloadSlots(1)
+	noWait := func(host string) {
+		t.Fatalf("the slot of %s must be free", host)
+	}
+	release, err := slots.acquire(context.Background(), "sftp://nas:22/media/movie.mkv", noWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another host has its own slots
+	releaseOther, err := slots.acquire(context.Background(), "https://gearr.example.com/api/v1/job/1/download", noWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseOther()
+
+	// the other ports of the host share its slots
+	waited := ""
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = slots.acquire(ctx, "smb://NAS/media/other.mkv", func(host string) { waited = host }); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("a second download from the host must wait for the slot, got %v", err)
+	}
+	if waited != "nas" {
+		t.Fatalf("waited for %q, expected nas", waited)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		releaseNext, err := slots.acquire(context.Background(), "sftp://nas/media/other.mkv", func(string) {})
+		if err == nil {
+			releaseNext()
+		}
+		close(acquired)
+	}()
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the released slot must go to the waiting download")
+	}
+}
+
+func TestHostDownloadSlotsWithoutLimit(t *testing.T) {
+	for _, slots := range []*hostDownloadSlots{nil, newHostDownloadSlots(0)} {
+		for i := 0; i < 3; i++ {
+			if _, err := slots.acquire(context.Background(), "sftp://nas/media/movie.mkv", func(host string) {
+				t.Fatal("downloads without limit never wait")
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestReserveEncodeBacklogStopsTheParallelDownloadsAtTheHighWatermark(t *testing.T) {
+	config := testConfig()
+	config.EncodeQueueHighWatermark = 3
+	worker := newTestWorker(config)
+	worker.encodeChan = make(chan *model.WorkTaskEncode, 10)
+	worker.encodeChan <- &model.WorkTaskEncode{}
+
+	// eight download queues check the backlog at the same time, only two fit under the watermark
+	reserved := make(chan bool, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(reserved); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reserved <- worker.reserveEncodeBacklog()
+		}()
+	}
+	wg.Wait()
+	close(reserved)
+	downloads := 0
+	for ok := range reserved {
+		if ok {
+			downloads++
+		}
+	}
+	if downloads != 2 || worker.encodeBacklog() != 3 {
+		t.Fatalf("%d downloads started with a backlog of %d, expected 2 and the watermark of 3", downloads, worker.encodeBacklog())
+	}
+
+	worker.releaseEncodeBacklog()
+	if !worker.reserveEncodeBacklog() {
+		t.Fatal("a released place must be reserved again")
+	}
+}
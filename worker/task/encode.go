@@ -12,12 +12,12 @@ import (
 	"gearr/model"
 	"hash"
 	"io"
-	"mime"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,6 +33,15 @@ const RESET_LINE = "\r\033[K"
 
 var ffmpegSpeedRegex = regexp.MustCompile(`speed=(\d*\.?\d+)x`)
 var ErrorJobNotFound = errors.New("job Not found")
+var ErrorPGSWorkerUnavailable = errors.New("no PGS worker available")
+var ErrorDownloadRejected = errors.New("download rejected")
+var ErrorUploadRejected = errors.New("upload rejected")
+var ErrorChecksumMismatch = errors.New("checksum mismatch")
+var ErrorNoEncodeBenefit = errors.New("no encode benefit")
+var ErrorSourceTooSmall = errors.New("source too small")
+var ErrorFFmpegWarnings = errors.New("ffmpeg warnings")
+var ErrorRequiredLanguageMissing = errors.New("required language missing")
+var ErrorHostNotAllowed = errors.New("host not allowed")
 
 type FFMPEGProgress struct {
 	duration int
@@ -49,14 +58,36 @@ type EncodeWorker struct {
 	prefetchJobs    uint32
 	downloadChan    chan *model.WorkTaskEncode
 	encodeChan      chan *model.WorkTaskEncode
+	// encodePools are the queues of the encode pools configured besides the default one, by pool name
+	encodePools     map[string]chan *model.WorkTaskEncode
 	uploadChan      chan *model.WorkTaskEncode
 	workerConfig    Config
 	tempPath        string
 	wg              sync.WaitGroup
-	mu              sync.RWMutex
+	taskStatusFiles sync.Map
 	terminal        *ConsoleWorkerPrinter
 	ctxStopQueues   context.Context
 	stopQueues      context.CancelFunc
+	throughput      throughputHistory
+	// ffmpegWarningPatterns are the compiled worker.ffmpegWarningPatterns
+	ffmpegWarningPatterns []*regexp.Regexp
+	ocrRate               ocrRate
+	// checksumSlots bounds the simultaneous checksum passes to worker.checksumJobs, nil is unlimited
+	checksumSlots chan struct{}
+	// ffmpegSlots bounds the simultaneous ffmpeg processes to worker.ffmpegJobs, nil is unlimited
+	ffmpegSlots *ffmpegLimiter
+	// hostDownloadSlots bounds the simultaneous downloads from a host to worker.maxHostDownloads
+	hostDownloadSlots *hostDownloadSlots
+	// backlogMutex makes checking the encode backlog and reserving a place in it for a download a single step
+	backlogMutex sync.Mutex
+	// backlogDownloads are the downloads that reserved a place in the encode backlog and did not reach it yet
+	backlogDownloads int
+}
+
+// taskStatusFile serializes the writes to the status file of a single job.
+type taskStatusFile struct {
+	mu        sync.Mutex
+	lastWrite time.Time
 }
 
 func ensureDirectoryExists(path string) {
@@ -70,21 +101,39 @@ func NewEncodeWorker(ctx context.Context, workerConfig Config, workerName string
 
 	ensureDirectoryExists(tempPath)
 
+	encodePools := make(map[string]chan *model.WorkTaskEncode)
+	for name := range workerConfig.EncodePools {
+		encodePools[name] = make(chan *model.WorkTaskEncode, 100)
+	}
+
+	// the patterns are validated when the worker starts
+	ffmpegWarningPatterns, _ := CompileFFmpegWarningPatterns(workerConfig.FFmpegWarningPatterns)
+
+	var checksumSlots chan struct{}
+	if workerConfig.ChecksumJobs > 0 {
+		checksumSlots = make(chan struct{}, workerConfig.ChecksumJobs)
+	}
+
 	return &EncodeWorker{
-		name:            workerName,
-		ctx:             newCtx,
-		ctxStopQueues:   ctxStopQueues,
-		stopQueues:      stopQueues,
-		wg:              sync.WaitGroup{},
-		cancelContext:   cancel,
-		workerConfig:    workerConfig,
-		downloadChan:    make(chan *model.WorkTaskEncode, 100),
-		encodeChan:      make(chan *model.WorkTaskEncode, 100),
-		uploadChan:      make(chan *model.WorkTaskEncode, 100),
-		tempPath:        tempPath,
-		terminal:        printer,
-		maxPrefetchJobs: uint32(workerConfig.MaxPrefetchJobs),
-		prefetchJobs:    0,
+		name:                  workerName,
+		ctx:                   newCtx,
+		ctxStopQueues:         ctxStopQueues,
+		stopQueues:            stopQueues,
+		wg:                    sync.WaitGroup{},
+		cancelContext:         cancel,
+		workerConfig:          workerConfig,
+		downloadChan:          make(chan *model.WorkTaskEncode, 100),
+		encodeChan:            make(chan *model.WorkTaskEncode, 100),
+		encodePools:           encodePools,
+		uploadChan:            make(chan *model.WorkTaskEncode, 100),
+		tempPath:              tempPath,
+		terminal:              printer,
+		maxPrefetchJobs:       uint32(workerConfig.MaxPrefetchJobs),
+		prefetchJobs:          0,
+		ffmpegWarningPatterns: ffmpegWarningPatterns,
+		checksumSlots:         checksumSlots,
+		ffmpegSlots:           newFFmpegLimiter(workerConfig.FFmpegJobs),
+		hostDownloadSlots:     newHostDownloadSlots(workerConfig.MaxHostDownloads),
 	}
 }
 
@@ -129,22 +178,49 @@ func getDuration(res string) int {
 func (E *EncodeWorker) Initialize() {
 	E.resumeJobs()
 	go E.terminal.Render()
-	go E.downloadQueue()
+	for i := 0; i < max(E.workerConfig.DownloadJobs, 1); i++ {
+		go E.downloadQueue()
+	}
 
 	for i := 0; i < E.workerConfig.EncodeJobs; i++ {
 		go E.uploadQueue()
-		go E.encodeQueue()
+		go E.encodeQueue(E.encodeChan)
+	}
+	for name, jobs := range E.workerConfig.EncodePools {
+		for i := 0; i < jobs; i++ {
+			go E.uploadQueue()
+			go E.encodeQueue(E.encodePools[name])
+		}
 	}
 
 }
 
+// resumeJobs queues again the unfinished jobs found in the temp path and in the work directory roots.
 func (E *EncodeWorker) resumeJobs() {
-	err := filepath.Walk(E.tempPath, func(path string, info os.FileInfo, err error) error {
+	E.resumeCleanups()
+	for _, workPath := range E.workPaths() {
+		E.resumeJobsFrom(workPath)
+	}
+}
+
+func (E *EncodeWorker) resumeJobsFrom(workPath string) {
+	err := filepath.Walk(workPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil || info.IsDir() || filepath.Ext(path) != ".json" {
 			return nil
 		}
+		if isPendingCleanup(filepath.Dir(path)) {
+			return nil
+		}
 
-		taskEncode := E.readTaskStatusFromDiskByPath(path)
+		taskEncode, err := E.readTaskStatusFromDiskByPath(path)
+		if err != nil {
+			// quarantine the file so it is kept for inspection but not read again on the next start
+			E.terminal.Warn("skipping task status %s: %v", path, err)
+			if err = os.Rename(path, path+".corrupt"); err != nil {
+				E.terminal.Warn("error quarantining task status %s: %v", path, err)
+			}
+			return nil
+		}
 
 		switch {
 		case taskEncode.LastState.IsDownloading():
@@ -153,7 +229,7 @@ func (E *EncodeWorker) resumeJobs() {
 			atomic.AddUint32(&E.prefetchJobs, 1)
 			t := E.terminal.AddTask(fmt.Sprintf("cached: %s", taskEncode.Task.TaskEncode.Id.String()), DownloadJobStepType)
 			t.Done()
-			E.encodeChan <- taskEncode.Task
+			E.encodePoolChan(taskEncode.Task) <- taskEncode.Task
 		case taskEncode.LastState.IsUploading():
 			t := E.terminal.AddTask(fmt.Sprintf("cached: %s", taskEncode.Task.TaskEncode.Id.String()), EncodeJobStepType)
 			t.Done()
@@ -164,7 +240,7 @@ func (E *EncodeWorker) resumeJobs() {
 	})
 
 	if err != nil {
-		panic(err)
+		E.terminal.Warn("error resuming jobs from %s: %v", workPath, err)
 	}
 }
 func (J *EncodeWorker) IsTypeAccepted(jobType string) bool {
@@ -184,76 +260,199 @@ func (J *EncodeWorker) AcceptJobs() bool {
 	return J.PrefetchJobs() < uint32(J.workerConfig.MaxPrefetchJobs)
 }
 
+// downloadFile downloads the source, retrying transfer failures for 15 minutes. A complete download whose checksum
+// doesn't match is only retried worker.checksumMismatchRetries times, the source or its checksum is most likely wrong.
 func (J *EncodeWorker) downloadFile(job *model.WorkTaskEncode, track *TaskTracks) error {
-	err := retry.Do(func() error {
-		track.UpdateValue(0)
-		resp, err := http.Get(job.TaskEncode.DownloadURL)
-		if err != nil {
-			return err
+	release, err := J.hostDownloadSlots.acquire(J.ctx, job.TaskEncode.DownloadURL, func(host string) {
+		track.Message(fmt.Sprintf("waiting for a download slot of %s", host))
+	})
+	if err != nil {
+		return err
+	}
+	defer release()
+	track.ResetMessage()
+
+	checksumMismatches := 0
+	err = retry.Do(func() error {
+		if isRemoteURL(job.TaskEncode.DownloadURL) {
+			return J.downloadRemoteFile(job, track)
 		}
-		defer resp.Body.Close()
+		return J.downloadHTTPFile(job, track)
+	}, retry.Delay(time.Second*5),
+		retry.DelayType(J.workerConfig.retryDelayType(retry.BackOffDelay)),
+		retry.Attempts(180), // 15 min
+		retry.LastErrorOnly(true),
+		retry.OnRetry(func(n uint, err error) {
+			J.terminal.Error("error on downloading job %s", err.Error())
+		}),
+		retry.RetryIf(func(err error) bool {
+			if errors.Is(err, ErrorChecksumMismatch) {
+				checksumMismatches++
+				return checksumMismatches <= J.workerConfig.ChecksumMismatchRetries
+			}
+			return !(errors.Is(err, context.Canceled) || errors.Is(err, ErrorJobNotFound) || errors.Is(err, ErrorDownloadRejected) || errors.Is(err, ErrorHostNotAllowed) || errors.Is(err, ErrorSourceTooSmall))
+		}))
+
+	if errors.Is(err, ErrorChecksumMismatch) {
+		return fmt.Errorf("%w after %d complete downloads", err, checksumMismatches)
+	}
+	return err
+}
 
-		if resp.StatusCode == http.StatusNotFound {
-			return ErrorJobNotFound
+// downloadHTTPFile downloads the source over HTTP. When a previous attempt left part of the source, the download
+// resumes from there if the server answers the range request with 206. 404 and the other 4xx responses, but
+// request timeout and too many requests, are permanent failures that are not retried.
+func (J *EncodeWorker) downloadHTTPFile(job *model.WorkTaskEncode, track *TaskTracks) error {
+	track.UpdateValue(0)
+	req, err := http.NewRequestWithContext(J.ctx, "GET", job.TaskEncode.DownloadURL, nil)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	if J.workerConfig.DownloadResume && job.SourceFilePath != "" {
+		if stat, err := os.Stat(job.SourceFilePath); err == nil && stat.Size() > 0 {
+			offset = stat.Size()
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
 		}
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("non-200 response in download code %d", resp.StatusCode)
+	}
+	client := J.workerConfig.jobHTTPClient(func(req *http.Request, via []*http.Request) error {
+		if len(via) > J.workerConfig.DownloadMaxRedirects {
+			return fmt.Errorf("%w: stopped after %d redirects", ErrorDownloadRejected, J.workerConfig.DownloadMaxRedirects)
 		}
-
-		size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
-		if err != nil {
-			return err
+		// a redirect must not lead the worker to a host the job URL could not target
+		if err := J.workerConfig.checkURLHost(req.URL.String()); err != nil {
+			return fmt.Errorf("%w: %v", ErrorDownloadRejected, err)
 		}
-		track.SetTotal(size)
-
-		_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
-		if err != nil {
-			return err
+		return nil
+	})
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	for err == nil && downloadSlotBusy(resp) {
+		// the server serves too many downloads, wait in line for a slot without spending the download retries
+		resp.Body.Close()
+		track.Message("waiting for a download slot")
+		select {
+		case <-J.ctx.Done():
+			return J.ctx.Err()
+		case <-time.After(retryAfter(resp)):
 		}
+		resp, err = client.Do(req)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	track.ResetMessage()
 
-		job.SourceFilePath = filepath.Join(job.WorkDir, fmt.Sprintf("%s%s", job.TaskEncode.Id.String(), filepath.Ext(params["filename"])))
-		downloadFile, err := os.Create(job.SourceFilePath)
-		if err != nil {
-			return err
-		}
-		defer downloadFile.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		offset = 0
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// the partial source is not valid anymore, the next attempt downloads it whole
+		os.Remove(job.SourceFilePath)
+		return fmt.Errorf("range not satisfiable resuming download at %d bytes", offset)
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrorJobNotFound
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: response code %d", ErrorDownloadRejected, resp.StatusCode)
+	default:
+		return fmt.Errorf("unexpected response in download code %d", resp.StatusCode)
+	}
+
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return err
+	}
+	size += offset
+	if err := J.checkSourceSize(size); err != nil {
+		return err
+	}
+	track.SetTotal(size)
 
-		reader := NewProgressTrackStream(track, resp.Body)
-		_, err = io.Copy(downloadFile, reader)
-		if err != nil {
+	var downloadFile *os.File
+	if offset > 0 {
+		downloadFile, err = os.OpenFile(job.SourceFilePath, os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	} else {
+		job.SourceFilePath = filepath.Join(job.WorkDir, fmt.Sprintf("%s%s", job.TaskEncode.Id.String(), sourceFileExtension(resp)))
+		downloadFile, err = os.Create(job.SourceFilePath)
+	}
+	if err != nil {
+		return err
+	}
+	defer downloadFile.Close()
+
+	track.UpdateValue(offset)
+	reader := NewProgressTrackStream(track, resp.Body)
+	_, err = io.Copy(downloadFile, reader)
+	if err != nil {
+		return err
+	}
+
+	sha256String := hex.EncodeToString(reader.SumSha())
+	if offset > 0 {
+		// the reader only saw the resumed part
+		if sha256String, err = J.fileChecksum(job.SourceFilePath); err != nil {
 			return err
 		}
+	}
+	if err := J.verifySourceChecksum(job, sha256String); err != nil {
+		return err
+	}
+	if J.workerConfig.PreserveModTime {
+		setDownloadModTime(job.SourceFilePath, resp)
+	}
 
-		sha256String := hex.EncodeToString(reader.SumSha())
-		bodyString, checksumErr := J.calculateChecksum(job.TaskEncode.ChecksumURL)
-		if checksumErr != nil {
-			return checksumErr
-		}
+	track.UpdateValue(size)
+	return nil
+}
 
-		if sha256String != bodyString {
-			return fmt.Errorf("checksum error on download source:%s downloaded:%s", bodyString, sha256String)
-		}
+// checkSourceSize rejects the sources smaller than worker.minSourceSize, like an error page served in place of the
+// source or a truncated file, before spending a download and an encode on them.
+func (J *EncodeWorker) checkSourceSize(size int64) error {
+	if J.workerConfig.MinSourceSize > 0 && size < J.workerConfig.MinSourceSize {
+		return fmt.Errorf("%w: %d bytes, the minimum is %d bytes", ErrorSourceTooSmall, size, J.workerConfig.MinSourceSize)
+	}
+	return nil
+}
 
-		track.UpdateValue(size)
+// verifySourceChecksum compares the sha256 of the downloaded source with the expected one. The checksum sent with the
+// job wins over ChecksumURL, which is not requested then. Without either the source is not verified, unless
+// worker.requireSourceChecksum is set.
+func (J *EncodeWorker) verifySourceChecksum(job *model.WorkTaskEncode, sha256String string) error {
+	expected := job.TaskEncode.SourceChecksum
+	if expected == "" && job.TaskEncode.ChecksumURL != "" {
+		var err error
+		if expected, err = J.calculateChecksum(job.TaskEncode.ChecksumURL); err != nil {
+			return err
+		}
+	}
+	if expected == "" {
+		if J.workerConfig.RequireSourceChecksum {
+			return fmt.Errorf("%w: no checksum to verify the source", ErrorDownloadRejected)
+		}
+		log.Debugf("job %s has no source checksum, skipping its verification", job.TaskEncode.Id.String())
 		return nil
-	}, retry.Delay(time.Second*5),
-		retry.Attempts(180), // 15 min
-		retry.LastErrorOnly(true),
-		retry.OnRetry(func(n uint, err error) {
-			J.terminal.Error("error on downloading job %s", err.Error())
-		}),
-		retry.RetryIf(func(err error) bool {
-			return !(errors.Is(err, context.Canceled) || errors.Is(err, ErrorJobNotFound))
-		}))
-
-	return err
+	}
+	if !strings.EqualFold(expected, sha256String) {
+		os.Remove(job.SourceFilePath)
+		return fmt.Errorf("%w: source:%s downloaded:%s", ErrorChecksumMismatch, expected, sha256String)
+	}
+	return nil
 }
 
 func (J *EncodeWorker) calculateChecksum(checksumURL string) (string, error) {
 	var bodyString string
 
+	client := J.workerConfig.jobHTTPClient(func(req *http.Request, via []*http.Request) error {
+		if len(via) > J.workerConfig.DownloadMaxRedirects {
+			return fmt.Errorf("%w: stopped after %d redirects", ErrorDownloadRejected, J.workerConfig.DownloadMaxRedirects)
+		}
+		return J.workerConfig.checkURLHost(req.URL.String())
+	})
+	defer client.CloseIdleConnections()
 	err := retry.Do(func() error {
-		respSha256, err := http.Get(checksumURL)
+		respSha256, err := client.Get(checksumURL)
 		if err != nil {
 			return err
 		}
@@ -270,13 +469,14 @@ func (J *EncodeWorker) calculateChecksum(checksumURL string) (string, error) {
 		bodyString = string(bodyBytes)
 		return nil
 	}, retry.Delay(time.Second*5),
+		retry.DelayType(J.workerConfig.retryDelayType(retry.BackOffDelay)),
 		retry.Attempts(10),
 		retry.LastErrorOnly(true),
 		retry.OnRetry(func(n uint, err error) {
 			J.terminal.Error("error %s on calculate checksum of downloaded job %s", err.Error(), checksumURL)
 		}),
 		retry.RetryIf(func(err error) bool {
-			return !errors.Is(err, context.Canceled)
+			return !errors.Is(err, context.Canceled) && !errors.Is(err, ErrorDownloadRejected) && !errors.Is(err, ErrorHostNotAllowed)
 		}))
 
 	if err != nil {
@@ -298,7 +498,7 @@ func (J *EncodeWorker) getVideoParameters(inputFile string) (data *ffprobe.Probe
 		return nil, 0, err
 	}
 
-	data, err = ffprobe.ProbeReader(J.ctx, fileReader)
+	data, err = ffprobe.ProbeReader(J.ctx, fileReader, J.probeOptions()...)
 	if err != nil {
 		return nil, 0, fmt.Errorf("error getting data: %v", err)
 	}
@@ -306,6 +506,34 @@ func (J *EncodeWorker) getVideoParameters(inputFile string) (data *ffprobe.Probe
 	return data, stat.Size(), nil
 }
 
+// probeOptions are the -analyzeduration and -probesize options used to read the sources, both ffprobe and ffmpeg
+// need the same ones or ffmpeg may miss streams found by ffprobe.
+func (J *EncodeWorker) probeOptions() []string {
+	var options []string
+	if J.workerConfig.AnalyzeDuration > 0 {
+		options = append(options, "-analyzeduration", strconv.FormatInt(J.workerConfig.AnalyzeDuration.Microseconds(), 10))
+	}
+	if J.workerConfig.ProbeSize > 0 {
+		options = append(options, "-probesize", strconv.FormatInt(J.workerConfig.ProbeSize, 10))
+	}
+	return options
+}
+
+// mainVideoStream returns the first video stream that is not an attached picture, the cover art some sources carry as
+// an extra mjpeg or png video stream. When every video stream is a picture the first one is returned.
+func mainVideoStream(data *ffprobe.ProbeData) *ffprobe.Stream {
+	videoStreams := data.StreamType(ffprobe.StreamVideo)
+	if len(videoStreams) == 0 {
+		return nil
+	}
+	for index := range videoStreams {
+		if videoStreams[index].Disposition.AttachedPic == 0 {
+			return &videoStreams[index]
+		}
+	}
+	return &videoStreams[0]
+}
+
 func FFProbeFrameRate(FFProbeFrameRate string) (frameRate int, err error) {
 	avgFrameSpl := strings.Split(FFProbeFrameRate, "/")
 	if len(avgFrameSpl) != 2 {
@@ -325,20 +553,33 @@ func FFProbeFrameRate(FFProbeFrameRate string) (frameRate int, err error) {
 	return frameRatio / rate, nil
 }
 
-func (J *EncodeWorker) clearData(data *ffprobe.ProbeData) (*ContainerData, error) {
-	container := &ContainerData{}
+// clearData chooses the streams to keep, the best audio per language and one subtitle per language plus the
+// forced and comment ones, unless the job carries a StreamSelection for that kind of stream.
+func (J *EncodeWorker) clearData(data *ffprobe.ProbeData, selection *model.StreamSelection) (*ContainerData, error) {
+	container := &ContainerData{Quality: defaultQualityProfile}
 
-	videoStream := data.StreamType(ffprobe.StreamVideo)[0]
+	videoStream := mainVideoStream(data)
+	if videoStream == nil {
+		return nil, fmt.Errorf("no video stream found")
+	}
 	frameRate, err := FFProbeFrameRate(videoStream.AvgFrameRate)
 	if err != nil {
 		frameRate = 24
 	}
 
 	container.Video = &Video{
-		Id:        uint8(videoStream.Index),
-		Duration:  data.Format.Duration(),
-		FrameRate: frameRate,
-	}
+		Id:         uint8(videoStream.Index),
+		Duration:   data.Format.Duration(),
+		FrameRate:  frameRate,
+		Width:      videoStream.Width,
+		Height:     videoStream.Height,
+		Bitrate:    videoBitrate(data, videoStream),
+		Codec:      videoStream.CodecName,
+		Profile:    videoStream.Profile,
+		PixFmt:     videoStream.PixFmt,
+		ColorRange: videoStream.ColorRange,
+	}
+	container.Video.CRF = J.workerConfig.CRFBitrateRules.CRF(container.Video.Bitrate)
 
 	betterAudioStreamPerLanguage := make(map[string]*Audio)
 
@@ -353,69 +594,112 @@ func (J *EncodeWorker) clearData(data *ffprobe.ProbeData) (*ContainerData, error
 		}
 
 		newAudio := &Audio{
-			Id:             uint8(stream.Index),
-			Language:       stream.Tags.Language,
-			Channels:       stream.ChannelLayout,
-			ChannelsNumber: uint8(stream.Channels),
-			ChannelLayour:  stream.ChannelLayout,
-			Default:        stream.Disposition.Default == 1,
-			Bitrate:        uint(bitRateInt),
-			Title:          stream.Tags.Title,
+			Id:              uint8(stream.Index),
+			Language:        sanitizeLanguage(stream.Tags.Language),
+			Channels:        stream.ChannelLayout,
+			ChannelsNumber:  uint8(stream.Channels),
+			ChannelLayour:   stream.ChannelLayout,
+			Default:         stream.Disposition.Default == 1,
+			Bitrate:         uint(bitRateInt),
+			Title:           J.workerConfig.sanitizeTitle(stream.Tags.Title),
+			Original:        stream.Disposition.Original == 1,
+			Dub:             stream.Disposition.Dub == 1,
+			Comment:         stream.Disposition.Comment == 1,
+			HearingImpaired: stream.Disposition.HearingImpaired == 1,
+			VisualImpaired:  stream.Disposition.VisualImpaired == 1,
+		}
+
+		if selection != nil && selection.Audio != nil {
+			if selection.Audio.Matches(stream.Index, newAudio.Language) {
+				container.Audios = append(container.Audios, newAudio)
+				container.addStreamDecision(&stream, true, "in the job stream selection")
+			} else {
+				container.addStreamDecision(&stream, false, "not in the job stream selection")
+			}
+			continue
 		}
 
 		betterAudio := betterAudioStreamPerLanguage[newAudio.Language]
+		bestAudioReason := fmt.Sprintf("best audio of language %s by channels and bitrate", newAudio.Language)
 
 		if betterAudio != nil && (newAudio.ChannelsNumber > betterAudio.ChannelsNumber || (newAudio.ChannelsNumber == betterAudio.ChannelsNumber && newAudio.Bitrate > betterAudio.Bitrate)) {
 			betterAudioStreamPerLanguage[newAudio.Language] = newAudio
+			container.setStreamDecision(betterAudio.Id, false, fmt.Sprintf("audio %d is better for language %s", newAudio.Id, newAudio.Language))
+			container.addStreamDecision(&stream, true, bestAudioReason)
 		} else if betterAudio == nil {
 			betterAudioStreamPerLanguage[newAudio.Language] = newAudio
+			container.addStreamDecision(&stream, true, bestAudioReason)
+		} else {
+			container.addStreamDecision(&stream, false, fmt.Sprintf("audio %d is better for language %s", betterAudio.Id, newAudio.Language))
 		}
 	}
 
 	for _, audioStream := range betterAudioStreamPerLanguage {
 		container.Audios = append(container.Audios, audioStream)
 	}
+	if selection == nil || selection.Audio == nil {
+		container.Audios = J.workerConfig.limitAudios(container.Audios)
+		container.dropUnselectedStreams("over worker.maxAudioTracks")
+	}
 
-	betterSubtitleStreamPerLanguage := make(map[string]*Subtitle)
+	var subtitleCandidates []*Subtitle
 
 	for _, stream := range data.StreamType(ffprobe.StreamSubtitle) {
 		newSubtitle := &Subtitle{
 			Id:       uint8(stream.Index),
-			Language: stream.Tags.Language,
+			Language: sanitizeLanguage(stream.Tags.Language),
 			Forced:   stream.Disposition.Forced == 1,
 			Comment:  stream.Disposition.Comment == 1,
+			Default:  stream.Disposition.Default == 1,
 			Format:   stream.CodecName,
-			Title:    stream.Tags.Title,
+			Title:    J.workerConfig.sanitizeTitle(stream.Tags.Title),
+			SDH:      stream.Disposition.HearingImpaired == 1 || isSDHTitle(stream.Tags.Title),
+			Size:     subtitleSize(&stream),
 		}
 
-		if newSubtitle.Forced || newSubtitle.Comment {
-			container.Subtitle = append(container.Subtitle, newSubtitle)
+		if selection != nil && selection.Subtitle != nil {
+			if selection.Subtitle.Matches(stream.Index, newSubtitle.Language) {
+				container.Subtitle = append(container.Subtitle, newSubtitle)
+				container.addStreamDecision(&stream, true, "in the job stream selection")
+			} else {
+				container.addStreamDecision(&stream, false, "not in the job stream selection")
+			}
 			continue
 		}
 
-		betterSubtitle := betterSubtitleStreamPerLanguage[newSubtitle.Language]
-
-		if betterSubtitle == nil {
-			betterSubtitleStreamPerLanguage[newSubtitle.Language] = newSubtitle
-		} else {
+		if newSubtitle.Forced || newSubtitle.Comment {
 			container.Subtitle = append(container.Subtitle, newSubtitle)
+			container.addStreamDecision(&stream, true, "forced or comment subtitles are always kept")
+			continue
 		}
+		subtitleCandidates = append(subtitleCandidates, newSubtitle)
+		container.addStreamDecision(&stream, false, "")
+	}
+	selectedSubtitles := J.workerConfig.selectSubtitles(subtitleCandidates)
+	container.recordSubtitleSelection(J.workerConfig, subtitleCandidates, selectedSubtitles)
+	container.Subtitle = append(container.Subtitle, selectedSubtitles...)
+	if selection == nil || selection.Subtitle == nil {
+		container.Subtitle = J.workerConfig.limitSubtitles(container.Subtitle)
+		container.dropUnselectedStreams("over worker.maxSubtitleTracks")
 	}
+	container.setDefaultSubtitle(J.workerConfig.ForcedSubtitleDefault)
 
-	for _, value := range betterSubtitleStreamPerLanguage {
-		container.Subtitle = append(container.Subtitle, value)
+	for _, attachmentStream := range data.StreamType(ffprobe.StreamAttachment) {
+		container.Attachments = append(container.Attachments, uint8(attachmentStream.Index))
+	}
+	for _, coverStream := range data.StreamType(ffprobe.StreamVideo) {
+		if coverStream.Index != videoStream.Index && coverStream.Disposition.AttachedPic == 1 {
+			container.CoverArt = append(container.CoverArt, uint8(coverStream.Index))
+		}
 	}
 
 	return container, nil
 }
 
-func (J *EncodeWorker) FFMPEG(job *model.WorkTaskEncode, videoContainer *ContainerData, ffmpegProgressChan chan<- FFMPEGProgress) error {
-	ffmpeg := &FFMPEGGenerator{}
-	ffmpeg.setInputFilters(videoContainer, job.SourceFilePath, job.WorkDir)
-	ffmpeg.setVideoFilters(videoContainer)
-	ffmpeg.setAudioFilters(videoContainer)
-	ffmpeg.setSubtFilters(videoContainer)
-	ffmpeg.setMetadata(videoContainer)
+// FFMPEG encodes the source into job.TargetFilePath. When segmentListPath is set the video was already encoded in
+// segments and it is copied from that concat list instead.
+func (J *EncodeWorker) FFMPEG(ctx context.Context, job *model.WorkTaskEncode, videoContainer *ContainerData, segmentListPath string, ffmpegProgressChan chan<- FFMPEGProgress) error {
+	ffmpegArguments := J.ffmpegArguments(job, videoContainer, segmentListPath)
 
 	ffmpegErrLog := ""
 	ffmpegOutLog := ""
@@ -457,23 +741,17 @@ func (J *EncodeWorker) FFMPEG(job *model.WorkTaskEncode, videoContainer *Contain
 		ffmpegOutLog += string(buffer)
 	}
 
-	sourceFileName := filepath.Base(job.SourceFilePath)
-	encodedFilePath := fmt.Sprintf("%s-encoded.%s", strings.TrimSuffix(sourceFileName, filepath.Ext(sourceFileName)), "mkv")
-	job.TargetFilePath = filepath.Join(job.WorkDir, encodedFilePath)
-
-	ffmpegArguments := ffmpeg.buildArguments(uint8(J.workerConfig.Threads), job.TargetFilePath)
-	J.terminal.Cmd("FFMPEG Command:%s %s", helper.GetFFmpegPath(), ffmpegArguments)
-
-	ffmpegCommand := command.NewCommandByString(helper.GetFFmpegPath(), ffmpegArguments).
+	ffmpegCommand := command.NewCommand(helper.GetFFmpegPath(), ffmpegArguments...).
 		SetWorkDir(job.WorkDir).
 		SetStdoutFunc(stdoutFFMPEG).
 		SetStderrFunc(checkPercentageFFMPEG)
+	J.terminal.Cmd("FFMPEG Command:%s", ffmpegCommand.GetFullCommand())
 
-	if runtime.GOOS == "linux" {
-		ffmpegCommand.AddEnv(fmt.Sprintf("LD_LIBRARY_PATH=%s", filepath.Dir(helper.GetFFmpegPath())))
+	if libraryPathEnv := helper.LibraryPathEnv(helper.GetFFmpegPath()); libraryPathEnv != "" {
+		ffmpegCommand.AddEnv(libraryPathEnv)
 	}
 
-	exitCode, err := ffmpegCommand.RunWithContext(J.ctx)
+	exitCode, err := J.runFFmpeg(ctx, ffmpegCommand, ffmpegPriorityEncode)
 	if err != nil {
 		return fmt.Errorf("%w: stderr:%s stdout:%s", err, ffmpegErrLog, ffmpegOutLog)
 	}
@@ -482,7 +760,44 @@ func (J *EncodeWorker) FFMPEG(job *model.WorkTaskEncode, videoContainer *Contain
 		return fmt.Errorf("exit code %d: stderr:%s stdout:%s", exitCode, ffmpegErrLog, ffmpegOutLog)
 	}
 
-	return nil
+	return J.checkFFmpegWarnings(job, ffmpegErrLog)
+}
+
+// ffmpegArguments runs the FFMPEGGenerator steps for the job and returns the ffmpeg arguments, setting
+// job.TargetFilePath to the encoded file.
+func (J *EncodeWorker) ffmpegArguments(job *model.WorkTaskEncode, videoContainer *ContainerData, segmentListPath string) []string {
+	ffmpeg := &FFMPEGGenerator{segmentListPath: segmentListPath}
+	sourceOptions := J.sourceInputOptions(videoContainer.Quality)
+	// the segments are decoded by their own encodes, a copied video is not decoded at all
+	if segmentListPath == "" && !videoContainer.Video.Copy {
+		sourceOptions = append(videoContainer.Video.decodeOptions(J.workerConfig), sourceOptions...)
+	}
+	ffmpeg.setInputFilters(videoContainer, job.SourceFilePath, sourceOptions, job.WorkDir)
+	ffmpeg.setVideoFilters(videoContainer)
+	ffmpeg.setAudioFilters(videoContainer, J.workerConfig)
+	// copying every stream is explicit, a subtitle the output can not hold fails the encode instead of being dropped
+	if !videoContainer.CopyStreams {
+		incompatibleSubtitleAction := J.workerConfig.IncompatibleSubtitleAction
+		if videoContainer.Quality.Container == ContainerWebM {
+			// webm holds no subtitle codec but webvtt, dropping every text subtitle by default is not expected
+			incompatibleSubtitleAction = IncompatibleSubtitleActionConvert
+		}
+		for _, message := range videoContainer.resolveSubtitleCompatibility(videoContainer.Quality.Container, incompatibleSubtitleAction) {
+			J.terminal.Warn("[%s] %s", job.TaskEncode.Id.String(), message)
+		}
+		videoContainer.dropUnselectedStreams(fmt.Sprintf("%s can not hold its codec", videoContainer.Quality.Container))
+	}
+	videoContainer.logStreamDecisions(job.TaskEncode.Id.String())
+	ffmpeg.setSubtFilters(videoContainer)
+	ffmpeg.setMetadata(videoContainer, J.workerConfig, job.TaskEncode.Metadata)
+
+	encodedFilePath := fmt.Sprintf("%s.%s", outputFileName(J.workerConfig.OutputFileTemplate, job, videoContainer), videoContainer.Quality.Container)
+	job.TargetFilePath = filepath.Join(job.WorkDir, encodedFilePath)
+	ffmpeg.setMuxingFlags(J.workerConfig, job.TargetFilePath)
+	ffmpeg.setAttachmentFilters(videoContainer, J.workerConfig, job.TargetFilePath)
+	ffmpeg.setCoverArtFilters(videoContainer, J.workerConfig)
+
+	return ffmpeg.buildArguments(uint8(J.workerConfig.Threads), job.TargetFilePath)
 }
 
 type ProgressTrackReader struct {
@@ -514,6 +829,13 @@ func (J *EncodeWorker) UploadJob(task *model.WorkTaskEncode, track *TaskTracks)
 	J.updateTaskStatus(task, model.UploadNotification, model.ProgressingNotificationStatus, "")
 	err := retry.Do(func() error {
 		track.UpdateValue(0)
+		if task.TargetFileChecksum == "" {
+			checksum, err := J.fileChecksum(task.TargetFilePath)
+			if err != nil {
+				return err
+			}
+			task.TargetFileChecksum = checksum
+		}
 		encodedFile, err := os.Open(task.TargetFilePath)
 		if err != nil {
 			return err
@@ -522,46 +844,18 @@ func (J *EncodeWorker) UploadJob(task *model.WorkTaskEncode, track *TaskTracks)
 		fi, _ := encodedFile.Stat()
 		fileSize := fi.Size()
 		track.SetTotal(fileSize)
-		sha := sha256.New()
-		if _, err := io.Copy(sha, encodedFile); err != nil {
-			return err
-		}
-		checksum := hex.EncodeToString(sha.Sum(nil))
-		encodedFile.Seek(0, io.SeekStart)
 
 		reader := NewProgressTrackStream(track, encodedFile)
-
-		client := &http.Client{}
-		//go printProgress(J.ctx, reader, fileSize, wg, "Uploading")
-		req, err := http.NewRequestWithContext(J.ctx, "POST", task.TaskEncode.UploadURL, reader)
-		if err != nil {
-			return err
-		}
-		req.ContentLength = fileSize
-		req.Body = reader
-		req.GetBody = func() (io.ReadCloser, error) {
-			return io.NopCloser(reader), nil
-		}
-
-		req.Header.Add("checksum", checksum)
-		req.Header.Add("Content-Type", "application/octet-stream")
-		req.Header.Add("Content-Length", strconv.FormatInt(fileSize, 10))
-		resp, err := client.Do(req)
-
-		if err != nil {
+		if err = J.uploadDestination(task.TaskEncode.UploadURL).Upload(task, reader, fileSize, task.TargetFileChecksum); err != nil {
 			return err
 		}
-		//wg.Wait()
-		if resp.StatusCode != 201 {
-			return fmt.Errorf("invalid status code %d", resp.StatusCode)
-		}
 		track.UpdateValue(fileSize)
 		return nil
 	}, retry.Delay(time.Second*5),
 		retry.RetryIf(func(err error) bool {
-			return !errors.Is(err, context.Canceled)
+			return !errors.Is(err, context.Canceled) && !errors.Is(err, ErrorUploadRejected) && !errors.Is(err, ErrorHostNotAllowed)
 		}),
-		retry.DelayType(retry.FixedDelay),
+		retry.DelayType(J.workerConfig.retryDelayType(retry.FixedDelay)),
 		retry.Attempts(17280),
 		retry.LastErrorOnly(true),
 		retry.OnRetry(func(n uint, err error) {
@@ -587,13 +881,25 @@ func (J *EncodeWorker) errorJob(taskEncode *model.WorkTaskEncode, err error) {
 	taskEncode.Clean()
 }
 
+// skipJob closes a job whose encode brought no benefit or whose source is too small, nothing is uploaded so the server
+// keeps the source.
+func (J *EncodeWorker) skipJob(taskEncode *model.WorkTaskEncode, err error) {
+	J.terminal.Warn("[%s] %v, keeping the source", taskEncode.TaskEncode.Id.String(), err)
+	J.updateTaskStatus(taskEncode, model.JobNotification, model.SkippedNotificationStatus, err.Error())
+	taskEncode.Clean()
+}
+
 func (J *EncodeWorker) Execute(workData []byte) error {
 	taskEncode := &model.TaskEncode{}
 	err := json.Unmarshal(workData, taskEncode)
 	if err != nil {
 		return err
 	}
-	workDir := filepath.Join(J.tempPath, taskEncode.Id.String())
+	workDir, workDirErr := J.jobWorkDir(taskEncode)
+	if workDirErr != nil {
+		// the job is failed from the temp path, which always exists
+		workDir = filepath.Join(J.tempPath, taskEncode.Id.String())
+	}
 	workTaskEncode := &model.WorkTaskEncode{
 		TaskEncode: taskEncode,
 		WorkDir:    workDir,
@@ -601,6 +907,14 @@ func (J *EncodeWorker) Execute(workData []byte) error {
 	os.MkdirAll(workDir, os.ModePerm)
 
 	J.updateTaskStatus(workTaskEncode, model.JobNotification, model.ProgressingNotificationStatus, "")
+	if workDirErr != nil {
+		J.errorJob(workTaskEncode, workDirErr)
+		return nil
+	}
+	if err = J.workerConfig.checkJobURLs(taskEncode); err != nil {
+		J.errorJob(workTaskEncode, err)
+		return nil
+	}
 	J.AddDownloadJob(workTaskEncode)
 	return nil
 }
@@ -612,6 +926,9 @@ func (J *EncodeWorker) StopQueues() {
 	defer close(J.downloadChan)
 	defer close(J.uploadChan)
 	defer close(J.encodeChan)
+	for _, poolChan := range J.encodePools {
+		defer close(poolChan)
+	}
 	J.stopQueues()
 	J.wg.Wait()
 }
@@ -621,14 +938,17 @@ func (J *EncodeWorker) GetID() string {
 func (J *EncodeWorker) updateTaskStatus(encode *model.WorkTaskEncode, notificationType model.NotificationType, status model.NotificationStatus, message string) {
 	encode.TaskEncode.EventID++
 	event := model.TaskEvent{
-		Id:               encode.TaskEncode.Id,
-		EventID:          encode.TaskEncode.EventID,
-		EventType:        model.NotificationEvent,
-		WorkerName:       J.workerConfig.Name,
-		EventTime:        time.Now(),
-		NotificationType: notificationType,
-		Status:           status,
-		Message:          message,
+		Id:                  encode.TaskEncode.Id,
+		EventID:             encode.TaskEncode.EventID,
+		EventType:           model.NotificationEvent,
+		WorkerName:          J.workerConfig.Name,
+		EventTime:           time.Now(),
+		NotificationType:    notificationType,
+		Status:              status,
+		Message:             message,
+		Report:              encode.Report,
+		Manifest:            encode.Manifest,
+		DestinationFileName: encode.DestinationFileName,
 	}
 	J.Manager.EventNotification(event)
 	J.terminal.Log("[%s] %s has been %s: %s", event.Id.String(), event.NotificationType, event.Status, event.Message)
@@ -641,62 +961,118 @@ func (J *EncodeWorker) updateTaskStatus(encode *model.WorkTaskEncode, notificati
 }
 
 func (J *EncodeWorker) saveTaskStatusDisk(taskEncode *model.TaskStatus) {
-	J.mu.Lock()
-	defer J.mu.Unlock()
+	value, _ := J.taskStatusFiles.LoadOrStore(taskEncode.Task.TaskEncode.Id, &taskStatusFile{})
+	statusFile := value.(*taskStatusFile)
+	statusFile.mu.Lock()
+	defer statusFile.mu.Unlock()
+	if taskEncode.LastState.IsFinished() {
+		defer J.taskStatusFiles.Delete(taskEncode.Task.TaskEncode.Id)
+	}
+
+	// progress updates are only written every taskStatusSyncInterval, any other state change is written right away
+	isProgressUpdate := taskEncode.LastState.Status == model.ProgressingNotificationStatus && taskEncode.LastState.Message != ""
+	if isProgressUpdate && time.Since(statusFile.lastWrite) < J.workerConfig.TaskStatusSyncInterval {
+		return
+	}
+
 	b, err := json.MarshalIndent(taskEncode, "", "\t")
 	if err != nil {
 		panic(err)
 	}
-	eventFile, err := os.OpenFile(filepath.Join(taskEncode.Task.WorkDir, fmt.Sprintf("%s.json", taskEncode.Task.TaskEncode.Id)), os.O_TRUNC|os.O_CREATE|os.O_RDWR, os.ModePerm)
+	// the status is written to a synced temporary file and renamed over the previous one, so a crash in the middle
+	// of the write never leaves a truncated status file behind, whatever the filesystem orders the writes
+	statusFilePath := filepath.Join(taskEncode.Task.WorkDir, fmt.Sprintf("%s.json", taskEncode.Task.TaskEncode.Id))
+	tmpFilePath := statusFilePath + ".tmp"
+	eventFile, err := os.OpenFile(tmpFilePath, os.O_TRUNC|os.O_CREATE|os.O_RDWR, os.ModePerm)
 	if err != nil {
+		J.terminal.Warn("[%s] error creating task status: %v", taskEncode.Task.TaskEncode.Id.String(), err)
 		return
 	}
-	defer eventFile.Close()
-	eventFile.Write(b)
-	eventFile.Sync()
+	if _, err = eventFile.Write(b); err != nil {
+		eventFile.Close()
+		J.terminal.Warn("[%s] error writing task status: %v", taskEncode.Task.TaskEncode.Id.String(), err)
+		return
+	}
+	if err = eventFile.Sync(); err != nil {
+		eventFile.Close()
+		J.terminal.Warn("[%s] error syncing task status: %v", taskEncode.Task.TaskEncode.Id.String(), err)
+		return
+	}
+	eventFile.Close()
+	if err = os.Rename(tmpFilePath, statusFilePath); err != nil {
+		J.terminal.Warn("[%s] error saving task status: %v", taskEncode.Task.TaskEncode.Id.String(), err)
+		return
+	}
+	statusFile.lastWrite = time.Now()
 }
-func (J *EncodeWorker) readTaskStatusFromDiskByPath(filepath string) *model.TaskStatus {
+func (J *EncodeWorker) readTaskStatusFromDiskByPath(filepath string) (*model.TaskStatus, error) {
 	eventFile, err := os.Open(filepath)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer eventFile.Close()
 	b, err := io.ReadAll(eventFile)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	taskStatus := &model.TaskStatus{}
 	err = json.Unmarshal(b, taskStatus)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return taskStatus
+	if taskStatus.LastState == nil || taskStatus.Task == nil || taskStatus.Task.TaskEncode == nil {
+		return nil, errors.New("incomplete task status")
+	}
+	return taskStatus, nil
 }
 
-func (J *EncodeWorker) PGSMkvExtractDetectAndConvert(taskEncode *model.WorkTaskEncode, track *TaskTracks, container *ContainerData) error {
+func (J *EncodeWorker) PGSMkvExtractDetectAndConvert(taskEncode *model.WorkTaskEncode, track *TaskTracks, progress *jobProgress, container *ContainerData) error {
 	var PGSTOSrt []*Subtitle
 	for _, subt := range container.Subtitle {
-		if subt.isImageTypeSubtitle() {
+		if container.convertsToSrt(subt) {
 			PGSTOSrt = append(PGSTOSrt, subt)
 		}
 	}
 	if len(PGSTOSrt) > 0 {
-		J.updateTaskStatus(taskEncode, model.MKVExtractNotification, model.ProgressingNotificationStatus, "")
-		track.Message(string(model.MKVExtractNotification))
-		track.SetTotal(0)
-		err := J.MKVExtract(PGSTOSrt, taskEncode)
-		if err != nil {
-			J.updateTaskStatus(taskEncode, model.MKVExtractNotification, model.FailedNotificationStatus, err.Error())
-			return err
+		if subtitlesExtracted(taskEncode, PGSTOSrt) {
+			// a resumed job, the previous run extracted them before the restart
+			J.terminal.Log("[%s] reusing the %d image subtitles already extracted", taskEncode.TaskEncode.Id.String(), len(PGSTOSrt))
+		} else {
+			extractNotification, extract := J.subtitleExtractor(taskEncode)
+			J.updateTaskStatus(taskEncode, extractNotification, model.ProgressingNotificationStatus, "")
+			track.Message(string(extractNotification))
+			var sourceSize int64
+			if stat, err := os.Stat(taskEncode.SourceFilePath); err == nil {
+				sourceSize = stat.Size()
+			}
+			extractPhase := progress.phase(float64(sourceSize) / extractBytesPerSecond)
+			extractCtx, cancelExtract := J.extractContext()
+			err := extract(extractCtx, PGSTOSrt, taskEncode)
+			if errors.Is(extractCtx.Err(), context.DeadlineExceeded) {
+				err = fmt.Errorf("subtitle extraction exceeded the maximum duration of %s", J.workerConfig.SubtitleExtractTimeout)
+			}
+			cancelExtract()
+			extractPhase.finish()
+			if err != nil {
+				J.updateTaskStatus(taskEncode, extractNotification, model.FailedNotificationStatus, err.Error())
+				return err
+			}
+			J.markSubtitlesExtracted(taskEncode, PGSTOSrt)
+			J.updateTaskStatus(taskEncode, extractNotification, model.CompletedNotificationStatus, "")
 		}
-		J.updateTaskStatus(taskEncode, model.MKVExtractNotification, model.CompletedNotificationStatus, "")
 
 		log.Debug("is going to start PGS task?")
 		J.updateTaskStatus(taskEncode, model.PGSNotification, model.ProgressingNotificationStatus, "")
 		track.Message(string(model.PGSNotification))
 		log.Debugf("converting PGS to SRT: %+v", PGSTOSrt)
-		err = J.convertPGSToSrt(taskEncode, container, PGSTOSrt)
-		if err != nil {
+		err := J.convertPGSToSrt(taskEncode, track, container, PGSTOSrt, progress)
+		if errors.Is(err, ErrorPGSWorkerUnavailable) && J.workerConfig.PGSUnavailableAction == PGSUnavailableActionDrop {
+			message := fmt.Sprintf("dropping %d image subtitles: %v", len(PGSTOSrt), err)
+			J.terminal.Warn("[%s] %s", taskEncode.TaskEncode.Id.String(), message)
+			container.dropImageTypeSubtitles()
+			container.dropUnselectedStreams("no PGS worker converted it, worker.pgsUnavailableAction is drop")
+			J.updateTaskStatus(taskEncode, model.PGSNotification, model.CompletedNotificationStatus, message)
+		} else if err != nil {
 			J.updateTaskStatus(taskEncode, model.PGSNotification, model.FailedNotificationStatus, err.Error())
 			return err
 		} else {
@@ -706,75 +1082,205 @@ func (J *EncodeWorker) PGSMkvExtractDetectAndConvert(taskEncode *model.WorkTaskE
 	return nil
 }
 
-func (J *EncodeWorker) convertPGSToSrt(taskEncode *model.WorkTaskEncode, container *ContainerData, subtitles []*Subtitle) error {
+// pgsConversionTimeout is the time to wait for the SRT of tracks image subtitles of size bytes. With
+// worker.pgsTimeoutPerTrack or worker.pgsTimeoutPerMB it grows with the subtitles up to worker.pgsTimeout, which is
+// otherwise the timeout of every job. 0 waits forever.
+func (c Config) pgsConversionTimeout(tracks int, size int64) time.Duration {
+	if c.PGSTimeoutPerTrack <= 0 && c.PGSTimeoutPerMB <= 0 {
+		return c.PGSTimeout
+	}
+	timeout := c.PGSTimeoutPerTrack*time.Duration(tracks) + time.Duration(float64(c.PGSTimeoutPerMB)*float64(size)/(1024*1024))
+	if c.PGSTimeout > 0 && timeout > c.PGSTimeout {
+		return c.PGSTimeout
+	}
+	return timeout
+}
+
+// pgsRetryDelay is the wait before the retry attempt of a failed PGS conversion, worker.pgsRetryDelay doubled on
+// every attempt up to worker.pgsRetryMaxDelay, plus up to a fifth of it so the retries of several encode workers
+// spread.
+func (c Config) pgsRetryDelay(attempt int) time.Duration {
+	delay := c.PGSRetryDelay
+	for i := 1; i < attempt && (c.PGSRetryMaxDelay <= 0 || delay < c.PGSRetryMaxDelay); i++ {
+		delay *= 2
+	}
+	if c.PGSRetryMaxDelay > 0 && delay > c.PGSRetryMaxDelay {
+		delay = c.PGSRetryMaxDelay
+	}
+	return delay + randomDuration(delay/5)
+}
+
+// retryPGSJob requests again the conversion of a subtitle after delay, unless the worker stops meanwhile.
+func (J *EncodeWorker) retryPGSJob(pgsRequest model.TaskPGS, delay time.Duration, forward func(<-chan *model.TaskPGSResponse)) {
+	select {
+	case <-J.ctx.Done():
+		return
+	case <-time.After(delay):
+	}
+	forward(J.RequestPGSJob(pgsRequest))
+}
+
+// convertPGSToSrt sends every image subtitle to the PGS workers and waits for their SRT. The OCR gets no progress
+// from the PGS workers, so its share of the job progress is estimated from the PGS bytes and the OCR rate measured
+// on previous jobs, capped until the responses arrive, and each response fills the share of its subtitle. While the
+// PGS queue holds jobs no PGS worker picked up, the PGS step is reported as waiting for an OCR worker.
+func (J *EncodeWorker) convertPGSToSrt(taskEncode *model.WorkTaskEncode, track *TaskTracks, container *ContainerData, subtitles []*Subtitle, progress *jobProgress) error {
 	log.Debug("convert PGS to SRT")
-	out := make(chan *model.TaskPGSResponse)
-	var pendingPGSResponses []<-chan *model.TaskPGSResponse
+	// every subtitle has at most one request in flight, the forwarders never block even after an early return
+	out := make(chan *model.TaskPGSResponse, len(subtitles))
+	forward := func(response <-chan *model.TaskPGSResponse) {
+		for v := range response {
+			out <- v
+		}
+	}
+	pgsRequests := make(map[int]model.TaskPGS)
+	pgsAttempts := make(map[int]int)
+	subtitlesByPGSID := make(map[int]*Subtitle)
+	pgsBytes := make(map[int]int64)
+	var totalBytes, convertedBytes int64
 	for _, subtitle := range subtitles {
 		log.Debugf("starting to process subtitle %+v", subtitle)
-		subFile, err := os.Open(filepath.Join(taskEncode.WorkDir, fmt.Sprintf("%d.sup", subtitle.Id)))
-		if err != nil {
-			return err
+		if convertedSrt(taskEncode, subtitle) {
+			J.terminal.Log("[%s] subtitle %d already converted before a restart, reusing its SRT", taskEncode.TaskEncode.Id.String(), subtitle.Id)
+			continue
+		}
+		outputBytes, err := os.ReadFile(filepath.Join(taskEncode.WorkDir, subtitle.supFileName()))
+		// malformed sources may extract nothing for a track, that subtitle is lost but the rest of the job is fine
+		if errors.Is(err, os.ErrNotExist) || (err == nil && len(outputBytes) == 0) {
+			J.terminal.Warn("[%s] subtitle %d extracted no PGS data, skipping it", taskEncode.TaskEncode.Id.String(), subtitle.Id)
+			container.dropSubtitle(subtitle)
+			container.setStreamDecision(subtitle.Id, false, "extracted no PGS data")
+			continue
 		}
-		outputBytes, err := io.ReadAll(subFile)
 		if err != nil {
 			return err
 		}
-		subFile.Close()
+		subtitlesByPGSID[int(subtitle.Id)] = subtitle
+		pgsBytes[int(subtitle.Id)] = int64(len(outputBytes))
+		totalBytes += int64(len(outputBytes))
 		log.Debugf("subtitle %d is pgs, requesting conversion", subtitle.Id)
 
-		PGSResponse := J.RequestPGSJob(model.TaskPGS{
+		pgsRequest := model.TaskPGS{
 			Id:          taskEncode.TaskEncode.Id,
 			PGSID:       int(subtitle.Id),
 			PGSdata:     outputBytes,
 			PGSLanguage: subtitle.Language,
-		})
-		pendingPGSResponses = append(pendingPGSResponses, PGSResponse)
-	}
-	go func() {
-		for _, c := range pendingPGSResponses {
-			for v := range c {
-				out <- v
-			}
 		}
-		close(out)
-	}()
+		pgsRequests[pgsRequest.PGSID] = pgsRequest
+		go forward(J.RequestPGSJob(pgsRequest))
+	}
+	if len(pgsRequests) == 0 {
+		return nil
+	}
+
+	rate := J.ocrRate.get()
+	ocrPhase := progress.phase(float64(totalBytes) / rate)
+	defer ocrPhase.finish()
+	ocrStart := time.Now()
+	ocrTicker := time.NewTicker(time.Second * 5)
+	defer ocrTicker.Stop()
 
 	log.Debug("start the PGs counter")
+	var pgsTimeout, pickupCheck <-chan time.Time
+	timeout := J.workerConfig.pgsConversionTimeout(len(subtitlesByPGSID), totalBytes)
+	if timeout > 0 {
+		log.Debugf("waiting up to %s for %d PGS (%d bytes)", timeout, len(subtitlesByPGSID), totalBytes)
+		pgsTimeout = time.After(timeout)
+	}
+	lastQueueMessages, err := J.Manager.PGSQueueMessages()
+	if err == nil && J.workerConfig.PGSPickupTimeout > 0 {
+		pickupCheck = time.After(J.workerConfig.PGSPickupTimeout)
+	}
+	waitingOCR := false
+	setWaitingOCR := func(waiting bool) {
+		if waiting == waitingOCR {
+			return
+		}
+		waitingOCR = waiting
+		if waiting {
+			J.updateTaskStatus(taskEncode, model.PGSNotification, model.WaitingNotificationStatus, "waiting for OCR worker")
+			track.Message("waiting for OCR worker")
+		} else {
+			J.updateTaskStatus(taskEncode, model.PGSNotification, model.ProgressingNotificationStatus, "")
+			track.Message(string(model.PGSNotification))
+		}
+	}
 	for {
 		select {
 		case <-J.ctx.Done():
 			return J.ctx.Err()
-		case <-time.After(time.Minute * 90):
-			return errors.New("timeout waiting for PGS job done")
-		case response, ok := <-out:
-			if !ok {
-				return nil
+		case <-ocrTicker.C:
+			if totalBytes > 0 {
+				ocrPhase.advance(math.Min(time.Since(ocrStart).Seconds()*rate/float64(totalBytes), ocrEstimateCap))
 			}
-			log.Debugf("response: %+v", response)
-			if response.Err != "" {
-				return fmt.Errorf("error on process PGS %d: %s", response.PGSID, response.Err)
+			if queueMessages, err := J.Manager.PGSQueueMessages(); err == nil {
+				setWaitingOCR(queueMessages > 0)
 			}
-			subtFilePath := filepath.Join(taskEncode.WorkDir, fmt.Sprintf("%d.srt", response.PGSID))
-			err := os.WriteFile(subtFilePath, response.Srt, os.ModePerm)
+		case <-pgsTimeout:
+			return fmt.Errorf("timeout waiting for PGS job done after %s", timeout)
+		case <-pickupCheck:
+			queueMessages, err := J.Manager.PGSQueueMessages()
 			if err != nil {
+				log.Warnf("error inspecting PGS queue: %v", err)
+			} else if queueMessages == 0 {
+				// every PGS job has been picked up, the responses will arrive eventually
+				pickupCheck = nil
+				continue
+			} else if queueMessages >= lastQueueMessages {
+				return fmt.Errorf("%w: PGS queue did not shrink in %s", ErrorPGSWorkerUnavailable, J.workerConfig.PGSPickupTimeout)
+			}
+			lastQueueMessages = queueMessages
+			pickupCheck = time.After(J.workerConfig.PGSPickupTimeout)
+		case response := <-out:
+			log.Debugf("response: %+v", response)
+			setWaitingOCR(false)
+			if response.Err == ErrorPGSWorkerUnavailable.Error() {
+				return ErrorPGSWorkerUnavailable
+			}
+			subtitle, found := subtitlesByPGSID[response.PGSID]
+			if !found {
+				return fmt.Errorf("received PGS %d that was not requested", response.PGSID)
+			}
+			if response.Err != "" {
+				pgsAttempts[response.PGSID]++
+				if pgsAttempts[response.PGSID] <= J.workerConfig.PGSRetries {
+					delay := J.workerConfig.pgsRetryDelay(pgsAttempts[response.PGSID])
+					J.terminal.Warn("[%s] error on process PGS %d: %s, retry %d/%d in %s", taskEncode.TaskEncode.Id.String(), response.PGSID, response.Err, pgsAttempts[response.PGSID], J.workerConfig.PGSRetries, delay)
+					go J.retryPGSJob(pgsRequests[response.PGSID], delay, forward)
+					continue
+				}
+				err := fmt.Errorf("error on process PGS %d after %d attempts: %s", response.PGSID, pgsAttempts[response.PGSID], response.Err)
+				if J.workerConfig.PGSFailureAction != PGSFailureActionDrop {
+					return err
+				}
+				J.terminal.Warn("[%s] dropping subtitle %d: %v", taskEncode.TaskEncode.Id.String(), subtitle.Id, err)
+				container.dropSubtitle(subtitle)
+				container.setStreamDecision(subtitle.Id, false, "OCR failed, worker.pgsFailureAction is drop")
+			} else if err := writeWorkFile(filepath.Join(taskEncode.WorkDir, subtitle.srtFileName()), response.Srt); err != nil {
 				return err
 			}
+			delete(pgsRequests, response.PGSID)
+			convertedBytes += pgsBytes[response.PGSID]
+			ocrPhase.advance(float64(convertedBytes) / float64(totalBytes))
+			if len(pgsRequests) == 0 {
+				J.ocrRate.record(totalBytes, time.Since(ocrStart))
+				return nil
+			}
 		}
 	}
 }
 
-func (J *EncodeWorker) MKVExtract(subtitles []*Subtitle, taskEncode *model.WorkTaskEncode) error {
+func (J *EncodeWorker) MKVExtract(ctx context.Context, subtitles []*Subtitle, taskEncode *model.WorkTaskEncode) error {
 	mkvExtractCommand := command.NewCommand(helper.GetMKVExtractPath(), "tracks", taskEncode.SourceFilePath).
 		SetWorkDir(taskEncode.WorkDir)
-	if runtime.GOOS == "linux" {
-		mkvExtractCommand.AddEnv(fmt.Sprintf("LD_LIBRARY_PATH=%s", filepath.Dir(helper.GetMKVExtractPath())))
+	if libraryPathEnv := helper.LibraryPathEnv(helper.GetMKVExtractPath()); libraryPathEnv != "" {
+		mkvExtractCommand.AddEnv(libraryPathEnv)
 	}
 	for _, subtitle := range subtitles {
-		mkvExtractCommand.AddParam(fmt.Sprintf("%d:%d.sup", subtitle.Id, subtitle.Id))
+		mkvExtractCommand.AddParam(fmt.Sprintf("%d:%s", subtitle.Id, subtitle.supFileName()))
 	}
 
-	_, err := mkvExtractCommand.RunWithContext(J.ctx, command.NewAllowedCodesOption(0, 1))
+	_, err := mkvExtractCommand.RunWithContext(ctx, command.NewAllowedCodesOption(0, 1))
 	if err != nil {
 		J.terminal.Cmd("MKVExtract command:%s", mkvExtractCommand.GetFullCommand())
 		return fmt.Errorf("MKVExtract unexpected error:%v", err.Error())
@@ -782,6 +1288,42 @@ func (J *EncodeWorker) MKVExtract(subtitles []*Subtitle, taskEncode *model.WorkT
 
 	return nil
 }
+
+// FFMPEGExtract extracts the subtitles to the same files as MKVExtract, but works with any container.
+func (J *EncodeWorker) FFMPEGExtract(ctx context.Context, subtitles []*Subtitle, taskEncode *model.WorkTaskEncode) error {
+	ffmpegCommand := command.NewCommand(helper.GetFFmpegPath(), "-hide_banner", "-y", "-i", taskEncode.SourceFilePath).
+		SetWorkDir(taskEncode.WorkDir)
+	if libraryPathEnv := helper.LibraryPathEnv(helper.GetFFmpegPath()); libraryPathEnv != "" {
+		ffmpegCommand.AddEnv(libraryPathEnv)
+	}
+	for _, subtitle := range subtitles {
+		ffmpegCommand.AddParam("-map").AddParam(fmt.Sprintf("0:%d", subtitle.Id)).
+			AddParam("-c:s").AddParam("copy").
+			AddParam(subtitle.supFileName())
+	}
+
+	_, err := J.runFFmpeg(ctx, ffmpegCommand, ffmpegPriorityAuxiliary)
+	if err != nil {
+		J.terminal.Cmd("FFMPEG extract command:%s", ffmpegCommand.GetFullCommand())
+		return fmt.Errorf("FFMPEG extract unexpected error:%v", err.Error())
+	}
+
+	return nil
+}
+
+// subtitleExtractor returns the extractor configured in worker.subtitleExtractor and its notification type.
+func (J *EncodeWorker) subtitleExtractor(taskEncode *model.WorkTaskEncode) (model.NotificationType, func(context.Context, []*Subtitle, *model.WorkTaskEncode) error) {
+	switch J.workerConfig.SubtitleExtractor {
+	case SubtitleExtractorMKVExtract:
+		return model.MKVExtractNotification, J.MKVExtract
+	case SubtitleExtractorFFMPEG:
+		return model.FFMPEGExtractNotification, J.FFMPEGExtract
+	}
+	if strings.EqualFold(filepath.Ext(taskEncode.SourceFilePath), ".mkv") {
+		return model.MKVExtractNotification, J.MKVExtract
+	}
+	return model.FFMPEGExtractNotification, J.FFMPEGExtract
+}
 func (J *EncodeWorker) PrefetchJobs() uint32 {
 	return atomic.LoadUint32(&J.prefetchJobs)
 }
@@ -806,6 +1348,10 @@ func (J *EncodeWorker) downloadQueue() {
 				continue
 			}
 
+			// the place reserved in the encode backlog is released once the job is in an encode queue, or failed
+			if !J.waitEncodeBacklog() {
+				continue
+			}
 			taskTrack := J.terminal.AddTask(job.TaskEncode.Id.String(), DownloadJobStepType)
 
 			J.updateTaskStatus(job, model.DownloadNotification, model.ProgressingNotificationStatus, "")
@@ -813,18 +1359,83 @@ func (J *EncodeWorker) downloadQueue() {
 			if err != nil {
 				J.updateTaskStatus(job, model.DownloadNotification, model.FailedNotificationStatus, err.Error())
 				taskTrack.Error()
-				J.errorJob(job, err)
+				if errors.Is(err, ErrorSourceTooSmall) && J.workerConfig.SmallSourceAction == SmallSourceActionSkip {
+					J.skipJob(job, err)
+				} else {
+					J.errorJob(job, err)
+				}
 				atomic.AddUint32(&J.prefetchJobs, ^uint32(0))
+				J.releaseEncodeBacklog()
 				continue
 			}
 			J.updateTaskStatus(job, model.DownloadNotification, model.CompletedNotificationStatus, "")
 			taskTrack.Done()
-			J.encodeChan <- job
+			J.encodePoolChan(job) <- job
+			J.releaseEncodeBacklog()
 		}
 	}
 
 }
 
+// encodeBacklog is the number of downloaded jobs waiting in the encode queues, counting the downloads running for them.
+func (J *EncodeWorker) encodeBacklog() int {
+	J.backlogMutex.Lock()
+	defer J.backlogMutex.Unlock()
+	return J.queuedEncodeBacklog()
+}
+
+// queuedEncodeBacklog is encodeBacklog, called with backlogMutex held.
+func (J *EncodeWorker) queuedEncodeBacklog() int {
+	backlog := len(J.encodeChan) + J.backlogDownloads
+	for _, encodePool := range J.encodePools {
+		backlog += len(encodePool)
+	}
+	return backlog
+}
+
+// reserveEncodeBacklog takes a place in the encode backlog for a download unless it reached
+// worker.encodeQueueHighWatermark. The check and the reservation are a single step, so the download queues of
+// worker.downloadJobs never overshoot the watermark together.
+func (J *EncodeWorker) reserveEncodeBacklog() bool {
+	J.backlogMutex.Lock()
+	defer J.backlogMutex.Unlock()
+	highWatermark := J.workerConfig.EncodeQueueHighWatermark
+	if highWatermark > 0 && J.queuedEncodeBacklog() >= highWatermark {
+		return false
+	}
+	J.backlogDownloads++
+	return true
+}
+
+func (J *EncodeWorker) releaseEncodeBacklog() {
+	J.backlogMutex.Lock()
+	J.backlogDownloads--
+	J.backlogMutex.Unlock()
+}
+
+// waitEncodeBacklog pauses the download queue once the encode backlog reaches worker.encodeQueueHighWatermark until
+// it drains to worker.encodeQueueLowWatermark, so the scratch disk doesn't fill with sources waiting to be encoded.
+// It returns true with a place reserved in the backlog, to release with releaseEncodeBacklog, or false when the
+// queues are stopped while waiting.
+func (J *EncodeWorker) waitEncodeBacklog() bool {
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+	for !J.reserveEncodeBacklog() {
+		J.terminal.Log("pausing downloads, %d jobs waiting to be encoded", J.encodeBacklog())
+		for J.encodeBacklog() > J.workerConfig.EncodeQueueLowWatermark {
+			select {
+			case <-J.ctx.Done():
+				return false
+			case <-J.ctxStopQueues.Done():
+				return false
+			case <-ticker.C:
+			}
+		}
+		J.terminal.Log("resuming downloads, %d jobs waiting to be encoded", J.encodeBacklog())
+	}
+	return true
+}
+
 func (J *EncodeWorker) uploadQueue() {
 	J.wg.Add(1)
 	for {
@@ -845,16 +1456,25 @@ func (J *EncodeWorker) uploadQueue() {
 				J.errorJob(job, err)
 				continue
 			}
+			if J.workerConfig.PostProcessCommand != "" {
+				if err = J.postProcess(job); err != nil && J.workerConfig.PostProcessFailJob {
+					taskTrack.Error()
+					J.errorJob(job, err)
+					continue
+				} else if err != nil {
+					J.terminal.Warn("[%s] %v", job.TaskEncode.Id.String(), err)
+				}
+			}
 
 			J.updateTaskStatus(job, model.JobNotification, model.CompletedNotificationStatus, "")
 			taskTrack.Done()
-			job.Clean()
+			J.cleanJob(job)
 		}
 	}
 
 }
 
-func (J *EncodeWorker) encodeQueue() {
+func (J *EncodeWorker) encodeQueue(encodeChan <-chan *model.WorkTaskEncode) {
 	J.wg.Add(1)
 	for {
 		select {
@@ -863,13 +1483,28 @@ func (J *EncodeWorker) encodeQueue() {
 			J.terminal.Warn("stopping encode queue")
 			J.wg.Done()
 			return
-		case job, ok := <-J.encodeChan:
+		case job, ok := <-encodeChan:
 			if !ok {
 				continue
 			}
 			atomic.AddUint32(&J.prefetchJobs, ^uint32(0))
 			taskTrack := J.terminal.AddTask(job.TaskEncode.Id.String(), EncodeJobStepType)
+			if job.TaskEncode.IndexOnly {
+				if err := J.indexJob(job, taskTrack); err != nil {
+					taskTrack.Error()
+					J.errorJob(job, err)
+					continue
+				}
+				taskTrack.Done()
+				J.cleanJob(job)
+				continue
+			}
 			err := J.encodeVideo(job, taskTrack)
+			if errors.Is(err, ErrorNoEncodeBenefit) {
+				J.skipJob(job, err)
+				taskTrack.Done()
+				continue
+			}
 			if err != nil {
 				taskTrack.Error()
 				J.errorJob(job, err)
@@ -877,6 +1512,9 @@ func (J *EncodeWorker) encodeQueue() {
 			}
 
 			taskTrack.Done()
+			if J.workerConfig.PreserveModTime {
+				J.copySourceModTime(job)
+			}
 			J.uploadChan <- job
 		}
 	}
@@ -893,21 +1531,64 @@ func (J *EncodeWorker) encodeVideo(job *model.WorkTaskEncode, track *TaskTracks)
 	}
 	J.updateTaskStatus(job, model.FFProbeNotification, model.CompletedNotificationStatus, "")
 
-	videoContainer, err := J.clearData(sourceVideoParams)
+	videoContainer, err := J.clearData(sourceVideoParams, job.TaskEncode.StreamSelection)
 	if err != nil {
 		J.terminal.Warn("error in clear data. Id: %s", J.GetID())
 		return err
 	}
-	if err = J.PGSMkvExtractDetectAndConvert(job, track, videoContainer); err != nil {
+	// the decisions keep being updated by the later steps that drop subtitles, the status file gets them as they are
+	job.StreamDecisions = videoContainer.StreamDecisions
+	J.checkRotation(job.SourceFilePath, videoContainer.Video)
+	if len(videoContainer.Audios) == 0 && J.workerConfig.NoAudioAction == NoAudioActionFail {
+		return errors.New("source has no audio streams")
+	}
+	if err = J.workerConfig.checkRequiredLanguages(videoContainer); err != nil {
+		return err
+	}
+	if err = J.applyQualityProfile(job, videoContainer); err != nil {
+		return err
+	}
+	if videoContainer.Quality.audioOnly() {
+		J.terminal.Log("[%s] audio only transcode, copying the video and subtitles", job.TaskEncode.Id.String())
+	} else if videoContainer.Quality.SubtitlesOnly {
+		J.terminal.Log("[%s] subtitles only, converting the image subtitles without encoding", job.TaskEncode.Id.String())
+	} else if J.workerConfig.RemuxIfAlreadyTarget && videoContainer.Video.isEncodeTarget(videoContainer.Quality) {
+		J.terminal.Log("[%s] source video is already %s %s, copying it", job.TaskEncode.Id.String(), videoContainer.Video.Codec, videoContainer.Video.Profile)
+		videoContainer.Video.Copy = true
+	} else if err = J.checkDynamicHDR(job, videoContainer.Video); err != nil {
+		return err
+	}
+	progress := J.newJobProgress(track, videoContainer.Video)
+	if err = J.PGSMkvExtractDetectAndConvert(job, track, progress, videoContainer); err != nil {
 		return err
 	}
+	// the image subtitles of a required language may have been dropped
+	if err = J.workerConfig.checkRequiredLanguages(videoContainer); err != nil {
+		return err
+	}
+	if videoContainer.Quality.SubtitlesOnly {
+		return J.packSubtitles(job, videoContainer)
+	}
+	// a copied video keeps its captions
+	if J.workerConfig.ClosedCaptions && !videoContainer.CopyStreams && !videoContainer.Video.Copy && !videoContainer.Quality.audioOnly() {
+		if err = J.extractClosedCaptions(job, track, videoContainer); err != nil {
+			J.terminal.Warn("[%s] error extracting closed captions, encoding without them: %v", job.TaskEncode.Id.String(), err)
+		}
+	}
+	if J.workerConfig.Loudnorm && !videoContainer.CopyStreams {
+		track.Message("loudnorm")
+		if err = J.measureAudioLoudness(J.ctx, job, videoContainer); err != nil {
+			return err
+		}
+	}
 	J.updateTaskStatus(job, model.FFMPEGSNotification, model.ProgressingNotificationStatus, "")
 	track.ResetMessage()
-	track.SetTotal(int64(videoContainer.Video.Duration.Seconds()) * int64(videoContainer.Video.FrameRate))
 	FFMPEGProgressChan := make(chan FFMPEGProgress)
+	speed := newEncodeSpeed()
 
 	go func() {
 		lastProgressEvent := float64(0)
+		lastProgressEventTime := time.Now()
 		lastDuration := 0
 	loop:
 		for {
@@ -920,17 +1601,30 @@ func (J *EncodeWorker) encodeVideo(job *model.WorkTaskEncode, track *TaskTracks)
 				}
 				encodeFramesIncrement := (FFMPEGProgress.duration - lastDuration) * videoContainer.Video.FrameRate
 				lastDuration = FFMPEGProgress.duration
+				speed.sample(FFMPEGProgress.speed)
 
 				track.Increment(encodeFramesIncrement)
 
-				if FFMPEGProgress.percent-lastProgressEvent > 10 {
+				// every notification is also persisted to disk, so throttling them reduces both broker and disk load
+				if FFMPEGProgress.percent-lastProgressEvent > J.workerConfig.ProgressStep && time.Since(lastProgressEventTime) >= J.workerConfig.ProgressInterval {
+					job.Report = J.estimateEncodeReport(job, sourceVideoParams, sourceVideoSize, FFMPEGProgress.percent)
 					J.updateTaskStatus(job, model.FFMPEGSNotification, model.ProgressingNotificationStatus, fmt.Sprintf("{\"progress\":\"%.2f\"}", track.PercentDone()))
 					lastProgressEvent = FFMPEGProgress.percent
+					lastProgressEventTime = time.Now()
 				}
 			}
 		}
 	}()
-	err = J.FFMPEG(job, videoContainer, FFMPEGProgressChan)
+	encodeCtx, cancelEncode := J.encodeContext()
+	if J.useEncodeSegments(videoContainer.Video) {
+		err = J.segmentedFFMPEG(encodeCtx, job, videoContainer, FFMPEGProgressChan)
+	} else {
+		err = J.FFMPEG(encodeCtx, job, videoContainer, "", FFMPEGProgressChan)
+	}
+	if errors.Is(encodeCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("encode exceeded the maximum encode duration of %s", J.workerConfig.MaxEncodeDuration)
+	}
+	cancelEncode()
 	if err != nil {
 		//<-time.After(time.Minute*30)
 		J.updateTaskStatus(job, model.FFMPEGSNotification, model.FailedNotificationStatus, err.Error())
@@ -943,115 +1637,455 @@ func (J *EncodeWorker) encodeVideo(job *model.WorkTaskEncode, track *TaskTracks)
 		J.updateTaskStatus(job, model.FFMPEGSNotification, model.FailedNotificationStatus, err.Error())
 		return err
 	}
-	diffDuration := encodedVideoParams.Format.DurationSeconds - sourceVideoParams.Format.DurationSeconds
-	if diffDuration > 60 || diffDuration < -60 {
+	diffDuration := math.Abs(encodedVideoParams.Format.DurationSeconds - sourceVideoParams.Format.DurationSeconds)
+	if J.workerConfig.DurationCheck && diffDuration > J.durationTolerance(sourceVideoParams.Format.DurationSeconds) {
 		err = fmt.Errorf("source file duration %f is diferent than encoded %f", sourceVideoParams.Format.DurationSeconds, encodedVideoParams.Format.DurationSeconds)
 		J.updateTaskStatus(job, model.FFMPEGSNotification, model.FailedNotificationStatus, err.Error())
 		return err
 	}
-	if encodedVideoSize > sourceVideoSize {
-		err = fmt.Errorf("source file size %d bytes is less than encoded %d bytes", sourceVideoSize, encodedVideoSize)
+	job.Report = &model.EncodeReport{
+		SourceSize:         sourceVideoSize,
+		EncodedSize:        encodedVideoSize,
+		SourceCodec:        videoCodecName(sourceVideoParams),
+		EncodedCodec:       videoCodecName(encodedVideoParams),
+		SourceVideoBitrate: videoContainer.Video.Bitrate,
+	}
+	speed.fillReport(job.Report, videoContainer.Video)
+	if !videoContainer.Video.Copy {
+		job.Report.CRF = videoContainer.Video.CRF
+		// copied videos only remux, their speed says nothing about the encode capacity of the worker
+		J.throughput.add(job.Report)
+	}
+	if videoContainer.Quality.audioOnly() {
+		if encodedVideoSize > sourceVideoSize {
+			// the video is copied, the size only changes with the audio and the encode is about compatibility
+			J.terminal.Warn("[%s] audio only transcode grew the file from %d to %d bytes", job.TaskEncode.Id.String(), sourceVideoSize, encodedVideoSize)
+		}
+	} else if err = J.workerConfig.encodeBenefit(sourceVideoParams, sourceVideoSize, encodedVideoParams, encodedVideoSize, videoContainer.Video.Copy); err != nil {
+		// a source already in the target codec was encoded efficiently before, keeping it is the best outcome
+		if J.workerConfig.NoBenefitAction == NoBenefitActionKeep && videoContainer.Video.Codec == videoContainer.Quality.sourceCodec() {
+			err = fmt.Errorf("%w: %v", ErrorNoEncodeBenefit, err)
+			J.updateTaskStatus(job, model.FFMPEGSNotification, model.CompletedNotificationStatus, err.Error())
+			return err
+		}
 		J.updateTaskStatus(job, model.FFMPEGSNotification, model.FailedNotificationStatus, err.Error())
 		return err
 	}
-	J.updateTaskStatus(job, model.FFMPEGSNotification, model.CompletedNotificationStatus, "")
+	if J.workerConfig.DeepVerify {
+		track.Message("verify")
+		if err = J.deepVerify(J.ctx, job); err != nil {
+			J.updateTaskStatus(job, model.FFMPEGSNotification, model.FailedNotificationStatus, err.Error())
+			return err
+		}
+		track.ResetMessage()
+	}
+	completedMessage := ""
+	if job.FFmpegWarnings != "" {
+		completedMessage = fmt.Sprintf("ffmpeg warnings: %s", job.FFmpegWarnings)
+	}
+	J.updateTaskStatus(job, model.FFMPEGSNotification, model.CompletedNotificationStatus, completedMessage)
+
+	if J.workerConfig.VMAFMinScore > 0 && !videoContainer.Video.Copy {
+		return J.checkVMAF(job, track, sourceVideoParams, encodedVideoParams)
+	}
+	return nil
+}
+
+// extractContext limits the subtitle extraction of a single job to subtitleExtractTimeout, so a stalled extractor
+// fails its job instead of holding the encode slot until the worker stops.
+func (J *EncodeWorker) extractContext() (context.Context, context.CancelFunc) {
+	if J.workerConfig.SubtitleExtractTimeout > 0 {
+		return context.WithTimeout(J.ctx, J.workerConfig.SubtitleExtractTimeout)
+	}
+	return context.WithCancel(J.ctx)
+}
+
+// encodeContext limits the FFMPEG encode of a single job to maxEncodeDuration, without affecting other jobs.
+func (J *EncodeWorker) encodeContext() (context.Context, context.CancelFunc) {
+	if J.workerConfig.MaxEncodeDuration > 0 {
+		return context.WithTimeout(J.ctx, J.workerConfig.MaxEncodeDuration)
+	}
+	return context.WithCancel(J.ctx)
+}
+
+// durationTolerance is the maximum difference in seconds allowed between the source and encoded durations, a
+// percentage of the source duration when durationTolerancePercent is set.
+func (J *EncodeWorker) durationTolerance(sourceDurationSeconds float64) float64 {
+	if J.workerConfig.DurationTolerancePercent > 0 {
+		return sourceDurationSeconds * J.workerConfig.DurationTolerancePercent / 100
+	}
+	return J.workerConfig.DurationTolerance.Seconds()
+}
+
+func (J *EncodeWorker) checkVMAF(job *model.WorkTaskEncode, track *TaskTracks, sourceVideoParams *ffprobe.ProbeData, encodedVideoParams *ffprobe.ProbeData) error {
+	J.updateTaskStatus(job, model.VMAFNotification, model.ProgressingNotificationStatus, "")
+	track.Message(string(model.VMAFNotification))
+	score, err := J.VMAF(job, sourceVideoParams, encodedVideoParams)
+	if err != nil {
+		J.updateTaskStatus(job, model.VMAFNotification, model.FailedNotificationStatus, err.Error())
+		return err
+	}
+	job.Report.VMAFScore = score
+
+	if score < J.workerConfig.VMAFMinScore {
+		message := fmt.Sprintf("VMAF score %.2f is lower than %.2f", score, J.workerConfig.VMAFMinScore)
+		if J.workerConfig.VMAFAction == VMAFActionFail {
+			J.updateTaskStatus(job, model.VMAFNotification, model.FailedNotificationStatus, message)
+			return errors.New(message)
+		}
+		J.terminal.Warn("[%s] %s", job.TaskEncode.Id.String(), message)
+		J.updateTaskStatus(job, model.VMAFNotification, model.CompletedNotificationStatus, message)
+		return nil
+	}
+	J.updateTaskStatus(job, model.VMAFNotification, model.CompletedNotificationStatus, fmt.Sprintf("VMAF score %.2f", score))
+	return nil
+}
+
+// checkDynamicHDR warns, or fails the job with DynamicHDRActionFail, when the source carries Dolby Vision or HDR10+
+// metadata, which is lost by the encode. A failed detection only logs a warning.
+func (J *EncodeWorker) checkDynamicHDR(job *model.WorkTaskEncode, video *Video) error {
+	if err := J.detectDynamicHDR(job, video); err != nil {
+		J.terminal.Warn("[%s] error detecting dynamic HDR metadata: %v", job.TaskEncode.Id.String(), err)
+		return nil
+	}
+	formats := video.dynamicHDRFormats()
+	if formats == "" {
+		return nil
+	}
+	message := fmt.Sprintf("source has %s metadata that will be lost", formats)
+	if J.workerConfig.DynamicHDRAction == DynamicHDRActionFail {
+		return errors.New(message)
+	}
+	J.terminal.Warn("[%s] %s", job.TaskEncode.Id.String(), message)
 	return nil
 }
 
+// estimateEncodeReport projects the final encoded size from the partial output written so far.
+func (J *EncodeWorker) estimateEncodeReport(job *model.WorkTaskEncode, sourceVideoParams *ffprobe.ProbeData, sourceVideoSize int64, percent float64) *model.EncodeReport {
+	stat, err := os.Stat(job.TargetFilePath)
+	if err != nil || percent <= 0 {
+		return job.Report
+	}
+	return &model.EncodeReport{
+		SourceSize:  sourceVideoSize,
+		EncodedSize: int64(float64(stat.Size()) * 100 / percent),
+		SourceCodec: videoCodecName(sourceVideoParams),
+		Estimated:   true,
+	}
+}
+
+func videoCodecName(data *ffprobe.ProbeData) string {
+	videoStream := mainVideoStream(data)
+	if videoStream == nil {
+		return ""
+	}
+	return videoStream.CodecName
+}
+
 /*func (J *EncodeWorker) isQueueFull() bool {
 	return len(J.encodeChan) >= MAX_PREFETCHED_JOBS || len(J.downloadChan) > 0
 }*/
 
 type FFMPEGGenerator struct {
-	inputPaths     []string
-	VideoFilter    string
-	AudioFilter    []string
-	SubtitleFilter []string
-	Metadata       string
+	inputs []ffmpegInput
+	// subtitleInputIndex maps the stream id of each image subtitle to the ffmpeg input of its SRT file
+	subtitleInputIndex map[uint8]int
+	// segmentListPath is the concat list of the encoded video segments, empty when the video is encoded in one pass
+	segmentListPath  string
+	VideoFilter      []string
+	AudioFilter      []string
+	SubtitleFilter   []string
+	AttachmentFilter []string
+	CoverArtFilter   []string
+	MuxingFlags      []string
+	Metadata         []string
 }
 
-func (F *FFMPEGGenerator) setAudioFilters(container *ContainerData) {
+func (F *FFMPEGGenerator) setAudioFilters(container *ContainerData, config Config) {
+	if len(container.Audios) == 0 {
+		if config.NoAudioAction == NoAudioActionSilent {
+			silentAudioInput := F.addInput([]string{"-f", "lavfi", "-t", formatSeconds(container.Video.Duration)}, "anullsrc=channel_layout=stereo:sample_rate=48000")
+			F.AudioFilter = append(F.AudioFilter, "-map", fmt.Sprintf("%d:a", silentAudioInput))
+			F.AudioFilter = append(F.AudioFilter, container.Quality.audioParameters(0)...)
+		}
+		return
+	}
+	if container.CopyStreams {
+		F.AudioFilter = []string{"-map", "0:a", "-c:a", "copy"}
+		return
+	}
 
-	for index, audioStream := range container.Audios {
+	// the output index of the first selected audio stream, after the mobile track when there is one
+	firstIndex := 0
+	// the single default audio stream, the mobile track takes its place
+	defaultAudio := container.preferredAudio()
+	// webm can not hold aac
+	if config.MobileCompatAudio && container.Quality.Container != ContainerWebM {
+		F.setMobileAudioFilters(defaultAudio)
+		firstIndex = 1
+		defaultAudio = nil
+	}
+	for sourceIndex, audioStream := range container.Audios {
+		index := firstIndex + sourceIndex
 		//TODO que pasa quan el channelLayout esta empty??
 		title := fmt.Sprintf("%s (%s)", audioStream.Language, audioStream.ChannelLayour)
-		metadata := fmt.Sprintf(" -metadata:s:a:%d \"title=%s\"", index, title)
-		codecQuality := fmt.Sprintf("-c:a:%d %s -vbr %d", index, "libfdk_aac", 5)
-		F.AudioFilter = append(F.AudioFilter, fmt.Sprintf(" -map 0:%d %s %s", audioStream.Id, metadata, codecQuality))
+		F.AudioFilter = append(F.AudioFilter, "-map", fmt.Sprintf("0:%d", audioStream.Id), fmt.Sprintf("-metadata:s:a:%d", index), fmt.Sprintf("title=%s", title))
+		F.AudioFilter = append(F.AudioFilter, container.Quality.audioParameters(index)...)
+		if audioStream.Loudnorm != "" {
+			F.AudioFilter = append(F.AudioFilter, fmt.Sprintf("-filter:a:%d", index), audioStream.Loudnorm)
+		}
+		F.AudioFilter = append(F.AudioFilter, fmt.Sprintf("-disposition:a:%d", index), audioStream.disposition(audioStream == defaultAudio))
+	}
+}
+
+// mobileAudioBitrate is the bitrate of the AAC stereo track of worker.mobileCompatAudio.
+const mobileAudioBitrate = "160k"
+
+// setMobileAudioFilters adds the first output audio stream, an AAC stereo downmix of the preferred audio stream marked
+// as default, which any phone plays without transcoding. It also gets the loudness normalization of its source.
+func (F *FFMPEGGenerator) setMobileAudioFilters(audio *Audio) {
+	F.AudioFilter = append(F.AudioFilter, "-map", fmt.Sprintf("0:%d", audio.Id), "-metadata:s:a:0", fmt.Sprintf("title=%s (stereo AAC)", audio.Language),
+		"-c:a:0", "aac", "-b:a:0", mobileAudioBitrate, "-ac:a:0", "2", "-disposition:a:0", "default")
+	if audio.Loudnorm != "" {
+		F.AudioFilter = append(F.AudioFilter, "-filter:a:0", audio.Loudnorm)
 	}
 }
 func (F *FFMPEGGenerator) setVideoFilters(container *ContainerData) {
-	// TODO: Make ffmpeg parameters configurable
-	videoFilterParameters := "\"scale='min(1920,iw)':-1:force_original_aspect_ratio=decrease\""
-	videoEncoderQuality := "-pix_fmt yuv420p10le -c:v libx265 -crf 28 -x265-params profile=main10"
-	//TODO HDR??
-	videoHDR := ""
-	F.VideoFilter = fmt.Sprintf("-map 0:%d -map_chapters -1 -flags +global_header -filter:v %s %s %s", container.Video.Id, videoFilterParameters, videoHDR, videoEncoderQuality)
+	if F.segmentListPath != "" {
+		segmentsInput := F.addInput([]string{"-f", "concat", "-safe", "0"}, F.segmentListPath)
+		F.VideoFilter = []string{"-map", fmt.Sprintf("%d:v:0", segmentsInput), "-map_chapters", "-1", "-c:v", "copy"}
+		return
+	}
+	if container.Video.Copy {
+		F.VideoFilter = []string{"-map", fmt.Sprintf("0:%d", container.Video.Id), "-map_chapters", "-1", "-c:v", "copy"}
+		return
+	}
+	F.VideoFilter = append([]string{"-map", fmt.Sprintf("0:%d", container.Video.Id), "-map_chapters", "-1"}, videoEncodeParameters(container.Quality, container.Video, 0)...)
+
+}
 
+// videoEncodeParameters are the ffmpeg filter and encoder parameters of the video encode. x265Pools limits the
+// x265 thread pool, 0 lets x265 use every core.
+func videoEncodeParameters(quality QualityProfile, video *Video, x265Pools int) []string {
+	scaleRange := ""
+	var videoColor []string
+	// the scaler must neither expand nor compress the levels, and the encoder must tag the same range or players
+	// show washed out or crushed blacks
+	if video.ColorRange == "tv" || video.ColorRange == "pc" {
+		scaleRange = fmt.Sprintf(":in_range=%s:out_range=%s", video.ColorRange, video.ColorRange)
+		videoColor = []string{"-color_range", video.ColorRange}
+	}
+	videoFilterParameters := fmt.Sprintf("scale='min(%d,iw)':-1:force_original_aspect_ratio=decrease%s", quality.MaxWidth, scaleRange)
+	// the frames are turned upright before scaling, so maxWidth applies to the width players show
+	if rotationFilter := video.rotationFilter(); rotationFilter != "" {
+		videoFilterParameters = rotationFilter + "," + videoFilterParameters
+		videoColor = append(videoColor, "-metadata:s:v:0", "rotate=0")
+	}
+	videoEncoderQuality := []string{"-pix_fmt:v:0", quality.PixFmt, "-c:v:0", quality.VideoCodec, "-crf", strconv.Itoa(video.CRF)}
+	if quality.VideoCodec == VideoCodecNVENC {
+		// nvenc has no crf, the constant quality mode of the vbr rate control is the closest
+		videoEncoderQuality = []string{"-pix_fmt:v:0", quality.PixFmt, "-c:v:0", quality.VideoCodec, "-rc", "vbr", "-cq", strconv.Itoa(video.CRF), "-b:v", "0"}
+		if quality.Profile != "" {
+			videoEncoderQuality = append(videoEncoderQuality, "-profile:v:0", quality.Profile)
+		}
+		if quality.Level != "" {
+			videoEncoderQuality = append(videoEncoderQuality, "-level:v:0", quality.Level)
+		}
+	}
+	if quality.VideoCodec == VideoCodecVP9 {
+		// without -b:v 0 libvpx-vp9 takes -crf as a quality cap of its default bitrate instead of constant quality
+		videoEncoderQuality = append(videoEncoderQuality, "-b:v:0", "0", "-row-mt", "1")
+		if quality.Preset != "" {
+			videoEncoderQuality = append(videoEncoderQuality, "-deadline", "good", "-cpu-used", quality.Preset)
+		}
+	} else if quality.Preset != "" {
+		videoEncoderQuality = append(videoEncoderQuality, "-preset", quality.Preset)
+	}
+	if quality.VideoCodec == VideoCodecX265 {
+		var x265Params []string
+		if profile := quality.hevcProfile(); profile != "" {
+			x265Params = append(x265Params, "profile="+profile)
+		}
+		if quality.Level != "" {
+			x265Params = append(x265Params, "level-idc="+quality.Level)
+		}
+		if x265Pools > 0 {
+			x265Params = append(x265Params, fmt.Sprintf("pools=%d", x265Pools))
+		}
+		if len(x265Params) > 0 {
+			videoEncoderQuality = append(videoEncoderQuality, "-x265-params", strings.Join(x265Params, ":"))
+		}
+	} else if x265Pools > 0 {
+		videoEncoderQuality = append(videoEncoderQuality, "-threads:v", strconv.Itoa(x265Pools))
+	}
+	//TODO HDR??
+	// only the first output video stream is encoded, the cover art after it is copied and can not be filtered
+	parameters := append([]string{"-filter:v:0", videoFilterParameters}, videoColor...)
+	return append(parameters, videoEncoderQuality...)
 }
 func (F *FFMPEGGenerator) setSubtFilters(container *ContainerData) {
-	subtInputIndex := 1
+	if container.CopyStreams {
+		// the source may have no subtitles at all
+		F.SubtitleFilter = []string{"-map", "0:s?", "-c:s", "copy"}
+		return
+	}
 	for index, subtitle := range container.Subtitle {
-		if subtitle.isImageTypeSubtitle() {
-
-			subtitleMap := fmt.Sprintf("-map %d -c:s:%d srt", subtInputIndex, index)
-			subtitleForced := ""
-			subtitleComment := ""
-			if subtitle.Forced {
-				subtitleForced = fmt.Sprintf(" -disposition:s:s:%d forced  -disposition:s:s:%d default", index, index)
-			}
-			if subtitle.Comment {
-				subtitleComment = fmt.Sprintf(" -disposition:s:s:%d comment", index)
-			}
-
-			F.SubtitleFilter = append(F.SubtitleFilter, fmt.Sprintf("%s %s %s -metadata:s:s:%d language=%s -metadata:s:s:%d \"title=%s\" -max_interleave_delta 0", subtitleMap, subtitleForced, subtitleComment, index, subtitle.Language, index, subtitle.Title))
-			subtInputIndex++
+		if container.muxesSrt(subtitle) {
+			// the srt of the image subtitle or the closed captions is written in the text subtitle codec of the output container
+			F.SubtitleFilter = append(F.SubtitleFilter, "-map", strconv.Itoa(F.subtitleInputIndex[subtitle.Id]), fmt.Sprintf("-c:s:%d", index), subtitleConvertCodecs[container.Quality.Container])
+			F.SubtitleFilter = append(F.SubtitleFilter, fmt.Sprintf("-metadata:s:s:%d", index), fmt.Sprintf("language=%s", subtitle.Language),
+				fmt.Sprintf("-metadata:s:s:%d", index), fmt.Sprintf("title=%s", subtitle.Title))
+		} else if subtitle.Convert != "" {
+			F.SubtitleFilter = append(F.SubtitleFilter, "-map", fmt.Sprintf("0:%d", subtitle.Id), fmt.Sprintf("-c:s:%d", index), subtitle.Convert)
 		} else {
-			F.SubtitleFilter = append(F.SubtitleFilter, fmt.Sprintf("-map 0:%d -c:s:%d copy", subtitle.Id, index))
+			F.SubtitleFilter = append(F.SubtitleFilter, "-map", fmt.Sprintf("0:%d", subtitle.Id), fmt.Sprintf("-c:s:%d", index), "copy")
 		}
+		// set on every subtitle, a subtitle copied with its source disposition could be a second default one
+		F.SubtitleFilter = append(F.SubtitleFilter, fmt.Sprintf("-disposition:s:%d", index), subtitle.disposition())
+	}
+}
+func (F *FFMPEGGenerator) setMuxingFlags(config Config, outputFilePath string) {
+	var muxingFlags []string
+	if config.GlobalHeader {
+		muxingFlags = append(muxingFlags, "-flags", "+global_header")
+	}
+	if config.MaxInterleaveDelta >= 0 {
+		muxingFlags = append(muxingFlags, "-max_interleave_delta", strconv.Itoa(config.MaxInterleaveDelta))
+	}
+	// faststart moves the moov atom to the front, it only exists in the mp4 family of muxers
+	switch strings.ToLower(filepath.Ext(outputFilePath)) {
+	case ".mp4", ".m4v", ".mov":
+		if config.Faststart {
+			muxingFlags = append(muxingFlags, "-movflags", "+faststart")
+		}
+	case ".mkv", ".mka", ".mks", ".webm":
+		if config.MKVCuesToFront {
+			muxingFlags = append(muxingFlags, "-cues_to_front", "1")
+		}
+		if config.MKVClusterTimeLimit > 0 {
+			muxingFlags = append(muxingFlags, "-cluster_time_limit", strconv.FormatInt(config.MKVClusterTimeLimit.Milliseconds(), 10))
+		}
+	}
+	F.MuxingFlags = muxingFlags
+}
 
+// setAttachmentFilters copies the attachments, like the fonts used by ASS subtitles, only matroska can hold them.
+func (F *FFMPEGGenerator) setAttachmentFilters(container *ContainerData, config Config, outputFilePath string) {
+	if !config.CopyAttachments || len(container.Attachments) == 0 {
+		return
+	}
+	switch strings.ToLower(filepath.Ext(outputFilePath)) {
+	case ".mkv", ".mka", ".mks":
+		var attachmentMaps []string
+		for _, attachment := range container.Attachments {
+			attachmentMaps = append(attachmentMaps, "-map", fmt.Sprintf("0:%d", attachment))
+		}
+		F.AttachmentFilter = append(attachmentMaps, "-c:t", "copy")
 	}
 }
-func (F *FFMPEGGenerator) setMetadata(container *ContainerData) {
-	F.Metadata = fmt.Sprintf("-metadata encodeParameters='%s'", container.ToJson())
+
+// setCoverArtFilters copies the cover art pictures after the encoded video, keeping them flagged as attached
+// pictures so players don't take them for a video track.
+func (F *FFMPEGGenerator) setCoverArtFilters(container *ContainerData, config Config) {
+	// webm holds a single kind of video, the pictures would fail the encode
+	if !config.CopyCoverArt || container.Quality.Container == ContainerWebM {
+		return
+	}
+	for index, coverArt := range container.CoverArt {
+		outputIndex := index + 1
+		F.CoverArtFilter = append(F.CoverArtFilter, "-map", fmt.Sprintf("0:%d", coverArt),
+			fmt.Sprintf("-c:v:%d", outputIndex), "copy", fmt.Sprintf("-disposition:v:%d", outputIndex), "attached_pic")
+	}
 }
-func (F *FFMPEGGenerator) buildArguments(threads uint8, outputFilePath string) string {
-	coreParameters := fmt.Sprintf("-hide_banner  -threads %d", threads)
-	inputsParameters := ""
-	for _, input := range F.inputPaths {
-		inputsParameters = fmt.Sprintf("%s -i \"%s\"", inputsParameters, input)
+
+// setMetadata writes the container tags of the output. The global tags of the source, like its title, are kept
+// unless worker.preserveMetadata is off, the tags of the job replace them and an empty job tag removes it. The
+// encode parameters are always recorded last, so nothing overrides them.
+func (F *FFMPEGGenerator) setMetadata(container *ContainerData, config Config, metadata model.ContainerMetadata) {
+	if config.PreserveMetadata {
+		F.Metadata = []string{"-map_metadata:g", "0:g"}
+	} else {
+		F.Metadata = []string{"-map_metadata:g", "-1"}
 	}
-	//-ss 900 -t 10
-	audioParameters := ""
-	for _, audio := range F.AudioFilter {
-		audioParameters = fmt.Sprintf("%s %s", audioParameters, audio)
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
 	}
-	subtParameters := ""
-	for _, subt := range F.SubtitleFilter {
-		subtParameters = fmt.Sprintf("%s %s", subtParameters, subt)
+	sort.Strings(keys)
+	for _, key := range keys {
+		F.Metadata = append(F.Metadata, "-metadata", fmt.Sprintf("%s=%s", key, metadata[key]))
 	}
+	F.Metadata = append(F.Metadata, "-metadata", fmt.Sprintf("%s=%s", model.EncodeParametersMetadataKey, container.ToJson()))
+}
 
-	return fmt.Sprintf("%s %s -max_muxing_queue_size 9999 %s %s %s %s %s -y", coreParameters, inputsParameters, F.VideoFilter, audioParameters, subtParameters, F.Metadata, outputFilePath)
+// buildArguments joins the generated parameters in the ffmpeg arguments. Every value is its own argument, so paths
+// and titles need no quoting.
+func (F *FFMPEGGenerator) buildArguments(threads uint8, outputFilePath string) []string {
+	arguments := []string{"-hide_banner", "-threads", strconv.Itoa(int(threads))}
+	for _, input := range F.inputs {
+		arguments = append(arguments, input.options...)
+		arguments = append(arguments, "-i", input.path)
+	}
+	//-ss 900 -t 10
+	arguments = append(arguments, "-max_muxing_queue_size", "9999")
+	arguments = append(arguments, F.VideoFilter...)
+	arguments = append(arguments, F.AudioFilter...)
+	arguments = append(arguments, F.SubtitleFilter...)
+	arguments = append(arguments, F.AttachmentFilter...)
+	arguments = append(arguments, F.CoverArtFilter...)
+	arguments = append(arguments, F.MuxingFlags...)
+	arguments = append(arguments, F.Metadata...)
+	return append(arguments, outputFilePath, "-y")
 }
 
-func (F *FFMPEGGenerator) setInputFilters(container *ContainerData, sourceFilePath string, tempPath string) {
-	F.inputPaths = append(F.inputPaths, sourceFilePath)
-	inputIndex := 0
-	if container.HaveImageTypeSubtitle() {
-		for _, subt := range container.Subtitle {
-			if subt.isImageTypeSubtitle() {
-				inputIndex++
-				F.inputPaths = append(F.inputPaths, filepath.Join(tempPath, fmt.Sprintf("%d.srt", subt.Id)))
-			}
+func (F *FFMPEGGenerator) setInputFilters(container *ContainerData, sourceFilePath string, sourceOptions []string, tempPath string) {
+	F.addInput(sourceOptions, sourceFilePath)
+	F.subtitleInputIndex = make(map[uint8]int)
+	for _, subt := range container.Subtitle {
+		if container.muxesSrt(subt) {
+			F.subtitleInputIndex[subt.Id] = F.addInput(nil, filepath.Join(tempPath, subt.srtFileName()))
 		}
 	}
 }
 
+// addInput adds an input with its ffmpeg input options and returns its input index.
+func (F *FFMPEGGenerator) addInput(options []string, path string) int {
+	F.inputs = append(F.inputs, ffmpegInput{options: options, path: path})
+	return len(F.inputs) - 1
+}
+
+type ffmpegInput struct {
+	options []string
+	path    string
+}
+
 type Video struct {
-	Id        uint8
-	Duration  time.Duration
-	FrameRate int
+	Id          uint8
+	Duration    time.Duration
+	FrameRate   int
+	Width       int
+	Height      int
+	DolbyVision bool
+	HDR10Plus   bool
+	Bitrate     int64
+	CRF         int
+	Codec       string
+	Profile     string
+	PixFmt      string
+	// ColorRange is the tv (limited) or pc (full) range of the source, empty or unknown when not tagged
+	ColorRange string
+	// Rotation is the clockwise rotation players apply to the stored frames, 0, 90, 180 or 270
+	Rotation int
+	// Copy remuxes the source video stream instead of encoding it
+	Copy bool
+}
+
+// isEncodeTarget reports whether the video already has the codec, pixel format and maximum width the encode of the
+// quality profile produces. Rotated videos are encoded to turn their frames upright.
+func (V *Video) isEncodeTarget(quality QualityProfile) bool {
+	return V.Codec == quality.sourceCodec() && V.PixFmt == quality.PixFmt && V.Width <= quality.MaxWidth && V.Rotation == 0
 }
+
 type Audio struct {
 	Id             uint8
 	Language       string
@@ -1061,6 +2095,14 @@ type Audio struct {
 	Default        bool
 	Bitrate        uint
 	Title          string
+	// Original, Dub, Comment, HearingImpaired and VisualImpaired are the source disposition flags kept on the output
+	Original        bool
+	Dub             bool
+	Comment         bool
+	HearingImpaired bool
+	VisualImpaired  bool
+	// Loudnorm is the second pass loudnorm filter of the stream, when loudness normalization is enabled
+	Loudnorm string
 }
 type Subtitle struct {
 	Id       uint8
@@ -1069,11 +2111,42 @@ type Subtitle struct {
 	Comment  bool
 	Format   string
 	Title    string
+	// SDH subtitles are the ones for the deaf and hard of hearing
+	SDH bool
+	// Size in bytes of the subtitle stream, 0 when unknown
+	Size int64
+	// Convert is the subtitle codec the stream is converted to when the output container can not hold it as it is
+	Convert string
+	// Default is set on the single subtitle chosen to be shown by default
+	Default bool
+	// ClosedCaptions is the SRT of the EIA-608/708 captions of the video stream, Id is the one of the video stream
+	ClosedCaptions bool
 }
 type ContainerData struct {
-	Video    *Video
-	Audios   []*Audio
-	Subtitle []*Subtitle
+	Video       *Video
+	Audios      []*Audio
+	Subtitle    []*Subtitle
+	Attachments []uint8
+	// CoverArt are the attached picture streams, the cover art some sources carry as an extra video stream
+	CoverArt []uint8
+	// Quality are the encode settings of the job quality profile
+	Quality QualityProfile
+	// CopySubtitles copies the image subtitles too instead of converting them to srt
+	CopySubtitles bool
+	// CopyStreams maps every audio and subtitle stream of the source with copy, instead of the selected ones
+	CopyStreams bool
+	// StreamDecisions tell which audio and subtitle streams of the source are kept and why
+	StreamDecisions []*model.StreamDecision
+}
+
+// convertsToSrt reports whether the subtitle is an image subtitle converted to srt before the encode.
+func (C *ContainerData) convertsToSrt(subtitle *Subtitle) bool {
+	return subtitle.isImageTypeSubtitle() && !C.CopySubtitles
+}
+
+// muxesSrt reports whether the subtitle is muxed from a SRT of the work directory instead of the source.
+func (C *ContainerData) muxesSrt(subtitle *Subtitle) bool {
+	return C.convertsToSrt(subtitle) || subtitle.ClosedCaptions
 }
 
 func (C *ContainerData) HaveImageTypeSubtitle() bool {
@@ -1084,6 +2157,27 @@ func (C *ContainerData) HaveImageTypeSubtitle() bool {
 	}
 	return false
 }
+func (C *ContainerData) dropImageTypeSubtitles() {
+	var subtitles []*Subtitle
+	for _, sub := range C.Subtitle {
+		if !sub.isImageTypeSubtitle() {
+			subtitles = append(subtitles, sub)
+		}
+	}
+	C.Subtitle = subtitles
+}
+
+// dropSubtitle removes a single subtitle stream from the output.
+func (C *ContainerData) dropSubtitle(subtitle *Subtitle) {
+	var subtitles []*Subtitle
+	for _, sub := range C.Subtitle {
+		if sub != subtitle {
+			subtitles = append(subtitles, sub)
+		}
+	}
+	C.Subtitle = subtitles
+}
+
 func (C *ContainerData) ToJson() string {
 	b, err := json.Marshal(C)
 	if err != nil {
@@ -1094,3 +2188,16 @@ func (C *ContainerData) ToJson() string {
 func (C *Subtitle) isImageTypeSubtitle() bool {
 	return strings.Index(strings.ToLower(C.Format), "pgs") != -1
 }
+
+// supFileName is the file inside the job WorkDir where the image subtitle stream is extracted to.
+func (C *Subtitle) supFileName() string {
+	return fmt.Sprintf("subtitle-%d.sup", C.Id)
+}
+
+// srtFileName is the file inside the job WorkDir where the OCR result of the image subtitle is saved.
+func (C *Subtitle) srtFileName() string {
+	if C.ClosedCaptions {
+		return closedCaptionsFileName
+	}
+	return fmt.Sprintf("subtitle-%d.srt", C.Id)
+}
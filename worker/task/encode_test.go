@@ -0,0 +1,218 @@
+package task
+
+import (
+	"context"
+	"gearr/model"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+// testConfig has the worker flag defaults the ffmpeg arguments depend on.
+func testConfig() Config {
+	return Config{
+		Threads:                    4,
+		OutputFileTemplate:         "{basename}-encoded",
+		IncompatibleSubtitleAction: IncompatibleSubtitleActionConvert,
+		SubtitleSelection:          SubtitleSelectionAll,
+		SubtitleSDH:                SubtitleSDHKeep,
+		TitleSanitization:          TitleSanitizationReplace,
+	}
+}
+
+func newTestWorker(config Config) *EncodeWorker {
+	return &EncodeWorker{
+		ctx:          context.Background(),
+		workerConfig: config,
+		terminal:     NewConsoleWorkerPrinter(true, time.Minute),
+	}
+}
+
+func probeFixture(streams ...*ffprobe.Stream) *ffprobe.ProbeData {
+	return &ffprobe.ProbeData{
+		Streams: streams,
+		Format:  &ffprobe.Format{DurationSeconds: 60, BitRate: "8000000"},
+	}
+}
+
+func videoStreamFixture(index int) *ffprobe.Stream {
+	return &ffprobe.Stream{
+		Index:        index,
+		CodecType:    string(ffprobe.StreamVideo),
+		CodecName:    "h264",
+		Width:        1920,
+		Height:       1080,
+		PixFmt:       "yuv420p",
+		AvgFrameRate: "24/1",
+	}
+}
+
+func audioStreamFixture(index int, language string, channels int) *ffprobe.Stream {
+	return &ffprobe.Stream{
+		Index:         index,
+		CodecType:     string(ffprobe.StreamAudio),
+		CodecName:     "ac3",
+		Channels:      channels,
+		ChannelLayout: "5.1(side)",
+		BitRate:       "640000",
+		Tags:          ffprobe.StreamTags{Language: language},
+	}
+}
+
+func subtitleStreamFixture(index int, language string, codec string, title string) *ffprobe.Stream {
+	return &ffprobe.Stream{
+		Index:     index,
+		CodecType: string(ffprobe.StreamSubtitle),
+		CodecName: codec,
+		Tags:      ffprobe.StreamTags{Language: language, Title: title},
+	}
+}
+
+// encodeArguments chooses the streams of the probe and returns the ffmpeg arguments encoding them with the quality
+// profile.
+func encodeArguments(t *testing.T, worker *EncodeWorker, data *ffprobe.ProbeData, quality QualityProfile) []string {
+	t.Helper()
+	container, err := worker.clearData(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container.Quality = quality.withDefaults()
+	job := &model.WorkTaskEncode{
+		TaskEncode:     &model.TaskEncode{Id: uuid.New()},
+		SourceFilePath: "/source/movie.mkv",
+		WorkDir:        t.TempDir(),
+	}
+	return worker.ffmpegArguments(job, container, "")
+}
+
+// argumentValue is the argument following the first flag, the value of an ffmpeg option.
+func argumentValue(arguments []string, flag string) (string, bool) {
+	for i := 0; i < len(arguments)-1; i++ {
+		if arguments[i] == flag {
+			return arguments[i+1], true
+		}
+	}
+	return "", false
+}
+
+// containsArguments reports whether the arguments hold the sequence, in order and next to each other.
+func containsArguments(arguments []string, sequence ...string) bool {
+	for i := 0; i+len(sequence) <= len(arguments); i++ {
+		found := true
+		for j := range sequence {
+			if arguments[i+j] != sequence[j] {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFFmpegArgumentsKeepTheFullColorRange(t *testing.T) {
+	video := videoStreamFixture(0)
+	video.ColorRange = "pc"
+	arguments := encodeArguments(t, newTestWorker(testConfig()), probeFixture(video), QualityProfile{})
+
+	if colorRange, _ := argumentValue(arguments, "-color_range"); colorRange != "pc" {
+		t.Fatalf("-color_range %q, expected the pc range of the source to be tagged: %v", colorRange, arguments)
+	}
+	expectedFilter := "scale='min(1920,iw)':-1:force_original_aspect_ratio=decrease:in_range=pc:out_range=pc"
+	if filter, _ := argumentValue(arguments, "-filter:v:0"); filter != expectedFilter {
+		t.Fatalf("-filter:v:0 %q, expected %q", filter, expectedFilter)
+	}
+}
+
+func TestFFmpegArgumentsLeaveAnUnknownColorRangeUntagged(t *testing.T) {
+	video := videoStreamFixture(0)
+	video.ColorRange = "unknown"
+	arguments := encodeArguments(t, newTestWorker(testConfig()), probeFixture(video), QualityProfile{})
+
+	if colorRange, found := argumentValue(arguments, "-color_range"); found {
+		t.Fatalf("-color_range %q, an untagged range must be left to the encoder", colorRange)
+	}
+	expectedFilter := "scale='min(1920,iw)':-1:force_original_aspect_ratio=decrease"
+	if filter, _ := argumentValue(arguments, "-filter:v:0"); filter != expectedFilter {
+		t.Fatalf("-filter:v:0 %q, expected %q", filter, expectedFilter)
+	}
+}
+
+func coverArtFixture() *ffprobe.ProbeData {
+	coverArt := &ffprobe.Stream{Index: 0, CodecType: string(ffprobe.StreamVideo), CodecName: "mjpeg", Width: 600, Height: 900}
+	coverArt.Disposition.AttachedPic = 1
+	return probeFixture(coverArt, videoStreamFixture(1), audioStreamFixture(2, "eng", 2))
+}
+
+func TestClearDataTellsTheCoverArtFromTheVideo(t *testing.T) {
+	container, err := newTestWorker(testConfig()).clearData(coverArtFixture(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container.Video.Id != 1 || container.Video.Codec != "h264" {
+		t.Fatalf("video stream %d %s, expected the h264 stream 1", container.Video.Id, container.Video.Codec)
+	}
+	if len(container.CoverArt) != 1 || container.CoverArt[0] != 0 {
+		t.Fatalf("cover art %v, expected the attached picture 0", container.CoverArt)
+	}
+}
+
+func TestFFmpegArgumentsCopyTheCoverArt(t *testing.T) {
+	config := testConfig()
+	config.CopyCoverArt = true
+	arguments := encodeArguments(t, newTestWorker(config), coverArtFixture(), QualityProfile{})
+	if !containsArguments(arguments, "-map", "0:1", "-map_chapters", "-1", "-filter:v:0") {
+		t.Fatalf("the encoded video must be stream 1: %v", arguments)
+	}
+	if !containsArguments(arguments, "-map", "0:0", "-c:v:1", "copy", "-disposition:v:1", "attached_pic") {
+		t.Fatalf("the cover art must be copied after the video as an attached picture: %v", arguments)
+	}
+
+	config.CopyCoverArt = false
+	arguments = encodeArguments(t, newTestWorker(config), coverArtFixture(), QualityProfile{})
+	if containsArguments(arguments, "-map", "0:0") {
+		t.Fatalf("the cover art must be dropped without worker.copyCoverArt: %v", arguments)
+	}
+}
+
+func TestSaveTaskStatusDiskThrottlesOnlyTheProgressUpdates(t *testing.T) {
+	config := testConfig()
+	config.TaskStatusSyncInterval = time.Hour
+	worker := newTestWorker(config)
+	job := &model.WorkTaskEncode{TaskEncode: &model.TaskEncode{Id: uuid.New()}, WorkDir: t.TempDir()}
+	save := func(status model.NotificationStatus, message string) {
+		job.TaskEncode.EventID++
+		worker.saveTaskStatusDisk(&model.TaskStatus{
+			LastState: &model.TaskEvent{Id: job.TaskEncode.Id, EventID: job.TaskEncode.EventID, EventType: model.NotificationEvent,
+				NotificationType: model.FFMPEGSNotification, Status: status, Message: message},
+			Task: job,
+		})
+	}
+	savedEventID := func() int {
+		t.Helper()
+		taskStatus, err := worker.readTaskStatusFromDiskByPath(filepath.Join(job.WorkDir, job.TaskEncode.Id.String()+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return taskStatus.LastState.EventID
+	}
+
+	save(model.ProgressingNotificationStatus, `{"progress":"10.00"}`)
+	save(model.ProgressingNotificationStatus, `{"progress":"20.00"}`)
+	if eventID := savedEventID(); eventID != 1 {
+		t.Fatalf("event %d saved, the second progress update must wait for the interval", eventID)
+	}
+	save(model.CompletedNotificationStatus, "")
+	if eventID := savedEventID(); eventID != 3 {
+		t.Fatalf("event %d saved, a state change must be written right away", eventID)
+	}
+	if _, err := os.Stat(filepath.Join(job.WorkDir, job.TaskEncode.Id.String()+".json.tmp")); !os.IsNotExist(err) {
+		t.Fatalf("the temporary status file must be renamed: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package task
+
+import (
+	"context"
+	"gearr/helper/command"
+	"sync"
+)
+
+// ffmpegPriority orders the ffmpeg runs waiting for a slot of worker.ffmpegJobs, lower first.
+type ffmpegPriority int
+
+const (
+	// ffmpegPriorityEncode are the runs producing the encoded file: the encode, the segment split and the segment
+	// encodes
+	ffmpegPriorityEncode ffmpegPriority = iota
+	// ffmpegPriorityAuxiliary are the analysis and verification passes around the encode
+	ffmpegPriorityAuxiliary
+	ffmpegPriorities
+)
+
+// ffmpegLimiter caps the ffmpeg processes of the worker running at the same time, whatever phase runs them. A freed
+// slot goes to the oldest encode run waiting and only then to the auxiliary passes, so a burst of passes can't make
+// the encodes wait. The passes can't starve either: every job runs them before or after its own encode, holding no
+// slot, so they get the slots whenever no encode is waiting.
+type ffmpegLimiter struct {
+	mu      sync.Mutex
+	free    int
+	waiting [ffmpegPriorities][]chan struct{}
+}
+
+// newFFmpegLimiter returns nil, which doesn't limit anything, when jobs is 0.
+func newFFmpegLimiter(jobs int) *ffmpegLimiter {
+	if jobs <= 0 {
+		return nil
+	}
+	return &ffmpegLimiter{free: jobs}
+}
+
+func (L *ffmpegLimiter) acquire(ctx context.Context, priority ffmpegPriority) error {
+	if L == nil {
+		return nil
+	}
+	L.mu.Lock()
+	if L.free > 0 {
+		L.free--
+		L.mu.Unlock()
+		return nil
+	}
+	slot := make(chan struct{})
+	L.waiting[priority] = append(L.waiting[priority], slot)
+	L.mu.Unlock()
+
+	select {
+	case <-slot:
+		return nil
+	case <-ctx.Done():
+		L.mu.Lock()
+		defer L.mu.Unlock()
+		for i, waiting := range L.waiting[priority] {
+			if waiting == slot {
+				L.waiting[priority] = append(L.waiting[priority][:i], L.waiting[priority][i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// the slot was handed over while the context was canceled
+		L.releaseLocked()
+		return ctx.Err()
+	}
+}
+
+func (L *ffmpegLimiter) release() {
+	if L == nil {
+		return
+	}
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	L.releaseLocked()
+}
+
+func (L *ffmpegLimiter) releaseLocked() {
+	for priority := range L.waiting {
+		if len(L.waiting[priority]) > 0 {
+			slot := L.waiting[priority][0]
+			L.waiting[priority] = L.waiting[priority][1:]
+			close(slot)
+			return
+		}
+	}
+	L.free++
+}
+
+// runFFmpeg runs an ffmpeg command once a slot of worker.ffmpegJobs is free.
+func (J *EncodeWorker) runFFmpeg(ctx context.Context, ffmpegCommand *command.Command, priority ffmpegPriority) (int, error) {
+	if err := J.ffmpegSlots.acquire(ctx, priority); err != nil {
+		return -1, err
+	}
+	defer J.ffmpegSlots.release()
+	return ffmpegCommand.RunWithContext(ctx)
+}
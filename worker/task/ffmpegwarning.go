@@ -0,0 +1,89 @@
+package task
+
+import (
+	"fmt"
+	"gearr/model"
+	"regexp"
+	"strings"
+)
+
+const (
+	FFmpegWarningActionIgnore = "ignore"
+	FFmpegWarningActionWarn   = "warn"
+	FFmpegWarningActionFail   = "fail"
+)
+
+// maxFFmpegWarnings bounds the warning lines kept in the job notification, broken sources repeat them on every frame.
+const maxFFmpegWarnings = 5
+
+// DefaultFFmpegWarningPatterns match the ffmpeg messages of encodes that exit fine but likely have glitches: broken
+// timestamps and corrupt or undecodable frames of the source.
+var DefaultFFmpegWarningPatterns = []string{
+	`Non-monoton(ous|ic) DTS`,
+	`Packet corrupt`,
+	`corrupt decoded frame`,
+	`error while decoding`,
+	`Invalid NAL unit size`,
+}
+
+// CompileFFmpegWarningPatterns compiles worker.ffmpegWarningPatterns, they are regular expressions matched against
+// every line ffmpeg writes to stderr.
+func CompileFFmpegWarningPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var regexps []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid worker.ffmpegWarningPatterns %s: %w", pattern, err)
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+// ffmpegWarningLines returns the distinct stderr lines matching any of the patterns, up to maxFFmpegWarnings, and
+// the total of matching lines.
+func ffmpegWarningLines(stderr string, patterns []*regexp.Regexp) ([]string, int) {
+	var lines []string
+	seen := make(map[string]bool)
+	total := 0
+	// the progress lines end in \r instead of \n
+	for _, line := range strings.FieldsFunc(stderr, func(r rune) bool { return r == '\n' || r == '\r' }) {
+		line = strings.TrimSpace(line)
+		for _, pattern := range patterns {
+			if !pattern.MatchString(line) {
+				continue
+			}
+			total++
+			if !seen[line] && len(lines) < maxFFmpegWarnings {
+				seen[line] = true
+				lines = append(lines, line)
+			}
+			break
+		}
+	}
+	return lines, total
+}
+
+// checkFFmpegWarnings looks for worker.ffmpegWarningPatterns in the stderr of an encode that exited fine. With
+// FFmpegWarningActionFail the encode fails, with FFmpegWarningActionWarn the lines are logged and kept in the job
+// to be sent with the FFMPEG completed notification.
+func (J *EncodeWorker) checkFFmpegWarnings(job *model.WorkTaskEncode, stderr string) error {
+	job.FFmpegWarnings = ""
+	if J.workerConfig.FFmpegWarningAction == FFmpegWarningActionIgnore {
+		return nil
+	}
+	lines, total := ffmpegWarningLines(stderr, J.ffmpegWarningPatterns)
+	if total == 0 {
+		return nil
+	}
+	message := strings.Join(lines, "; ")
+	if total > len(lines) {
+		message = fmt.Sprintf("%s (%d matching lines)", message, total)
+	}
+	if J.workerConfig.FFmpegWarningAction == FFmpegWarningActionFail {
+		return fmt.Errorf("%w: %s", ErrorFFmpegWarnings, message)
+	}
+	J.terminal.Warn("[%s] ffmpeg succeeded with warnings: %s", job.TaskEncode.Id.String(), message)
+	job.FFmpegWarnings = message
+	return nil
+}
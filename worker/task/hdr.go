@@ -0,0 +1,84 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"gearr/helper"
+	"gearr/helper/command"
+	"gearr/model"
+	"strings"
+)
+
+const (
+	DynamicHDRActionWarn = "warn"
+	DynamicHDRActionFail = "fail"
+)
+
+const (
+	dolbyVisionSideDataType = "DOVI configuration record"
+	hdr10PlusSideDataType   = "HDR Dynamic Metadata SMPTE2094-40 (HDR10+)"
+)
+
+type hdrSideData struct {
+	SideDataList []struct {
+		SideDataType string `json:"side_data_type"`
+	} `json:"side_data_list"`
+}
+
+type hdrProbe struct {
+	Streams []hdrSideData `json:"streams"`
+	Frames  []hdrSideData `json:"frames"`
+}
+
+// detectDynamicHDR looks for Dolby Vision and HDR10+ metadata in the video stream. Dolby Vision is announced in
+// the stream side data while HDR10+ is only carried by the frames, so the first frame is probed too.
+func (J *EncodeWorker) detectDynamicHDR(job *model.WorkTaskEncode, video *Video) error {
+	ffprobeCommand := command.NewCommand(helper.GetFFProbePath(), "-v", "error", "-select_streams", fmt.Sprintf("%d", video.Id),
+		"-read_intervals", "%+#1", "-show_entries", "stream=index:stream_side_data=side_data_type:frame_side_data=side_data_type",
+		"-show_frames", "-of", "json", job.SourceFilePath)
+
+	ffprobeOutput := ""
+	ffprobeErrLog := ""
+	ffprobeCommand.SetWorkDir(job.WorkDir).
+		SetStdoutFunc(func(buffer []byte, exit bool) {
+			ffprobeOutput += string(buffer)
+		}).
+		SetStderrFunc(func(buffer []byte, exit bool) {
+			ffprobeErrLog += string(buffer)
+		})
+	exitCode, err := ffprobeCommand.RunWithContext(J.ctx)
+	if err != nil {
+		return fmt.Errorf("%w: stderr:%s", err, ffprobeErrLog)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("exit code %d: stderr:%s", exitCode, ffprobeErrLog)
+	}
+
+	probe := &hdrProbe{}
+	if err = json.Unmarshal([]byte(ffprobeOutput), probe); err != nil {
+		return fmt.Errorf("error parsing ffprobe output: %v", err)
+	}
+	for _, sideData := range append(probe.Streams, probe.Frames...) {
+		for _, s := range sideData.SideDataList {
+			switch s.SideDataType {
+			case dolbyVisionSideDataType:
+				video.DolbyVision = true
+			case hdr10PlusSideDataType:
+				video.HDR10Plus = true
+			}
+		}
+	}
+	return nil
+}
+
+// dynamicHDRFormats lists the dynamic HDR metadata of the video, which the encode does not preserve.
+func (V *Video) dynamicHDRFormats() string {
+	var formats []string
+	if V.DolbyVision {
+		formats = append(formats, "Dolby Vision")
+	}
+	if V.HDR10Plus {
+		formats = append(formats, "HDR10+")
+	}
+	return strings.Join(formats, " and ")
+}
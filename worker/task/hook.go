@@ -0,0 +1,78 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gearr/helper/command"
+	"gearr/model"
+	"os"
+	"strconv"
+)
+
+// postProcessOutputLimit bounds the command output kept for the error message.
+const postProcessOutputLimit = 4096
+
+// postProcessEnv is the environment of the post processing command. It only gets PATH, HOME and the job variables,
+// so the worker environment, like broker credentials, is not exposed to it.
+func (J *EncodeWorker) postProcessEnv(job *model.WorkTaskEncode) []string {
+	env := []string{
+		fmt.Sprintf("PATH=%s", os.Getenv("PATH")),
+		fmt.Sprintf("HOME=%s", os.Getenv("HOME")),
+		fmt.Sprintf("GEARR_JOB_ID=%s", job.TaskEncode.Id.String()),
+		fmt.Sprintf("GEARR_WORKER_NAME=%s", J.workerConfig.Name),
+		fmt.Sprintf("GEARR_SOURCE_FILE=%s", job.SourceFilePath),
+		fmt.Sprintf("GEARR_ENCODED_FILE=%s", job.TargetFilePath),
+		fmt.Sprintf("GEARR_UPLOAD_URL=%s", job.TaskEncode.UploadURL),
+		fmt.Sprintf("GEARR_QUALITY_PROFILE=%s", job.TaskEncode.QualityProfile),
+	}
+	if job.Report != nil {
+		env = append(env,
+			fmt.Sprintf("GEARR_SOURCE_SIZE=%d", job.Report.SourceSize),
+			fmt.Sprintf("GEARR_ENCODED_SIZE=%d", job.Report.EncodedSize),
+			fmt.Sprintf("GEARR_CRF=%d", job.Report.CRF),
+			fmt.Sprintf("GEARR_VMAF_SCORE=%s", strconv.FormatFloat(job.Report.VMAFScore, 'f', 2, 64)),
+		)
+	}
+	return env
+}
+
+// postProcess runs the configured post processing command once the job is uploaded. It runs without a shell, in
+// the job WorkDir and with the worker.postProcessTimeout limit.
+func (J *EncodeWorker) postProcess(job *model.WorkTaskEncode) error {
+	ctx := J.ctx
+	if J.workerConfig.PostProcessTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(J.ctx, J.workerConfig.PostProcessTimeout)
+		defer cancel()
+	}
+
+	output := ""
+	appendOutput := func(buffer []byte, exit bool) {
+		if len(output) < postProcessOutputLimit {
+			output += string(buffer)
+		}
+	}
+	arguments := command.StringToSlice(J.workerConfig.PostProcessCommand)
+	if len(arguments) == 0 {
+		return nil
+	}
+	postProcessCommand := command.NewCommand(arguments[0], arguments[1:]...).
+		SetWorkDir(job.WorkDir).
+		SetEnv(J.postProcessEnv(job)).
+		SetStdoutFunc(appendOutput).
+		SetStderrFunc(appendOutput)
+	J.terminal.Cmd("Post process command:%s", postProcessCommand.GetFullCommand())
+
+	exitCode, err := postProcessCommand.RunWithContext(ctx)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("post process command exceeded %s: %s", J.workerConfig.PostProcessTimeout, output)
+	}
+	if err != nil {
+		return fmt.Errorf("post process command failed: %w: %s", err, output)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("post process command exit code %d: %s", exitCode, output)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package task
+
+import (
+	"fmt"
+	"gearr/model"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// checkJobURLs rejects the jobs whose download, checksum or upload URL targets a host outside worker.allowedHosts or
+// inside worker.deniedHosts, before the worker sends any request for them.
+func (c Config) checkJobURLs(taskEncode *model.TaskEncode) error {
+	for _, rawURL := range []string{taskEncode.DownloadURL, taskEncode.ChecksumURL, taskEncode.UploadURL} {
+		if rawURL == "" {
+			continue
+		}
+		if err := c.checkURLHost(rawURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkURLHost checks the host of a URL against worker.allowedHosts and worker.deniedHosts, the denied hosts win.
+// Without lists every host is allowed. file:// URLs are checked as localhost.
+func (c Config) checkURLHost(rawURL string) error {
+	if len(c.AllowedHosts) == 0 && len(c.DeniedHosts) == 0 {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrorHostNotAllowed, err)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		host = "localhost"
+	}
+	hostIPs := resolveHost(host)
+	if len(hostIPs) == 0 && (hasIPPatterns(c.AllowedHosts) || hasIPPatterns(c.DeniedHosts)) {
+		// the IP and CIDR rules can't be checked, the name could still resolve when connecting
+		return fmt.Errorf("%w: %s does not resolve", ErrorHostNotAllowed, host)
+	}
+	if matchesHostPattern(c.DeniedHosts, host, hostIPs) {
+		return fmt.Errorf("%w: %s is in worker.deniedHosts", ErrorHostNotAllowed, host)
+	}
+	if len(c.AllowedHosts) > 0 && !matchesHostPattern(c.AllowedHosts, host, hostIPs) {
+		return fmt.Errorf("%w: %s is not in worker.allowedHosts", ErrorHostNotAllowed, host)
+	}
+	return nil
+}
+
+// jobHTTPClient is the HTTP client requesting the job URLs, its connections are checked by dialControl. The caller
+// closes its idle connections once done.
+func (c Config) jobHTTPClient(checkRedirect func(req *http.Request, via []*http.Request) error) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   c.dialControl,
+	}).DialContext
+	return &http.Client{Transport: transport, CheckRedirect: checkRedirect}
+}
+
+// dialControl checks the address a connection dials against the IPs and CIDRs of worker.deniedHosts and, when
+// worker.allowedHosts only lists IPs and CIDRs, of worker.allowedHosts. checkURLHost resolved the host before, but the
+// name can resolve to another address when connecting, like with DNS rebinding, the dialed address is the one used.
+func (c Config) dialControl(network string, address string, conn syscall.RawConn) error {
+	if !hasIPPatterns(c.AllowedHosts) && !hasIPPatterns(c.DeniedHosts) {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrorHostNotAllowed, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: dialing %s, not an address", ErrorHostNotAllowed, host)
+	}
+	if matchesHostPattern(c.DeniedHosts, host, []net.IP{ip}) {
+		return fmt.Errorf("%w: %s is in worker.deniedHosts", ErrorHostNotAllowed, host)
+	}
+	// a name pattern was checked on the name, the dialed address can't tell which name it belongs to
+	if hasIPPatterns(c.AllowedHosts) && !hasNamePatterns(c.AllowedHosts) && !matchesHostPattern(c.AllowedHosts, host, []net.IP{ip}) {
+		return fmt.Errorf("%w: %s is not in worker.allowedHosts", ErrorHostNotAllowed, host)
+	}
+	return nil
+}
+
+// isIPPattern reports whether the host pattern is an IP or a CIDR instead of a name.
+func isIPPattern(pattern string) bool {
+	pattern = strings.TrimSpace(pattern)
+	if _, _, err := net.ParseCIDR(pattern); err == nil {
+		return true
+	}
+	return net.ParseIP(pattern) != nil
+}
+
+func hasIPPatterns(patterns []string) bool {
+	for _, pattern := range patterns {
+		if isIPPattern(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasNamePatterns(patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) != "" && !isIPPattern(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveHost returns the addresses of the host, so a name pointing to a denied network is denied too. A host that
+// doesn't resolve has no addresses and can only match the name patterns.
+func resolveHost(host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	return ips
+}
+
+// matchesHostPattern reports whether the host matches a pattern: a host name, a *.domain wildcard matching its
+// subdomains, an IP or a CIDR matching any address of the host.
+func matchesHostPattern(patterns []string, host string, hostIPs []net.IP) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			if containsAnyIP(network, hostIPs) {
+				return true
+			}
+			continue
+		}
+		if ip := net.ParseIP(pattern); ip != nil {
+			for _, hostIP := range hostIPs {
+				if ip.Equal(hostIP) {
+					return true
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAnyIP(network *net.IPNet, ips []net.IP) bool {
+	for _, ip := range ips {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
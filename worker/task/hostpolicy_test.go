@@ -0,0 +1,76 @@
+package task
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDialControlChecksTheDialedAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		address string
+		allowed bool
+	}{
+		{"no lists", Config{}, "10.0.0.1:80", true},
+		{"denied network", Config{DeniedHosts: []string{"10.0.0.0/8"}}, "10.0.0.1:80", false},
+		{"denied ip", Config{DeniedHosts: []string{"::1"}}, "[::1]:443", false},
+		{"out of the denied network", Config{DeniedHosts: []string{"10.0.0.0/8"}}, "192.168.1.1:80", true},
+		{"allowed network", Config{AllowedHosts: []string{"192.168.0.0/16"}}, "192.168.1.1:80", true},
+		{"out of the allowed network", Config{AllowedHosts: []string{"192.168.0.0/16"}}, "10.0.0.1:80", false},
+		// the name was checked before connecting, the address can't be matched with it
+		{"allowed names", Config{AllowedHosts: []string{"nas.example.com", "192.168.0.0/16"}}, "10.0.0.1:80", true},
+		{"denied wins over allowed names", Config{AllowedHosts: []string{"nas.example.com"}, DeniedHosts: []string{"10.0.0.0/8"}}, "10.0.0.1:80", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.dialControl("tcp", test.address, nil)
+			if test.allowed && err != nil {
+				t.Fatalf("dialing %s must be allowed: %v", test.address, err)
+			}
+			if !test.allowed && !errors.Is(err, ErrorHostNotAllowed) {
+				t.Fatalf("dialing %s must be refused, got %v", test.address, err)
+			}
+		})
+	}
+}
+
+func TestJobHTTPClientRefusesADeniedAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config := Config{DeniedHosts: []string{"127.0.0.0/8"}}
+	client := config.jobHTTPClient(nil)
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(server.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("the connection to a denied address must be refused")
+	}
+	if !errors.Is(err, ErrorHostNotAllowed) {
+		t.Fatalf("error %v, expected %v", err, ErrorHostNotAllowed)
+	}
+
+	config = Config{DeniedHosts: []string{"10.0.0.0/8"}}
+	client = config.jobHTTPClient(nil)
+	defer client.CloseIdleConnections()
+	if resp, err = client.Get(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestCheckURLHostRejectsUnresolvedHostsWithAddressRules(t *testing.T) {
+	// .invalid never resolves
+	rawURL := "http://gearr.invalid/api/v1/download/1"
+	if err := (Config{DeniedHosts: []string{"10.0.0.0/8"}}).checkURLHost(rawURL); !errors.Is(err, ErrorHostNotAllowed) {
+		t.Fatalf("an unresolved host can't be checked against the denied networks, got %v", err)
+	}
+	if err := (Config{DeniedHosts: []string{"*.example.com"}}).checkURLHost(rawURL); err != nil {
+		t.Fatalf("name rules don't need the host to resolve: %v", err)
+	}
+}
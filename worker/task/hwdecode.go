@@ -0,0 +1,23 @@
+package task
+
+const (
+	HWDecodeNone  = ""
+	HWDecodeCUDA  = "cuda"
+	HWDecodeQSV   = "qsv"
+	HWDecodeVAAPI = "vaapi"
+)
+
+// hwDecodeOptions are the ffmpeg input options decoding the source video with worker.hwDecode, whatever encoder the
+// job uses. No -hwaccel_output_format is set, so the decoder hands the frames back in system memory: ffmpeg does the
+// hwdownload itself and the software scale filter and encoders take them as they are. Codecs the hardware can't
+// decode fall back to the software decoder.
+func (c Config) hwDecodeOptions() []string {
+	if c.HWDecode == HWDecodeNone {
+		return nil
+	}
+	options := []string{"-hwaccel", c.HWDecode}
+	if c.HWDecodeDevice != "" {
+		options = append(options, "-hwaccel_device", c.HWDecodeDevice)
+	}
+	return options
+}
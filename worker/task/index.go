@@ -0,0 +1,66 @@
+package task
+
+import (
+	"gearr/model"
+	"strconv"
+
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+// indexedMessage is the message of the completed event of an indexOnly job.
+const indexedMessage = "indexed"
+
+// indexJob completes an indexOnly job with the manifest of its source: the probed streams and the sha256 of the
+// file. Nothing is encoded or uploaded, the source is only read.
+func (J *EncodeWorker) indexJob(job *model.WorkTaskEncode, track *TaskTracks) error {
+	J.updateTaskStatus(job, model.FFProbeNotification, model.ProgressingNotificationStatus, "")
+	track.Message(string(model.FFProbeNotification))
+	data, size, err := J.getVideoParameters(job.SourceFilePath)
+	if err != nil {
+		J.updateTaskStatus(job, model.FFProbeNotification, model.FailedNotificationStatus, err.Error())
+		return err
+	}
+	J.updateTaskStatus(job, model.FFProbeNotification, model.CompletedNotificationStatus, "")
+
+	// the download already verified any checksum sent with the job, the manifest records the one of the file as read
+	track.Message("checksum")
+	checksum, err := J.fileChecksum(job.SourceFilePath)
+	if err != nil {
+		return err
+	}
+	job.Manifest = newSourceManifest(data, size, checksum)
+	J.terminal.Log("[%s] indexed %d streams, sha256 %s", job.TaskEncode.Id.String(), len(job.Manifest.Streams), checksum)
+	J.updateTaskStatus(job, model.JobNotification, model.CompletedNotificationStatus, indexedMessage)
+	return nil
+}
+
+func newSourceManifest(data *ffprobe.ProbeData, size int64, checksum string) *model.SourceManifest {
+	manifest := &model.SourceManifest{
+		Checksum: checksum,
+		Size:     size,
+		Streams:  []*model.ManifestStream{},
+	}
+	if data.Format != nil {
+		manifest.FormatName = data.Format.FormatName
+		manifest.DurationSeconds = data.Format.DurationSeconds
+		manifest.Bitrate, _ = strconv.ParseInt(data.Format.BitRate, 10, 64)
+	}
+	for _, stream := range data.Streams {
+		manifest.Streams = append(manifest.Streams, &model.ManifestStream{
+			Index:    stream.Index,
+			Type:     stream.CodecType,
+			Codec:    stream.CodecName,
+			Profile:  stream.Profile,
+			Language: stream.Tags.Language,
+			Title:    stream.Tags.Title,
+			Width:    stream.Width,
+			Height:   stream.Height,
+			PixFmt:   stream.PixFmt,
+			Channels: stream.Channels,
+			Bitrate:  streamBitrate(stream, data.Format),
+			Default:  stream.Disposition.Default == 1,
+			Forced:   stream.Disposition.Forced == 1,
+		})
+	}
+	return manifest
+}
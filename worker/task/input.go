@@ -0,0 +1,77 @@
+package task
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// knownInputOptions are the ffmpeg input options expected in inputOptions, mostly fixes for broken timestamps and A/V
+// sync. Other options are passed through with a warning, ffmpeg may reject them or they may not do what is expected.
+var knownInputOptions = []string{"-fflags", "-r", "-framerate", "-itsoffset", "-itsscale", "-ss", "-t", "-to", "-f", "-err_detect",
+	"-thread_queue_size", "-copyts", "-start_at_zero", "-discard", "-ignore_editlist", "-seek_timestamp", "-hwaccel", "-c:v", "-c:a"}
+
+// inputOptionFlags returns the option names of a list of ffmpeg options, the values, negative numbers included, are
+// skipped.
+func inputOptionFlags(options []string) []string {
+	var flags []string
+	for _, option := range options {
+		if !strings.HasPrefix(option, "-") {
+			continue
+		}
+		if _, err := strconv.ParseFloat(option, 64); err == nil {
+			continue
+		}
+		flags = append(flags, option)
+	}
+	return flags
+}
+
+// ValidateInputOptions rejects the input options that would break the ffmpeg command instead of tuning the input.
+func ValidateInputOptions(options []string) error {
+	if len(options) == 0 {
+		return nil
+	}
+	if !strings.HasPrefix(options[0], "-") {
+		return fmt.Errorf("invalid inputOptions %s, must start with an option", strings.Join(options, " "))
+	}
+	for _, flag := range inputOptionFlags(options) {
+		if flag == "-i" || flag == "-y" || flag == "-n" {
+			return fmt.Errorf("invalid inputOptions %s, %s is set by the worker", strings.Join(options, " "), flag)
+		}
+	}
+	return nil
+}
+
+// InputOptionsWarnings lists the unknown options of worker.inputOptions and of the quality profiles inputOptions, they
+// are passed to ffmpeg anyway.
+func InputOptionsWarnings(config Config) []string {
+	var warnings []string
+	for _, flag := range inputOptionFlags(config.InputOptions) {
+		if !containsCodec(knownInputOptions, flag) {
+			warnings = append(warnings, fmt.Sprintf("worker.inputOptions: unknown input option %s, passing it to ffmpeg as it is", flag))
+		}
+	}
+	var names []string
+	for name := range config.QualityProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, flag := range inputOptionFlags(config.QualityProfiles[name].InputOptions) {
+			if !containsCodec(knownInputOptions, flag) {
+				warnings = append(warnings, fmt.Sprintf("quality profile %s: unknown input option %s, passing it to ffmpeg as it is", name, flag))
+			}
+		}
+	}
+	return warnings
+}
+
+// sourceInputOptions are the ffmpeg options placed before the -i of the source: the probe options, then
+// worker.inputOptions and last the inputOptions of the job quality profile, so the profile ones win.
+func (J *EncodeWorker) sourceInputOptions(quality QualityProfile) []string {
+	options := J.probeOptions()
+	options = append(options, J.workerConfig.InputOptions...)
+	return append(options, quality.InputOptions...)
+}
@@ -0,0 +1,33 @@
+package task
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFFmpegArgumentsPlaceTheInputOptionsBeforeTheSource(t *testing.T) {
+	config := testConfig()
+	config.AnalyzeDuration = 100 * time.Second
+	config.InputOptions = []string{"-fflags", "+genpts"}
+	config.HWDecode = "vaapi"
+	quality := QualityProfile{InputOptions: []string{"-ss", "10"}}
+	// the pgs subtitle is muxed from its srt, a second input which must get none of the options
+	data := probeFixture(videoStreamFixture(0), audioStreamFixture(1, "eng", 6), subtitleStreamFixture(2, "eng", "hdmv_pgs_subtitle", ""))
+	arguments := encodeArguments(t, newTestWorker(config), data, quality)
+
+	// the decode options of the video go first, then the probe, worker and quality profile options
+	expected := []string{"-hide_banner", "-threads", "4",
+		"-hwaccel", "vaapi", "-analyzeduration", "100000000", "-fflags", "+genpts", "-ss", "10", "-i", "/source/movie.mkv",
+		"-i"}
+	if len(arguments) < len(expected)+2 || strings.Join(arguments[:len(expected)], " ") != strings.Join(expected, " ") {
+		t.Fatalf("arguments %v, expected them to start with %v", arguments, expected)
+	}
+	if srtPath := arguments[len(expected)]; filepath.Base(srtPath) != "subtitle-2.srt" {
+		t.Fatalf("second input %s, expected the srt of the pgs subtitle", srtPath)
+	}
+	if next := arguments[len(expected)+1]; next != "-max_muxing_queue_size" {
+		t.Fatalf("argument %s after the inputs, expected the output options", next)
+	}
+}
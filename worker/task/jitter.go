@@ -0,0 +1,60 @@
+package task
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/avast/retry-go"
+)
+
+const (
+	RetryJitterNone         = "none"
+	RetryJitterSmall        = "small"
+	RetryJitterFull         = "full"
+	RetryJitterDecorrelated = "decorrelated"
+)
+
+// decorrelatedJitterCap bounds the waits of the decorrelated jitter, which grow with every retry.
+const decorrelatedJitterCap = time.Minute
+
+// retryDelayType spreads the waits of a retry loop with worker.retryJitter, so workers failing together because of
+// a shared outage don't all retry at the same instant. delayType is the delay policy of the loop without jitter.
+func (c Config) retryDelayType(delayType retry.DelayTypeFunc) retry.DelayTypeFunc {
+	switch c.RetryJitter {
+	case RetryJitterNone:
+		return delayType
+	case RetryJitterFull:
+		// anywhere between no wait and the policy delay
+		return func(n uint, config *retry.Config) time.Duration {
+			return randomDuration(delayType(n, config))
+		}
+	case RetryJitterDecorrelated:
+		// between the first policy delay and three times the previous wait, the waits drift apart across workers
+		var previous time.Duration
+		return func(n uint, config *retry.Config) time.Duration {
+			base := delayType(0, config)
+			if previous < base {
+				previous = base
+			}
+			previous = base + randomDuration(previous*3-base)
+			if previous > decorrelatedJitterCap {
+				previous = decorrelatedJitterCap
+			}
+			return previous
+		}
+	default:
+		// the policy delay plus up to a fifth of it
+		return func(n uint, config *retry.Config) time.Duration {
+			delay := delayType(n, config)
+			return delay + randomDuration(delay/5)
+		}
+	}
+}
+
+// randomDuration is a random duration from 0 to max, 0 when max is not positive.
+func randomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
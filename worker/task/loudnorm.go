@@ -0,0 +1,73 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gearr/model"
+	"regexp"
+	"strings"
+)
+
+var loudnormMeasurementRegex = regexp.MustCompile(`(?s)\{[^{}]*"input_i"[^{}]*\}`)
+
+// loudnormMeasurement is the loudness the loudnorm filter measures in its first pass, as printed by ffmpeg.
+type loudnormMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// loudnormTargets are the EBU R128 integrated loudness, true peak and loudness range targets of the filter.
+func (c Config) loudnormTargets() string {
+	return fmt.Sprintf("I=%.1f:TP=%.1f:LRA=%.1f", c.LoudnormTarget, c.LoudnormTruePeak, c.LoudnormRange)
+}
+
+// measureLoudness runs the loudnorm measurement pass over an audio stream, decoding the whole stream.
+func (J *EncodeWorker) measureLoudness(ctx context.Context, job *model.WorkTaskEncode, audio *Audio) (*loudnormMeasurement, error) {
+	ffmpegErrLog := ""
+	arguments := append([]string{"-hide_banner", "-nostats"}, J.probeOptions()...)
+	ffmpegCommand := newFFMPEGCommand(job.WorkDir, append(arguments, "-i", job.SourceFilePath, "-map", fmt.Sprintf("0:%d", audio.Id),
+		"-af", fmt.Sprintf("loudnorm=%s:print_format=json", J.workerConfig.loudnormTargets()), "-f", "null", "-")...).
+		SetStderrFunc(func(buffer []byte, exit bool) {
+			ffmpegErrLog += string(buffer)
+		})
+	J.terminal.Cmd("FFMPEG loudnorm command:%s", ffmpegCommand.GetFullCommand())
+	exitCode, err := J.runFFmpeg(ctx, ffmpegCommand, ffmpegPriorityAuxiliary)
+	if err != nil {
+		return nil, fmt.Errorf("%w: stderr:%s", err, ffmpegErrLog)
+	}
+	if exitCode != 0 {
+		return nil, fmt.Errorf("exit code %d: stderr:%s", exitCode, ffmpegErrLog)
+	}
+
+	measurementJson := loudnormMeasurementRegex.FindString(ffmpegErrLog)
+	if measurementJson == "" {
+		return nil, fmt.Errorf("loudnorm measurement not found: stderr:%s", ffmpegErrLog)
+	}
+	measurement := &loudnormMeasurement{}
+	if err = json.Unmarshal([]byte(measurementJson), measurement); err != nil {
+		return nil, fmt.Errorf("error parsing loudnorm measurement: %w", err)
+	}
+	return measurement, nil
+}
+
+// measureAudioLoudness measures every encoded audio stream and sets the loudnorm filter that brings it to the
+// configured targets. Measurements that are not finite, like on silent streams, leave the stream untouched.
+func (J *EncodeWorker) measureAudioLoudness(ctx context.Context, job *model.WorkTaskEncode, container *ContainerData) error {
+	for _, audio := range container.Audios {
+		measurement, err := J.measureLoudness(ctx, job, audio)
+		if err != nil {
+			return fmt.Errorf("error measuring loudness of audio %d: %w", audio.Id, err)
+		}
+		if strings.Contains(measurement.InputI, "inf") {
+			J.terminal.Warn("[%s] audio %d loudness can not be measured, it is not normalized", job.TaskEncode.Id.String(), audio.Id)
+			continue
+		}
+		audio.Loudnorm = fmt.Sprintf("loudnorm=%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+			J.workerConfig.loudnormTargets(), measurement.InputI, measurement.InputTP, measurement.InputLRA, measurement.InputThresh, measurement.TargetOffset)
+	}
+	return nil
+}
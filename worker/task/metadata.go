@@ -0,0 +1,43 @@
+package task
+
+import (
+	"strings"
+	"unicode"
+)
+
+// titleReplacements are typographic lookalikes of the quoting characters, some players and tools still choke on them.
+var titleReplacements = map[rune]string{
+	'"':  "”",
+	'\'': "’",
+	'`':  "‘",
+	'\\': "/",
+}
+
+// sanitizeTitle cleans a stream title before it is written to the encoded file: the quoting characters are
+// replaced by lookalikes, stripped or kept, depending on worker.titleSanitization, and control characters are dropped.
+func (c Config) sanitizeTitle(title string) string {
+	sanitized := strings.Builder{}
+	for _, r := range title {
+		if replacement, found := titleReplacements[r]; found && c.TitleSanitization != TitleSanitizationNone {
+			if c.TitleSanitization != TitleSanitizationStrip {
+				sanitized.WriteString(replacement)
+			}
+			continue
+		}
+		if unicode.IsControl(r) {
+			continue
+		}
+		sanitized.WriteRune(r)
+	}
+	return strings.TrimSpace(sanitized.String())
+}
+
+// sanitizeLanguage keeps only the characters of language codes, like eng or pt-BR.
+func sanitizeLanguage(language string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || (r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r))) {
+			return r
+		}
+		return -1
+	}, language)
+}
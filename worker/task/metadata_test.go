@@ -0,0 +1,38 @@
+package task
+
+import "testing"
+
+func TestSanitizeTitle(t *testing.T) {
+	title := "  Director's \"Cut\"\t`Commentary` \\ Ñoño & <5.1> 100%\x00  "
+	tests := []struct {
+		sanitization string
+		expected     string
+	}{
+		{TitleSanitizationReplace, "Director’s ”Cut”‘Commentary‘ / Ñoño & <5.1> 100%"},
+		{TitleSanitizationStrip, "Directors CutCommentary  Ñoño & <5.1> 100%"},
+		{TitleSanitizationNone, "Director's \"Cut\"`Commentary` \\ Ñoño & <5.1> 100%"},
+	}
+	for _, test := range tests {
+		t.Run(test.sanitization, func(t *testing.T) {
+			config := Config{TitleSanitization: test.sanitization}
+			if sanitized := config.sanitizeTitle(title); sanitized != test.expected {
+				t.Fatalf("sanitized title %q, expected %q", sanitized, test.expected)
+			}
+		})
+	}
+}
+
+func TestSanitizeLanguage(t *testing.T) {
+	tests := map[string]string{
+		"eng":         "eng",
+		"pt-BR":       "pt-BR",
+		"en\"g; rm -": "engrm-",
+		"español":     "espaol",
+		" fr\n":       "fr",
+	}
+	for language, expected := range tests {
+		if sanitized := sanitizeLanguage(language); sanitized != expected {
+			t.Errorf("sanitized language %q of %q, expected %q", sanitized, language, expected)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package task
+
+import (
+	"gearr/model"
+	"net/http"
+	"os"
+	"time"
+)
+
+// modTimeHeader carries the modification time of the source with the HTTP upload, in RFC 3339.
+const modTimeHeader = "modtime"
+
+// setDownloadModTime gives the downloaded source the Last-Modified time of the HTTP response, the server sends the
+// modification time of the source file. Responses without it leave the download time.
+func setDownloadModTime(sourceFilePath string, resp *http.Response) {
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return
+	}
+	os.Chtimes(sourceFilePath, time.Now(), lastModified)
+}
+
+// copySourceModTime gives the encoded file the modification time of the downloaded source, which carries the one of
+// the original file, so the upload can preserve it.
+func (J *EncodeWorker) copySourceModTime(job *model.WorkTaskEncode) {
+	sourceStat, err := os.Stat(job.SourceFilePath)
+	if err == nil {
+		err = os.Chtimes(job.TargetFilePath, time.Now(), sourceStat.ModTime())
+	}
+	if err != nil {
+		J.terminal.Warn("[%s] error preserving the source modification time: %v", job.TaskEncode.Id.String(), err)
+	}
+}
+
+// targetModTime is the modification time of the encoded file, zero when it can't be read.
+func targetModTime(job *model.WorkTaskEncode) time.Time {
+	stat, err := os.Stat(job.TargetFilePath)
+	if err != nil {
+		return time.Time{}
+	}
+	return stat.ModTime()
+}
@@ -10,7 +10,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"strconv"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
@@ -74,8 +73,9 @@ func (P *PGSWorker) Prepare(workData []byte, queueManager model.Manager) error {
 func (P *PGSWorker) Execute() (err error) {
 	log.Infof("converting PGS to SRT for job %s stream %d", P.task.Id.String(), P.task.PGSID)
 	//TODO events??
-	inputFilePath := filepath.Join(P.tempPath, strconv.Itoa(P.task.PGSID)+".sup")
-	outputFileName := strconv.Itoa(P.task.PGSID) + ".srt"
+	fileName := fmt.Sprintf("%s-%d", P.task.Id.String(), P.task.PGSID)
+	inputFilePath := filepath.Join(P.tempPath, fileName+".sup")
+	outputFileName := fileName + ".srt"
 	outputFilePath := filepath.Join(P.tempPath, outputFileName)
 	var outputBytes []byte
 	defer func() {
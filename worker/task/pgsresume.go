@@ -0,0 +1,89 @@
+package task
+
+import (
+	"encoding/json"
+	"gearr/model"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pgsExtractionFileName is the file inside the job WorkDir recording a complete extraction of the image subtitles,
+// written once the extractor succeeded so a job resumed after a restart doesn't extract them again. It is not a .json
+// file, the worker reads every .json file of the work directories as a task status when it starts.
+const pgsExtractionFileName = "pgs-extraction.done"
+
+// pgsExtraction identifies the source the subtitles were extracted from and which ones.
+type pgsExtraction struct {
+	SourceSize    int64     `json:"sourceSize"`
+	SourceModTime time.Time `json:"sourceModTime"`
+	Subtitles     []uint8   `json:"subtitles"`
+}
+
+func newPGSExtraction(taskEncode *model.WorkTaskEncode, subtitles []*Subtitle) (*pgsExtraction, error) {
+	stat, err := os.Stat(taskEncode.SourceFilePath)
+	if err != nil {
+		return nil, err
+	}
+	extraction := &pgsExtraction{SourceSize: stat.Size(), SourceModTime: stat.ModTime().UTC()}
+	for _, subtitle := range subtitles {
+		extraction.Subtitles = append(extraction.Subtitles, subtitle.Id)
+	}
+	return extraction, nil
+}
+
+// subtitlesExtracted reports whether a previous run of the job already extracted every subtitle from the same source.
+func subtitlesExtracted(taskEncode *model.WorkTaskEncode, subtitles []*Subtitle) bool {
+	b, err := os.ReadFile(filepath.Join(taskEncode.WorkDir, pgsExtractionFileName))
+	if err != nil {
+		return false
+	}
+	previous := &pgsExtraction{}
+	if err = json.Unmarshal(b, previous); err != nil {
+		return false
+	}
+	current, err := newPGSExtraction(taskEncode, subtitles)
+	if err != nil || previous.SourceSize != current.SourceSize || !previous.SourceModTime.Equal(current.SourceModTime) {
+		return false
+	}
+	extracted := make(map[uint8]bool)
+	for _, id := range previous.Subtitles {
+		extracted[id] = true
+	}
+	for _, id := range current.Subtitles {
+		if !extracted[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// markSubtitlesExtracted records the extraction of the subtitles, a failure only costs extracting them again.
+func (J *EncodeWorker) markSubtitlesExtracted(taskEncode *model.WorkTaskEncode, subtitles []*Subtitle) {
+	extraction, err := newPGSExtraction(taskEncode, subtitles)
+	if err == nil {
+		var b []byte
+		if b, err = json.Marshal(extraction); err == nil {
+			err = writeWorkFile(filepath.Join(taskEncode.WorkDir, pgsExtractionFileName), b)
+		}
+	}
+	if err != nil {
+		J.terminal.Warn("[%s] error recording the subtitle extraction: %v", taskEncode.TaskEncode.Id.String(), err)
+	}
+}
+
+// convertedSrt returns the SRT a previous run of the job already got for the subtitle. The SRT files are written
+// with writeWorkFile, so one that exists is complete.
+func convertedSrt(taskEncode *model.WorkTaskEncode, subtitle *Subtitle) bool {
+	stat, err := os.Stat(filepath.Join(taskEncode.WorkDir, subtitle.srtFileName()))
+	return err == nil && stat.Mode().IsRegular()
+}
+
+// writeWorkFile writes the file through a temporary one renamed in place, a restart in the middle leaves no
+// truncated file behind.
+func writeWorkFile(path string, data []byte) error {
+	if err := os.WriteFile(path+".tmp", data, os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
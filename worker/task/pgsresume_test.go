@@ -0,0 +1,52 @@
+package task
+
+import (
+	"gearr/model"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestResumeJobsKeepsTheSubtitleExtractionRecord(t *testing.T) {
+	worker := newTestWorker(testConfig())
+	worker.tempPath = t.TempDir()
+	worker.encodeChan = make(chan *model.WorkTaskEncode, 1)
+
+	source := filepath.Join(t.TempDir(), "movie.mkv")
+	if err := os.WriteFile(source, []byte("source"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.New()
+	job := &model.WorkTaskEncode{
+		TaskEncode:     &model.TaskEncode{Id: id},
+		SourceFilePath: source,
+		WorkDir:        filepath.Join(worker.tempPath, id.String()),
+	}
+	ensureDirectoryExists(job.WorkDir)
+	subtitles := []*Subtitle{{Id: 2, Language: "eng", Format: "hdmv_pgs_subtitle"}}
+	worker.markSubtitlesExtracted(job, subtitles)
+	// the worker stopped during the OCR of the extracted subtitles
+	worker.saveTaskStatusDisk(&model.TaskStatus{
+		LastState: &model.TaskEvent{Id: id, EventType: model.NotificationEvent, NotificationType: model.PGSNotification, Status: model.ProgressingNotificationStatus},
+		Task:      job,
+	})
+
+	worker.resumeJobsFrom(worker.tempPath)
+	select {
+	case resumed := <-worker.encodeChan:
+		if resumed.TaskEncode.Id != id {
+			t.Fatalf("resumed job %s, expected %s", resumed.TaskEncode.Id, id)
+		}
+	default:
+		t.Fatal("the job must be queued to encode again")
+	}
+	corrupt, _ := filepath.Glob(filepath.Join(job.WorkDir, "*.corrupt"))
+	if len(corrupt) > 0 {
+		t.Fatalf("quarantined %v, only the task status is read on resume", corrupt)
+	}
+	if !subtitlesExtracted(job, subtitles) {
+		t.Fatal("the resumed job must reuse the subtitles already extracted")
+	}
+}
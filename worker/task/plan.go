@@ -0,0 +1,54 @@
+package task
+
+import (
+	"gearr/helper"
+	"gearr/helper/command"
+	"gearr/model"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// EncodePlan is what the worker would do with a source, without encoding it.
+type EncodePlan struct {
+	Container *ContainerData
+	Segments  bool
+	Command   string
+}
+
+// Plan probes a local source and runs the same stream selection and ffmpeg generation as an encode, stopping before
+// ffmpeg runs. It is used to validate the worker config against real files.
+func (J *EncodeWorker) Plan(sourceFilePath string, qualityProfile string) (*EncodePlan, error) {
+	job := &model.WorkTaskEncode{
+		TaskEncode:     &model.TaskEncode{Id: uuid.New(), QualityProfile: qualityProfile},
+		WorkDir:        J.tempPath,
+		SourceFilePath: sourceFilePath,
+	}
+	sourceVideoParams, _, err := J.getVideoParameters(sourceFilePath)
+	if err != nil {
+		return nil, err
+	}
+	videoContainer, err := J.clearData(sourceVideoParams, nil)
+	if err != nil {
+		return nil, err
+	}
+	J.checkRotation(sourceFilePath, videoContainer.Video)
+	if err = J.applyQualityProfile(job, videoContainer); err != nil {
+		return nil, err
+	}
+	if J.workerConfig.RemuxIfAlreadyTarget && videoContainer.Video.isEncodeTarget(videoContainer.Quality) {
+		videoContainer.Video.Copy = true
+	}
+	// segmented encodes end muxing the encoded segments with the rest of the streams
+	segments := J.useEncodeSegments(videoContainer.Video)
+	segmentListPath := ""
+	if segments {
+		segmentListPath = filepath.Join(job.WorkDir, segmentListFileName)
+	}
+	ffmpegArguments := J.ffmpegArguments(job, videoContainer, segmentListPath)
+	return &EncodePlan{
+		Container: videoContainer,
+		Segments:  segments,
+		Command:   command.NewCommand(helper.GetFFmpegPath(), ffmpegArguments...).GetFullCommand(),
+	}, nil
+}
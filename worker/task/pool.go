@@ -0,0 +1,36 @@
+package task
+
+import (
+	"fmt"
+	"gearr/model"
+	"strings"
+)
+
+// ValidateEncodePools checks the concurrency of every encode pool and that the quality profiles only route jobs to
+// existing pools.
+func ValidateEncodePools(pools map[string]int, profiles map[string]QualityProfile) error {
+	for name, jobs := range pools {
+		if jobs < 1 {
+			return fmt.Errorf("encode pool %s: invalid jobs %d, must be at least 1", name, jobs)
+		}
+	}
+	for name, profile := range profiles {
+		if _, found := pools[strings.ToLower(profile.Pool)]; profile.Pool != "" && !found {
+			return fmt.Errorf("quality profile %s: unknown encode pool %s", name, profile.Pool)
+		}
+	}
+	return nil
+}
+
+// encodePoolChan is the queue of the encode pool running the job, the one of its quality profile or the default
+// worker.encodeJobs pool. Jobs with an unknown profile go to the default pool, where they fail.
+func (J *EncodeWorker) encodePoolChan(job *model.WorkTaskEncode) chan *model.WorkTaskEncode {
+	profile, err := J.workerConfig.qualityProfile(job.TaskEncode.QualityProfile, job.TaskEncode.EncodeOverrides)
+	if err != nil || profile.Pool == "" {
+		return J.encodeChan
+	}
+	if poolChan, found := J.encodePools[strings.ToLower(profile.Pool)]; found {
+		return poolChan
+	}
+	return J.encodeChan
+}
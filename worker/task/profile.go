@@ -0,0 +1,350 @@
+package task
+
+import (
+	"fmt"
+	"gearr/model"
+	"strings"
+)
+
+const (
+	VideoCodecX265 = "libx265"
+	VideoCodecX264 = "libx264"
+	// VideoCodecNVENC encodes HEVC on NVIDIA GPUs
+	VideoCodecNVENC = "hevc_nvenc"
+	// VideoCodecVP9 encodes VP9, which browsers play natively from WebM files
+	VideoCodecVP9 = "libvpx-vp9"
+	// VideoCodecCopy copies the video and subtitles and only transcodes the audio
+	VideoCodecCopy = "copy"
+)
+
+const (
+	ContainerMKV = "mkv"
+	// ContainerWebM only holds VP9 video, Opus or Vorbis audio and WebVTT subtitles
+	ContainerWebM = "webm"
+)
+
+// webmAudioCodecs are the audio encoders whose output the webm muxer accepts.
+var webmAudioCodecs = []string{"libopus", "libvorbis"}
+
+var videoCodecPresets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow", "placebo"}
+
+var nvencPresets = []string{"p1", "p2", "p3", "p4", "p5", "p6", "p7"}
+
+// vp9Presets are the libvpx-vp9 -cpu-used speeds of the good deadline, 0 is the slowest and best
+var vp9Presets = []string{"0", "1", "2", "3", "4", "5"}
+
+const (
+	// HEVCProfileMain is 8 bit HEVC, the only one older devices decode
+	HEVCProfileMain   = "main"
+	HEVCProfileMain10 = "main10"
+)
+
+var hevcLevels = []string{"1", "2", "2.1", "3", "3.1", "4", "4.1", "5", "5.1", "5.2", "6", "6.1", "6.2"}
+
+// QualityProfile bundles the video and audio settings of an encode. Jobs select one by name, the settings left
+// empty keep the default encode ones.
+type QualityProfile struct {
+	// VideoCodec is libx265, libx264, hevc_nvenc, libvpx-vp9 or copy
+	VideoCodec string `mapstructure:"videoCodec"`
+	// CRF 0 picks the CRF from crfBitrateRules
+	CRF    int    `mapstructure:"crf"`
+	Preset string `mapstructure:"preset"`
+	PixFmt string `mapstructure:"pixFmt"`
+	// MaxWidth scales down wider videos keeping the aspect ratio
+	MaxWidth   int    `mapstructure:"maxWidth"`
+	AudioCodec string `mapstructure:"audioCodec"`
+	// AudioBitrate empty uses the libfdk_aac variable bitrate mode
+	AudioBitrate string `mapstructure:"audioBitrate"`
+	// Pool is the encode pool running the jobs of the profile, empty is the default worker.encodeJobs pool
+	Pool string `mapstructure:"pool"`
+	// InputOptions are ffmpeg options placed before the -i of the source, after worker.inputOptions
+	InputOptions []string `mapstructure:"inputOptions"`
+	// Profile is the HEVC profile, main or main10, empty lets the pixel format decide
+	Profile string `mapstructure:"profile"`
+	// Level is the HEVC level, like 5.1, empty lets the encoder pick it
+	Level string `mapstructure:"level"`
+	// CopyStreams copies every audio and subtitle stream of the source as they are, skipping their selection
+	CopyStreams bool `mapstructure:"copyStreams"`
+	// Container is the output container, mkv or webm, empty is webm for libvpx-vp9 and mkv for the rest
+	Container string `mapstructure:"container"`
+	// SubtitlesOnly converts the image subtitles to SRT and uploads them in a zip archive, without encoding
+	SubtitlesOnly bool `mapstructure:"subtitlesOnly"`
+}
+
+var defaultQualityProfile = QualityProfile{
+	VideoCodec: VideoCodecX265,
+	PixFmt:     "yuv420p10le",
+	MaxWidth:   maxOutputWidth,
+	AudioCodec: "libfdk_aac",
+	Container:  ContainerMKV,
+}
+
+// withDefaults fills the settings the profile leaves empty with the default encode ones.
+func (Q QualityProfile) withDefaults() QualityProfile {
+	if Q.VideoCodec == "" {
+		Q.VideoCodec = defaultQualityProfile.VideoCodec
+	}
+	if Q.Container == "" && Q.VideoCodec == VideoCodecVP9 {
+		Q.Container = ContainerWebM
+	} else if Q.Container == "" {
+		Q.Container = ContainerMKV
+	}
+	// browsers only decode 8 bit VP9 everywhere
+	if Q.PixFmt == "" && (Q.Profile == HEVCProfileMain || Q.VideoCodec == VideoCodecVP9) {
+		Q.PixFmt = "yuv420p"
+	} else if Q.PixFmt == "" && Q.VideoCodec == VideoCodecNVENC {
+		// nvenc takes 10 bit video as p010le instead of yuv420p10le
+		Q.PixFmt = "p010le"
+	} else if Q.PixFmt == "" {
+		Q.PixFmt = defaultQualityProfile.PixFmt
+	}
+	if Q.MaxWidth == 0 {
+		Q.MaxWidth = defaultQualityProfile.MaxWidth
+	}
+	if Q.AudioCodec == "" && Q.Container == ContainerWebM {
+		Q.AudioCodec = "libopus"
+	} else if Q.AudioCodec == "" {
+		Q.AudioCodec = defaultQualityProfile.AudioCodec
+	}
+	return Q
+}
+
+// audioOnly reports whether the profile only transcodes the audio, copying the video and subtitles as they are.
+func (Q QualityProfile) audioOnly() bool {
+	return Q.VideoCodec == VideoCodecCopy
+}
+
+// codecName is the short name of the video codec used by the {codec} output file template token.
+func (Q QualityProfile) codecName() string {
+	switch Q.VideoCodec {
+	case VideoCodecNVENC:
+		return "hevc"
+	case VideoCodecVP9:
+		return "vp9"
+	}
+	return strings.TrimPrefix(Q.VideoCodec, "lib")
+}
+
+// tenBitPixFmt reports whether the pixel format stores 10 bits per component, like yuv420p10le or p010le.
+func tenBitPixFmt(pixFmt string) bool {
+	return strings.Contains(pixFmt, "10")
+}
+
+// hevcProfile is the profile the HEVC encoder is asked for, 10 bit x265 encodes default to main10 as they always did.
+func (Q QualityProfile) hevcProfile() string {
+	if Q.Profile == "" && Q.VideoCodec == VideoCodecX265 && Q.PixFmt == "yuv420p10le" {
+		return HEVCProfileMain10
+	}
+	return Q.Profile
+}
+
+// presets are the presets accepted by the video codec.
+func (Q QualityProfile) presets() []string {
+	switch Q.VideoCodec {
+	case VideoCodecNVENC:
+		return nvencPresets
+	case VideoCodecVP9:
+		return vp9Presets
+	}
+	return videoCodecPresets
+}
+
+// sourceCodec is the ffprobe codec name of the video codec, used to detect sources that already match the profile.
+func (Q QualityProfile) sourceCodec() string {
+	switch Q.VideoCodec {
+	case VideoCodecX264:
+		return "h264"
+	case VideoCodecVP9:
+		return "vp9"
+	}
+	return "hevc"
+}
+
+func (Q QualityProfile) audioParameters(index int) []string {
+	parameters := []string{fmt.Sprintf("-c:a:%d", index), Q.AudioCodec}
+	if Q.AudioBitrate != "" {
+		return append(parameters, fmt.Sprintf("-b:a:%d", index), Q.AudioBitrate)
+	}
+	if Q.AudioCodec == defaultQualityProfile.AudioCodec {
+		return append(parameters, "-vbr", "5")
+	}
+	return parameters
+}
+
+// ValidateQualityProfiles checks every quality profile when the worker starts, instead of failing the jobs using them.
+func ValidateQualityProfiles(profiles map[string]QualityProfile) error {
+	for name, profile := range profiles {
+		if err := profile.withDefaults().validate(); err != nil {
+			return fmt.Errorf("quality profile %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (Q QualityProfile) validate() error {
+	switch Q.VideoCodec {
+	case VideoCodecX265, VideoCodecX264, VideoCodecNVENC, VideoCodecVP9, VideoCodecCopy:
+	default:
+		return fmt.Errorf("invalid videoCodec %s, must be %s, %s, %s, %s or %s", Q.VideoCodec, VideoCodecX265, VideoCodecX264, VideoCodecNVENC, VideoCodecVP9, VideoCodecCopy)
+	}
+	if Q.CRF < 0 || Q.CRF > Q.maxCRF() {
+		return fmt.Errorf("invalid crf %d, must be between 0 and %d", Q.CRF, Q.maxCRF())
+	}
+	if Q.Preset != "" && !containsCodec(Q.presets(), Q.Preset) {
+		return fmt.Errorf("invalid preset %s, must be one of %s", Q.Preset, strings.Join(Q.presets(), ","))
+	}
+	if Q.MaxWidth < 0 {
+		return fmt.Errorf("invalid maxWidth %d", Q.MaxWidth)
+	}
+	if Q.AudioBitrate != "" {
+		if _, err := parseBitrate(Q.AudioBitrate); err != nil {
+			return fmt.Errorf("invalid audioBitrate %s: %w", Q.AudioBitrate, err)
+		}
+	}
+	if err := ValidateInputOptions(Q.InputOptions); err != nil {
+		return err
+	}
+	if err := Q.validateContainer(); err != nil {
+		return err
+	}
+	if err := Q.validateSubtitlesOnly(); err != nil {
+		return err
+	}
+	return Q.validateHEVCProfile()
+}
+
+// maxCRF is the highest CRF of the video codec, libvpx-vp9 has a wider scale than the x26x encoders.
+func (Q QualityProfile) maxCRF() int {
+	if Q.VideoCodec == VideoCodecVP9 {
+		return 63
+	}
+	return 51
+}
+
+// validateContainer checks the streams of the profile fit the container, the webm muxer refuses any other codec.
+func (Q QualityProfile) validateContainer() error {
+	switch Q.Container {
+	case ContainerMKV:
+		return nil
+	case ContainerWebM:
+	default:
+		return fmt.Errorf("invalid container %s, must be %s or %s", Q.Container, ContainerMKV, ContainerWebM)
+	}
+	if Q.VideoCodec != VideoCodecVP9 {
+		return fmt.Errorf("container %s needs videoCodec %s, not %s", Q.Container, VideoCodecVP9, Q.VideoCodec)
+	}
+	if !containsCodec(webmAudioCodecs, Q.AudioCodec) {
+		return fmt.Errorf("container %s needs audioCodec %s, not %s", Q.Container, strings.Join(webmAudioCodecs, " or "), Q.AudioCodec)
+	}
+	if Q.CopyStreams {
+		return fmt.Errorf("container %s can not copy the source streams as they are", Q.Container)
+	}
+	return nil
+}
+
+// validateSubtitlesOnly rejects the settings that copy the image subtitles, a subtitlesOnly profile would have
+// nothing to convert.
+func (Q QualityProfile) validateSubtitlesOnly() error {
+	if Q.SubtitlesOnly && (Q.CopyStreams || Q.audioOnly()) {
+		return fmt.Errorf("subtitlesOnly can not be combined with copyStreams or videoCodec %s", VideoCodecCopy)
+	}
+	return nil
+}
+
+// validateHEVCProfile checks the profile and level are supported by the codec and the pixel format has the bit depth
+// of the profile, x265 refuses to encode 10 bit input as main.
+func (Q QualityProfile) validateHEVCProfile() error {
+	if Q.Profile == "" && Q.Level == "" {
+		return nil
+	}
+	if Q.VideoCodec != VideoCodecX265 && Q.VideoCodec != VideoCodecNVENC {
+		return fmt.Errorf("profile and level are only supported by %s and %s, not %s", VideoCodecX265, VideoCodecNVENC, Q.VideoCodec)
+	}
+	switch Q.Profile {
+	case "":
+	case HEVCProfileMain:
+		if tenBitPixFmt(Q.PixFmt) {
+			return fmt.Errorf("invalid pixFmt %s, profile %s is 8 bit", Q.PixFmt, Q.Profile)
+		}
+	case HEVCProfileMain10:
+		if !tenBitPixFmt(Q.PixFmt) {
+			return fmt.Errorf("invalid pixFmt %s, profile %s is 10 bit", Q.PixFmt, Q.Profile)
+		}
+	default:
+		return fmt.Errorf("invalid profile %s, must be %s or %s", Q.Profile, HEVCProfileMain, HEVCProfileMain10)
+	}
+	if Q.Level != "" && !containsCodec(hevcLevels, Q.Level) {
+		return fmt.Errorf("invalid level %s, must be one of %s", Q.Level, strings.Join(hevcLevels, ","))
+	}
+	return nil
+}
+
+// qualityProfile resolves the quality profile name of a job, an empty name is the default encode. The encode overrides
+// of the job win over the profile, and both over the defaults, which are filled last so overriding the codec also
+// gets the default pixel format of that codec.
+func (c Config) qualityProfile(name string, overrides *model.EncodeOverrides) (QualityProfile, error) {
+	profile := QualityProfile{}
+	if name != "" {
+		var found bool
+		// profile names are config keys, which are case insensitive
+		profile, found = c.QualityProfiles[strings.ToLower(name)]
+		if !found {
+			return QualityProfile{}, fmt.Errorf("unknown quality profile %s", name)
+		}
+	}
+	if overrides == nil {
+		return profile.withDefaults(), nil
+	}
+	profile = profile.withOverrides(overrides).withDefaults()
+	if err := profile.validate(); err != nil {
+		return QualityProfile{}, fmt.Errorf("invalid encode overrides: %w", err)
+	}
+	return profile, nil
+}
+
+// withOverrides replaces the settings of the profile set in the job encode overrides.
+func (Q QualityProfile) withOverrides(overrides *model.EncodeOverrides) QualityProfile {
+	if overrides.VideoCodec != "" {
+		Q.VideoCodec = overrides.VideoCodec
+	}
+	if overrides.CRF > 0 {
+		Q.CRF = overrides.CRF
+	}
+	if overrides.Preset != "" {
+		Q.Preset = overrides.Preset
+	}
+	if overrides.PixFmt != "" {
+		Q.PixFmt = overrides.PixFmt
+	}
+	if overrides.MaxWidth > 0 {
+		Q.MaxWidth = overrides.MaxWidth
+	}
+	if overrides.AudioCodec != "" {
+		Q.AudioCodec = overrides.AudioCodec
+	}
+	if overrides.AudioBitrate != "" {
+		Q.AudioBitrate = overrides.AudioBitrate
+	}
+	return Q
+}
+
+// applyQualityProfile resolves the quality profile of the job into the encode settings of the container.
+func (J *EncodeWorker) applyQualityProfile(job *model.WorkTaskEncode, container *ContainerData) error {
+	profile, err := J.workerConfig.qualityProfile(job.TaskEncode.QualityProfile, job.TaskEncode.EncodeOverrides)
+	if err != nil {
+		return err
+	}
+	container.Quality = profile
+	if profile.CRF > 0 {
+		container.Video.CRF = profile.CRF
+	}
+	if profile.audioOnly() {
+		container.Video.Copy = true
+		container.CopySubtitles = true
+	}
+	if profile.CopyStreams {
+		container.CopyStreams = true
+		container.CopySubtitles = true
+	}
+	return nil
+}
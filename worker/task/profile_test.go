@@ -0,0 +1,62 @@
+package task
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFFmpegArgumentsSetTheX265ProfileOfAMain8BitProfile(t *testing.T) {
+	quality := QualityProfile{VideoCodec: VideoCodecX265, PixFmt: "yuv420p", Profile: HEVCProfileMain, Level: "4.1"}
+	if err := quality.withDefaults().validate(); err != nil {
+		t.Fatal(err)
+	}
+	arguments := encodeArguments(t, newTestWorker(testConfig()), probeFixture(videoStreamFixture(0)), quality)
+
+	if pixFmt, _ := argumentValue(arguments, "-pix_fmt:v:0"); pixFmt != "yuv420p" {
+		t.Fatalf("-pix_fmt:v:0 %q, expected yuv420p: %v", pixFmt, arguments)
+	}
+	if params, _ := argumentValue(arguments, "-x265-params"); params != "profile=main:level-idc=4.1" {
+		t.Fatalf("-x265-params %q, expected profile=main:level-idc=4.1: %v", params, arguments)
+	}
+}
+
+func TestFFmpegArgumentsDefaultToTheMain10X265Profile(t *testing.T) {
+	arguments := encodeArguments(t, newTestWorker(testConfig()), probeFixture(videoStreamFixture(0)), QualityProfile{})
+	if params, _ := argumentValue(arguments, "-x265-params"); params != "profile=main10" {
+		t.Fatalf("-x265-params %q, expected the profile of the 10 bit pixel format: %v", params, arguments)
+	}
+}
+
+func TestValidateRejectsA10BitMainProfile(t *testing.T) {
+	quality := QualityProfile{VideoCodec: VideoCodecX265, PixFmt: "yuv420p10le", Profile: HEVCProfileMain}
+	if err := quality.withDefaults().validate(); err == nil {
+		t.Fatal("x265 can not encode 10 bit input as main, the profile must be rejected")
+	}
+}
+
+func TestFFmpegArgumentsEncodeVP9IntoWebM(t *testing.T) {
+	quality := QualityProfile{VideoCodec: VideoCodecVP9, Preset: "2"}
+	if err := quality.withDefaults().validate(); err != nil {
+		t.Fatal(err)
+	}
+	arguments := encodeArguments(t, newTestWorker(testConfig()), probeFixture(videoStreamFixture(0), audioStreamFixture(1, "eng", 6)), quality)
+
+	if !containsArguments(arguments, "-pix_fmt:v:0", "yuv420p", "-c:v:0", VideoCodecVP9, "-crf") {
+		t.Fatalf("the video must be 8 bit VP9: %v", arguments)
+	}
+	// -b:v 0 makes the crf a constant quality, the preset is the -cpu-used speed of the good deadline
+	if !containsArguments(arguments, "-b:v:0", "0", "-row-mt", "1", "-deadline", "good", "-cpu-used", "2") {
+		t.Fatalf("the VP9 rate control and speed are missing: %v", arguments)
+	}
+	for _, flag := range []string{"-preset", "-x265-params"} {
+		if value, found := argumentValue(arguments, flag); found {
+			t.Fatalf("%s %s, libvpx-vp9 has no such option", flag, value)
+		}
+	}
+	if codec, _ := argumentValue(arguments, "-c:a:0"); codec != "libopus" {
+		t.Fatalf("-c:a:0 %q, webm needs opus audio", codec)
+	}
+	if output := arguments[len(arguments)-2]; filepath.Ext(output) != ".webm" {
+		t.Fatalf("output %s, expected a webm file", output)
+	}
+}
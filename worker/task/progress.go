@@ -0,0 +1,97 @@
+package task
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// extractBytesPerSecond is the rate the subtitle extraction is assumed to read the source at, it reads it whole.
+	extractBytesPerSecond = 200 * 1024 * 1024
+	// defaultOCRBytesPerSecond is the PGS to SRT rate assumed until the worker measured its own.
+	defaultOCRBytesPerSecond = 64 * 1024
+	// ocrEstimateCap is how much of the OCR phase the estimate can fill before the PGS responses arrive.
+	ocrEstimateCap = 0.95
+)
+
+// jobProgress weights the phases before the encode into the encode track, so the bar covers the whole job instead
+// of restarting for every phase. The track counts encode frames, so every phase is converted from its estimated
+// duration to the frames the worker encodes in that time, using the encode speed of its last jobs.
+type jobProgress struct {
+	track           *TaskTracks
+	framesPerSecond float64
+}
+
+func (J *EncodeWorker) newJobProgress(track *TaskTracks, video *Video) *jobProgress {
+	speed := float64(1)
+	if throughput := J.Throughput(); throughput != nil && throughput.AverageSpeed > 0 {
+		speed = throughput.AverageSpeed
+	}
+	track.SetTotal(int64(video.Duration.Seconds()) * int64(video.FrameRate))
+	return &jobProgress{
+		track:           track,
+		framesPerSecond: float64(video.FrameRate) * speed,
+	}
+}
+
+// phase adds a phase estimated to take seconds to the total of the track.
+func (p *jobProgress) phase(seconds float64) *progressPhase {
+	frames := int64(seconds * p.framesPerSecond)
+	p.track.AddTotal(frames)
+	return &progressPhase{track: p.track, frames: frames}
+}
+
+// progressPhase is a share of the job progress, advanced as it goes and filled when it ends.
+type progressPhase struct {
+	mu     sync.Mutex
+	track  *TaskTracks
+	frames int64
+	done   int64
+}
+
+// advance moves the phase to fraction of its frames, it never goes back.
+func (p *progressPhase) advance(fraction float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if fraction > 1 {
+		fraction = 1
+	}
+	if done := int64(fraction * float64(p.frames)); done > p.done {
+		p.track.Increment64(done - p.done)
+		p.done = done
+	}
+}
+
+func (p *progressPhase) finish() {
+	p.advance(1)
+}
+
+// ocrRate is the PGS to SRT rate of the worker in bytes of PGS per second, averaged over its conversions.
+type ocrRate struct {
+	mu          sync.Mutex
+	bytesPerSec float64
+}
+
+func (r *ocrRate) get() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.bytesPerSec <= 0 {
+		return defaultOCRBytesPerSecond
+	}
+	return r.bytesPerSec
+}
+
+// record adds a conversion to the average, the last ones weight the most as the PGS workers come and go.
+func (r *ocrRate) record(bytes int64, elapsed time.Duration) {
+	if bytes <= 0 || elapsed <= 0 {
+		return
+	}
+	rate := float64(bytes) / elapsed.Seconds()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.bytesPerSec <= 0 {
+		r.bytesPerSec = rate
+		return
+	}
+	r.bytesPerSec = r.bytesPerSec*0.7 + rate*0.3
+}
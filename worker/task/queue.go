@@ -28,10 +28,10 @@ type JobWorker struct {
 	encodeWorker *EncodeWorker
 }
 
-func (w *JobWorker) GetPGSByID(pgsid int) *TaskPGSJobControl {
+func (w *JobWorker) GetPGSByID(jobID uuid.UUID, pgsid int) *TaskPGSJobControl {
 	for obj := range w.pgs.Iter() {
 		taskPGSJobControl := obj.Value.(*TaskPGSJobControl)
-		if taskPGSJobControl.task.PGSID == pgsid {
+		if taskPGSJobControl.task.Id == jobID && taskPGSJobControl.task.PGSID == pgsid {
 			return taskPGSJobControl
 		}
 	}
@@ -85,14 +85,61 @@ func (Q *RabbitMQClient) Run(wg *sync.WaitGroup, ctx context.Context) {
 	log.Info("starting broker client")
 	Q.start(ctx)
 	log.Info("started broker client")
+	go Q.publishLifecycleEvent(model.WorkerStartedEvent)
 	wg.Add(1)
 	go func() {
 		<-ctx.Done()
 		log.Info("stopping broker client")
 		Q.stop()
+		Q.publishLifecycleEvent(model.WorkerStoppedEvent)
 		wg.Done()
 	}()
 }
+
+// publishLifecycleEvent tells the server the worker started or stopped. It is best effort, a single publish
+// attempt, so a broker problem never delays the worker start or shutdown.
+func (Q *RabbitMQClient) publishLifecycleEvent(eventType model.EventType) {
+	event := model.TaskEvent{
+		EventType:   eventType,
+		WorkerName:  Q.workerConfig.Name,
+		WorkerQueue: Q.workerUniqueQueue,
+		EventTime:   time.Now(),
+	}
+	if eventType == model.WorkerStartedEvent {
+		event.IP = helper.GetPublicIP()
+		event.WorkerInfo = &model.WorkerInfo{
+			Version:      helper.Version,
+			AcceptedJobs: Q.workerConfig.Jobs,
+			Threads:      Q.workerConfig.Threads,
+			EncodeJobs:   Q.workerConfig.EncodeJobs,
+			EncodePools:  Q.workerConfig.EncodePools,
+			PGSJobs:      Q.workerConfig.PgsJobs,
+		}
+		if Q.workerConfig.FFmpeg != nil {
+			event.WorkerInfo.FFmpegVersion = Q.workerConfig.FFmpeg.Version
+			event.WorkerInfo.Encoders = Q.workerConfig.FFmpeg.Encoders
+		}
+	}
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		Q.printer.Warn("error publishing %s event: %v", eventType, err)
+		return
+	}
+	channel, err := Q.connection.Channel()
+	if err != nil {
+		Q.printer.Warn("error publishing %s event: %v", eventType, err)
+		return
+	}
+	defer channel.Close()
+	err = channel.Publish("", Q.brokerConfig.TaskEventQueueName, false, false, amqp.Publishing{
+		ContentType: "text/plain",
+		Timestamp:   time.Now(),
+		Body:        bytes,
+	})
+	if err != nil {
+		Q.printer.Warn("error publishing %s event: %v", eventType, err)
+	}
+}
 func (Q *RabbitMQClient) conn() (*rabbitmq.Connection, error) {
 	conn, err := rabbitmq.Dial(fmt.Sprintf("amqp://%s:%s@%s:%d/", Q.brokerConfig.User, Q.brokerConfig.Password, Q.brokerConfig.Host, Q.brokerConfig.Port))
 	return conn, err
@@ -131,6 +178,20 @@ func (Q *RabbitMQClient) RequestPGSJob(pgsJob model.TaskPGS) <-chan *model.TaskP
 	Q.EncodeWorker.pgs.Append(pgsJobControl)
 	return pgsJobControl.response
 }
+
+// PGSQueueMessages returns the number of PGS jobs waiting in the broker for a PGS worker.
+func (Q *RabbitMQClient) PGSQueueMessages() (int, error) {
+	channel, err := Q.connection.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer channel.Close()
+	queue, err := channel.QueueInspect(Q.brokerConfig.TaskPGSToSrtQueueName)
+	if err != nil {
+		return 0, err
+	}
+	return queue.Messages, nil
+}
 func (Q *RabbitMQClient) ResponsePGSJob(pgsResponse model.TaskPGSResponse) error {
 	bytes, err := json.Marshal(pgsResponse)
 	if err != nil {
@@ -206,13 +267,16 @@ func (Q *RabbitMQClient) eventProcessor(ctx context.Context) {
 				EventTime:   time.Now(),
 				IP:          helper.GetPublicIP(),
 			}
+			if Q.EncodeWorker != nil {
+				pingEvent.Throughput = Q.EncodeWorker.encodeWorker.Throughput()
+			}
 			Q.publishMessageTtl(Q.brokerConfig.TaskEventQueueName, pingEvent, time.Duration(30)*time.Second)
 		case rabbitEvent := <-workerQueueChan:
 			switch rabbitEvent.Type {
 			case "PGSResponse":
 				PGSResponse := &model.TaskPGSResponse{}
 				Q.ObjectUnmarshall(rabbitEvent, PGSResponse)
-				taskPGS := Q.EncodeWorker.GetPGSByID(PGSResponse.PGSID)
+				taskPGS := Q.EncodeWorker.GetPGSByID(PGSResponse.Id, PGSResponse.PGSID)
 				if taskPGS != nil {
 					taskPGS.response <- PGSResponse
 					close(taskPGS.response)
@@ -297,8 +361,6 @@ func (Q *RabbitMQClient) encodeQueueProcessor(ctx context.Context, taskQueueName
 		log.Panic(err)
 	}
 
-	log.Debug("start encode worker manager")
-	Q.EncodeWorker.encodeWorker.Manager = Q
 	for {
 		select {
 		case <-ctx.Done():
@@ -0,0 +1,136 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"gearr/helper"
+	"gearr/helper/command"
+	"math"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RotationActionTranspose = "transpose"
+	RotationActionIgnore    = "ignore"
+)
+
+type rotationProbe struct {
+	Streams []struct {
+		SideDataList []struct {
+			Rotation *float64 `json:"rotation"`
+		} `json:"side_data_list"`
+		Tags struct {
+			Rotate string `json:"rotate"`
+		} `json:"tags"`
+	} `json:"streams"`
+}
+
+// detectRotation reads the rotation players apply to the video, from the display matrix side data phones write or
+// from the rotate tag older ffmpeg versions report instead.
+func (J *EncodeWorker) detectRotation(sourceFilePath string, video *Video) error {
+	arguments := append([]string{"-v", "error"}, J.probeOptions()...)
+	ffprobeCommand := command.NewCommand(helper.GetFFProbePath(), append(arguments, "-select_streams", fmt.Sprintf("%d", video.Id),
+		"-show_entries", "stream=index:stream_side_data=rotation:stream_tags=rotate", "-of", "json", sourceFilePath)...)
+
+	ffprobeOutput := ""
+	ffprobeErrLog := ""
+	ffprobeCommand.SetStdoutFunc(func(buffer []byte, exit bool) {
+		ffprobeOutput += string(buffer)
+	}).
+		SetStderrFunc(func(buffer []byte, exit bool) {
+			ffprobeErrLog += string(buffer)
+		})
+	exitCode, err := ffprobeCommand.RunWithContext(J.ctx)
+	if err != nil {
+		return fmt.Errorf("%w: stderr:%s", err, ffprobeErrLog)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("exit code %d: stderr:%s", exitCode, ffprobeErrLog)
+	}
+
+	rotation, err := parseRotation(ffprobeOutput)
+	if err != nil {
+		return err
+	}
+	video.Rotation = rotation
+	return nil
+}
+
+// parseRotation reads the clockwise rotation from the ffprobe json output of detectRotation, 0 when the video has
+// neither a display matrix nor a rotate tag.
+func parseRotation(ffprobeOutput string) (int, error) {
+	probe := &rotationProbe{}
+	if err := json.Unmarshal([]byte(ffprobeOutput), probe); err != nil {
+		return 0, fmt.Errorf("error parsing ffprobe output: %v", err)
+	}
+	rotation := 0
+	for _, stream := range probe.Streams {
+		for _, sideData := range stream.SideDataList {
+			if sideData.Rotation != nil {
+				// the display matrix rotates counterclockwise
+				return normalizeRotation(-*sideData.Rotation), nil
+			}
+		}
+		if rotate, err := strconv.ParseFloat(stream.Tags.Rotate, 64); err == nil {
+			rotation = normalizeRotation(rotate)
+		}
+	}
+	return rotation, nil
+}
+
+// normalizeRotation turns a rotation in degrees into the clockwise quarter turns 0, 90, 180 or 270.
+func normalizeRotation(degrees float64) int {
+	rotation := int(math.Round(degrees/90)) * 90 % 360
+	if rotation < 0 {
+		rotation += 360
+	}
+	return rotation
+}
+
+// rotationFilter is the filter turning the stored frames upright, empty when they already are.
+func (V *Video) rotationFilter() string {
+	switch V.Rotation {
+	case 90:
+		return "transpose=clock"
+	case 180:
+		return "hflip,vflip"
+	case 270:
+		return "transpose=cclock"
+	}
+	return ""
+}
+
+// displaySize is the width and height of the video as players show it, after the rotation.
+func (V *Video) displaySize() (int, int) {
+	if V.Rotation == 90 || V.Rotation == 270 {
+		return V.Height, V.Width
+	}
+	return V.Width, V.Height
+}
+
+// checkRotation detects the rotation of the video with worker.rotationAction transpose. A failed detection only logs
+// a warning and the video is encoded as ffmpeg rotates it by itself.
+func (J *EncodeWorker) checkRotation(sourceFilePath string, video *Video) {
+	if J.workerConfig.RotationAction != RotationActionTranspose {
+		return
+	}
+	if err := J.detectRotation(sourceFilePath, video); err != nil {
+		J.terminal.Warn("error detecting the rotation of %s: %v", sourceFilePath, err)
+		return
+	}
+	if video.Rotation != 0 {
+		log.Debugf("%s is rotated %d degrees", sourceFilePath, video.Rotation)
+	}
+}
+
+// decodeOptions are the ffmpeg input options decoding the video. The rotation of the video is applied by the filters
+// of the encode, ffmpeg must not rotate the frames on its own too.
+func (V *Video) decodeOptions(config Config) []string {
+	options := config.hwDecodeOptions()
+	if V.Rotation != 0 {
+		options = append(options, "-noautorotate")
+	}
+	return options
+}
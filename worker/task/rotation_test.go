@@ -0,0 +1,103 @@
+package task
+
+import (
+	"gearr/model"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// phoneRotationProbe is the detectRotation output of a portrait phone video, stored landscape with a display matrix
+// rotating it 90 degrees counterclockwise.
+const phoneRotationProbe = `{
+    "programs": [],
+    "streams": [
+        {
+            "index": 0,
+            "side_data_list": [
+                {
+                    "rotation": -90
+                }
+            ]
+        }
+    ]
+}`
+
+func TestParseRotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		expected int
+	}{
+		{"display matrix", phoneRotationProbe, 90},
+		{"counterclockwise display matrix", `{"streams":[{"index":0,"side_data_list":[{"rotation":90}]}]}`, 270},
+		{"upside down display matrix", `{"streams":[{"index":0,"side_data_list":[{"rotation":180}]}]}`, 180},
+		{"rotate tag", `{"streams":[{"index":0,"tags":{"rotate":"90"}}]}`, 90},
+		{"display matrix over the rotate tag", `{"streams":[{"index":0,"side_data_list":[{"rotation":-90}],"tags":{"rotate":"180"}}]}`, 90},
+		{"upright", `{"streams":[{"index":0}]}`, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rotation, err := parseRotation(test.output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rotation != test.expected {
+				t.Fatalf("rotation %d, expected %d", rotation, test.expected)
+			}
+		})
+	}
+	if _, err := parseRotation("not json"); err == nil {
+		t.Fatal("an unreadable ffprobe output must fail the detection")
+	}
+}
+
+func TestNormalizeRotation(t *testing.T) {
+	tests := map[float64]int{0: 0, 90: 90, -90: 270, 180: 180, -180: 180, 270: 270, 360: 0, 450: 90, 89.9: 90, -270: 90}
+	for degrees, expected := range tests {
+		if rotation := normalizeRotation(degrees); rotation != expected {
+			t.Errorf("normalizeRotation(%v) is %d, expected %d", degrees, rotation, expected)
+		}
+	}
+}
+
+func TestFFmpegArgumentsTurnARotatedVideoUpright(t *testing.T) {
+	worker := newTestWorker(testConfig())
+	video := videoStreamFixture(0)
+	video.Width, video.Height = 1920, 1080
+	container, err := worker.clearData(probeFixture(video), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container.Video.Rotation, err = parseRotation(phoneRotationProbe); err != nil {
+		t.Fatal(err)
+	}
+	container.Quality = defaultQualityProfile
+	job := &model.WorkTaskEncode{TaskEncode: &model.TaskEncode{Id: uuid.New()}, SourceFilePath: "/source/phone.mp4", WorkDir: t.TempDir()}
+	arguments := worker.ffmpegArguments(job, container, "")
+
+	// ffmpeg must not rotate the decoded frames too, the transpose of the encode does it
+	if !containsArguments(arguments, "-noautorotate", "-i", "/source/phone.mp4") {
+		t.Fatalf("the source must be decoded with -noautorotate: %v", arguments)
+	}
+	expectedFilter := "transpose=clock,scale='min(1920,iw)':-1:force_original_aspect_ratio=decrease"
+	if filter, _ := argumentValue(arguments, "-filter:v:0"); filter != expectedFilter {
+		t.Fatalf("-filter:v:0 %q, expected %q", filter, expectedFilter)
+	}
+	if rotate, _ := argumentValue(arguments, "-metadata:s:v:0"); rotate != "rotate=0" {
+		t.Fatalf("-metadata:s:v:0 %q, the upright output must not be rotated again by players", rotate)
+	}
+	if width, height := container.Video.displaySize(); width != 1080 || height != 1920 {
+		t.Fatalf("display size %dx%d, expected the portrait 1080x1920", width, height)
+	}
+}
+
+func TestDecodeOptionsOfAnUprightVideo(t *testing.T) {
+	video := &Video{}
+	if options := video.decodeOptions(testConfig()); len(options) != 0 {
+		t.Fatalf("decode options %v, an upright video is decoded as it is", options)
+	}
+	if filter := video.rotationFilter(); filter != "" {
+		t.Fatalf("rotation filter %q, an upright video needs none", filter)
+	}
+}
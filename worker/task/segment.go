@@ -0,0 +1,224 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"gearr/helper"
+	"gearr/helper/command"
+	"gearr/model"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avast/retry-go"
+)
+
+const (
+	sourceSegmentPrefix   = "source-segment-"
+	encodedSegmentPrefix  = "encoded-segment-"
+	segmentListFileName   = "segments.txt"
+	segmentEncodeAttempts = 3
+	// minSegmentDuration avoids splitting short videos, where the split and mux passes cost more than they save
+	minSegmentDuration = time.Minute
+)
+
+// useEncodeSegments reports whether the video is encoded in parallel segments.
+func (J *EncodeWorker) useEncodeSegments(video *Video) bool {
+	segments := J.workerConfig.EncodeSegments
+	return segments > 1 && !video.Copy && video.Duration >= time.Duration(segments)*minSegmentDuration
+}
+
+// segmentedFFMPEG splits the source video at keyframes in encodeSegments parts, encodes them at the same time and
+// muxes the encoded segments with the audio and subtitles of the source in a final FFMPEG pass.
+func (J *EncodeWorker) segmentedFFMPEG(ctx context.Context, job *model.WorkTaskEncode, videoContainer *ContainerData, ffmpegProgressChan chan<- FFMPEGProgress) error {
+	defer removeSegmentFiles(job.WorkDir)
+	sourceSegments, err := J.splitVideoSegments(ctx, job, videoContainer.Video, videoContainer.Quality)
+	if err != nil {
+		return fmt.Errorf("error splitting video in segments: %w", err)
+	}
+	encodedSegments, err := J.encodeVideoSegments(ctx, job, videoContainer, sourceSegments, ffmpegProgressChan)
+	if err != nil {
+		return err
+	}
+
+	segmentList := ""
+	for _, encodedSegment := range encodedSegments {
+		segmentList += fmt.Sprintf("file '%s'\n", filepath.Base(encodedSegment))
+	}
+	segmentListPath := filepath.Join(job.WorkDir, segmentListFileName)
+	if err = os.WriteFile(segmentListPath, []byte(segmentList), os.ModePerm); err != nil {
+		return err
+	}
+
+	// the final pass only copies the encoded video, its progress would restart the encode progress so it is dropped
+	muxProgressChan := make(chan FFMPEGProgress)
+	muxDone := make(chan struct{})
+	defer close(muxDone)
+	go func() {
+		for {
+			select {
+			case <-muxDone:
+				return
+			case <-muxProgressChan:
+			}
+		}
+	}()
+	return J.FFMPEG(ctx, job, videoContainer, segmentListPath, muxProgressChan)
+}
+
+// splitVideoSegments copies the video stream of the source in segments of similar length. The segment muxer only
+// cuts at keyframes, so every segment can be encoded on its own without seams.
+func (J *EncodeWorker) splitVideoSegments(ctx context.Context, job *model.WorkTaskEncode, video *Video, quality QualityProfile) ([]string, error) {
+	removeSegmentFiles(job.WorkDir)
+	segments := J.workerConfig.EncodeSegments
+	var segmentTimes []string
+	for i := 1; i < segments; i++ {
+		segmentTimes = append(segmentTimes, formatSeconds(video.Duration*time.Duration(i)/time.Duration(segments)))
+	}
+
+	ffmpegErrLog := ""
+	arguments := append([]string{"-hide_banner", "-nostats"}, J.sourceInputOptions(quality)...)
+	ffmpegCommand := newFFMPEGCommand(job.WorkDir, append(arguments, "-i", job.SourceFilePath,
+		"-map", fmt.Sprintf("0:%d", video.Id), "-c", "copy", "-f", "segment", "-segment_times", strings.Join(segmentTimes, ","),
+		"-reset_timestamps", "1", fmt.Sprintf("%s%%03d.mkv", sourceSegmentPrefix))...).
+		SetStderrFunc(func(buffer []byte, exit bool) {
+			ffmpegErrLog += string(buffer)
+		})
+	J.terminal.Cmd("FFMPEG split command:%s", ffmpegCommand.GetFullCommand())
+	exitCode, err := J.runFFmpeg(ctx, ffmpegCommand, ffmpegPriorityEncode)
+	if err != nil {
+		return nil, fmt.Errorf("%w: stderr:%s", err, ffmpegErrLog)
+	}
+	if exitCode != 0 {
+		return nil, fmt.Errorf("exit code %d: stderr:%s", exitCode, ffmpegErrLog)
+	}
+	return filepath.Glob(filepath.Join(job.WorkDir, fmt.Sprintf("%s*.mkv", sourceSegmentPrefix)))
+}
+
+// encodeVideoSegments encodes all the segments at the same time, sharing the worker threads between them. A failed
+// segment is retried up to segmentEncodeAttempts times, when it keeps failing the other segments are cancelled.
+func (J *EncodeWorker) encodeVideoSegments(ctx context.Context, job *model.WorkTaskEncode, videoContainer *ContainerData, sourceSegments []string, ffmpegProgressChan chan<- FFMPEGProgress) ([]string, error) {
+	video := videoContainer.Video
+	threads := J.workerConfig.Threads
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	segmentThreads := threads / len(sourceSegments)
+	if segmentThreads < 1 {
+		segmentThreads = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	progress := &segmentProgress{
+		durations:    make([]int, len(sourceSegments)),
+		total:        video.Duration,
+		progressChan: ffmpegProgressChan,
+	}
+
+	encodedSegments := make([]string, len(sourceSegments))
+	var segmentErr error
+	var segmentErrMu sync.Mutex
+	wg := sync.WaitGroup{}
+	for i, sourceSegment := range sourceSegments {
+		encodedSegments[i] = filepath.Join(job.WorkDir, fmt.Sprintf("%s%03d.mkv", encodedSegmentPrefix, i))
+		wg.Add(1)
+		go func(i int, sourceSegment string) {
+			defer wg.Done()
+			err := retry.Do(func() error {
+				progress.update(i, 0)
+				return J.encodeVideoSegment(ctx, sourceSegment, encodedSegments[i], videoContainer.Quality, video, segmentThreads, func(duration int) {
+					progress.update(i, duration)
+				})
+			}, retry.Delay(time.Second*5),
+				retry.Attempts(segmentEncodeAttempts),
+				retry.LastErrorOnly(true),
+				retry.OnRetry(func(n uint, err error) {
+					J.terminal.Warn("[%s] error encoding segment %d, retrying: %v", job.TaskEncode.Id.String(), i, err)
+				}),
+				retry.RetryIf(func(err error) bool {
+					return ctx.Err() == nil
+				}))
+			if err != nil {
+				segmentErrMu.Lock()
+				if segmentErr == nil {
+					segmentErr = fmt.Errorf("error encoding segment %d: %w", i, err)
+				}
+				segmentErrMu.Unlock()
+				cancel()
+			}
+		}(i, sourceSegment)
+	}
+	wg.Wait()
+	return encodedSegments, segmentErr
+}
+
+func (J *EncodeWorker) encodeVideoSegment(ctx context.Context, sourceSegment string, encodedSegment string, quality QualityProfile, video *Video, threads int, progressFunc func(duration int)) error {
+	ffmpegErrLog := ""
+	ffmpegArguments := append([]string{"-hide_banner", "-threads", strconv.Itoa(threads)}, video.decodeOptions(J.workerConfig)...)
+	ffmpegArguments = append(ffmpegArguments, "-i", sourceSegment, "-map", "0:v:0")
+	ffmpegArguments = append(ffmpegArguments, videoEncodeParameters(quality, video, threads)...)
+	ffmpegCommand := newFFMPEGCommand(filepath.Dir(sourceSegment), append(ffmpegArguments, "-y", encodedSegment)...)
+	J.terminal.Cmd("FFMPEG segment command:%s", ffmpegCommand.GetFullCommand())
+	ffmpegCommand.SetStderrFunc(func(buffer []byte, exit bool) {
+		stringedBuffer := string(buffer)
+		ffmpegErrLog += stringedBuffer
+		if duration := getDuration(stringedBuffer); duration != -1 {
+			progressFunc(duration)
+		}
+	})
+	exitCode, err := J.runFFmpeg(ctx, ffmpegCommand, ffmpegPriorityEncode)
+	if err != nil {
+		return fmt.Errorf("%w: stderr:%s", err, ffmpegErrLog)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("exit code %d: stderr:%s", exitCode, ffmpegErrLog)
+	}
+	return nil
+}
+
+func newFFMPEGCommand(workDir string, params ...string) *command.Command {
+	ffmpegCommand := command.NewCommand(helper.GetFFmpegPath(), params...).
+		SetWorkDir(workDir).
+		SetStdoutFunc(func(buffer []byte, exit bool) {})
+	if libraryPathEnv := helper.LibraryPathEnv(helper.GetFFmpegPath()); libraryPathEnv != "" {
+		ffmpegCommand.AddEnv(libraryPathEnv)
+	}
+	return ffmpegCommand
+}
+
+func removeSegmentFiles(workDir string) {
+	for _, pattern := range []string{sourceSegmentPrefix + "*", encodedSegmentPrefix + "*", segmentListFileName} {
+		files, _ := filepath.Glob(filepath.Join(workDir, pattern))
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}
+}
+
+// segmentProgress adds up the encoded duration of every segment into a single progress of the whole video.
+type segmentProgress struct {
+	mu           sync.Mutex
+	durations    []int
+	total        time.Duration
+	progressChan chan<- FFMPEGProgress
+}
+
+func (S *segmentProgress) update(segment int, duration int) {
+	S.mu.Lock()
+	defer S.mu.Unlock()
+	S.durations[segment] = duration
+	encodedDuration := 0
+	for _, d := range S.durations {
+		encodedDuration += d
+	}
+	S.progressChan <- FFMPEGProgress{
+		duration: encodedDuration,
+		speed:    -1,
+		percent:  float64(encodedDuration*100) / S.total.Seconds(),
+	}
+}
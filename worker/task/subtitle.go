@@ -0,0 +1,202 @@
+package task
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+// subtitleContainerCodecs are the subtitle codecs each output container can hold as they are.
+var subtitleContainerCodecs = map[string][]string{
+	"mkv":  {"subrip", "srt", "ass", "ssa", "webvtt", "text", "dvd_subtitle", "hdmv_pgs_subtitle", "dvb_subtitle"},
+	"mp4":  {"mov_text", "dvd_subtitle"},
+	"webm": {"webvtt"},
+}
+
+// subtitleConvertCodecs is the text subtitle codec each output container converts incompatible text subtitles to.
+var subtitleConvertCodecs = map[string]string{
+	"mkv":  "srt",
+	"mp4":  "mov_text",
+	"webm": "webvtt",
+}
+
+// textSubtitleCodecs are the subtitle codecs ffmpeg can convert to another text subtitle codec.
+var textSubtitleCodecs = []string{"subrip", "srt", "ass", "ssa", "webvtt", "mov_text", "text", "microdvd", "subviewer", "sami", "realtext", "mpl2", "vplayer"}
+
+func containsCodec(codecs []string, codec string) bool {
+	for _, c := range codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSubtitleCompatibility checks the subtitles copied to the output container up front, so one odd subtitle
+// doesn't fail the whole encode at ffmpeg runtime. Incompatible text subtitles are converted when the action is
+// convert, the rest are dropped. It returns a message per subtitle changed.
+func (C *ContainerData) resolveSubtitleCompatibility(container string, action string) []string {
+	var messages []string
+	var subtitles []*Subtitle
+	for _, subtitle := range C.Subtitle {
+		// image subtitles and closed captions are converted to srt before the encode
+		codec := strings.ToLower(subtitle.Format)
+		if subtitle.isImageTypeSubtitle() || subtitle.ClosedCaptions || containsCodec(subtitleContainerCodecs[container], codec) {
+			subtitles = append(subtitles, subtitle)
+			continue
+		}
+		if codec == "" {
+			codec = "unknown"
+		}
+		convertCodec, convertible := subtitleConvertCodecs[container]
+		if action == IncompatibleSubtitleActionConvert && convertible && containsCodec(textSubtitleCodecs, codec) {
+			subtitle.Convert = convertCodec
+			subtitles = append(subtitles, subtitle)
+			messages = append(messages, fmt.Sprintf("converting subtitle %d from %s to %s, %s can not hold %s subtitles", subtitle.Id, codec, convertCodec, container, codec))
+			continue
+		}
+		messages = append(messages, fmt.Sprintf("dropping subtitle %d, %s can not hold %s subtitles", subtitle.Id, container, codec))
+	}
+	C.Subtitle = subtitles
+	return messages
+}
+
+// preferredAudio is the default audio stream, or the first one when none is default.
+func (C *ContainerData) preferredAudio() *Audio {
+	var preferred *Audio
+	for _, audio := range C.Audios {
+		if preferred == nil || (audio.Default && !preferred.Default) || (audio.Default == preferred.Default && audio.Id < preferred.Id) {
+			preferred = audio
+		}
+	}
+	return preferred
+}
+
+// preferredAudioLanguage is the language of the preferred audio stream.
+func (C *ContainerData) preferredAudioLanguage() string {
+	preferred := C.preferredAudio()
+	if preferred == nil {
+		return ""
+	}
+	return preferred.Language
+}
+
+// setDefaultSubtitle leaves a single default subtitle, sources marking several of them make players pick the wrong
+// one. With forcedDefault it is the first forced subtitle in the preferred audio language, so players show the
+// foreign dialogue parts without enabling it by hand. Otherwise, or when there is none, it is the first forced
+// subtitle and then the first one that was default in the source.
+func (C *ContainerData) setDefaultSubtitle(forcedDefault bool) {
+	var chosen *Subtitle
+	if language := C.preferredAudioLanguage(); forcedDefault && language != "" {
+		for _, subtitle := range C.Subtitle {
+			if subtitle.Forced && strings.EqualFold(subtitle.Language, language) {
+				chosen = subtitle
+				break
+			}
+		}
+	}
+	for _, subtitle := range C.Subtitle {
+		if chosen == nil && subtitle.Forced {
+			chosen = subtitle
+		}
+	}
+	for _, subtitle := range C.Subtitle {
+		if chosen == nil && subtitle.Default {
+			chosen = subtitle
+		}
+	}
+	for _, subtitle := range C.Subtitle {
+		subtitle.Default = subtitle == chosen
+	}
+}
+
+// isSDHTitle reports whether the subtitle title has SDH or CC as a whole word, so titles like "Accented" don't match.
+func isSDHTitle(title string) bool {
+	words := strings.FieldsFunc(strings.ToUpper(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if word == "SDH" || word == "CC" {
+			return true
+		}
+	}
+	return false
+}
+
+// disposition is the value of the ffmpeg -disposition option of the subtitle, 0 clears every flag.
+func (S *Subtitle) disposition() string {
+	var flags []string
+	if S.Default {
+		flags = append(flags, "default")
+	}
+	if S.Forced {
+		flags = append(flags, "forced")
+	}
+	if S.Comment {
+		flags = append(flags, "comment")
+	}
+	if S.SDH {
+		flags = append(flags, "hearing_impaired")
+	}
+	if len(flags) == 0 {
+		return "0"
+	}
+	return strings.Join(flags, "+")
+}
+
+// subtitleSize is the size of the subtitle stream from the matroska statistics tags, 0 when unknown.
+func subtitleSize(stream *ffprobe.Stream) int64 {
+	numberOfBytes, err := stream.TagList.GetString("NUMBER_OF_BYTES")
+	if err != nil {
+		return 0
+	}
+	size, _ := strconv.ParseInt(numberOfBytes, 10, 64)
+	return size
+}
+
+// selectSubtitles applies the subtitle selection policy to the subtitles that are not forced or comments, in stream
+// order so the choice is deterministic.
+func (c Config) selectSubtitles(subtitles []*Subtitle) []*Subtitle {
+	var candidates []*Subtitle
+	for _, subtitle := range subtitles {
+		if subtitle.SDH && c.SubtitleSDH == SubtitleSDHDrop {
+			continue
+		}
+		candidates = append(candidates, subtitle)
+	}
+	if c.SubtitleSelection == SubtitleSelectionAll {
+		return candidates
+	}
+
+	var languages []string
+	bestSubtitlePerLanguage := make(map[string]*Subtitle)
+	for _, subtitle := range candidates {
+		bestSubtitle, found := bestSubtitlePerLanguage[subtitle.Language]
+		if !found {
+			languages = append(languages, subtitle.Language)
+			bestSubtitlePerLanguage[subtitle.Language] = subtitle
+		} else if c.betterSubtitle(subtitle, bestSubtitle) {
+			bestSubtitlePerLanguage[subtitle.Language] = subtitle
+		}
+	}
+	var selected []*Subtitle
+	for _, language := range languages {
+		selected = append(selected, bestSubtitlePerLanguage[language])
+	}
+	return selected
+}
+
+// betterSubtitle reports whether candidate replaces current as the subtitle of their language. On a tie the first
+// stream stays.
+func (c Config) betterSubtitle(candidate *Subtitle, current *Subtitle) bool {
+	if c.SubtitleSDH == SubtitleSDHAvoid && candidate.SDH != current.SDH {
+		return !candidate.SDH
+	}
+	if c.SubtitleSelection == SubtitleSelectionSmallest && candidate.Size > 0 && current.Size > 0 {
+		return candidate.Size < current.Size
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package task
+
+import (
+	"testing"
+
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+func subtitleIds(subtitles []*Subtitle) []uint8 {
+	var ids []uint8
+	for _, subtitle := range subtitles {
+		ids = append(ids, subtitle.Id)
+	}
+	return ids
+}
+
+func equalIds(ids []uint8, expected ...uint8) bool {
+	if len(ids) != len(expected) {
+		return false
+	}
+	for i := range ids {
+		if ids[i] != expected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestClearDataPicksOneOfTwoSameLanguageSRTSubtitles(t *testing.T) {
+	// the first english srt is bigger, the smallest policy picks the second one
+	first := subtitleStreamFixture(2, "eng", "subrip", "English")
+	first.TagList = ffprobe.Tags{"NUMBER_OF_BYTES": "52000"}
+	second := subtitleStreamFixture(3, "eng", "subrip", "English")
+	second.TagList = ffprobe.Tags{"NUMBER_OF_BYTES": "31000"}
+	spanish := subtitleStreamFixture(4, "spa", "subrip", "Spanish")
+
+	tests := []struct {
+		selection string
+		expected  []uint8
+	}{
+		{SubtitleSelectionAll, []uint8{2, 3, 4}},
+		{SubtitleSelectionFirst, []uint8{2, 4}},
+		{SubtitleSelectionSmallest, []uint8{3, 4}},
+	}
+	for _, test := range tests {
+		t.Run(test.selection, func(t *testing.T) {
+			config := testConfig()
+			config.SubtitleSelection = test.selection
+			data := probeFixture(videoStreamFixture(0), audioStreamFixture(1, "eng", 6), first, second, spanish)
+			container, err := newTestWorker(config).clearData(data, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := subtitleIds(container.Subtitle); !equalIds(ids, test.expected...) {
+				t.Fatalf("subtitles %v, expected %v", ids, test.expected)
+			}
+		})
+	}
+}
+
+func TestSelectSubtitlesKeepsTheFirstOnATie(t *testing.T) {
+	config := testConfig()
+	config.SubtitleSelection = SubtitleSelectionSmallest
+	// without the matroska statistics tags the sizes are unknown, the first stream stays
+	subtitles := []*Subtitle{
+		{Id: 2, Language: "eng", Format: "subrip"},
+		{Id: 3, Language: "eng", Format: "subrip", Size: 31000},
+	}
+	if ids := subtitleIds(config.selectSubtitles(subtitles)); !equalIds(ids, 2) {
+		t.Fatalf("subtitles %v, expected the first english one", ids)
+	}
+}
+
+func TestFFmpegArgumentsMakeTheForcedSubtitleOfTheAudioLanguageTheDefault(t *testing.T) {
+	config := testConfig()
+	config.ForcedSubtitleDefault = true
+	spanishForced := subtitleStreamFixture(2, "spa", "subrip", "Forced")
+	spanishForced.Disposition.Forced = 1
+	englishForced := subtitleStreamFixture(3, "eng", "subrip", "Forced")
+	englishForced.Disposition.Forced = 1
+	englishFull := subtitleStreamFixture(4, "eng", "subrip", "Full")
+	englishFull.Disposition.Default = 1
+	data := probeFixture(videoStreamFixture(0), audioStreamFixture(1, "eng", 6), spanishForced, englishForced, englishFull)
+	arguments := encodeArguments(t, newTestWorker(config), data, QualityProfile{})
+
+	// forced subtitles come first, in stream order
+	expected := map[string]string{
+		"-disposition:s:0": "forced",
+		"-disposition:s:1": "default+forced",
+		"-disposition:s:2": "0",
+	}
+	for flag, disposition := range expected {
+		if value, _ := argumentValue(arguments, flag); value != disposition {
+			t.Errorf("%s %q, expected %q: %v", flag, value, disposition, arguments)
+		}
+	}
+}
+
+func TestIsSDHTitle(t *testing.T) {
+	tests := map[string]bool{
+		"English SDH":       true,
+		"English (CC)":      true,
+		"sdh":               true,
+		"English [SDH/CC]":  true,
+		"Accented":          false,
+		"SDHx":              false,
+		"English":           false,
+		"":                  false,
+		"Commentary by CCR": false,
+	}
+	for title, expected := range tests {
+		if isSDHTitle(title) != expected {
+			t.Errorf("isSDHTitle(%q) is %v, expected %v", title, !expected, expected)
+		}
+	}
+}
+
+func TestClearDataFiltersSDHSubtitles(t *testing.T) {
+	sdhTitle := subtitleStreamFixture(2, "eng", "subrip", "English SDH")
+	plain := subtitleStreamFixture(3, "eng", "subrip", "English")
+	hearingImpaired := subtitleStreamFixture(4, "eng", "subrip", "English")
+	hearingImpaired.Disposition.HearingImpaired = 1
+
+	tests := []struct {
+		name      string
+		sdh       string
+		selection string
+		expected  []uint8
+	}{
+		{"keep", SubtitleSDHKeep, SubtitleSelectionFirst, []uint8{2}},
+		{"avoid", SubtitleSDHAvoid, SubtitleSelectionFirst, []uint8{3}},
+		{"drop", SubtitleSDHDrop, SubtitleSelectionAll, []uint8{3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.SubtitleSDH = test.sdh
+			config.SubtitleSelection = test.selection
+			data := probeFixture(videoStreamFixture(0), audioStreamFixture(1, "eng", 6), sdhTitle, plain, hearingImpaired)
+			container, err := newTestWorker(config).clearData(data, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := subtitleIds(container.Subtitle); !equalIds(ids, test.expected...) {
+				t.Fatalf("subtitles %v, expected %v", ids, test.expected)
+			}
+		})
+	}
+}
+
+func TestClearDataKeepsTheOnlySDHSubtitleOfALanguageWhenAvoided(t *testing.T) {
+	config := testConfig()
+	config.SubtitleSDH = SubtitleSDHAvoid
+	config.SubtitleSelection = SubtitleSelectionFirst
+	data := probeFixture(videoStreamFixture(0), audioStreamFixture(1, "eng", 6), subtitleStreamFixture(2, "eng", "subrip", "English CC"))
+	container, err := newTestWorker(config).clearData(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(container.Subtitle) != 1 || !container.Subtitle[0].SDH {
+		t.Fatalf("subtitles %v, expected the SDH subtitle", subtitleIds(container.Subtitle))
+	}
+	if disposition := container.Subtitle[0].disposition(); disposition != "hearing_impaired" {
+		t.Fatalf("disposition %q, expected the SDH subtitle to be flagged hearing_impaired", disposition)
+	}
+}
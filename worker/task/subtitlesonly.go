@@ -0,0 +1,85 @@
+package task
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"gearr/model"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// subtitlesArchiveExtension is the extension of the file uploaded by the subtitlesOnly jobs.
+const subtitlesArchiveExtension = ".subtitles.zip"
+
+// packSubtitles zips the SRT files the PGS workers produced for a subtitlesOnly job, the archive is the single file
+// uploaded in place of an encode. The video is never encoded.
+func (J *EncodeWorker) packSubtitles(job *model.WorkTaskEncode, container *ContainerData) error {
+	var subtitles []*Subtitle
+	for _, subtitle := range container.Subtitle {
+		if container.convertsToSrt(subtitle) {
+			subtitles = append(subtitles, subtitle)
+		}
+	}
+	if len(subtitles) == 0 {
+		return errors.New("no image subtitle converted to srt")
+	}
+
+	name := outputFileName(J.workerConfig.OutputFileTemplate, job, container)
+	job.TargetFilePath = filepath.Join(job.WorkDir, name+subtitlesArchiveExtension)
+	archiveFile, err := os.Create(job.TargetFilePath)
+	if err != nil {
+		return err
+	}
+	defer archiveFile.Close()
+	archive := zip.NewWriter(archiveFile)
+	entries := make(map[string]bool)
+	for _, subtitle := range subtitles {
+		entry := subtitleEntryName(name, subtitle)
+		if entries[entry] {
+			// a second subtitle with the same language and flags
+			entry = subtitleEntryName(fmt.Sprintf("%s.%d", name, subtitle.Id), subtitle)
+		}
+		entries[entry] = true
+		if err = addArchiveFile(archive, entry, filepath.Join(job.WorkDir, subtitle.srtFileName())); err != nil {
+			return err
+		}
+	}
+	if err = archive.Close(); err != nil {
+		return err
+	}
+	J.terminal.Log("[%s] %d subtitles packed in %s", job.TaskEncode.Id.String(), len(subtitles), filepath.Base(job.TargetFilePath))
+	return archiveFile.Sync()
+}
+
+// subtitleEntryName names the SRT like media servers expect external subtitles next to the video:
+// <name>.<language>[.forced][.sdh].srt.
+func subtitleEntryName(name string, subtitle *Subtitle) string {
+	language := subtitle.Language
+	if language == "" {
+		language = "und"
+	}
+	entry := fmt.Sprintf("%s.%s", name, language)
+	if subtitle.Forced {
+		entry += ".forced"
+	}
+	if subtitle.SDH {
+		entry += ".sdh"
+	}
+	return entry + ".srt"
+}
+
+func addArchiveFile(archive *zip.Writer, entry string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer, err := archive.Create(entry)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, file)
+	return err
+}
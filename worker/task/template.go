@@ -0,0 +1,72 @@
+package task
+
+import (
+	"fmt"
+	"gearr/model"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	videoCRF       = 28
+	maxOutputWidth = 1920
+)
+
+var outputFileTemplateTokenRegex = regexp.MustCompile(`\{([^{}]*)\}`)
+
+var outputFileTemplateTokens = map[string]func(job *model.WorkTaskEncode, container *ContainerData) string{
+	"basename": func(job *model.WorkTaskEncode, container *ContainerData) string {
+		sourceFileName := filepath.Base(job.SourceFilePath)
+		return strings.TrimSuffix(sourceFileName, filepath.Ext(sourceFileName))
+	},
+	"codec": func(job *model.WorkTaskEncode, container *ContainerData) string {
+		if container.Quality.audioOnly() {
+			return container.Video.Codec
+		}
+		return container.Quality.codecName()
+	},
+	"crf": func(job *model.WorkTaskEncode, container *ContainerData) string {
+		return strconv.Itoa(container.Video.CRF)
+	},
+	"resolution": func(job *model.WorkTaskEncode, container *ContainerData) string {
+		return container.Video.outputResolution(container.Quality.MaxWidth)
+	},
+	"id": func(job *model.WorkTaskEncode, container *ContainerData) string {
+		return job.TaskEncode.Id.String()
+	},
+}
+
+// ValidateOutputFileTemplate checks every token of the template is known, so a typo fails when the worker starts
+// instead of in the middle of a job.
+func ValidateOutputFileTemplate(template string) error {
+	if template == "" {
+		return fmt.Errorf("output file template can not be empty")
+	}
+	if strings.ContainsAny(template, `/\`) {
+		return fmt.Errorf("output file template %s can not contain path separators", template)
+	}
+	for _, token := range outputFileTemplateTokenRegex.FindAllStringSubmatch(template, -1) {
+		if _, found := outputFileTemplateTokens[token[1]]; !found {
+			return fmt.Errorf("unknown token {%s} in output file template %s", token[1], template)
+		}
+	}
+	return nil
+}
+
+// outputFileName renders the output file template of the job, without extension.
+func outputFileName(template string, job *model.WorkTaskEncode, container *ContainerData) string {
+	return outputFileTemplateTokenRegex.ReplaceAllStringFunc(template, func(token string) string {
+		return outputFileTemplateTokens[token[1:len(token)-1]](job, container)
+	})
+}
+
+// outputResolution is the height of the encoded video, after being turned upright and scaled down to maxWidth.
+func (V *Video) outputResolution(maxWidth int) string {
+	width, height := V.displaySize()
+	if width > maxWidth {
+		height = height * maxWidth / width
+	}
+	return fmt.Sprintf("%dp", height)
+}
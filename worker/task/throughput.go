@@ -0,0 +1,87 @@
+package task
+
+import (
+	"gearr/model"
+	"sync"
+	"time"
+)
+
+// throughputWindow is the number of last encodes the worker throughput is computed from.
+const throughputWindow = 10
+
+// encodeSpeed measures a single FFMPEG run, the peak is sampled from the progress goroutine.
+type encodeSpeed struct {
+	mu    sync.Mutex
+	start time.Time
+	peak  float64
+}
+
+func newEncodeSpeed() *encodeSpeed {
+	return &encodeSpeed{start: time.Now()}
+}
+
+func (s *encodeSpeed) sample(speed float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if speed > s.peak {
+		s.peak = speed
+	}
+}
+
+// fillReport sets the speed fields of the report, the averages are computed from the wall time of the whole run so
+// they include the segments merge and any stall ffmpeg does not account for in its own speed.
+func (s *encodeSpeed) fillReport(report *model.EncodeReport, video *Video) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := time.Since(s.start).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	report.EncodeSeconds = elapsed
+	report.AverageSpeed = video.Duration.Seconds() / elapsed
+	report.AverageFPS = video.Duration.Seconds() * float64(video.FrameRate) / elapsed
+	report.PeakSpeed = s.peak
+}
+
+// throughputHistory keeps the speed of the last throughputWindow encodes of the worker.
+type throughputHistory struct {
+	mu      sync.Mutex
+	reports []model.EncodeReport
+}
+
+func (h *throughputHistory) add(report *model.EncodeReport) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reports = append(h.reports, *report)
+	if len(h.reports) > throughputWindow {
+		h.reports = h.reports[len(h.reports)-throughputWindow:]
+	}
+}
+
+// throughput weights every encode by its duration, so a short job does not count as much as a movie. It returns nil
+// until the worker encodes something.
+func (h *throughputHistory) throughput() *model.WorkerThroughput {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.reports) == 0 {
+		return nil
+	}
+	throughput := &model.WorkerThroughput{Jobs: len(h.reports)}
+	var encodeSeconds, mediaSeconds, frames float64
+	for _, report := range h.reports {
+		encodeSeconds += report.EncodeSeconds
+		mediaSeconds += report.AverageSpeed * report.EncodeSeconds
+		frames += report.AverageFPS * report.EncodeSeconds
+		if report.PeakSpeed > throughput.PeakSpeed {
+			throughput.PeakSpeed = report.PeakSpeed
+		}
+	}
+	throughput.AverageSpeed = mediaSeconds / encodeSeconds
+	throughput.AverageFPS = frames / encodeSeconds
+	return throughput
+}
+
+// Throughput is the encode speed of the worker over its last encodes, nil when it did not encode anything yet.
+func (J *EncodeWorker) Throughput() *model.WorkerThroughput {
+	return J.throughput.throughput()
+}
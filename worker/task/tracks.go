@@ -0,0 +1,106 @@
+package task
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// languageRank is the position of the language in worker.preferredLanguages, languages not listed rank after them.
+func (c Config) languageRank(language string) int {
+	for i, preferred := range c.PreferredLanguages {
+		if strings.EqualFold(preferred, language) {
+			return i
+		}
+	}
+	return len(c.PreferredLanguages)
+}
+
+// disposition is the value of the ffmpeg -disposition option of the audio stream, only the stream chosen as default
+// keeps the default flag. 0 clears every flag.
+func (A *Audio) disposition(isDefault bool) string {
+	var flags []string
+	if isDefault {
+		flags = append(flags, "default")
+	}
+	if A.Original {
+		flags = append(flags, "original")
+	}
+	if A.Dub {
+		flags = append(flags, "dub")
+	}
+	if A.Comment {
+		flags = append(flags, "comment")
+	}
+	if A.HearingImpaired {
+		flags = append(flags, "hearing_impaired")
+	}
+	if A.VisualImpaired {
+		flags = append(flags, "visual_impaired")
+	}
+	if len(flags) == 0 {
+		return "0"
+	}
+	return strings.Join(flags, "+")
+}
+
+// checkRequiredLanguages fails the job when the selected audio or subtitles miss a language of
+// worker.requiredAudioLanguages or worker.requiredSubtitleLanguages, instead of producing a file without it.
+func (c Config) checkRequiredLanguages(container *ContainerData) error {
+	var missing []string
+	for _, language := range c.RequiredAudioLanguages {
+		found := false
+		for _, audio := range container.Audios {
+			found = found || strings.EqualFold(audio.Language, language)
+		}
+		if !found {
+			missing = append(missing, fmt.Sprintf("%s audio", language))
+		}
+	}
+	for _, language := range c.RequiredSubtitleLanguages {
+		found := false
+		for _, subtitle := range container.Subtitle {
+			found = found || strings.EqualFold(subtitle.Language, language)
+		}
+		if !found {
+			missing = append(missing, fmt.Sprintf("%s subtitle", language))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: no %s", ErrorRequiredLanguageMissing, strings.Join(missing, ", no "))
+	}
+	return nil
+}
+
+// limitAudios keeps the worker.maxAudioTracks best audio streams, by preferred language and then by channels and
+// bitrate. 0 keeps them all.
+func (c Config) limitAudios(audios []*Audio) []*Audio {
+	if c.MaxAudioTracks <= 0 || len(audios) <= c.MaxAudioTracks {
+		return audios
+	}
+	sort.SliceStable(audios, func(i, j int) bool {
+		if rankI, rankJ := c.languageRank(audios[i].Language), c.languageRank(audios[j].Language); rankI != rankJ {
+			return rankI < rankJ
+		}
+		if audios[i].ChannelsNumber != audios[j].ChannelsNumber {
+			return audios[i].ChannelsNumber > audios[j].ChannelsNumber
+		}
+		if audios[i].Bitrate != audios[j].Bitrate {
+			return audios[i].Bitrate > audios[j].Bitrate
+		}
+		return audios[i].Id < audios[j].Id
+	})
+	return audios[:c.MaxAudioTracks]
+}
+
+// limitSubtitles keeps the worker.maxSubtitleTracks first subtitles by preferred language, keeping the stream order
+// within a language. 0 keeps them all.
+func (c Config) limitSubtitles(subtitles []*Subtitle) []*Subtitle {
+	if c.MaxSubtitleTracks <= 0 || len(subtitles) <= c.MaxSubtitleTracks {
+		return subtitles
+	}
+	sort.SliceStable(subtitles, func(i, j int) bool {
+		return c.languageRank(subtitles[i].Language) < c.languageRank(subtitles[j].Language)
+	})
+	return subtitles[:c.MaxSubtitleTracks]
+}
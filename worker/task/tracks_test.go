@@ -0,0 +1,122 @@
+package task
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+// argumentValues are the arguments following every occurrence of the flag, in order.
+func argumentValues(arguments []string, flag string) []string {
+	var values []string
+	for i := 0; i < len(arguments)-1; i++ {
+		if arguments[i] == flag {
+			values = append(values, arguments[i+1])
+		}
+	}
+	return values
+}
+
+func tracksFixture() *ffprobe.ProbeData {
+	spanish := audioStreamFixture(1, "spa", 6)
+	english := audioStreamFixture(2, "eng", 6)
+	english.Disposition.Default = 1
+	return probeFixture(videoStreamFixture(0), spanish, english, subtitleStreamFixture(3, "eng", "subrip", "English"))
+}
+
+func TestFFmpegArgumentsMapTheSelectedStreams(t *testing.T) {
+	tests := []struct {
+		name              string
+		mobileCompatAudio bool
+		// the audio streams of the same language are unordered
+		expected []string
+	}{
+		{"encoded audio", false, []string{"0:0", "0:1 0:2", "0:3"}},
+		{"mobile audio first", true, []string{"0:0", "0:2", "0:1 0:2", "0:3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.MobileCompatAudio = test.mobileCompatAudio
+			maps := argumentValues(encodeArguments(t, newTestWorker(config), tracksFixture(), QualityProfile{}), "-map")
+
+			var groups []string
+			for _, group := range test.expected {
+				streams := strings.Fields(group)
+				if len(maps) < len(streams) {
+					t.Fatalf("maps %v, expected %v", maps, test.expected)
+				}
+				mapped := append([]string{}, maps[:len(streams)]...)
+				sort.Strings(mapped)
+				groups = append(groups, strings.Join(mapped, " "))
+				maps = maps[len(streams):]
+			}
+			if len(maps) > 0 || strings.Join(groups, ",") != strings.Join(test.expected, ",") {
+				t.Fatalf("maps %v, expected %v", append(groups, maps...), test.expected)
+			}
+		})
+	}
+}
+
+func TestFFmpegArgumentsEncodeTheMobileAudioFromThePreferredStream(t *testing.T) {
+	config := testConfig()
+	config.MobileCompatAudio = true
+	arguments := encodeArguments(t, newTestWorker(config), tracksFixture(), QualityProfile{})
+	if !containsArguments(arguments, "-map", "0:2", "-metadata:s:a:0", "title=eng (stereo AAC)", "-c:a:0", "aac", "-b:a:0", mobileAudioBitrate, "-ac:a:0", "2") {
+		t.Fatalf("the first audio stream must be the stereo AAC of the default english one: %v", arguments)
+	}
+}
+
+// defaultStreams are the input streams mapped to an output stream of the kind, a or s, with the default disposition.
+func defaultStreams(arguments []string, kind string) []string {
+	var defaults []string
+	mapped := ""
+	for i := 0; i < len(arguments)-1; i++ {
+		if arguments[i] == "-map" {
+			mapped = arguments[i+1]
+		}
+		if strings.HasPrefix(arguments[i], "-disposition:"+kind+":") && strings.Contains(arguments[i+1], "default") {
+			defaults = append(defaults, mapped)
+		}
+	}
+	return defaults
+}
+
+func TestFFmpegArgumentsLeaveASingleDefaultAudioAndSubtitle(t *testing.T) {
+	spanish := audioStreamFixture(1, "spa", 6)
+	spanish.Disposition.Default = 1
+	english := audioStreamFixture(2, "eng", 6)
+	english.Disposition.Default = 1
+	englishSubtitle := subtitleStreamFixture(3, "eng", "subrip", "English")
+	englishSubtitle.Disposition.Default = 1
+	spanishSubtitle := subtitleStreamFixture(4, "spa", "subrip", "Spanish")
+	spanishSubtitle.Disposition.Default = 1
+	data := probeFixture(videoStreamFixture(0), spanish, english, englishSubtitle, spanishSubtitle, subtitleStreamFixture(5, "fre", "subrip", "French"))
+	arguments := encodeArguments(t, newTestWorker(testConfig()), data, QualityProfile{})
+
+	// a stream copied with its source disposition would be a second default one
+	for _, flag := range []string{"-disposition:a:0", "-disposition:a:1"} {
+		if _, found := argumentValue(arguments, flag); !found {
+			t.Fatalf("%s missing, every audio stream must get its disposition: %v", flag, arguments)
+		}
+	}
+	if defaults := defaultStreams(arguments, "a"); len(defaults) != 1 || defaults[0] != "0:1" {
+		t.Fatalf("default audio streams %v, expected only the first default one of the source", defaults)
+	}
+
+	expected := map[string]string{
+		"-disposition:s:0": "default",
+		"-disposition:s:1": "0",
+		"-disposition:s:2": "0",
+	}
+	for flag, disposition := range expected {
+		if value, _ := argumentValue(arguments, flag); value != disposition {
+			t.Errorf("%s %q, expected %q: %v", flag, value, disposition, arguments)
+		}
+	}
+	if defaults := defaultStreams(arguments, "s"); len(defaults) != 1 || defaults[0] != "0:3" {
+		t.Fatalf("default subtitles %v, expected only the first default one of the source", defaults)
+	}
+}
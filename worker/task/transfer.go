@@ -0,0 +1,212 @@
+package task
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"gearr/helper"
+	"gearr/helper/command"
+	"gearr/model"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sftpScheme = "sftp"
+	smbScheme  = "smb"
+	fileScheme = "file"
+)
+
+// genericSourceExtension is used when the download tells nothing about the source format, ffprobe and ffmpeg
+// detect it from the content anyway.
+const genericSourceExtension = ".video"
+
+// videoContentTypeExtensions are the extensions of the video content types, mime only knows a few of them.
+var videoContentTypeExtensions = map[string]string{
+	"video/x-matroska": ".mkv",
+	"video/mp4":        ".mp4",
+	"video/webm":       ".webm",
+	"video/x-msvideo":  ".avi",
+	"video/quicktime":  ".mov",
+	"video/mpeg":       ".mpg",
+	"video/x-flv":      ".flv",
+	"video/x-ms-wmv":   ".wmv",
+	"video/mp2t":       ".ts",
+}
+
+var curlContentLengthRegex = regexp.MustCompile(`(?i)content-length:\s*(\d+)`)
+
+// isRemoteURL reports whether the URL is a sftp:// or smb:// share or a file:// path, transferred with curl instead
+// of the HTTP API.
+func isRemoteURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == sftpScheme || u.Scheme == smbScheme || u.Scheme == fileScheme)
+}
+
+// curlCommand builds a curl command with the credentials of the configured netrc file, which holds them per host,
+// and the ssh key used by sftp.
+func (J *EncodeWorker) curlCommand(workDir string, params ...string) *command.Command {
+	arguments := []string{"--silent", "--show-error", "--fail"}
+	if J.workerConfig.NetrcFile != "" {
+		arguments = append(arguments, "--netrc-file", J.workerConfig.NetrcFile)
+	}
+	if J.workerConfig.SSHKeyFile != "" {
+		arguments = append(arguments, "--key", J.workerConfig.SSHKeyFile)
+	}
+	return command.NewCommand(helper.GetCurlPath(), append(arguments, params...)...).
+		SetWorkDir(workDir).
+		SetStdoutFunc(func(buffer []byte, exit bool) {})
+}
+
+// remoteFileSize asks the share for the file size.
+func (J *EncodeWorker) remoteFileSize(workDir string, remoteURL string) (int64, error) {
+	headOutput := ""
+	curlErrLog := ""
+	curlCommand := J.curlCommand(workDir, "--head", remoteURL).
+		SetStdoutFunc(func(buffer []byte, exit bool) {
+			headOutput += string(buffer)
+		}).
+		SetStderrFunc(func(buffer []byte, exit bool) {
+			curlErrLog += string(buffer)
+		})
+	exitCode, err := curlCommand.RunWithContext(J.ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%w: stderr:%s", err, curlErrLog)
+	}
+	if exitCode != 0 {
+		return 0, fmt.Errorf("exit code %d: stderr:%s", exitCode, curlErrLog)
+	}
+	match := curlContentLengthRegex.FindStringSubmatch(headOutput)
+	if match == nil {
+		return 0, fmt.Errorf("no size in the answer of %s", remoteURL)
+	}
+	return strconv.ParseInt(match[1], 10, 64)
+}
+
+// downloadRemoteFile downloads the source from a sftp:// or smb:// share and verifies its checksum like the HTTP
+// download does. The progress is the size of the file written so far.
+func (J *EncodeWorker) downloadRemoteFile(job *model.WorkTaskEncode, track *TaskTracks) error {
+	track.UpdateValue(0)
+	downloadURL, err := url.Parse(job.TaskEncode.DownloadURL)
+	if err != nil {
+		return err
+	}
+	// an unknown size only leaves the progress without total, the download is still verified
+	size, _ := J.remoteFileSize(job.WorkDir, job.TaskEncode.DownloadURL)
+	if size > 0 {
+		if err := J.checkSourceSize(size); err != nil {
+			return err
+		}
+	}
+	track.SetTotal(size)
+
+	job.SourceFilePath = filepath.Join(job.WorkDir, fmt.Sprintf("%s%s", job.TaskEncode.Id.String(), path.Ext(downloadURL.Path)))
+	curlArguments := []string{"--output", job.SourceFilePath}
+	if J.workerConfig.PreserveModTime {
+		// the download gets the modification time of the file on the share
+		curlArguments = append(curlArguments, "--remote-time")
+	}
+	curlErrLog := ""
+	curlCommand := J.curlCommand(job.WorkDir, append(curlArguments, job.TaskEncode.DownloadURL)...).
+		SetStderrFunc(func(buffer []byte, exit bool) {
+			curlErrLog += string(buffer)
+		})
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Second):
+				if stat, err := os.Stat(job.SourceFilePath); err == nil {
+					track.UpdateValue(stat.Size())
+				}
+			}
+		}
+	}()
+	exitCode, err := curlCommand.RunWithContext(J.ctx)
+	close(done)
+	if err != nil {
+		return fmt.Errorf("%w: stderr:%s", err, curlErrLog)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("exit code %d: stderr:%s", exitCode, curlErrLog)
+	}
+
+	stat, err := os.Stat(job.SourceFilePath)
+	if err != nil {
+		return err
+	}
+	// the share may not tell the size before the transfer
+	if err := J.checkSourceSize(stat.Size()); err != nil {
+		return err
+	}
+
+	sha256String, err := J.fileChecksum(job.SourceFilePath)
+	if err != nil {
+		return err
+	}
+	if err := J.verifySourceChecksum(job, sha256String); err != nil {
+		return err
+	}
+	track.UpdateValue(stat.Size())
+	return nil
+}
+
+// sourceFileExtension picks the extension of a downloaded source from the Content-Disposition file name, the URL
+// path or the Content-Type, in that order. Plain static file hosts usually don't send Content-Disposition.
+func sourceFileExtension(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		if extension := filepath.Ext(params["filename"]); extension != "" {
+			return extension
+		}
+	}
+	if resp.Request != nil && resp.Request.URL != nil {
+		if extension := path.Ext(resp.Request.URL.Path); helper.ValidExtension(strings.ToLower(strings.TrimPrefix(extension, "."))) {
+			return extension
+		}
+	}
+	if contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		if extension, found := videoContentTypeExtensions[contentType]; found {
+			return extension
+		}
+	}
+	return genericSourceExtension
+}
+
+// fileChecksum is the sha256 of a file once a worker.checksumJobs slot is free, so several uploads starting together
+// don't read their whole files from the scratch disk at the same time.
+func (J *EncodeWorker) fileChecksum(filePath string) (string, error) {
+	if J.checksumSlots != nil {
+		select {
+		case J.checksumSlots <- struct{}{}:
+			defer func() { <-J.checksumSlots }()
+		case <-J.ctx.Done():
+			return "", J.ctx.Err()
+		}
+	}
+	return fileSHA256(filePath)
+}
+
+func fileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	sha := sha256.New()
+	if _, err := io.Copy(sha, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sha.Sum(nil)), nil
+}
@@ -0,0 +1,35 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"gearr/model"
+	"strings"
+)
+
+// deepVerifyErrorLimit bounds the decode errors kept for the error message, a corrupt file can log one per frame.
+const deepVerifyErrorLimit = 4096
+
+// deepVerify decodes every frame of the encoded file, catching the corruption that probing alone misses, like
+// truncated files or broken frames. Any decode error fails the verification.
+func (J *EncodeWorker) deepVerify(ctx context.Context, job *model.WorkTaskEncode) error {
+	decodeErrors := ""
+	ffmpegCommand := newFFMPEGCommand(job.WorkDir, "-hide_banner", "-nostats", "-v", "error", "-i", job.TargetFilePath, "-map", "0", "-f", "null", "-").
+		SetStderrFunc(func(buffer []byte, exit bool) {
+			if len(decodeErrors) < deepVerifyErrorLimit {
+				decodeErrors += string(buffer)
+			}
+		})
+	J.terminal.Cmd("FFMPEG verify command:%s", ffmpegCommand.GetFullCommand())
+	exitCode, err := J.runFFmpeg(ctx, ffmpegCommand, ffmpegPriorityAuxiliary)
+	if err != nil {
+		return fmt.Errorf("%w: stderr:%s", err, decodeErrors)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("encoded file verification exit code %d: %s", exitCode, strings.TrimSpace(decodeErrors))
+	}
+	if strings.TrimSpace(decodeErrors) != "" {
+		return fmt.Errorf("encoded file has decode errors: %s", strings.TrimSpace(decodeErrors))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"gearr/helper"
+	"gearr/helper/command"
+	"gearr/model"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+const (
+	VMAFActionWarn = "warn"
+	VMAFActionFail = "fail"
+)
+
+// vmafLogFileName is the libvmaf log written in the job WorkDir, the format is json but the name must not end in
+// .json, the worker reads those files as task statuses when it starts.
+const vmafLogFileName = "vmaf.log"
+
+type vmafLog struct {
+	PooledMetrics struct {
+		VMAF struct {
+			Mean float64 `json:"mean"`
+		} `json:"vmaf"`
+	} `json:"pooled_metrics"`
+}
+
+// VMAF compares the encoded video against the source with the ffmpeg libvmaf filter and returns the score.
+// When the resolutions differ the source, used as reference, is scaled to the encoded resolution. If
+// vmafSampleDuration is set only a sample of that length from the middle of the video is compared.
+func (J *EncodeWorker) VMAF(job *model.WorkTaskEncode, sourceVideoParams *ffprobe.ProbeData, encodedVideoParams *ffprobe.ProbeData) (float64, error) {
+	encodedVideoStream := mainVideoStream(encodedVideoParams)
+	if encodedVideoStream == nil {
+		return 0, fmt.Errorf("no video stream found in %s", job.TargetFilePath)
+	}
+	sourceVideoStream := mainVideoStream(sourceVideoParams)
+	if sourceVideoStream == nil {
+		return 0, fmt.Errorf("no video stream found in %s", job.SourceFilePath)
+	}
+
+	var inputArguments []string
+	sampleDuration := J.workerConfig.VMAFSampleDuration
+	videoDuration := encodedVideoParams.Format.Duration()
+	if sampleDuration > 0 && sampleDuration < videoDuration {
+		sampleStart := (videoDuration - sampleDuration) / 2
+		inputArguments = []string{"-ss", formatSeconds(sampleStart), "-t", formatSeconds(sampleDuration)}
+	}
+
+	threads := J.workerConfig.Threads
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	filter := fmt.Sprintf("[0:%d]setpts=PTS-STARTPTS[distorted];[1:%d]scale=%d:%d:flags=bicubic,setpts=PTS-STARTPTS[reference];[distorted][reference]libvmaf=log_fmt=json:log_path=%s:n_threads=%d",
+		encodedVideoStream.Index, sourceVideoStream.Index, encodedVideoStream.Width, encodedVideoStream.Height, vmafLogFileName, threads)
+
+	ffmpegCommand := command.NewCommand(helper.GetFFmpegPath(), "-hide_banner", "-nostats")
+	for _, input := range []string{job.TargetFilePath, job.SourceFilePath} {
+		for _, argument := range inputArguments {
+			ffmpegCommand.AddParam(argument)
+		}
+		ffmpegCommand.AddParam("-i").AddParam(input)
+	}
+	ffmpegCommand.AddParam("-lavfi").AddParam(filter).AddParam("-f").AddParam("null").AddParam("-")
+
+	ffmpegErrLog := ""
+	ffmpegCommand.SetWorkDir(job.WorkDir).
+		SetStdoutFunc(func(buffer []byte, exit bool) {}).
+		SetStderrFunc(func(buffer []byte, exit bool) {
+			ffmpegErrLog += string(buffer)
+		})
+	if libraryPathEnv := helper.LibraryPathEnv(helper.GetFFmpegPath()); libraryPathEnv != "" {
+		ffmpegCommand.AddEnv(libraryPathEnv)
+	}
+	J.terminal.Cmd("VMAF command:%s", ffmpegCommand.GetFullCommand())
+
+	exitCode, err := J.runFFmpeg(J.ctx, ffmpegCommand, ffmpegPriorityAuxiliary)
+	if err != nil {
+		return 0, fmt.Errorf("%w: stderr:%s", err, ffmpegErrLog)
+	}
+	if exitCode != 0 {
+		return 0, fmt.Errorf("exit code %d: stderr:%s", exitCode, ffmpegErrLog)
+	}
+
+	b, err := os.ReadFile(filepath.Join(job.WorkDir, vmafLogFileName))
+	if err != nil {
+		return 0, fmt.Errorf("error reading VMAF log: %v", err)
+	}
+	score := &vmafLog{}
+	if err = json.Unmarshal(b, score); err != nil {
+		return 0, fmt.Errorf("error parsing VMAF log: %v", err)
+	}
+	return score.PooledMetrics.VMAF.Mean, nil
+}
+
+func formatSeconds(duration time.Duration) string {
+	return strconv.FormatFloat(duration.Seconds(), 'f', 3, 64)
+}
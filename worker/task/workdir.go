@@ -0,0 +1,53 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"gearr/model"
+	"path/filepath"
+)
+
+var ErrorWorkDirRootNotAllowed = errors.New("work directory root not allowed")
+
+// ValidateWorkDirRoots checks the work directory roots jobs can ask for are absolute paths, a relative one would
+// depend on the directory the worker was started from.
+func ValidateWorkDirRoots(roots []string) error {
+	for _, root := range roots {
+		if !filepath.IsAbs(root) {
+			return fmt.Errorf("invalid worker.workDirRoots %s, must be an absolute path", root)
+		}
+	}
+	return nil
+}
+
+// workerDirectory is the directory of the worker under a work directory root, like its temp path under
+// worker.temporalPath, so workers sharing a volume don't resume each other jobs.
+func (J *EncodeWorker) workerDirectory(root string) string {
+	return filepath.Join(filepath.Clean(root), fmt.Sprintf("worker-%s", J.name))
+}
+
+// workPaths are the directories holding the work directories of the worker jobs, its temp path first.
+func (J *EncodeWorker) workPaths() []string {
+	paths := []string{J.tempPath}
+	for _, root := range J.workerConfig.WorkDirRoots {
+		paths = append(paths, J.workerDirectory(root))
+	}
+	return paths
+}
+
+// jobWorkDir is the work directory of the job, under the temp path unless the job asks for another root. Only the
+// roots listed in worker.workDirRoots are accepted, compared as clean paths, so a job can neither pick an arbitrary
+// path nor climb out of a listed one with "..". The directory below the root is always named by the worker and the
+// job id, which is a parsed UUID.
+func (J *EncodeWorker) jobWorkDir(taskEncode *model.TaskEncode) (string, error) {
+	if taskEncode.WorkDirRoot == "" {
+		return filepath.Join(J.tempPath, taskEncode.Id.String()), nil
+	}
+	requested := filepath.Clean(taskEncode.WorkDirRoot)
+	for _, root := range J.workerConfig.WorkDirRoots {
+		if filepath.Clean(root) == requested {
+			return filepath.Join(J.workerDirectory(root), taskEncode.Id.String()), nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s is not in worker.workDirRoots", ErrorWorkDirRootNotAllowed, taskEncode.WorkDirRoot)
+}
@@ -10,20 +10,24 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func NewWorkerClient(config Config, rabbit *RabbitMQClient, printer *ConsoleWorkerPrinter) *WorkerRuntime {
+// NewWorkerClient builds the worker runtime, rabbit is nil when the worker only reads jobs from worker.jobDirectory
+// and directoryQueue is nil when it only reads them from the broker.
+func NewWorkerClient(config Config, rabbit *RabbitMQClient, directoryQueue *DirectoryQueue, printer *ConsoleWorkerPrinter) *WorkerRuntime {
 	return &WorkerRuntime{
-		config:  config,
-		rabbit:  rabbit,
-		printer: printer,
+		config:         config,
+		rabbit:         rabbit,
+		directoryQueue: directoryQueue,
+		printer:        printer,
 	}
 }
 
 type WorkerRuntime struct {
-	config       Config
-	EncodeWorker *EncodeWorker
-	PGSWorker    []*PGSWorker
-	rabbit       *RabbitMQClient
-	printer      *ConsoleWorkerPrinter
+	config         Config
+	EncodeWorker   *EncodeWorker
+	PGSWorker      []*PGSWorker
+	rabbit         *RabbitMQClient
+	directoryQueue *DirectoryQueue
+	printer        *ConsoleWorkerPrinter
 }
 
 func (W *WorkerRuntime) Run(wg *sync.WaitGroup, ctx context.Context) {
@@ -41,9 +45,19 @@ func (W *WorkerRuntime) Run(wg *sync.WaitGroup, ctx context.Context) {
 func (W *WorkerRuntime) start(ctx context.Context) {
 	if W.config.Jobs.IsAccepted(model.EncodeJobType) {
 		W.EncodeWorker = NewEncodeWorker(ctx, W.config, fmt.Sprintf("%s-%d", model.EncodeJobType, 1), W.printer)
-		W.rabbit.RegisterEncodeWorker(W.EncodeWorker)
+		if W.rabbit != nil {
+			W.rabbit.RegisterEncodeWorker(W.EncodeWorker)
+		}
+		if W.directoryQueue != nil {
+			if err := W.directoryQueue.RegisterEncodeWorker(W.EncodeWorker); err != nil {
+				log.Panic(err)
+			}
+		}
 		W.EncodeWorker.Initialize()
 		log.Info("initializing encode worker")
+		if W.directoryQueue != nil {
+			go W.directoryQueue.Run(ctx)
+		}
 
 	}
 	if W.config.Jobs.IsAccepted(model.PGSToSrtJobType) {